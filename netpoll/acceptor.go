@@ -0,0 +1,643 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// AcceptorConfig contains options for Acceptor.
+type AcceptorConfig struct {
+	// Overloaded is a load probe which enables the automatic mode: it is
+	// evaluated every Interval and the acceptor is paused when it reports
+	// true for PauseAfter consecutive times and resumed when it reports false
+	// for ResumeAfter consecutive times.
+	Overloaded func() bool
+
+	// Interval is the period of the load probe evaluation.
+	// If zero, 100ms is used.
+	Interval time.Duration
+
+	// PauseAfter and ResumeAfter make the automatic mode to not flap when
+	// the load is near to the threshold.
+	// If zero, 1 and 5 are used respectively.
+	PauseAfter  int
+	ResumeAfter int
+
+	// Budget enables the file descriptors accounting: the acceptor stops
+	// accepting when Budget.Available() drops to zero instead of running
+	// into EMFILE, and pauses until descriptors are freed. The budget is
+	// recounted every Interval while acceptor is paused by it.
+	Budget *FDBudget
+
+	// OnError is called with errors returned by accept(2) other than the
+	// temporary ones, as well as with errors of pausing and resuming made by
+	// the automatic mode. If nil, such errors are ignored.
+	OnError func(error)
+}
+
+func (c *AcceptorConfig) withDefaults() (config AcceptorConfig) {
+	if c != nil {
+		config = *c
+	}
+	if config.Interval <= 0 {
+		config.Interval = 100 * time.Millisecond
+	}
+	if config.PauseAfter <= 0 {
+		config.PauseAfter = 1
+	}
+	if config.ResumeAfter <= 0 {
+		config.ResumeAfter = 5
+	}
+	return config
+}
+
+// Acceptor accepts connections of a listener observed by EventPoll and
+// passes them to a handler. It could be paused to stop accepting new
+// connections under overload without closing the listener: new connections
+// then queue in the kernel's backlog.
+//
+// Running out of file descriptors is handled according to the poller's
+// Config.EMFILEStrategy.
+type Acceptor struct {
+	// backoff is the last delay acceptor was disabled for, in nanoseconds.
+	// It is reset once the backlog is drained. Must be accessed atomically,
+	// thus it goes first to be 64-bit aligned on 32-bit platforms.
+	backoff int64
+
+	poller   EventPoll
+	desc     *Desc
+	fn       func(net.Conn)
+	config   AcceptorConfig
+	strategy EMFILEStrategy
+
+	// paused is set to 1 while acceptor is paused. Must be accessed
+	// atomically.
+	paused int32
+
+	// starved is set to 1 while acceptor is paused by the budget. Must be
+	// accessed atomically.
+	starved int32
+
+	// disabled is set to 1 while acceptor is paused by EMFILEDisable
+	// strategy. Must be accessed atomically.
+	disabled int32
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	timer  *time.Timer
+
+	// spare is the descriptor kept open for EMFILESpareFd strategy, or -1.
+	spare int
+}
+
+// NewAcceptor starts observing ln within poller and calls fn for each
+// accepted connection. Note that fn is called from the listener's callback,
+// thus it should not block.
+//
+// The listener is not closed by Acceptor.
+func NewAcceptor(poller EventPoll, ln net.Listener, fn func(net.Conn), c *AcceptorConfig) (*Acceptor, error) {
+	desc, err := HandleListener(ln, EventRead|EventEdgeTriggered)
+	if err != nil {
+		return nil, err
+	}
+	a := &Acceptor{
+		poller: poller,
+		desc:   desc,
+		fn:     fn,
+		config: c.withDefaults(),
+		done:   make(chan struct{}),
+		spare:  -1,
+	}
+	if s, ok := poller.(emfileStrategist); ok {
+		a.strategy = s.emfileStrategy()
+	}
+	if a.strategy == EMFILESpareFd {
+		if a.spare, err = openSpareFd(); err != nil {
+			desc.Close()
+			return nil, err
+		}
+	}
+	if err = poller.Start(desc, a.handle); err != nil {
+		a.closeSpareFd()
+		desc.Close()
+		return nil, err
+	}
+	if a.config.Overloaded != nil || a.config.Budget != nil {
+		go a.maintain()
+	}
+	return a, nil
+}
+
+// Pause stops accepting new connections. Connections accepted before are
+// passed to the handler anyway. Acceptor paused by Pause() is not resumed
+// when the budget or EMFILEDisable strategy allows it.
+func (a *Acceptor) Pause() error {
+	return a.pause(false)
+}
+
+func (a *Acceptor) pause(starved bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return ErrClosed
+	}
+	if !atomic.CompareAndSwapInt32(&a.paused, 0, 1) {
+		if !starved {
+			// Explicit pause is not undone automatically.
+			atomic.StoreInt32(&a.starved, 0)
+			atomic.StoreInt32(&a.disabled, 0)
+		}
+		return nil
+	}
+	if starved {
+		atomic.StoreInt32(&a.starved, 1)
+	}
+	return a.poller.Stop(a.desc)
+}
+
+// Resume resumes accepting of connections, starting from the ones queued in
+// the backlog while acceptor was paused.
+func (a *Acceptor) Resume() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.resume()
+}
+
+// resume resumes accepting of connections. Note that a.mu must be held.
+func (a *Acceptor) resume() error {
+	if a.closed {
+		return ErrClosed
+	}
+	if atomic.LoadInt32(&a.paused) == 0 {
+		return nil
+	}
+	// Registration reports the listener readiness, thus the backlog is
+	// drained even in edge-triggered mode.
+	if err := a.poller.Start(a.desc, a.handle); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&a.starved, 0)
+	atomic.StoreInt32(&a.disabled, 0)
+	atomic.StoreInt32(&a.paused, 0)
+
+	return nil
+}
+
+// Paused reports whether acceptor is paused.
+func (a *Acceptor) Paused() bool {
+	return atomic.LoadInt32(&a.paused) == 1
+}
+
+// Close stops accepting connections and releases acceptor's resources.
+// Note that it does not close the listener.
+func (a *Acceptor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return ErrClosed
+	}
+	a.closed = true
+	close(a.done)
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	a.closeSpareFd()
+
+	if atomic.SwapInt32(&a.paused, 1) == 0 {
+		a.poller.Stop(a.desc)
+	}
+	return a.desc.Close()
+}
+
+func (a *Acceptor) handle(event Event) {
+	if event&EventRead == 0 {
+		return
+	}
+	var emfile func() (bool, error)
+	switch a.strategy {
+	case EMFILESpareFd:
+		emfile = a.reject
+	case EMFILEDisable:
+		emfile = a.disable
+	}
+	err := acceptAll(a.desc.Fd(), a.accept, a.stopped, emfile)
+	if err == nil && atomic.LoadInt32(&a.disabled) == 0 {
+		atomic.StoreInt64(&a.backoff, 0)
+	}
+	if err == nil && a.exhausted() {
+		err = a.pause(true)
+	}
+	if err != nil && err != ErrClosed && a.config.OnError != nil {
+		a.config.OnError(err)
+	}
+}
+
+func (a *Acceptor) accept(conn net.Conn) {
+	if a.config.Budget != nil {
+		a.config.Budget.take(1)
+	}
+	a.fn(conn)
+}
+
+// stopped reports whether acceptAll() must stop accepting connections.
+func (a *Acceptor) stopped() bool {
+	return a.Paused() || a.exhausted()
+}
+
+// exhausted reports whether there are no descriptors left in the budget.
+func (a *Acceptor) exhausted() bool {
+	return a.config.Budget != nil && a.config.Budget.Available() == 0
+}
+
+// reject implements EMFILESpareFd strategy: it closes the spare descriptor
+// to accept the pending connection and close it immediately, and opens the
+// spare descriptor again. If there is no spare descriptor, acceptor is
+// disabled as by EMFILEDisable strategy.
+func (a *Acceptor) reject() (bool, error) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return false, nil
+	}
+	if a.spare == -1 {
+		a.spare, _ = openSpareFd()
+	}
+	if a.spare == -1 {
+		a.mu.Unlock()
+		return a.disable()
+	}
+	unix.Close(a.spare)
+	fd, _, err := unix.Accept(a.desc.Fd())
+	if err == nil {
+		unix.Close(fd)
+	}
+	// Descriptor could be taken by someone else in the meantime, in which
+	// case the next rejection disables the acceptor.
+	a.spare, _ = openSpareFd()
+	a.mu.Unlock()
+
+	switch err {
+	case nil, syscall.ECONNABORTED, syscall.EINTR:
+		// Go on accepting until the backlog is drained.
+		return true, nil
+	case syscall.EAGAIN:
+		// Note that accept(2) fails with EMFILE before it finds out that
+		// there are no pending connections.
+		return false, nil
+	case syscall.EMFILE, syscall.ENFILE:
+		return a.disable()
+	}
+	return false, os.NewSyscallError("accept", err)
+}
+
+// disable implements EMFILEDisable strategy: it stops observing the listener
+// and starts it again after exponentially growing delay.
+func (a *Acceptor) disable() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed || !atomic.CompareAndSwapInt32(&a.paused, 0, 1) {
+		return false, nil
+	}
+	if err := a.poller.Stop(a.desc); err != nil {
+		atomic.StoreInt32(&a.paused, 0)
+		return false, err
+	}
+	atomic.StoreInt32(&a.disabled, 1)
+
+	backoff := acceptBackoff(time.Duration(atomic.LoadInt64(&a.backoff)))
+	atomic.StoreInt64(&a.backoff, int64(backoff))
+	a.timer = time.AfterFunc(backoff, a.enable)
+
+	return false, nil
+}
+
+// enable resumes acceptor disabled by disable(), unless it was paused or
+// resumed explicitly in the meantime.
+func (a *Acceptor) enable() {
+	a.mu.Lock()
+	var err error
+	if atomic.LoadInt32(&a.disabled) == 1 {
+		err = a.resume()
+	}
+	a.mu.Unlock()
+
+	if err != nil && err != ErrClosed && a.config.OnError != nil {
+		a.config.OnError(err)
+	}
+}
+
+// closeSpareFd closes the spare descriptor, if any.
+func (a *Acceptor) closeSpareFd() {
+	if a.spare != -1 {
+		unix.Close(a.spare)
+		a.spare = -1
+	}
+}
+
+// openSpareFd opens a descriptor to be kept for EMFILESpareFd strategy.
+func openSpareFd() (int, error) {
+	fd, err := unix.Open(os.DevNull, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, os.NewSyscallError("open", err)
+	}
+	return fd, nil
+}
+
+// maintain evaluates the load probe and the budget and pauses or resumes
+// the acceptor.
+func (a *Acceptor) maintain() {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+
+	var over, under int
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+		if a.config.Overloaded != nil {
+			if a.config.Overloaded() {
+				over, under = over+1, 0
+			} else {
+				over, under = 0, under+1
+			}
+		}
+		var err error
+		switch {
+		case atomic.LoadInt32(&a.starved) == 1:
+			// Resume once descriptors are freed, unless the load probe
+			// wants acceptor to be paused anyway.
+			a.config.Budget.Invalidate()
+			if !a.exhausted() && over < a.config.PauseAfter {
+				err = a.Resume()
+			}
+		case a.config.Overloaded == nil:
+		case over >= a.config.PauseAfter && !a.Paused():
+			err = a.Pause()
+		case under >= a.config.ResumeAfter && a.Paused() && atomic.LoadInt32(&a.disabled) == 0:
+			err = a.Resume()
+		}
+		if err != nil && err != ErrClosed && a.config.OnError != nil {
+			a.config.OnError(err)
+		}
+	}
+}
+
+// PollListener is a net.Listener which accepts connections of the wrapped
+// listener with help of EventPoll: the listener is observed in edge-triggered
+// mode and Accept() callers are parked until a connection is pending. It
+// makes possible to keep the code written for blocking Accept() loops while
+// using the poller under the hood.
+type PollListener struct {
+	ln     net.Listener
+	poller EventPoll
+	desc   *Desc
+
+	// ready is signaled when the listener is reported by the poller or when
+	// some connection is accepted, since there could be more of them for
+	// the other parked callers.
+	ready chan struct{}
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewPollListener starts observing ln within poller and returns listener
+// accepting its connections.
+//
+// Closing returned listener closes ln as well.
+func NewPollListener(poller EventPoll, ln net.Listener) (*PollListener, error) {
+	desc, err := HandleListener(ln, EventRead|EventEdgeTriggered)
+	if err != nil {
+		return nil, err
+	}
+	l := &PollListener{
+		ln:     ln,
+		poller: poller,
+		desc:   desc,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err = poller.Start(desc, l.handle); err != nil {
+		desc.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Accept waits for and returns the next connection to the listener.
+// It returns ErrClosed after the listener or its poller is closed.
+func (l *PollListener) Accept() (net.Conn, error) {
+	strictBlocking("PollListener.Accept")
+	for {
+		select {
+		case <-l.done:
+			return nil, ErrClosed
+		default:
+		}
+		conn, err := acceptConn(l.desc.Fd())
+		switch err {
+		case nil:
+			l.signal()
+			return conn, nil
+
+		case syscall.ECONNABORTED, syscall.EINTR:
+			continue
+
+		case syscall.EAGAIN:
+			select {
+			case <-l.ready:
+			case <-l.done:
+				return nil, ErrClosed
+			}
+			continue
+		}
+		if _, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("accept", err)
+		}
+		return nil, err
+	}
+}
+
+// Close stops observing the listener, unblocks parked Accept() calls and
+// closes the wrapped listener.
+func (l *PollListener) Close() (err error) {
+	err = ErrClosed
+	l.once.Do(func() {
+		close(l.done)
+		l.poller.Stop(l.desc)
+		l.desc.Close()
+		err = l.ln.Close()
+	})
+	return err
+}
+
+// Addr returns the wrapped listener's network address.
+func (l *PollListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *PollListener) handle(event Event) {
+	if event&EventPollClosed != 0 {
+		l.once.Do(func() {
+			close(l.done)
+			l.desc.Close()
+			l.ln.Close()
+		})
+		return
+	}
+	l.signal()
+}
+
+// signal wakes up one of the parked Accept() callers, if any.
+func (l *PollListener) signal() {
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+// AcceptAll accepts connections of ln until its backlog is drained and calls
+// fn for each of them. It is intended to be called from the listener's
+// callback, since edge-triggered listener is not reported again until all
+// pending connections are accepted.
+//
+// Aborted connections are skipped. When the process or system runs out of
+// file descriptors (EMFILE or ENFILE), it backs off with exponentially
+// growing delays instead of spinning, until a descriptor is available.
+//
+// It returns ErrNotFiler if ln does not provide access to its file
+// descriptor. Other errors are returned as is.
+func AcceptAll(ln net.Listener, fn func(net.Conn)) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return ErrNotFiler
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var acceptErr error
+	err = rc.Control(func(fd uintptr) {
+		acceptErr = acceptAll(int(fd), fn, nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return acceptErr
+}
+
+const (
+	acceptMinBackoff = 5 * time.Millisecond
+	acceptMaxBackoff = time.Second
+)
+
+// acceptBackoff returns the delay to be used after the given one when
+// descriptors are exhausted.
+func acceptBackoff(prev time.Duration) time.Duration {
+	if prev == 0 {
+		return acceptMinBackoff
+	}
+	if prev *= 2; prev > acceptMaxBackoff {
+		return acceptMaxBackoff
+	}
+	return prev
+}
+
+// acceptAll accepts connections on the non-blocking listening socket fd
+// until there are no pending ones or stop returns true.
+//
+// When descriptors are exhausted, it calls emfile, which reports whether
+// accepting must go on. If emfile is nil, it backs off with exponentially
+// growing delays.
+func acceptAll(fd int, fn func(net.Conn), stop func() bool, emfile func() (bool, error)) error {
+	var backoff time.Duration
+	for stop == nil || !stop() {
+		conn, err := acceptConn(fd)
+		switch err {
+		case nil:
+			backoff = 0
+			fn(conn)
+			continue
+
+		case syscall.EAGAIN:
+			return nil
+
+		case syscall.ECONNABORTED, syscall.EINTR:
+			continue
+
+		case syscall.EMFILE, syscall.ENFILE:
+			if emfile != nil {
+				if ok, err := emfile(); !ok || err != nil {
+					return err
+				}
+				continue
+			}
+			backoff = acceptBackoff(backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		if _, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("accept", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// acceptConn accepts a connection on the non-blocking listening socket fd.
+// It returns syscall.EAGAIN if there are no pending connections.
+func acceptConn(fd int) (net.Conn, error) {
+	syscall.ForkLock.RLock()
+	nfd, _, err := unix.Accept(fd)
+	if err == nil {
+		unix.CloseOnExec(nfd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(nfd), "")
+	defer file.Close()
+
+	// Note that FileConn() makes a duplicate of the descriptor and sets it
+	// to non-blocking mode. Duplication fails when descriptors are exhausted
+	// right after the connection was accepted, in which case the connection
+	// is dropped and the bare error is returned to be handled the same way
+	// as accept(2) failure.
+	conn, err := net.FileConn(file)
+	if err != nil {
+		if errno := dupErrno(err); errno == syscall.EMFILE || errno == syscall.ENFILE {
+			return nil, errno
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dupErrno returns the error number of the descriptor duplication made by
+// net.FileConn(), or zero if err is not the one.
+func dupErrno(err error) syscall.Errno {
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	errno, _ := err.(syscall.Errno)
+	return errno
+}
@@ -0,0 +1,608 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAcceptorPause(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var (
+		mu       sync.Mutex
+		accepted []net.Conn
+	)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	}()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(accepted)
+	}
+	a, err := NewAcceptor(poller, ln, func(conn net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		accepted = append(accepted, conn)
+	}, &AcceptorConfig{
+		OnError: func(err error) { t.Error(err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	dial := func(n int) {
+		for i := 0; i < n; i++ {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+		}
+	}
+	waitAccepted := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for count() != n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if act := count(); act != n {
+			t.Fatalf("accepted %d connections; want %d", act, n)
+		}
+	}
+
+	dial(5)
+	waitAccepted(5)
+
+	if err = a.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Paused() {
+		t.Fatalf("Paused() = false after Pause()")
+	}
+	if n := poller.Stats().Registered; n != 0 {
+		t.Errorf("%d descriptors registered while paused; want 0", n)
+	}
+	dial(20)
+	time.Sleep(50 * time.Millisecond)
+	if act := count(); act != 5 {
+		t.Fatalf("accepted %d connections while paused; want %d", act, 5)
+	}
+
+	if err = a.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitAccepted(25)
+}
+
+func TestAcceptorOverloaded(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var overloaded int32
+	a, err := NewAcceptor(poller, ln, func(conn net.Conn) {
+		conn.Close()
+	}, &AcceptorConfig{
+		Overloaded: func() bool {
+			return atomic.LoadInt32(&overloaded) == 1
+		},
+		Interval:    time.Millisecond,
+		PauseAfter:  2,
+		ResumeAfter: 10,
+		OnError:     func(err error) { t.Error(err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	waitPaused := func(exp bool) {
+		deadline := time.Now().Add(time.Second)
+		for a.Paused() != exp && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if act := a.Paused(); act != exp {
+			t.Fatalf("Paused() = %t; want %t", act, exp)
+		}
+	}
+
+	atomic.StoreInt32(&overloaded, 1)
+	waitPaused(true)
+	atomic.StoreInt32(&overloaded, 0)
+	waitPaused(false)
+}
+
+func TestAcceptorBudget(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	budget, err := NewFDBudget(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		accepted []net.Conn
+	)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	}()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(accepted)
+	}
+	a, err := NewAcceptor(poller, ln, func(conn net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		accepted = append(accepted, conn)
+	}, &AcceptorConfig{
+		Budget:   budget,
+		Interval: time.Millisecond,
+		OnError:  func(err error) { t.Error(err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err = a.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue connections in the backlog while there are enough descriptors.
+	for i := 0; i < 32; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	const (
+		headroom = 12
+		reserve  = 4
+	)
+	var lim unix.Rlimit
+	if err = unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	restore := lim
+	if err = budget.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	setRlimitCur(&lim, budget.open+headroom)
+	if err = unix.Setrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Setrlimit(unix.RLIMIT_NOFILE, &restore)
+	if err = budget.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	budget.Reserve(reserve)
+
+	waitAccepted := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for (count() != n || !a.Paused()) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if act := count(); act != n {
+			t.Fatalf("accepted %d connections; want %d", act, n)
+		}
+		if !a.Paused() {
+			t.Fatal("acceptor is not paused by the budget")
+		}
+		// The reserve must be left untouched.
+		var fds []int
+		defer func() {
+			for _, fd := range fds {
+				unix.Close(fd)
+			}
+		}()
+		for i := 0; i < reserve; i++ {
+			fd, err := unix.Dup(0)
+			if err != nil {
+				t.Fatalf("can not use the reserved descriptors: %v", err)
+			}
+			fds = append(fds, fd)
+		}
+	}
+
+	if err = a.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitAccepted(headroom - reserve)
+
+	// Acceptor is resumed once descriptors are freed.
+	mu.Lock()
+	for _, conn := range accepted[:reserve] {
+		conn.Close()
+	}
+	accepted = accepted[reserve:]
+	mu.Unlock()
+
+	waitAccepted(headroom - reserve)
+}
+
+func TestAcceptorEMFILE(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		strategy EMFILEStrategy
+		rejected bool
+	}{
+		{"spare", EMFILESpareFd, true},
+		{"disable", EMFILEDisable, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config(t)
+			cfg.EMFILEStrategy = test.strategy
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			var accepted int32
+			a, err := NewAcceptor(poller, ln, func(conn net.Conn) {
+				atomic.AddInt32(&accepted, 1)
+				conn.Close()
+			}, &AcceptorConfig{
+				OnError: func(err error) { t.Error(err) },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if err = a.Pause(); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var lim unix.Rlimit
+			if err = unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+				t.Fatal(err)
+			}
+			restore := lim
+			fds := exhaustFds(t, &lim)
+			defer func() {
+				for _, fd := range fds {
+					unix.Close(fd)
+				}
+			}()
+			defer unix.Setrlimit(unix.RLIMIT_NOFILE, &restore)
+
+			if err = a.Resume(); err != nil {
+				t.Fatal(err)
+			}
+			if test.rejected {
+				// Connection is accepted and closed right away.
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err = conn.Read(make([]byte, 1)); err == nil {
+					t.Fatalf("connection is not rejected")
+				}
+				if a.Paused() {
+					t.Errorf("acceptor is disabled; want it to reject connections")
+				}
+			} else {
+				time.Sleep(50 * time.Millisecond)
+				if !a.Paused() {
+					t.Errorf("acceptor is not disabled")
+				}
+			}
+			if n := atomic.LoadInt32(&accepted); n != 0 {
+				t.Fatalf("accepted %d connections; want %d", n, 0)
+			}
+
+			if err = unix.Setrlimit(unix.RLIMIT_NOFILE, &restore); err != nil {
+				t.Fatal(err)
+			}
+			exp := int32(1)
+			if test.rejected {
+				// Check that acceptor works after rejection.
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+			}
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&accepted) != exp && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if n := atomic.LoadInt32(&accepted); n != exp {
+				t.Fatalf("accepted %d connections; want %d", n, exp)
+			}
+			if a.Paused() {
+				t.Errorf("acceptor is not enabled again")
+			}
+		})
+	}
+}
+
+func TestPollListener(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := NewPollListener(poller, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Several callers are parked at once. Each connection must be accepted
+	// by some of them, even if all connections are reported by a single
+	// edge.
+	const n = 8
+	conns := make(chan net.Conn, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			conn, err := pl.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < n-1; i++ {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	for i := 0; i < n-1; i++ {
+		select {
+		case conn := <-conns:
+			conn.Close()
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatalf("accepted %d connections; want %d", i, n-1)
+		}
+	}
+
+	// Close must unblock the last parked caller.
+	if err = pl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Errorf("Accept() = %v; want %v", err, ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept() was not unblocked by Close()")
+	}
+	if _, err = pl.Accept(); err != ErrClosed {
+		t.Errorf("Accept() after Close() = %v; want %v", err, ErrClosed)
+	}
+	if _, err = net.Dial("tcp", pl.Addr().String()); err == nil {
+		t.Errorf("wrapped listener was not closed")
+	}
+}
+
+func TestAcceptAll(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	// Let the kernel to complete the handshakes.
+	time.Sleep(50 * time.Millisecond)
+
+	var accepted int
+	err = AcceptAll(ln, func(conn net.Conn) {
+		accepted++
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != n {
+		t.Errorf("accepted %d connections; want %d", accepted, n)
+	}
+
+	if err = AcceptAll(stubListener{}, nil); err != ErrNotFiler {
+		t.Errorf("AcceptAll() error is %v; want %v", err, ErrNotFiler)
+	}
+}
+
+func TestAcceptAllEMFILE(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	var lim unix.Rlimit
+	if err = unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	restore := lim
+	fds := exhaustFds(t, &lim)
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	defer unix.Setrlimit(unix.RLIMIT_NOFILE, &restore)
+
+	const delay = 50 * time.Millisecond
+	go func() {
+		time.Sleep(delay)
+		unix.Setrlimit(unix.RLIMIT_NOFILE, &restore)
+	}()
+
+	var accepted int
+	begin := time.Now()
+	err = AcceptAll(ln, func(conn net.Conn) {
+		accepted++
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 1 {
+		t.Errorf("accepted %d connections; want %d", accepted, 1)
+	}
+	if elapsed := time.Since(begin); elapsed < delay {
+		t.Errorf("AcceptAll() returned after %s; want at least %s", elapsed, delay)
+	}
+}
+
+func TestAcceptConnDupEMFILE(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	var lim unix.Rlimit
+	if err = unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	restore := lim
+	fds := exhaustFds(t, &lim)
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	defer unix.Setrlimit(unix.RLIMIT_NOFILE, &restore)
+
+	// Leave the only descriptor free, such that accept(2) succeeds while
+	// duplication of the accepted descriptor fails.
+	unix.Close(fds[len(fds)-1])
+	fds = fds[:len(fds)-1]
+
+	if _, err = acceptConn(int(file.Fd())); err != syscall.EMFILE {
+		t.Fatalf("acceptConn() error is %v; want %v", err, syscall.EMFILE)
+	}
+}
+
+// exhaustFds lowers the RLIMIT_NOFILE to the lowest free descriptor and
+// opens descriptors below it until EMFILE. It returns opened descriptors
+// which must be closed by the caller, as well as the limit must be
+// restored.
+func exhaustFds(t *testing.T, lim *unix.Rlimit) (fds []int) {
+	t.Helper()
+
+	fd, err := unix.Dup(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds = append(fds, fd)
+	setRlimitCur(lim, fd+1)
+	if err = unix.Setrlimit(unix.RLIMIT_NOFILE, lim); err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	for {
+		fd, err := unix.Dup(0)
+		if err == syscall.EMFILE {
+			return fds
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, fd)
+	}
+}
+
+type stubListener struct{}
+
+func (stubListener) Accept() (net.Conn, error) { return nil, io.EOF }
+func (stubListener) Close() error              { return nil }
+func (stubListener) Addr() net.Addr            { return nil }
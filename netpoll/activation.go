@@ -0,0 +1,85 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation. See sd_listen_fds(3).
+const listenFdsStart = 3
+
+// HandleActivatedListeners returns descriptors for listeners inherited from
+// systemd (or any other service manager implementing the same protocol)
+// socket activation.
+//
+// It reads LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables
+// and unsets them, so the child processes do not inherit them. Returned
+// descriptors are named after LISTEN_FDNAMES (see Desc.Name()) and have
+// close-on-exec flag set.
+//
+// It returns no descriptors and no error if process was not socket
+// activated, or if the variables are addressed to some other process.
+func HandleActivatedListeners(ev Event) ([]*Desc, error) {
+	return activatedListeners(ev, listenFdsStart)
+}
+
+func activatedListeners(ev Event, start int) ([]*Desc, error) {
+	var (
+		pid   = os.Getenv("LISTEN_PID")
+		fds   = os.Getenv("LISTEN_FDS")
+		names = os.Getenv("LISTEN_FDNAMES")
+	)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return nil, fmt.Errorf("malformed LISTEN_PID: %v", err)
+	}
+	if p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("malformed LISTEN_FDS: %q", fds)
+	}
+
+	var nameList []string
+	if names != "" {
+		nameList = strings.Split(names, ":")
+	}
+
+	ret := make([]*Desc, 0, n)
+	for i := 0; i < n; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		desc, err := newDesc(file, ev, resolveDescOptions(nil))
+		if err != nil {
+			file.Close()
+			for _, d := range ret {
+				d.Close()
+			}
+			return nil, err
+		}
+		ret = append(ret, desc)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,90 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestActivatedListeners(t *testing.T) {
+	// Place duplicates of listener fds one after another, as systemd does.
+	var start int
+	for i, name := range []string{"http", "admin"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1000
+		if i > 0 {
+			want = start + i
+		}
+		fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD, want)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			start = fd
+		} else if fd != start+i {
+			unix.Close(fd)
+			t.Skipf("could not allocate consecutive fds for %q", name)
+		}
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "http:admin")
+
+	descs, err := activatedListeners(EventRead, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(descs); n != 2 {
+		t.Fatalf("got %d descriptors; want 2", n)
+	}
+	for i, name := range []string{"http", "admin"} {
+		desc := descs[i]
+		defer desc.Close()
+
+		if desc.Fd() != start+i {
+			t.Errorf("descriptor #%d has fd %d; want %d", i, desc.Fd(), start+i)
+		}
+		if desc.Name() != name {
+			t.Errorf("descriptor #%d has name %q; want %q", i, desc.Name(), name)
+		}
+		flags, err := unix.FcntlInt(uintptr(desc.Fd()), unix.F_GETFD, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&unix.FD_CLOEXEC == 0 {
+			t.Errorf("descriptor #%d has no close-on-exec flag", i)
+		}
+	}
+	if v := os.Getenv("LISTEN_FDS"); v != "" {
+		t.Errorf("LISTEN_FDS was not unset: %q", v)
+	}
+}
+
+func TestActivatedListenersOtherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	descs, err := activatedListeners(EventRead, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 0 {
+		t.Errorf("got %d descriptors; want 0", len(descs))
+	}
+}
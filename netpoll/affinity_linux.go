@@ -0,0 +1,30 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindThread locks calling goroutine to its current thread and binds that
+// thread to given CPUs.
+func bindThread(cpus []int) error {
+	runtime.LockOSThread()
+
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		// CPUSet silently ignores the CPUs it could not hold.
+		if cpu < 0 || cpu >= len(set)*int(unsafe.Sizeof(set[0]))*8 {
+			return os.NewSyscallError("sched_setaffinity", unix.EINVAL)
+		}
+		set.Set(cpu)
+	}
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return os.NewSyscallError("sched_setaffinity", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package netpoll
+
+import "sync/atomic"
+
+// Ready describes a descriptor received within a batch of ready ones.
+type Ready struct {
+	Desc   *Desc
+	Events Event
+}
+
+// BatchHandler receives all descriptors reported ready by a single wait
+// iteration of the poller (see EventPoll.SetBatchHandler()).
+//
+// The batch slice is reused between the calls: neither it nor its elements
+// may be retained after the handler returns.
+type BatchHandler func(batch []Ready)
+
+// batchHandler wraps BatchHandler to be stored within atomic.Value.
+type batchHandler struct {
+	fn BatchHandler
+}
+
+// SetBatchHandler implements EventPoll.SetBatchHandler() method.
+func (p *poller) SetBatchHandler(fn BatchHandler) {
+	p.batchFn.Store(batchHandler{fn})
+}
+
+// batchHandler returns the batch handler, if any.
+func (p *poller) batchHandler() BatchHandler {
+	h, _ := p.batchFn.Load().(batchHandler)
+	return h.fn
+}
+
+// appendBatch adds event received for r to the current batch. Events
+// received for the same registration within the iteration are merged into
+// a single entry, thus the bits available at the same time (e.g. EventRead
+// and EventReadHup reported by separate filters or completions) are
+// delivered together. It reports whether the event was added, that is
+// whether it is not EventPollClosed, which is delivered immediately.
+// It is called by the wait loop only.
+func (p *poller) appendBatch(r *registration, event Event) bool {
+	if event&EventPollClosed != 0 {
+		return false
+	}
+	if i := r.batched - 1; i >= 0 && i < len(p.batchRegs) && p.batchRegs[i] == r {
+		p.batch[i].Events |= event
+		return true
+	}
+	p.batch = append(p.batch, Ready{
+		Desc:   r.desc,
+		Events: event,
+	})
+	p.batchRegs = append(p.batchRegs, r)
+	r.batched = len(p.batchRegs)
+	return true
+}
+
+// flushBatch passes the current batch to the batch handler, or to the
+// callbacks if it is not set. It is called by the wait loop after all events
+// of the iteration are received.
+func (p *poller) flushBatch() {
+	if len(p.batch) == 0 {
+		return
+	}
+	for _, r := range p.batchRegs {
+		r.batched = 0
+	}
+	if fn := p.batchHandler(); fn != nil {
+		atomic.AddUint64(&p.stats.callbacks, uint64(len(p.batch)))
+		for _, r := range p.batchRegs {
+			if r.grouped {
+				atomic.AddUint64(&r.desc.fired, 1)
+			}
+		}
+		fn(p.batch)
+	} else {
+		for i, r := range p.batchRegs {
+			r.handle(p.batch[i].Events)
+		}
+	}
+	for i := range p.batch {
+		p.batch[i] = Ready{}
+		p.batchRegs[i] = nil
+	}
+	p.batch = p.batch[:0]
+	p.batchRegs = p.batchRegs[:0]
+}
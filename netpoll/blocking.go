@@ -0,0 +1,262 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BlockingConn adapts a descriptor observed by EventPoll to net.Conn. Its
+// Read() and Write() methods park the calling goroutine until the
+// descriptor is ready, which makes possible to use code written for
+// net.Conn (e.g. protocol parsers) with the descriptors of the poller.
+//
+// Deadlines set by the Set*Deadline() methods (or directly on the
+// descriptor, see Desc.SetReadDeadline()) interrupt the parked Read() and
+// Write() calls with ErrDeadlineExceeded.
+type BlockingConn struct {
+	poller EventPoll
+	desc   *Desc
+
+	// readable and writable are signaled by the callback when descriptor
+	// becomes ready for the corresponding operation or its deadline
+	// expires.
+	readable chan struct{}
+	writable chan struct{}
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewBlockingConn starts observing desc with poller and returns
+// BlockingConn reading from and writing to it. The desc must be created
+// with EventRead|EventWrite|EventEdgeTriggered and without EventOneShot;
+// ErrUnsupportedEvent is returned otherwise.
+//
+// The callback of desc is owned by BlockingConn, thus desc must not be
+// started by the caller.
+func NewBlockingConn(poller EventPoll, desc *Desc) (*BlockingConn, error) {
+	const need = EventRead | EventWrite | EventEdgeTriggered
+	if desc.event&need != need || desc.event&EventOneShot != 0 {
+		return nil, ErrUnsupportedEvent
+	}
+	c := &BlockingConn{
+		poller:   poller,
+		desc:     desc,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if err := poller.Start(desc, c.handle); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *BlockingConn) handle(event Event) {
+	if event&EventPollClosed != 0 {
+		c.once.Do(func() { close(c.done) })
+		return
+	}
+	if event&(EventRead|EventReadHup|EventHup|EventErr) != 0 {
+		signal(c.readable)
+	}
+	if event&(EventWrite|EventHup|EventErr) != 0 {
+		signal(c.writable)
+	}
+}
+
+// signal makes ch ready to be received from, unless it is already.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Read implements io.Reader. It returns io.EOF when the peer closed its
+// side of the connection.
+func (c *BlockingConn) Read(p []byte) (int, error) {
+	strictBlocking("BlockingConn.Read")
+	for {
+		if err := c.check(EventRead); err != nil {
+			return 0, err
+		}
+		n, err := syscall.Read(c.desc.Fd(), p)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			if err = c.wait(c.readable); err != nil {
+				return 0, err
+			}
+			continue
+		case err != nil:
+			return 0, err
+		case n == 0 && len(p) > 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// Write implements io.Writer. It returns when p is written completely or
+// an error occurs.
+func (c *BlockingConn) Write(p []byte) (int, error) {
+	strictBlocking("BlockingConn.Write")
+	var written int
+	for written < len(p) {
+		if err := c.check(EventWrite); err != nil {
+			return written, err
+		}
+		n, err := syscall.Write(c.desc.Fd(), p[written:])
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			if err = c.wait(c.writable); err != nil {
+				return written, err
+			}
+			continue
+		case err != nil:
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// check returns an error if c is closed or the deadline of event has
+// expired.
+func (c *BlockingConn) check(event Event) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if c.desc.deadlineExceeded(event) {
+		return ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// wait parks until ready is signaled or c is closed.
+func (c *BlockingConn) wait(ready chan struct{}) error {
+	select {
+	case <-ready:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// Close stops observing the descriptor and closes it. Parked Read() and
+// Write() calls return ErrClosed.
+func (c *BlockingConn) Close() error {
+	closed := true
+	c.once.Do(func() {
+		closed = false
+		close(c.done)
+	})
+	if closed {
+		return ErrClosed
+	}
+	if err := c.poller.Stop(c.desc); err != nil && err != ErrNotRegistered && err != ErrClosed {
+		c.desc.Close()
+		return err
+	}
+	return c.desc.Close()
+}
+
+// Desc returns the underlying descriptor.
+func (c *BlockingConn) Desc() *Desc {
+	return c.desc
+}
+
+// LocalAddr returns the local address of the socket, or nil if it could not
+// be retrieved.
+func (c *BlockingConn) LocalAddr() net.Addr {
+	sa, err := unix.Getsockname(c.desc.Fd())
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(c.desc.Fd(), sa)
+}
+
+// RemoteAddr returns the address of the peer, or nil if it could not be
+// retrieved.
+func (c *BlockingConn) RemoteAddr() net.Addr {
+	sa, err := unix.Getpeername(c.desc.Fd())
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(c.desc.Fd(), sa)
+}
+
+// SetDeadline implements net.Conn. See Desc.SetDeadline().
+func (c *BlockingConn) SetDeadline(t time.Time) error {
+	return c.desc.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn. See Desc.SetReadDeadline().
+func (c *BlockingConn) SetReadDeadline(t time.Time) error {
+	return c.desc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn. See Desc.SetWriteDeadline().
+func (c *BlockingConn) SetWriteDeadline(t time.Time) error {
+	return c.desc.SetWriteDeadline(t)
+}
+
+// sockaddrToAddr converts the address of socket fd to net.Addr.
+func sockaddrToAddr(fd int, sa unix.Sockaddr) net.Addr {
+	typ, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return nil
+	}
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrInet6:
+		if typ == unix.SOCK_DGRAM {
+			return sockaddrToUDP(sa)
+		}
+		return sockaddrToTCP(sa)
+	case *unix.SockaddrUnix:
+		network := "unix"
+		if typ == unix.SOCK_DGRAM {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: sa.Name, Net: network}
+	}
+	return nil
+}
+
+// sockaddrToTCP is like sockaddrToUDP, but for TCP.
+func sockaddrToTCP(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{
+			IP:   append(net.IP(nil), sa.Addr[:]...),
+			Port: sa.Port,
+		}
+	case *unix.SockaddrInet6:
+		var zone string
+		if sa.ZoneId != 0 {
+			zone = strconv.Itoa(int(sa.ZoneId))
+		}
+		return &net.TCPAddr{
+			IP:   append(net.IP(nil), sa.Addr[:]...),
+			Port: sa.Port,
+			Zone: zone,
+		}
+	}
+	return nil
+}
+
+var _ net.Conn = (*BlockingConn)(nil)
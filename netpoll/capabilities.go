@@ -0,0 +1,63 @@
+package netpoll
+
+import "sync"
+
+// Capabilities describes features supported by the poller's backend on the
+// running system. It is probed once, when the first poller is created, by
+// actually trying the features, so the result reflects the kernel the
+// process runs on rather than the one the program was built for.
+type Capabilities struct {
+	// Backend is the name of the event notification facility, e.g. "epoll"
+	// or "kqueue".
+	Backend string
+
+	// EdgeTriggered and OneShot report support of EventEdgeTriggered and
+	// EventOneShot.
+	EdgeTriggered bool
+	OneShot       bool
+
+	// ReadHup reports whether EventReadHup is reported when the peer shuts
+	// down its writing side (EPOLLRDHUP or EV_EOF of the read filter).
+	ReadHup bool
+
+	// Pri reports support of EventPri.
+	Pri bool
+
+	// ReadLowWater reports support of Options.ReadLowWater and SetLowWater().
+	ReadLowWater bool
+
+	// Exclusive reports whether EPOLLEXCLUSIVE is supported (linux 4.5+).
+	Exclusive bool
+
+	// Wakeup reports whether EventWakeup has effect, that is EPOLLWAKEUP is
+	// supported and the process has CAP_BLOCK_SUSPEND capability.
+	Wakeup bool
+
+	// IOUring reports whether io_uring(7) is available.
+	IOUring bool
+
+	// Timerfd reports whether timerfd_create(2) is available.
+	Timerfd bool
+
+	// ProcessExit reports whether process exit could be observed by a
+	// descriptor (pidfd or EVFILT_PROC).
+	ProcessExit bool
+
+	// CPUAffinity reports support of Config.CPUAffinity and
+	// PoolConfig.ShardCPUs.
+	CPUAffinity bool
+}
+
+var (
+	capsOnce sync.Once
+	caps     Capabilities
+)
+
+// probedCapabilities returns capabilities of the running system, probing
+// them on the first call.
+func probedCapabilities() Capabilities {
+	capsOnce.Do(func() {
+		caps = probeCapabilities()
+	})
+	return caps
+}
@@ -0,0 +1,10 @@
+package netpoll
+
+func probeCapabilities() Capabilities {
+	return Capabilities{
+		Backend: "pollset",
+		// One-shot delivery is emulated by removing the descriptor from the
+		// pollset.
+		OneShot: true,
+	}
+}
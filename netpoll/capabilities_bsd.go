@@ -0,0 +1,33 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+func probeCapabilities() Capabilities {
+	return Capabilities{
+		Backend:       "kqueue",
+		EdgeTriggered: true,
+		OneShot:       true,
+		ReadHup:       true,
+		Pri:           _EVFILT_EXCEPT != 0,
+		ReadLowWater:  true,
+		ProcessExit:   probeProcFilter(),
+	}
+}
+
+// probeProcFilter reports whether EVFILT_PROC could be registered for the
+// current process.
+func probeProcFilter() bool {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return false
+	}
+	defer unix.Close(kq)
+
+	changes := make([]unix.Kevent_t, 1)
+	unix.SetKevent(&changes[0], unix.Getpid(), unix.EVFILT_PROC, unix.EV_ADD)
+	changes[0].Fflags = unix.NOTE_EXIT
+	_, err = unix.Kevent(kq, changes, nil, nil)
+	return err == nil
+}
@@ -0,0 +1,135 @@
+// +build linux
+
+package netpoll
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// _SYS_PIDFD_OPEN is not defined in golang.org/x/sys/unix. It has the same
+// offset from io_uring_setup(2) on every architecture.
+const _SYS_PIDFD_OPEN = unix.SYS_IO_URING_SETUP + 9
+
+func probeCapabilities() Capabilities {
+	return Capabilities{
+		Backend:       "epoll",
+		EdgeTriggered: true,
+		OneShot:       true,
+		ReadHup:       true,
+		Pri:           true,
+		ReadLowWater:  true,
+		Exclusive:     probeEpollExclusive(),
+		Wakeup:        probeEpollWakeup(),
+		IOUring:       probeIOUring(),
+		Timerfd:       probeTimerfd(),
+		ProcessExit:   probePidfd(),
+		CPUAffinity:   true,
+	}
+}
+
+// probeEpollExclusive reports whether EPOLLEXCLUSIVE is supported. Kernels
+// which support it reject it for EPOLL_CTL_MOD with EINVAL, while the older
+// ones ignore the unknown flag.
+func probeEpollExclusive() bool {
+	ep, fd, err := probeEpoll(unix.EPOLLIN)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(ep)
+	defer unix.Close(fd)
+
+	err = unix.EpollCtl(ep, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLEXCLUSIVE,
+		Fd:     int32(fd),
+	})
+	return err == unix.EINVAL
+}
+
+// probeEpollWakeup reports whether EPOLLWAKEUP takes effect. The kernel
+// silently clears it if process has no CAP_BLOCK_SUSPEND capability, thus
+// the registered events are read back from epoll's fdinfo.
+func probeEpollWakeup() bool {
+	ep, fd, err := probeEpoll(unix.EPOLLIN | unix.EPOLLWAKEUP)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(ep)
+	defer unix.Close(fd)
+
+	f, err := os.Open("/proc/self/fdinfo/" + strconv.Itoa(ep))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// Lines of registered descriptors look like:
+	// tfd:        5 events:       19 data:                5  pos:0 ino:... sdev:...
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[0] != "tfd:" || fields[1] != strconv.Itoa(fd) || fields[2] != "events:" {
+			continue
+		}
+		events, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil {
+			return false
+		}
+		return events&unix.EPOLLWAKEUP != 0
+	}
+	return false
+}
+
+// probeEpoll creates epoll instance with eventfd registered for events.
+func probeEpoll(events uint32) (ep, fd int, err error) {
+	ep, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return -1, -1, err
+	}
+	fd, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(ep)
+		return -1, -1, err
+	}
+	err = unix.EpollCtl(ep, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Events: events,
+		Fd:     int32(fd),
+	})
+	if err != nil {
+		unix.Close(fd)
+		unix.Close(ep)
+		return -1, -1, err
+	}
+	return ep, fd, nil
+}
+
+func probeIOUring() bool {
+	// params is struct io_uring_params, which is 120 bytes long.
+	var params [120]byte
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, 1, uintptr(unsafe.Pointer(&params[0])), 0)
+	return probeClose(fd, errno)
+}
+
+func probeTimerfd() bool {
+	fd, _, errno := unix.Syscall(unix.SYS_TIMERFD_CREATE, unix.CLOCK_MONOTONIC, unix.O_CLOEXEC, 0)
+	return probeClose(fd, errno)
+}
+
+func probePidfd() bool {
+	fd, _, errno := unix.Syscall(_SYS_PIDFD_OPEN, uintptr(unix.Getpid()), 0, 0)
+	return probeClose(fd, errno)
+}
+
+// probeClose closes the descriptor created by successful probing syscall.
+func probeClose(fd uintptr, errno unix.Errno) bool {
+	if errno != 0 {
+		return false
+	}
+	unix.Close(int(fd))
+	return true
+}
@@ -0,0 +1,7 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!aix
+
+package netpoll
+
+func probeCapabilities() Capabilities {
+	return Capabilities{}
+}
@@ -0,0 +1,63 @@
+package netpoll
+
+// Channel starts desc within poller and returns the channel the events of
+// desc are delivered on, instead of the callback. It makes possible to wait
+// for the descriptor in a select statement along with other channels.
+//
+// The channel is buffered by buf events (at least one). When the buffer is
+// full, the event is not dropped but merged with the next one sent: a
+// pending event already tells the receiver that the descriptor needs to be
+// handled. Thus the receiver should handle the descriptor until EAGAIN,
+// like it does in edge-triggered mode.
+//
+// The channel is closed when the registration is stopped for any reason:
+// by Stop(), by closing desc or the poller (see Options.OnStop).
+// EventPollClosed is not delivered on the channel; its closing means the
+// same. Note that one-shot descriptors must be resumed as usual.
+func Channel(poller EventPoll, desc *Desc, buf int) (<-chan Event, error) {
+	if buf < 1 {
+		buf = 1
+	}
+	c := &eventChannel{
+		ch: make(chan Event, buf),
+	}
+	prev := desc.setCloseHook(func() {
+		_ = poller.Stop(desc)
+	})
+	err := poller.StartWithOptions(desc, c.send, WithOnStop(c.stop))
+	if err != nil {
+		desc.setCloseHook(prev)
+		return nil, err
+	}
+	return c.ch, nil
+}
+
+// eventChannel delivers events of a single registration started by
+// Channel().
+type eventChannel struct {
+	ch chan Event
+
+	// pending holds events which did not fit into the buffer. It is
+	// accessed from the callback only, which is never run concurrently.
+	pending Event
+}
+
+func (c *eventChannel) send(event Event) {
+	event = (event | c.pending) &^ EventPollClosed
+	if event == 0 {
+		return
+	}
+	select {
+	case c.ch <- event:
+		c.pending = 0
+	default:
+		c.pending = event
+	}
+}
+
+// stop is called once the last callback returned, thus the channel is not
+// written anymore.
+func (c *eventChannel) stop(desc *Desc, _ StopReason) {
+	desc.setCloseHook(nil)
+	close(c.ch)
+}
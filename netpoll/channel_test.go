@@ -0,0 +1,105 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestChannel(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	for _, test := range []struct {
+		name string
+		stop func(*Desc) error
+	}{
+		{"stop", poller.Stop},
+		{"close", (*Desc).Close},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+
+			ch, err := Channel(poller, desc, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = unix.Write(w, []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			// Level-triggered descriptor is reported continuously while
+			// not read, thus the buffer overflows.
+			time.Sleep(50 * time.Millisecond)
+			if n := len(ch); n != cap(ch) {
+				t.Fatalf("%d events buffered; want %d", n, cap(ch))
+			}
+			if event := <-ch; event&EventRead == 0 {
+				t.Fatalf("received %s; want %s", event, EventRead)
+			}
+			if _, err = unix.Read(r, make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = test.stop(desc); err != nil {
+				t.Fatal(err)
+			}
+			timeout := time.After(time.Second)
+			for {
+				select {
+				case _, ok := <-ch:
+					if !ok {
+						return
+					}
+				case <-timeout:
+					t.Fatal("channel is not closed")
+				}
+			}
+		})
+	}
+}
+
+func TestChannelPollerClosed(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	ch, err := Channel(poller, desc, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Channel(poller, desc, 1); err != ErrRegistered {
+		t.Fatalf("second Channel() error is %v; want %v", err, ErrRegistered)
+	}
+	if err = poller.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event, ok := <-ch:
+		if ok {
+			t.Fatalf("received %s; want channel to be closed", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel is not closed")
+	}
+}
@@ -0,0 +1,192 @@
+package netpoll
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+)
+
+// CmdDesc observes the standard output and error of a command along with
+// its exit within a poller.
+//
+// The callbacks must be set before Start() is called. Note that they could
+// be called concurrently if poller's Dispatcher runs callbacks concurrently.
+type CmdDesc struct {
+	// OnStdout and OnStderr are called with every chunk read from the
+	// command's standard output and error respectively. The chunk is valid
+	// only until the callback returns.
+	OnStdout func([]byte)
+	OnStderr func([]byte)
+
+	// OnExit is called once with the exit code of the command, after both
+	// of its outputs are read to the end. The code is -1 if command was
+	// terminated by a signal.
+	OnExit func(code int)
+
+	cmd    *exec.Cmd
+	poller EventPoll
+
+	stdout, stderr *Desc
+	wout, werr     *os.File
+	exit           *Desc
+
+	// remaining is the number of descriptors which are not done yet.
+	// Must be accessed atomically.
+	remaining int32
+
+	closeOnce sync.Once
+}
+
+// NewCmdDesc prepares cmd to be observed by a poller. It must be called
+// before cmd is started: it replaces cmd's Stdout and Stderr with pipes,
+// which must not be set by the caller.
+//
+// Command is started by CmdDesc.Start().
+func NewCmdDesc(cmd *exec.Cmd) (*CmdDesc, error) {
+	if cmd.Process != nil {
+		return nil, fmt.Errorf("netpoll: command is already started")
+	}
+	if cmd.Stdout != nil || cmd.Stderr != nil {
+		return nil, fmt.Errorf("netpoll: command Stdout or Stderr is already set")
+	}
+	c := &CmdDesc{cmd: cmd}
+
+	var err error
+	if c.stdout, c.wout, err = cmdPipe(); err != nil {
+		return nil, err
+	}
+	if c.stderr, c.werr, err = cmdPipe(); err != nil {
+		c.stdout.Close()
+		c.wout.Close()
+		return nil, err
+	}
+	cmd.Stdout = c.wout
+	cmd.Stderr = c.werr
+
+	return c, nil
+}
+
+// cmdPipe creates pipe and descriptor of its reading end.
+func cmdPipe() (*Desc, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	desc, err := newDesc(r, EventRead|EventEdgeTriggered, resolveDescOptions(nil))
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, err
+	}
+	return desc, w, nil
+}
+
+// Start starts the command and registers its outputs and exit within
+// poller. It returns ErrUnsupported if process exit could not be observed
+// on this system (see Capabilities.ProcessExit).
+//
+// When the command exits and its outputs are read to the end, OnExit is
+// called and all descriptors are stopped and closed. Note that if the
+// command passes its outputs to other processes which outlive it, OnExit
+// is not called until they exit too.
+func (c *CmdDesc) Start(poller EventPoll) error {
+	if !poller.Capabilities().ProcessExit {
+		c.Close()
+		return ErrUnsupported
+	}
+	err := c.cmd.Start()
+	// The writing ends are inherited by the child and must be closed within
+	// the parent to receive EOF when the child exits.
+	c.wout.Close()
+	c.werr.Close()
+	if err != nil {
+		c.Close()
+		return err
+	}
+	c.poller = poller
+
+	fd, err := processExitFd(c.cmd.Process.Pid)
+	if err == nil {
+		c.exit, err = NewDesc(uintptr(fd), EventRead|EventOneShot)
+	}
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	c.remaining = 3
+	if err = poller.Start(c.stdout, c.output(c.stdout, c.OnStdout)); err != nil {
+		c.Close()
+		return err
+	}
+	if err = poller.Start(c.stderr, c.output(c.stderr, c.OnStderr)); err != nil {
+		c.Close()
+		return err
+	}
+	if err = poller.Start(c.exit, c.exited); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// output returns callback of the output pipe descriptor.
+func (c *CmdDesc) output(desc *Desc, fn func([]byte)) CallbackFn {
+	return func(Event) {
+		err := DrainRead(desc, func(p []byte) bool {
+			if fn != nil {
+				fn(p)
+			}
+			return true
+		})
+		if err != nil {
+			// The output is read to the end (io.EOF) or could not be read
+			// anymore.
+			c.poller.Stop(desc)
+			c.done()
+		}
+	}
+}
+
+// exited is the callback of the process exit descriptor.
+func (c *CmdDesc) exited(Event) {
+	c.poller.Stop(c.exit)
+	c.done()
+}
+
+// done is called when some descriptor is done. When all of them are done,
+// the command is waited for and OnExit is called.
+func (c *CmdDesc) done() {
+	if atomic.AddInt32(&c.remaining, -1) != 0 {
+		return
+	}
+	c.cmd.Wait()
+	code := -1
+	if s := c.cmd.ProcessState; s != nil {
+		code = s.ExitCode()
+	}
+	c.Close()
+	if c.OnExit != nil {
+		c.OnExit(code)
+	}
+}
+
+// Close stops and closes all descriptors. It does not kill the command.
+func (c *CmdDesc) Close() error {
+	c.closeOnce.Do(func() {
+		for _, desc := range []*Desc{c.stdout, c.stderr, c.exit} {
+			if desc == nil {
+				continue
+			}
+			if c.poller != nil {
+				c.poller.Stop(desc)
+			}
+			desc.Close()
+		}
+		c.wout.Close()
+		c.werr.Close()
+	})
+	return nil
+}
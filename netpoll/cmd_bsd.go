@@ -0,0 +1,30 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// processExitFd returns descriptor which becomes readable when process with
+// given pid exits. It is a kqueue instance with EVFILT_PROC filter of the
+// process registered, since kqueue descriptor is readable while it has
+// pending events.
+func processExitFd(pid int) (int, error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return -1, os.NewSyscallError("kqueue", err)
+	}
+	unix.CloseOnExec(kq)
+
+	changes := make([]unix.Kevent_t, 1)
+	unix.SetKevent(&changes[0], pid, unix.EVFILT_PROC, unix.EV_ADD|unix.EV_ONESHOT)
+	changes[0].Fflags = unix.NOTE_EXIT
+	if _, err = unix.Kevent(kq, changes, nil, nil); err != nil {
+		unix.Close(kq)
+		return -1, os.NewSyscallError("kevent", err)
+	}
+	return kq, nil
+}
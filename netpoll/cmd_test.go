@@ -0,0 +1,87 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCmdDesc(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+	if !poller.Capabilities().ProcessExit {
+		t.Skip("process exit could not be observed on this system")
+	}
+
+	cmd := exec.Command("sh", "-c", `
+		for i in 1 2 3; do
+			echo "out$i"
+			echo "err$i" >&2
+			sleep 0.01
+		done
+		exit 3
+	`)
+	c, err := NewCmdDesc(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+		exit   = make(chan int, 1)
+	)
+	c.OnStdout = func(p []byte) {
+		mu.Lock()
+		stdout.Write(p)
+		mu.Unlock()
+	}
+	c.OnStderr = func(p []byte) {
+		mu.Lock()
+		stderr.Write(p)
+		mu.Unlock()
+	}
+	c.OnExit = func(code int) {
+		// All the output must be read before exit is reported.
+		mu.Lock()
+		defer mu.Unlock()
+		if exp := "out1\nout2\nout3\n"; stdout.String() != exp {
+			t.Errorf("stdout is %q; want %q", stdout.String(), exp)
+		}
+		if exp := "err1\nerr2\nerr3\n"; stderr.String() != exp {
+			t.Errorf("stderr is %q; want %q", stderr.String(), exp)
+		}
+		exit <- code
+	}
+	if err = c.Start(poller); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case code := <-exit:
+		if code != 3 {
+			t.Errorf("exit code is %d; want 3", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit is not reported")
+	}
+	if n := poller.Stats().Registered; n != 0 {
+		t.Errorf("%d descriptors are registered after exit; want 0", n)
+	}
+}
+
+func TestCmdDescStdoutSet(t *testing.T) {
+	cmd := exec.Command("true")
+	cmd.Stdout = new(bytes.Buffer)
+	if _, err := NewCmdDesc(cmd); err == nil {
+		t.Errorf("NewCmdDesc() of command with Stdout set returned no error")
+	}
+}
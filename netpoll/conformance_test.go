@@ -0,0 +1,38 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll_test
+
+import (
+	"testing"
+
+	"github.com/troian/easygo/netpoll"
+	"github.com/troian/easygo/netpoll/netpolltest"
+)
+
+func TestConformance(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		new  func() (netpoll.EventPoll, error)
+	}{
+		{"poller", func() (netpoll.EventPoll, error) {
+			return netpoll.New(nil)
+		}},
+		{"dispatcher", func() (netpoll.EventPoll, error) {
+			return netpoll.New(&netpoll.Config{
+				Dispatcher: netpoll.GoDispatcher,
+			})
+		}},
+		{"pool", func() (netpoll.EventPoll, error) {
+			return netpoll.NewPool(&netpoll.PoolConfig{Size: 4})
+		}},
+		{"uring", func() (netpoll.EventPoll, error) {
+			return netpoll.New(&netpoll.Config{
+				Backend: netpoll.BackendUring,
+			})
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			netpolltest.Conformance(t, test.new)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package netpoll
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlines holds the read and write deadlines of a descriptor.
+type deadlines struct {
+	mu    sync.Mutex
+	read  deadline
+	write deadline
+}
+
+// deadline is a single deadline and the timer which fires at it.
+type deadline struct {
+	at    time.Time
+	timer *time.Timer
+}
+
+// set sets the deadline to t, calling fire when it expires. Zero t clears
+// the deadline.
+func (d *deadline) set(t time.Time, fire func()) {
+	d.at = t
+	if t.IsZero() {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		return
+	}
+	if d.timer == nil {
+		d.timer = time.AfterFunc(time.Until(t), fire)
+		return
+	}
+	d.timer.Stop()
+	d.timer.Reset(time.Until(t))
+}
+
+// SetDeadline sets both the read and write deadlines of the descriptor. It
+// is the same as calling SetReadDeadline() and SetWriteDeadline() with t.
+func (h *Desc) SetDeadline(t time.Time) error {
+	h.setDeadline(EventRead|EventWrite, t)
+	return nil
+}
+
+// SetReadDeadline sets the time at which the callback of the descriptor
+// receives EventTimeout|EventRead. The event is delivered regardless of the
+// descriptor's readiness, armed state and delivery mask, but only if the
+// descriptor is registered within a poller at that time. Setting new
+// deadline before the event is delivered replaces the previous one; zero t
+// clears it. The deadline in the past makes the event to be delivered
+// immediately.
+//
+// Deadlines belong to the descriptor rather than to its registration, thus
+// they are kept by Stop() and Migrate(). Close() clears them. It always
+// returns nil; the error is for compatibility with net.Conn.
+func (h *Desc) SetReadDeadline(t time.Time) error {
+	h.setDeadline(EventRead, t)
+	return nil
+}
+
+// SetWriteDeadline is like SetReadDeadline(), but for EventWrite.
+func (h *Desc) SetWriteDeadline(t time.Time) error {
+	h.setDeadline(EventWrite, t)
+	return nil
+}
+
+func (h *Desc) setDeadline(event Event, t time.Time) {
+	d := &h.deadlines
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if event&EventRead != 0 {
+		d.read.set(t, func() { h.expire(EventRead) })
+	}
+	if event&EventWrite != 0 {
+		d.write.set(t, func() { h.expire(EventWrite) })
+	}
+}
+
+// deadlineExceeded reports whether the deadline of event (EventRead or
+// EventWrite) has expired.
+func (h *Desc) deadlineExceeded(event Event) bool {
+	d := &h.deadlines
+	d.mu.Lock()
+	at := d.read.at
+	if event == EventWrite {
+		at = d.write.at
+	}
+	d.mu.Unlock()
+
+	return !at.IsZero() && !time.Now().Before(at)
+}
+
+// expire is called by the deadline timer of event. The deadline could be
+// changed while the timer was firing, thus it is checked again.
+func (h *Desc) expire(event Event) {
+	if !h.deadlineExceeded(event) {
+		return
+	}
+	h.ownerMu.Lock()
+	p := h.owner
+	h.ownerMu.Unlock()
+
+	if p != nil {
+		p.timeout(h, EventTimeout|event)
+	}
+}
+
+// timeout passes synthetic event to the callback of desc, if it is
+// registered.
+func (p *poller) timeout(desc *Desc, event Event) {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r != nil {
+		r.schedule(event)
+	}
+}
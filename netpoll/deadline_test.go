@@ -0,0 +1,239 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDescDeadline(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	events := make(chan Event, 16)
+	if err = poller.Start(desc, func(event Event) {
+		if event&EventTimeout != 0 {
+			events <- event
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(t *testing.T, min time.Duration, want Event) {
+		start := time.Now()
+		select {
+		case event := <-events:
+			if event != want {
+				t.Fatalf("unexpected event: %s; want %s", event, want)
+			}
+			if d := time.Since(start); d < min {
+				t.Fatalf("event delivered after %s; want at least %s", d, min)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s delivered", want)
+		}
+	}
+	silence := func(t *testing.T, d time.Duration) {
+		select {
+		case event := <-events:
+			t.Fatalf("unexpected event: %s", event)
+		case <-time.After(d):
+		}
+	}
+
+	t.Run("expire", func(t *testing.T) {
+		desc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		expect(t, 10*time.Millisecond, EventTimeout|EventRead)
+		silence(t, 50*time.Millisecond)
+	})
+	t.Run("write", func(t *testing.T) {
+		desc.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		expect(t, 0, EventTimeout|EventWrite)
+	})
+	t.Run("past", func(t *testing.T) {
+		desc.SetReadDeadline(time.Now().Add(-time.Second))
+		expect(t, 0, EventTimeout|EventRead)
+	})
+	t.Run("extend", func(t *testing.T) {
+		desc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		desc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		expect(t, 80*time.Millisecond, EventTimeout|EventRead)
+	})
+	t.Run("clear", func(t *testing.T) {
+		desc.SetDeadline(time.Now().Add(20 * time.Millisecond))
+		desc.SetDeadline(time.Time{})
+		silence(t, 100*time.Millisecond)
+	})
+	t.Run("stopped", func(t *testing.T) {
+		if err := poller.Stop(desc); err != nil {
+			t.Fatal(err)
+		}
+		desc.SetReadDeadline(time.Now())
+		silence(t, 50*time.Millisecond)
+	})
+}
+
+func TestBlockingConn(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead|EventWrite|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewBlockingConn(poller, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	read := func() ([]byte, error) {
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	send := func(after time.Duration, data string) {
+		time.AfterFunc(after, func() {
+			if _, err := unix.Write(w, []byte(data)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Run("read", func(t *testing.T) {
+		send(10*time.Millisecond, "hello")
+		p, err := read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, []byte("hello")) {
+			t.Fatalf("unexpected data: %q", p)
+		}
+	})
+	t.Run("expire", func(t *testing.T) {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+		start := time.Now()
+		_, err := read()
+		if err != ErrDeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("error is not a timeout net.Error")
+		}
+		if d := time.Since(start); d < 20*time.Millisecond {
+			t.Fatalf("read returned after %s", d)
+		}
+		// Expired deadline fails the next calls immediately.
+		if _, err = read(); err != ErrDeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	t.Run("extend", func(t *testing.T) {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+		time.AfterFunc(10*time.Millisecond, func() {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+		})
+		send(60*time.Millisecond, "extended")
+		p, err := read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, []byte("extended")) {
+			t.Fatalf("unexpected data: %q", p)
+		}
+	})
+	t.Run("clear", func(t *testing.T) {
+		conn.SetReadDeadline(time.Now().Add(-time.Second))
+		if _, err := read(); err != ErrDeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		conn.SetReadDeadline(time.Time{})
+		send(50*time.Millisecond, "cleared")
+		p, err := read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, []byte("cleared")) {
+			t.Fatalf("unexpected data: %q", p)
+		}
+	})
+	t.Run("write", func(t *testing.T) {
+		// Fill the socket buffer; nobody reads the other side.
+		conn.SetWriteDeadline(time.Now().Add(30 * time.Millisecond))
+		n, err := conn.Write(make([]byte, 1<<20))
+		if err != ErrDeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n == 0 {
+			t.Fatalf("nothing was written")
+		}
+		conn.SetWriteDeadline(time.Time{})
+	})
+	t.Run("eof", func(t *testing.T) {
+		unix.Shutdown(w, unix.SHUT_WR)
+		if _, err := read(); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	t.Run("close", func(t *testing.T) {
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := read(); err != ErrClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestBlockingConnEvent(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead|EventOneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewBlockingConn(poller, desc); err != ErrUnsupportedEvent {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
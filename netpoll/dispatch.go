@@ -0,0 +1,117 @@
+package netpoll
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Dispatcher describes an object that runs callbacks of ready descriptors.
+//
+// Poller calls Dispatch for each event received from the kernel. Dispatch
+// may run fn synchronously, in a separate goroutine or pass it to some
+// worker pool. Note that the poller does not wait for fn to complete, so if
+// fn is not run synchronously, next events are received concurrently with
+// callbacks execution. Anyway, callbacks of a single descriptor are never
+// run concurrently.
+type Dispatcher interface {
+	Dispatch(fn func())
+}
+
+// DispatcherFunc is an adapter to allow the use of ordinary functions as
+// Dispatcher.
+type DispatcherFunc func(func())
+
+// Dispatch implements Dispatcher interface.
+func (f DispatcherFunc) Dispatch(fn func()) {
+	f(fn)
+}
+
+var (
+	// InlineDispatcher runs callbacks right in the goroutine waiting for
+	// events. That is, next events are not received until the callback
+	// returns. It is the default Dispatcher.
+	InlineDispatcher Dispatcher = inlineDispatcher{}
+
+	// GoDispatcher runs every callback in a separate goroutine.
+	GoDispatcher Dispatcher = goDispatcher{}
+)
+
+type inlineDispatcher struct{}
+
+func (inlineDispatcher) Dispatch(fn func()) { fn() }
+
+type goDispatcher struct{}
+
+func (goDispatcher) Dispatch(fn func()) { go fn() }
+
+// ScratchDispatcher is a Dispatcher which runs callbacks by a set of workers
+// each owning a Scratch arena. Callbacks started by StartWithScratch() are
+// passed to DispatchScratch() instead of Dispatch() to get the arena of the
+// worker running them. With other Dispatchers (except for
+// InlineDispatcher) such callbacks get a new Scratch for each call.
+type ScratchDispatcher interface {
+	Dispatcher
+	DispatchScratch(fn func(*Scratch))
+}
+
+// WorkerDispatcher is a ScratchDispatcher which runs callbacks by a fixed
+// number of worker goroutines. Dispatch blocks while all the workers are
+// busy and the queue is full, thus slowing down the poller's wait loop.
+type WorkerDispatcher struct {
+	work chan workerTask
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+type workerTask struct {
+	fn      func()
+	scratch func(*Scratch)
+}
+
+// NewWorkerDispatcher starts n workers. If n is not positive,
+// runtime.GOMAXPROCS(0) workers are started.
+func NewWorkerDispatcher(n int) *WorkerDispatcher {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	d := &WorkerDispatcher{
+		work: make(chan workerTask, n),
+	}
+	d.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// Dispatch implements Dispatcher interface.
+func (d *WorkerDispatcher) Dispatch(fn func()) {
+	d.work <- workerTask{fn: fn}
+}
+
+// DispatchScratch implements ScratchDispatcher interface.
+func (d *WorkerDispatcher) DispatchScratch(fn func(*Scratch)) {
+	d.work <- workerTask{scratch: fn}
+}
+
+// Close stops the workers after they run the callbacks already queued. It
+// must be called after all pollers using d are closed.
+func (d *WorkerDispatcher) Close() error {
+	d.once.Do(func() {
+		close(d.work)
+	})
+	d.wg.Wait()
+	return nil
+}
+
+func (d *WorkerDispatcher) worker() {
+	defer d.wg.Done()
+	var s Scratch
+	for t := range d.work {
+		if t.fn != nil {
+			t.fn()
+		} else {
+			t.scratch(&s)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package netpoll
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Drain gracefully closes the connection of desc off the hot path. It shuts
+// down the writing side of the connection (sending FIN), then discards the
+// incoming data until the peer closes its side too. Closing the socket with
+// unread data makes the kernel to reset the connection, which could destroy
+// the data the peer did not receive yet.
+//
+// The desc is stopped (if it is registered) and started within poller again
+// for EventRead in level-triggered mode with the callback of Drain. When
+// EOF is received or timeout passes, the desc is stopped and closed, and done
+// is called with nil or ErrDrainTimeout respectively; other errors are
+// passed to done as is. Non-positive timeout means no timeout.
+//
+// Note that done is called from the poller's callback or from the timer's
+// goroutine, thus it should not block.
+func Drain(poller EventPoll, desc *Desc, timeout time.Duration, done func(error)) {
+	d := &drainer{
+		poller: poller,
+		desc:   desc,
+		done:   done,
+	}
+	if err := syscall.Shutdown(desc.Fd(), syscall.SHUT_WR); err != nil && err != syscall.ENOTCONN {
+		d.finish(err)
+		return
+	}
+	if desc.Owner() != nil {
+		if err := poller.Stop(desc); err != nil {
+			d.finish(err)
+			return
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, d.expire)
+	}
+	desc.event = EventRead
+	if err := poller.Start(desc, d.handle); err != nil {
+		d.finishLocked(err)
+	}
+}
+
+// drainer holds the state of a single Drain() call.
+type drainer struct {
+	poller EventPoll
+	desc   *Desc
+	done   func(error)
+	timer  *time.Timer
+
+	// expired is set to 1 when the timeout passes. It is checked between
+	// the reads to not be stuck reading from the peer which never stops
+	// sending. Must be accessed atomically.
+	expired int32
+
+	// mu is held while desc is being read, thus it is not closed (and its
+	// fd reused) in the middle of reading.
+	mu       sync.Mutex
+	finished bool
+}
+
+func (d *drainer) handle(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.finished {
+		return
+	}
+	if event&EventPollClosed != 0 {
+		d.finishLocked(ErrClosed)
+		return
+	}
+	err := DrainRead(d.desc, func([]byte) bool {
+		return atomic.LoadInt32(&d.expired) == 0
+	})
+	switch {
+	case err == io.EOF:
+		d.finishLocked(nil)
+	case err != nil:
+		d.finishLocked(err)
+	case atomic.LoadInt32(&d.expired) == 1:
+		d.finishLocked(ErrDrainTimeout)
+	}
+}
+
+func (d *drainer) expire() {
+	atomic.StoreInt32(&d.expired, 1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.finished {
+		d.finishLocked(ErrDrainTimeout)
+	}
+}
+
+func (d *drainer) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finishLocked(err)
+}
+
+// finishLocked stops and closes the desc and calls the completion callback.
+// Note that d.mu must be held.
+func (d *drainer) finishLocked(err error) {
+	d.finished = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.poller.Stop(d.desc)
+	d.desc.Close()
+	d.done(err)
+}
@@ -4,11 +4,28 @@ package netpoll
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"runtime"
 	"golang.org/x/sys/unix"
 )
 
+// epollCtlFault, if set, is called before epoll_ctl(2) adds or modifies fd.
+// The error it returns, if any, is returned instead of making the call. It
+// is set by tests to inject errors.
+var epollCtlFault func(op, fd int) error
+
+// epollCtl is unix.EpollCtl used to add and modify descriptors.
+func epollCtl(epfd, op, fd int, ev *unix.EpollEvent) error {
+	if fault := epollCtlFault; fault != nil {
+		if err := fault(op, fd); err != nil {
+			return err
+		}
+	}
+	return unix.EpollCtl(epfd, op, fd, ev)
+}
+
 // EpollEvent represents epoll events configuration bit mask.
 type EpollEvent uint32
 
@@ -22,6 +39,7 @@ const (
 	EPOLLHUP     = unix.EPOLLHUP
 	EPOLLET      = unix.EPOLLET
 	EPOLLONESHOT = unix.EPOLLONESHOT
+	EPOLLWAKEUP  = unix.EPOLLWAKEUP
 
 	// _EPOLLCLOSED is a special EpollEvent value the receipt of which means
 	// that the epoll instance is closed.
@@ -48,6 +66,7 @@ func (evt EpollEvent) String() (str string) {
 	name(EPOLLHUP, "EPOLLHUP")
 	name(EPOLLET, "EPOLLET")
 	name(EPOLLONESHOT, "EPOLLONESHOT")
+	name(EPOLLWAKEUP, "EPOLLWAKEUP")
 	name(_EPOLLCLOSED, "_EPOLLCLOSED")
 
 	return
@@ -55,20 +74,90 @@ func (evt EpollEvent) String() (str string) {
 
 // Epoll represents single epoll instance.
 type Epoll struct {
+	// dels, waitNanos and waits are accessed by 64-bit atomic operations,
+	// thus they go first to be 64-bit aligned on 32-bit platforms.
+
+	// dels is the number of Del() calls. It is used to not call callbacks
+	// of descriptors removed while the received batch is being handled.
+	// Must be accessed atomically.
+	dels uint64
+
+	// waitNanos is the total time spent in epoll_wait(2) and waits is the
+	// number of its calls. They are updated only if metrics is true and
+	// must be accessed atomically.
+	waitNanos uint64
+	waits     uint64
+
 	mu sync.RWMutex
 
 	fd       int
-	eventFd  int
+	wakeR    int
+	wakeW    int
 	closed   bool
+	external bool
 	waitDone chan struct{}
 
-	callbacks map[int]func(EpollEvent)
+	// callbacks holds the callbacks of added descriptors. The gen is the
+	// generation of the last added one.
+	callbacks map[int]epollCallback
+	gen       uint64
+
+	// iterMu is held while events are received and handled. It makes the
+	// buffers below to be used by a single goroutine.
+	iterMu  sync.Mutex
+	events  []unix.EpollEvent
+	pending []epollCallback
+	rotate  int
+
+	// maxEvents limits the growth of the events buffer, which is doubled
+	// each time it is filled up by a single epoll_wait(2) call.
+	maxEvents int
+
+	// metrics enables waitNanos and waits counting.
+	metrics bool
+
+	onBatch  func()
+	onWakeup func()
 }
 
 // EpollConfig contains options for Epoll instance configuration.
 type EpollConfig struct {
 	// OnWaitError will be called from goroutine, waiting for events.
-	OnWaitError func(error)
+	// If it returns true, the wait loop continues. Otherwise the loop stops
+	// and no more events are delivered.
+	//
+	// Use StopOnWaitError() to adapt handlers of the former func(error)
+	// signature.
+	OnWaitError func(error) bool
+
+	// ExternalLoop makes EpollCreate() to not start the wait loop. Instead,
+	// the caller must call Iterate() when Fd() is ready for reading, e.g.
+	// when the instance is embedded into another event loop.
+	ExternalLoop bool
+
+	// WakeupMethod chooses the mechanism used to wake up the wait loop.
+	// WakeupDefault is eventfd, falling back to pipe on kernels without
+	// eventfd support.
+	WakeupMethod WakeupMethod
+
+	// cpus is a list of CPUs the wait loop thread is bound to.
+	cpus []int
+
+	// metrics enables accounting of time spent in epoll_wait(2).
+	metrics bool
+
+	// onIdle is called from the wait loop when no events were received
+	// for at least idleThreshold.
+	onIdle        func(time.Duration)
+	idleThreshold time.Duration
+
+	// onBatch is called after callbacks of all events received by a single
+	// epoll_wait(2) call were called.
+	onBatch func()
+
+	// onWakeup is called from the wait loop after the wakeup made by
+	// trigger() was drained.
+	onWakeup func()
 }
 
 func (c *EpollConfig) withDefaults() (config EpollConfig) {
@@ -82,49 +171,140 @@ func (c *EpollConfig) withDefaults() (config EpollConfig) {
 }
 
 // EpollCreate creates new epoll instance.
-// It starts the wait loop in separate goroutine.
+// It starts the wait loop in separate goroutine, unless config's ExternalLoop
+// is set.
 func EpollCreate(c *EpollConfig) (*Epoll, error) {
 	config := c.withDefaults()
 
-	fd, err := unix.EpollCreate1(0)
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
 	if err != nil {
 		return nil, err
 	}
 
-	r0, _, errno := unix.Syscall(unix.SYS_EVENTFD2, 0, 0, 0)
-	if errno != 0 {
-		return nil, errno
+	wakeR, wakeW, err := newWakeup(config.WakeupMethod)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
 	}
-	eventFd := int(r0)
 
 	// Set finalizer for write end of socket pair to avoid data races when
 	// closing Epoll instance and EBADF errors on writing ctl bytes from callers.
-	err = unix.EpollCtl(fd, unix.EPOLL_CTL_ADD | unix.EPOLL_CLOEXEC, eventFd, &unix.EpollEvent{
+	err = unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, wakeR, &unix.EpollEvent{
 		Events: unix.EPOLLIN,
-		Fd:     int32(eventFd),
+		Fd:     int32(wakeR),
 	})
 	if err != nil {
 		unix.Close(fd)
-		unix.Close(eventFd)
+		closeWakeup(wakeR, wakeW)
 		return nil, err
 	}
 
 	ep := &Epoll{
 		fd:        fd,
-		eventFd:   eventFd,
-		callbacks: make(map[int]func(EpollEvent)),
+		wakeR:     wakeR,
+		wakeW:     wakeW,
+		external:  config.ExternalLoop,
+		metrics:   config.metrics,
+		onBatch:   config.onBatch,
+		onWakeup:  config.onWakeup,
+		callbacks: make(map[int]epollCallback),
 		waitDone:  make(chan struct{}),
+		events:    make([]unix.EpollEvent, maxWaitEventsBegin),
+		pending:   make([]epollCallback, 0, maxWaitEventsBegin),
+		maxEvents: maxWaitEventsStop,
+	}
+	if ep.external {
+		return ep, nil
 	}
 
 	// Run wait loop.
-	go ep.wait(config.OnWaitError)
+	started := make(chan error, 1)
+	go ep.wait(config.OnWaitError, config.cpus, idleTracker{
+		fn:        config.onIdle,
+		threshold: config.idleThreshold,
+	}, started)
+	if len(config.cpus) == 0 {
+		return ep, nil
+	}
+	if err = <-started; err != nil {
+		// The wait loop has exited and closed the epoll descriptor.
+		closeWakeup(wakeR, wakeW)
+		return nil, err
+	}
 
 	return ep, nil
 }
 
-// closeBytes used for writing to eventfd.
+// newWakeup creates descriptors used to wake up the wait loop. The wait loop
+// observes r and the closer writes to w. For eventfd they are the same.
+func newWakeup(method WakeupMethod) (r, w int, err error) {
+	switch method {
+	case WakeupDefault, WakeupEventfd:
+		// Note that eventfd is not in semaphore mode, thus a single read
+		// consumes all pending wakeups.
+		r0, _, errno := unix.Syscall(unix.SYS_EVENTFD2, 0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK, 0)
+		if errno == 0 {
+			return int(r0), int(r0), nil
+		}
+		if errno != unix.ENOSYS || method == WakeupEventfd {
+			return -1, -1, errno
+		}
+		// Kernel without eventfd support; fall back to the pipe.
+		fallthrough
+
+	case WakeupPipe:
+		var p [2]int
+		if err = unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+			return -1, -1, err
+		}
+		return p[0], p[1], nil
+	}
+	return -1, -1, ErrUnsupported
+}
+
+func closeWakeup(r, w int) (err error) {
+	err = unix.Close(r)
+	if w != r {
+		if e := unix.Close(w); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// closeBytes used for writing to eventfd. Note that eventfd requires exactly
+// 8 bytes value, while pipe accepts any.
 var closeBytes = []byte{1, 0, 0, 0, 0, 0, 0, 0}
 
+// trigger wakes up the wait loop, which calls onWakeup then.
+func (ep *Epoll) trigger() error {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+
+	if ep.closed {
+		return ErrClosed
+	}
+	_, err := unix.Write(ep.wakeW, closeBytes)
+	if err == unix.EAGAIN {
+		// The pipe is full (or eventfd counter overflowed), thus the loop
+		// is woken up anyway.
+		return nil
+	}
+	return err
+}
+
+// drainWakeup consumes pending wakeups by a single read: eventfd returns
+// the whole counter, and the pipe holds at most a few bytes written since
+// the last drain.
+func (ep *Epoll) drainWakeup() {
+	var buf [64]byte
+	if ep.wakeR == ep.wakeW {
+		unix.Read(ep.wakeR, buf[:8])
+	} else {
+		unix.Read(ep.wakeR, buf[:])
+	}
+}
+
 // Close stops wait loop and closes all underlying resources.
 func (ep *Epoll) Close() (err error) {
 	ep.mu.Lock()
@@ -135,16 +315,27 @@ func (ep *Epoll) Close() (err error) {
 		}
 		ep.closed = true
 
-		if _, err = unix.Write(ep.eventFd, closeBytes); err != nil {
+		if _, err = unix.Write(ep.wakeW, closeBytes); err != nil {
 			ep.mu.Unlock()
 			return
 		}
 	}
 	ep.mu.Unlock()
 
-	<-ep.waitDone
+	if ep.external {
+		// Wait for the Iterate() call, if any. Note that wakeup descriptor is
+		// kept readable, so it returns immediately.
+		ep.iterMu.Lock()
+		err = unix.Close(ep.fd)
+		ep.iterMu.Unlock()
+		if err != nil {
+			return
+		}
+	} else {
+		<-ep.waitDone
+	}
 
-	if err = unix.Close(ep.eventFd); err != nil {
+	if err = closeWakeup(ep.wakeR, ep.wakeW); err != nil {
 		return
 	}
 
@@ -159,14 +350,20 @@ func (ep *Epoll) Close() (err error) {
 	ep.mu.Unlock()
 
 	for _, cb := range callbacks {
-		if cb != nil {
-			cb(_EPOLLCLOSED)
+		if cb.fn != nil {
+			cb.fn(_EPOLLCLOSED)
 		}
 	}
 
 	return
 }
 
+// epollCallback is a callback of descriptor added to Epoll.
+type epollCallback struct {
+	fn  func(EpollEvent)
+	gen uint64
+}
+
 // Add adds fd to epoll set with given events.
 // Callback will be called on each received event from epoll.
 // Note that _EPOLLCLOSED is triggered for every cb when epoll closed.
@@ -185,12 +382,22 @@ func (ep *Epoll) Add(fd int, events EpollEvent, cb func(EpollEvent)) (err error)
 	if _, has := ep.callbacks[fd]; has {
 		return ErrRegistered
 	}
-	ep.callbacks[fd] = cb
+	if err = epollCtl(ep.fd, unix.EPOLL_CTL_ADD, fd, ev); err != nil {
+		return err
+	}
+	ep.gen++
+	ep.callbacks[fd] = epollCallback{
+		fn:  cb,
+		gen: ep.gen,
+	}
 
-	return unix.EpollCtl(ep.fd, unix.EPOLL_CTL_ADD | unix.EPOLL_CLOEXEC, fd, ev)
+	return nil
 }
 
-// Del removes fd from epoll set.
+// Del removes fd from epoll set. Callback of fd is not called after Del
+// returns, even if the event for fd was already received within the batch
+// being handled. Note that if Del is called concurrently with the handling
+// of events, the callback could be already running.
 func (ep *Epoll) Del(fd int) (err error) {
 	ep.mu.Lock()
 	defer ep.mu.Unlock()
@@ -203,6 +410,7 @@ func (ep *Epoll) Del(fd int) (err error) {
 	}
 
 	delete(ep.callbacks, fd)
+	atomic.AddUint64(&ep.dels, 1)
 
 	return unix.EpollCtl(ep.fd, unix.EPOLL_CTL_DEL, fd, nil)
 }
@@ -224,7 +432,7 @@ func (ep *Epoll) Mod(fd int, events EpollEvent) (err error) {
 		return ErrNotRegistered
 	}
 
-	return unix.EpollCtl(ep.fd, unix.EPOLL_CTL_MOD, fd, ev)
+	return epollCtl(ep.fd, unix.EPOLL_CTL_MOD, fd, ev)
 }
 
 const (
@@ -232,7 +440,9 @@ const (
 	maxWaitEventsStop  = 32768
 )
 
-func (ep *Epoll) wait(onError func(error)) {
+// wait runs the wait loop. The result of binding the loop to cpus is sent
+// to started, which must be buffered, before the loop begins.
+func (ep *Epoll) wait(onError func(error) bool, cpus []int, idle idleTracker, started chan<- error) {
 	defer func() {
 		if err := unix.Close(ep.fd); err != nil {
 			onError(err)
@@ -240,45 +450,157 @@ func (ep *Epoll) wait(onError func(error)) {
 		close(ep.waitDone)
 	}()
 
-	events := make([]unix.EpollEvent, maxWaitEventsBegin)
-	callbacks := make([]func(EpollEvent), 0, maxWaitEventsBegin)
+	if len(cpus) > 0 {
+		if err := bindThread(cpus); err != nil {
+			started <- err
+			return
+		}
+	}
+	started <- nil
 
+	timeout := timeoutMillis(idle.timeout())
 	for {
-		n, err := unix.EpollWait(ep.fd, events, -1)
+		var start int64
+		if idle.fn != nil {
+			start = nanotime()
+		}
+		ep.iterMu.Lock()
+		n, closed, err := ep.poll(timeout)
+		ep.iterMu.Unlock()
 		if err != nil {
-			if temporaryErr(err) {
+			if temporaryErr(err) || onError(err) {
 				continue
 			}
-			onError(err)
 			return
 		}
+		if closed {
+			return
+		}
+		idle.observe(start, n)
+
+		// give more chance to other goroutine
+		runtime.Gosched()
+	}
+}
+
+// Fd returns the epoll file descriptor. It could be used to embed the
+// instance into another event loop (see EpollConfig.ExternalLoop).
+func (ep *Epoll) Fd() int {
+	return ep.fd
+}
+
+// Iterate waits for events for at most timeout and calls callbacks of ready
+// descriptors. Negative timeout means infinite waiting.
+// It must be used only if instance was created with ExternalLoop option.
+func (ep *Epoll) Iterate(timeout time.Duration) error {
+	if !ep.external {
+		return ErrNotExternalLoop
+	}
 
-		callbacks = callbacks[:n]
+	ep.iterMu.Lock()
+	defer ep.iterMu.Unlock()
 
-		ep.mu.RLock()
-		for i := 0; i < n; i++ {
-			fd := int(events[i].Fd)
-			if fd == ep.eventFd { // signal to close
+	ep.mu.RLock()
+	closed := ep.closed
+	ep.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	_, closed, err := ep.poll(timeoutMillis(timeout))
+	if err != nil {
+		if temporaryErr(err) {
+			return nil
+		}
+		return err
+	}
+	if closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// poll makes single epoll_wait() call and calls callbacks of ready
+// descriptors. It returns the number of received events and reports whether
+// instance was closed.
+// Note that ep.iterMu must be held.
+//
+// Callbacks are called starting from the rotating offset within the received
+// batch, thus no descriptor is always serviced first. Note that there is no
+// aging across batches: which descriptors get into the next batch is decided
+// by the kernel, which moves reported level-triggered descriptors to the
+// tail of its ready list.
+func (ep *Epoll) poll(timeout int) (n int, closed bool, err error) {
+	var start int64
+	if ep.metrics {
+		start = nanotime()
+	}
+	n, err = unix.EpollWait(ep.fd, ep.events, timeout)
+	if ep.metrics {
+		atomic.AddUint64(&ep.waitNanos, uint64(nanotime()-start))
+		atomic.AddUint64(&ep.waits, 1)
+	}
+	if err != nil {
+		return 0, false, wrapErr("wait", ep.fd, 0, err)
+	}
+
+	callbacks := ep.pending[:n]
+
+	var woken bool
+	ep.mu.RLock()
+	for i := 0; i < n; i++ {
+		fd := int(ep.events[i].Fd)
+		if fd == ep.wakeR {
+			if ep.closed {
 				ep.mu.RUnlock()
-				return
+				return n, true, nil
 			}
-			callbacks[i] = ep.callbacks[fd]
+			woken = true
+			callbacks[i] = epollCallback{}
+			continue
 		}
-		ep.mu.RUnlock()
+		callbacks[i] = ep.callbacks[fd]
+	}
+	dels := atomic.LoadUint64(&ep.dels)
+	ep.mu.RUnlock()
 
-		for i := 0; i < n; i++ {
-			if cb := callbacks[i]; cb != nil {
-				cb(EpollEvent(events[i].Events))
-				callbacks[i] = nil
-			}
+	if woken {
+		ep.drainWakeup()
+		if ep.onWakeup != nil {
+			ep.onWakeup()
 		}
+	}
 
-		if n == len(events) && n*2 <= maxWaitEventsStop {
-			events = make([]unix.EpollEvent, n*2)
-			callbacks = make([]func(EpollEvent), 0, n*2)
+	if n > 0 {
+		ep.rotate++
+	}
+	for j := 0; j < n; j++ {
+		i := (ep.rotate + j) % n
+		cb := callbacks[i]
+		callbacks[i] = epollCallback{}
+		if cb.fn != nil && atomic.LoadUint64(&ep.dels) != dels {
+			// Some descriptor was removed after the batch was received
+			// (e.g. by the callbacks called above). Its callback must not
+			// be called after Del() returned, nor the callback of the
+			// descriptor added with the same number since then.
+			ep.mu.RLock()
+			if ep.callbacks[int(ep.events[i].Fd)].gen != cb.gen {
+				cb = epollCallback{}
+			}
+			ep.mu.RUnlock()
+		}
+		if cb.fn != nil {
+			cb.fn(EpollEvent(ep.events[i].Events))
 		}
+	}
+	if n > 0 && ep.onBatch != nil {
+		ep.onBatch()
+	}
 
-		// give more chance to other goroutine
-		runtime.Gosched()
+	if n == len(ep.events) && n*2 <= ep.maxEvents {
+		ep.events = make([]unix.EpollEvent, n*2)
+		ep.pending = make([]epollCallback, 0, n*2)
 	}
+
+	return n, false, nil
 }
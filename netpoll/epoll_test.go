@@ -23,6 +23,107 @@ func TestEpollCreate(t *testing.T) {
 	}
 }
 
+func TestEpollWakeupMethod(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		method WakeupMethod
+		pipe   bool
+	}{
+		{"default", WakeupDefault, false},
+		{"eventfd", WakeupEventfd, false},
+		{"pipe", WakeupPipe, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := epollConfig(t)
+			config.WakeupMethod = test.method
+			ep, err := EpollCreate(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act := ep.wakeR != ep.wakeW; act != test.pipe {
+				t.Errorf("wakeup descriptors are distinct: %t; want %t", act, test.pipe)
+			}
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(r)
+			defer unix.Close(w)
+
+			events := make(chan EpollEvent, 2)
+			err = ep.Add(r, EPOLLIN|EPOLLET, func(evt EpollEvent) {
+				events <- evt
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = unix.Write(w, []byte{'x'}); err != nil {
+				t.Fatal(err)
+			}
+			if evt := <-events; evt&EPOLLIN == 0 {
+				t.Errorf("received %s; want %s", evt, EpollEvent(EPOLLIN))
+			}
+
+			// Close must wake up the wait loop.
+			closed := make(chan error)
+			go func() { closed <- ep.Close() }()
+			select {
+			case err = <-closed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Close() was blocked")
+			}
+			if evt := <-events; evt&_EPOLLCLOSED == 0 {
+				t.Errorf("received %s; want %s", evt, EpollEvent(_EPOLLCLOSED))
+			}
+		})
+	}
+}
+
+func TestEpollWaitErrorContinue(t *testing.T) {
+	var (
+		errs = make(chan error, 16)
+		n    int
+	)
+	s, err := EpollCreate(&EpollConfig{
+		OnWaitError: func(err error) bool {
+			n++
+			select {
+			case errs <- err:
+			default:
+			}
+			return n < 3
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make epoll_wait() fail. The loop must continue until the handler
+	// returns false.
+	if err = unix.Close(s.fd); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.waitDone:
+	case <-time.After(time.Second):
+		t.Fatalf("wait loop was not stopped")
+	}
+	if len(errs) < 3 {
+		t.Errorf("OnWaitError called %d times; want at least 3", len(errs))
+	}
+	e, ok := (<-errs).(*Error)
+	if !ok {
+		t.Fatalf("OnWaitError called with %T; want *Error", e)
+	}
+	if e.Op != "wait" || e.Err != unix.EBADF {
+		t.Errorf("unexpected error: %#v", e)
+	}
+}
+
 func TestEpollAddClosed(t *testing.T) {
 	s, err := EpollCreate(epollConfig(t))
 	if err != nil {
@@ -69,6 +170,98 @@ func TestEpollDel(t *testing.T) {
 	}
 }
 
+func TestEpollDelMidBatch(t *testing.T) {
+	config := epollConfig(t)
+	config.ExternalLoop = true
+	ep, err := EpollCreate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	const n = 16
+	fds := make([]int, n)
+	for i := range fds {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(r)
+		defer unix.Close(w)
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		fds[i] = r
+	}
+	var calls int
+	for _, fd := range fds {
+		err := ep.Add(fd, EPOLLIN, func(EpollEvent) {
+			calls++
+			for _, fd := range fds {
+				ep.Del(fd)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// All descriptors are ready and are received within a single batch.
+	if err = ep.Iterate(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("callbacks called %d times; want 1", calls)
+	}
+}
+
+func TestEpollReaddMidBatch(t *testing.T) {
+	config := epollConfig(t)
+	config.ExternalLoop = true
+	ep, err := EpollCreate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	const n = 16
+	fds := make([]int, n)
+	for i := range fds {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(r)
+		defer unix.Close(w)
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		fds[i] = r
+	}
+	var calls, stale int
+	for _, fd := range fds {
+		err := ep.Add(fd, EPOLLIN, func(EpollEvent) {
+			calls++
+			// Replace all descriptors by the new ones with the same numbers.
+			// Events received for the old ones must not be passed to them.
+			for _, fd := range fds {
+				ep.Del(fd)
+				ep.Add(fd, EPOLLIN, func(EpollEvent) {
+					stale++
+				})
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ep.Iterate(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || stale != 0 {
+		t.Errorf("callbacks called %d times and new ones %d times; want 1 and 0", calls, stale)
+	}
+}
+
 func TestEpollServer(t *testing.T) {
 	ep, err := EpollCreate(epollConfig(t))
 	if err != nil {
@@ -221,8 +414,9 @@ func RunEchoServer(tb testing.TB) net.Listener {
 
 func epollConfig(tb testing.TB) *EpollConfig {
 	return &EpollConfig{
-		OnWaitError: func(err error) {
+		OnWaitError: func(err error) bool {
 			tb.Fatal(err)
+			return false
 		},
 	}
 }
@@ -0,0 +1,140 @@
+package netpoll
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// DescState describes a registration within EventPoll. It is returned by
+// EventPoll.Export() and could be serialized (e.g. as JSON) to rebuild the
+// registrations within another process by Restore().
+type DescState struct {
+	// Fd is the file descriptor number. Note that it is valid within the
+	// exporting process only. If descriptors are passed to another process
+	// such that their numbers change (e.g. by exec.Cmd's ExtraFiles), Fd
+	// must be rewritten before Restore() is called.
+	Fd int `json:"fd"`
+
+	// Event is the set of events descriptor is registered for.
+	Event Event `json:"event"`
+
+	// Label is the label of the descriptor (see Desc.SetLabel()).
+	Label string `json:"label,omitempty"`
+
+	// Meta is the user metadata attached by WithMetadata().
+	Meta []byte `json:"meta,omitempty"`
+
+	// Desc is the registered descriptor. It is set by Export() and by
+	// Restore() when state is passed to bind function and is never
+	// serialized.
+	Desc *Desc `json:"-"`
+}
+
+// sortDescStates sorts states by file descriptor number.
+func sortDescStates(states []DescState) {
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Fd < states[j].Fd
+	})
+}
+
+// RestoreError is returned by Restore() when some descriptors could not be
+// restored. The others are registered anyway.
+type RestoreError struct {
+	// Errs holds the error of each state passed to Restore(), or nil if the
+	// state was restored successfully.
+	Errs []error
+}
+
+// Error implements error interface.
+func (e *RestoreError) Error() string {
+	var (
+		n     int
+		first error
+	)
+	for _, err := range e.Errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		n++
+	}
+	return "netpoll: could not restore " + strconv.Itoa(n) + " of " +
+		strconv.Itoa(len(e.Errs)) + " descriptors: " + fmt.Sprint(first)
+}
+
+// Restore registers descriptors described by states within poller. It is
+// intended to rebuild the registrations exported by EventPoll.Export()
+// within a process which inherited the descriptors, e.g. after exec(2)
+// made for graceful upgrade.
+//
+// For each state, a descriptor is created from the inherited file
+// descriptor number, which is made non-blocking and close-on-exec again.
+// Then bind is called with state (with Desc field set) and returns the
+// callback and options of the registration. Options are either nil, a
+// StartOption (e.g. Options) or []StartOption. Metadata of the state is
+// attached to the new registration. If bind returns nil callback, the
+// descriptor is closed and not registered.
+//
+// Failure to restore some descriptor (e.g. EBADF error for a descriptor
+// which was not inherited) does not abort the whole restore. Such
+// descriptors are reported by *RestoreError.
+func Restore(poller EventPoll, states []DescState, bind func(DescState) (CallbackFn, interface{})) error {
+	var (
+		errs   = make([]error, len(states))
+		failed bool
+	)
+	for i, state := range states {
+		if errs[i] = restore(poller, state, bind); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return &RestoreError{Errs: errs}
+	}
+	return nil
+}
+
+func restore(poller EventPoll, state DescState, bind func(DescState) (CallbackFn, interface{})) error {
+	file := os.NewFile(uintptr(state.Fd), "")
+	if file == nil {
+		return ErrNotFiler
+	}
+	desc, err := newDesc(file, state.Event, resolveDescOptions([]DescOption{
+		WithLabel(state.Label),
+	}))
+	if err != nil {
+		// Close the file anyway to not let its finalizer close the same
+		// descriptor number later, when it could belong to another file.
+		file.Close()
+		return err
+	}
+	state.Desc = desc
+
+	cb, x := bind(state)
+	if cb == nil {
+		return desc.Close()
+	}
+	var opts []StartOption
+	switch v := x.(type) {
+	case nil:
+	case StartOption:
+		opts = append(opts, v)
+	case []StartOption:
+		opts = append(opts, v...)
+	default:
+		desc.Close()
+		return fmt.Errorf("netpoll: unexpected restore options type %T", x)
+	}
+	if state.Meta != nil {
+		opts = append(opts, WithMetadata(state.Meta))
+	}
+	if err = poller.StartWithOptions(desc, cb, opts...); err != nil {
+		desc.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExport(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		new  func(*testing.T) EventPoll
+	}{
+		{"poller", func(t *testing.T) EventPoll {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return poller
+		}},
+		{"pool", func(t *testing.T) EventPoll {
+			pool, err := NewPool(&PoolConfig{Size: 2, Config: config(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pool
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller := test.new(t)
+			defer poller.(io.Closer).Close()
+
+			var descs []*Desc
+			for i := 0; i < 3; i++ {
+				r, w, err := socketPair()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer unix.Close(w)
+				desc := Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+				defer desc.Close()
+
+				err = poller.StartWithOptions(desc, func(Event) {},
+					WithMetadata([]byte{byte('a' + i)}),
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				descs = append(descs, desc)
+			}
+			// Event mask of the registration must be exported, not the
+			// descriptor's one.
+			if err := poller.ModifyEvent(descs[2], EventRead|EventWrite); err != nil {
+				t.Fatal(err)
+			}
+
+			states, err := poller.Export()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(states); n != len(descs) {
+				t.Fatalf("Export() returned %d states; want %d", n, len(descs))
+			}
+			for i, s := range states {
+				exp := DescState{
+					Fd:    descs[i].Fd(),
+					Event: EventRead | EventOneShot,
+					Meta:  []byte{byte('a' + i)},
+					Desc:  descs[i],
+				}
+				if i == 2 {
+					exp.Event = EventRead | EventWrite
+				}
+				if s.Fd != exp.Fd || s.Event != exp.Event || !bytes.Equal(s.Meta, exp.Meta) || s.Desc != exp.Desc {
+					t.Errorf("unexpected state #%d: %+v; want %+v", i, s, exp)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreDead(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	dead, err := unix.Dup(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(dead)
+
+	var restored []*Desc
+	err = Restore(poller, []DescState{
+		{Fd: r, Event: EventRead},
+		{Fd: dead, Event: EventRead},
+	}, func(s DescState) (CallbackFn, interface{}) {
+		restored = append(restored, s.Desc)
+		return func(Event) {}, Options{StopOnHup: true}
+	})
+	for _, desc := range restored {
+		defer desc.Close()
+	}
+	e, ok := err.(*RestoreError)
+	if !ok {
+		t.Fatalf("Restore() error is %v; want *RestoreError", err)
+	}
+	if len(e.Errs) != 2 || e.Errs[0] != nil || e.Errs[1] == nil {
+		t.Fatalf("unexpected errors: %v", e.Errs)
+	}
+	if x, ok := e.Errs[1].(*Error); !ok || x.Fd != dead || x.Temporary() {
+		t.Errorf("unexpected error of dead descriptor: %#v", e.Errs[1])
+	} else if s, ok := x.Err.(*os.SyscallError); !ok || s.Err != unix.EBADF {
+		t.Errorf("unexpected error of dead descriptor: %v; want EBADF", x.Err)
+	}
+	if n := len(restored); n != 1 {
+		t.Errorf("bind called %d times; want 1", n)
+	}
+	if n := poller.Stats().Registered; n != 1 {
+		t.Errorf("%d descriptors registered after Restore(); want 1", n)
+	}
+}
+
+const (
+	restoreHelperEnv = "NETPOLL_RESTORE_HELPER"
+	restoreStatesEnv = "NETPOLL_RESTORE_STATES"
+)
+
+// TestRestoreHelperProcess is not a real test. It is run as a child process
+// by TestRestoreExec.
+func TestRestoreHelperProcess(t *testing.T) {
+	if os.Getenv(restoreHelperEnv) != "1" {
+		return
+	}
+	var states []DescState
+	if err := json.Unmarshal([]byte(os.Getenv(restoreStatesEnv)), &states); err != nil {
+		t.Fatal(err)
+	}
+	poller, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Echo everything received, prefixed with the registration metadata.
+	err = Restore(poller, states, func(s DescState) (CallbackFn, interface{}) {
+		fd := s.Desc.Fd()
+		return func(event Event) {
+			buf := make([]byte, 128)
+			n, err := unix.Read(fd, buf)
+			if err != nil || n == 0 {
+				os.Exit(0)
+			}
+			unix.Write(fd, append(s.Meta, buf[:n]...))
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {}
+}
+
+func TestRestoreExec(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+	f := os.NewFile(uintptr(w), "w")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = poller.StartWithOptions(desc, func(Event) {}, WithMetadata([]byte("conn:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := poller.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The descriptor becomes 3 within the child, as the first of
+	// ExtraFiles.
+	states[0].Fd = 3
+	data, err := json.Marshal(states)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestoreHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		restoreHelperEnv+"=1",
+		restoreStatesEnv+"="+string(data),
+	)
+	cmd.ExtraFiles = []*os.File{desc.file}
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len("conn:hello"))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "conn:hello"; string(buf) != exp {
+		t.Errorf("child echoed %q; want %q", buf, exp)
+	}
+}
+
+func TestInternalFds(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		new    func(t *testing.T) EventPoll
+		expect int
+	}{
+		{"poller", func(t *testing.T) EventPoll {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return poller
+		}, 1},
+		{"pool", func(t *testing.T) EventPoll {
+			pool, err := NewPool(&PoolConfig{Size: 2, Config: config(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pool
+		}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller := test.new(t)
+			defer poller.(io.Closer).Close()
+
+			internal := poller.(internalFder).internalFds()
+			if len(internal) < test.expect {
+				t.Fatalf("got %d internal fds; want at least %d", len(internal), test.expect)
+			}
+			for _, fd := range internal {
+				flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+				if err != nil {
+					t.Fatalf("internal fd %d is not open: %v", fd, err)
+				}
+				if flags&unix.FD_CLOEXEC == 0 {
+					t.Errorf("internal fd %d is not close-on-exec", fd)
+				}
+			}
+			if n := poller.Stats().Registered; n != 0 {
+				t.Fatalf("%d descriptors registered in the new poller; want 0", n)
+			}
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+			if err = poller.Start(desc, func(Event) {}); err != nil {
+				t.Fatal(err)
+			}
+			defer poller.Stop(desc)
+
+			if n := poller.Stats().Registered; n != 1 {
+				t.Errorf("%d descriptors registered; want 1", n)
+			}
+			states, err := poller.Export()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(states) != 1 || states[0].Fd != r {
+				t.Fatalf("unexpected exported states: %+v", states)
+			}
+			for _, fd := range internal {
+				if fd == r {
+					t.Errorf("registered fd %d is reported as internal", fd)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FDBudget tracks the headroom of file descriptors left to the process
+// before it hits RLIMIT_NOFILE. Note that every descriptor created by
+// Handle() and its variants is a duplicate, thus the observed connection
+// holds two of them.
+//
+// Counting of open descriptors is not free, so the counts are cached and
+// are recounted when the cache expires or is invalidated.
+//
+// FDBudget methods are safe for concurrent use.
+type FDBudget struct {
+	maxAge time.Duration
+
+	// reserve is the headroom which is not considered available.
+	// Must be accessed atomically.
+	reserve int64
+
+	mu      sync.Mutex
+	limit   int
+	open    int
+	expires time.Time
+}
+
+// NewFDBudget counts the open descriptors of the process and returns the
+// budget caching the counts for maxAge. If maxAge is zero, one second is
+// used.
+func NewFDBudget(maxAge time.Duration) (*FDBudget, error) {
+	if maxAge <= 0 {
+		maxAge = time.Second
+	}
+	b := &FDBudget{
+		maxAge: maxAge,
+	}
+	if err := b.Refresh(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reserve sets the number of descriptors kept as headroom: they are never
+// reported by Available(). It is useful to leave some descriptors for the
+// files, pipes and outgoing connections opened by the application.
+func (b *FDBudget) Reserve(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&b.reserve, int64(n))
+}
+
+// Available returns the number of descriptors which could be opened before
+// the reserve is touched. It recounts the open descriptors if the cache is
+// expired; if recounting fails the cached counts are used.
+func (b *FDBudget) Available() int {
+	b.mu.Lock()
+	if time.Now().After(b.expires) {
+		b.refresh()
+	}
+	n := b.limit - b.open
+	b.mu.Unlock()
+
+	if n -= int(atomic.LoadInt64(&b.reserve)); n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Invalidate makes the next Available() call to recount the open
+// descriptors.
+func (b *FDBudget) Invalidate() {
+	b.mu.Lock()
+	b.expires = time.Time{}
+	b.mu.Unlock()
+}
+
+// Refresh recounts the open descriptors and reads the current limit.
+func (b *FDBudget) Refresh() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.refresh()
+}
+
+// take accounts n descriptors opened since the last count, so the cached
+// counts stay conservative until the next recount.
+func (b *FDBudget) take(n int) {
+	b.mu.Lock()
+	b.open += n
+	b.mu.Unlock()
+}
+
+// maxCountedFds limits the descriptors probed by the platforms which can not
+// list the open ones.
+const maxCountedFds = 1 << 20
+
+// refresh recounts the open descriptors. Note that b.mu must be held.
+func (b *FDBudget) refresh() error {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		return os.NewSyscallError("getrlimit", err)
+	}
+	limit := maxCountedFds
+	if cur := uint64(lim.Cur); cur < uint64(limit) {
+		limit = int(cur)
+	}
+	open, err := countOpenFds(limit)
+	if err != nil {
+		return err
+	}
+	b.limit = limit
+	b.open = open
+	b.expires = time.Now().Add(b.maxAge)
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build freebsd
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// countOpenFds returns the number of descriptors open by the process.
+// It asks kernel by kern.proc.nfds sysctl, which appeared in FreeBSD 11, and
+// falls back to probing on older systems. Note that /dev/fd is not used here
+// since it lists only the standard descriptors unless fdescfs is mounted.
+func countOpenFds(limit int) (int, error) {
+	n, err := unix.SysctlUint32("kern.proc.nfds")
+	if err != nil {
+		return probeOpenFds(limit), nil
+	}
+	return int(n), nil
+}
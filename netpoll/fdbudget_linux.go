@@ -0,0 +1,18 @@
+package netpoll
+
+import "os"
+
+// countOpenFds returns the number of descriptors open by the process.
+func countOpenFds(int) (int, error) {
+	d, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return 0, err
+	}
+	// Do not count the descriptor of the directory itself.
+	return len(names) - 1, nil
+}
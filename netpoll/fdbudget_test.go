@@ -0,0 +1,44 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFDBudget(t *testing.T) {
+	b, err := NewFDBudget(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avail := b.Available()
+	if avail == 0 {
+		t.Fatal("no descriptors available")
+	}
+
+	fd, err := unix.Dup(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+
+	if act := b.Available(); act != avail {
+		t.Errorf("Available() = %d before invalidation; want cached %d", act, avail)
+	}
+	b.Invalidate()
+	if act, exp := b.Available(), avail-1; act != exp {
+		t.Errorf("Available() = %d; want %d", act, exp)
+	}
+
+	b.Reserve(10)
+	if act, exp := b.Available(), avail-11; act != exp {
+		t.Errorf("Available() = %d after Reserve(); want %d", act, exp)
+	}
+	b.Reserve(avail)
+	if act := b.Available(); act != 0 {
+		t.Errorf("Available() = %d after reserving everything; want 0", act)
+	}
+}
@@ -0,0 +1,137 @@
+package netpoll
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	fifoMinBackoff = 10 * time.Millisecond
+	fifoMaxBackoff = 5 * time.Second
+)
+
+// fifoState holds the state of the descriptor created by NewFIFODesc().
+type fifoState struct {
+	path   string
+	reopen bool
+
+	// delay is the delay before the next reopen attempt. It grows while
+	// reopened FIFO gets hung up without data read from it, and is reset
+	// when data is delivered. It is accessed by the registration's run()
+	// only, thus it does not need synchronization.
+	delay time.Duration
+
+	// due is set when the delay of the next reopen attempt has passed.
+	due bool
+}
+
+// NewFIFODesc opens FIFO (named pipe) at given path for reading and creates
+// descriptor for further use in EventPoll methods. The FIFO is opened with
+// O_NONBLOCK, thus open(2) does not block until some writer connects.
+//
+// When the last writer closes the FIFO, the descriptor is hung up until it
+// is reopened. If reopen is true, the poller does it transparently: instead
+// of passing the hang up event to the callback, it closes the descriptor's
+// file, opens the path again and continues delivering events of the new
+// file to the same callback. Note that Fd() of the descriptor changes then.
+// Reopen failures (e.g. when the path is removed) are passed to
+// Config.OnDescError and are retried with exponential backoff. Reopening is
+// delayed in the same way if the FIFO gets hung up again without any data
+// read from it.
+func NewFIFODesc(path string, ev Event, reopen bool) (*Desc, error) {
+	file, err := openFIFO(path)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := newDesc(file, ev, resolveDescOptions(nil))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	desc.fifo = &fifoState{
+		path:   path,
+		reopen: reopen,
+	}
+	return desc, nil
+}
+
+func openFIFO(path string) (*os.File, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err == nil && st.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// reopen replaces the FIFO descriptor hung up by its last writer with the
+// freshly opened one. It must be called by run() only, thus the callback is
+// not running meanwhile.
+//
+// Note that the descriptor was muted on hang up, thus it does not spin the
+// loop until reopen succeeds.
+func (r *registration) reopen(f *fifoState) {
+	retry := func() {
+		time.AfterFunc(f.delay, func() {
+			r.schedule(EventHup)
+		})
+	}
+	if f.delay > 0 && !f.due {
+		f.due = true
+		retry()
+		return
+	}
+	f.due = false
+	if f.delay *= 2; f.delay < fifoMinBackoff {
+		f.delay = fifoMinBackoff
+	} else if f.delay > fifoMaxBackoff {
+		f.delay = fifoMaxBackoff
+	}
+
+	file, err := openFIFO(f.path)
+	if err != nil {
+		r.report("reopen", err)
+		f.due = true
+		retry()
+		return
+	}
+
+	p := r.poller
+	desc := r.desc
+
+	// Holding p.mu makes the swap to be ordered with concurrent Stop() call,
+	// which must delete the new file descriptor from the backend.
+	p.mu.Lock()
+	if p.regs[desc] != r {
+		p.mu.Unlock()
+		file.Close()
+		return
+	}
+	event := r.events()
+	_ = p.backend.del(desc.Fd(), event)
+	old := desc.file
+	desc.file = file
+	desc.desc = int(file.Fd())
+	err = syscall.SetNonblock(desc.desc, true)
+	if err == nil {
+		err = p.backend.add(desc.desc, event, r.notify)
+	}
+	p.mu.Unlock()
+	old.Close()
+
+	r.mu.Lock()
+	// Events received before the swap belong to the old file.
+	r.pending = 0
+	r.muted = false
+	r.mu.Unlock()
+
+	r.report("reopen", err)
+}
@@ -0,0 +1,180 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFIFODescReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fifo")
+	if err = unix.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 16)
+	c := config(t)
+	c.OnDescError = func(_ *Desc, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	poller, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, err := NewFIFODesc(path, EventRead, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	var (
+		mu       sync.Mutex
+		received []byte
+		hups     int
+	)
+	err = poller.Start(desc, func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event&EventRead == 0 {
+			hups++
+			return
+		}
+		DrainRead(desc, func(p []byte) bool {
+			received = append(received, p...)
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	waitReceived := func(exp string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			act := string(received)
+			mu.Unlock()
+			if act == exp {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("received %q; want %q", act, exp)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Writer connects, writes and disconnects repeatedly.
+	cmd := exec.Command("sh", "-c", `for i in 1 2 3 4 5; do echo "line$i" > "$0"; sleep 0.02; done`, path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("writer failed: %v: %s", err, out)
+	}
+	waitReceived("line1\nline2\nline3\nline4\nline5\n")
+
+	// Reopen fails while the path is absent, and succeeds once it appears.
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	select {
+	case err := <-errs:
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reopen error was not reported")
+	}
+	if err = unix.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("sh", "-c", `echo "again" > "$0"`, path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("writer failed: %v: %s", err, out)
+	}
+	waitReceived("line1\nline2\nline3\nline4\nline5\nagain\n")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hups != 0 {
+		t.Errorf("callback called with hang up %d times; want 0", hups)
+	}
+}
+
+func TestFIFODescNoReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fifo")
+	if err = unix.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, err := NewFIFODesc(path, EventRead, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	hup := make(chan struct{}, 1)
+	err = poller.Start(desc, func(event Event) {
+		DrainRead(desc, func([]byte) bool { return true })
+		if event&EventHup != 0 {
+			select {
+			case hup <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	select {
+	case <-hup:
+	case <-time.After(time.Second):
+		t.Fatal("no hang up received")
+	}
+
+	if _, err = NewFIFODesc(dir, EventRead, false); err == nil {
+		t.Errorf("NewFIFODesc() of directory succeeded")
+	}
+}
@@ -0,0 +1,75 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// HandleFile creates descriptor for the already opened file f, which must
+// be pollable: character device (e.g. TUN/TAP device, see OpenTUN()), pipe,
+// FIFO or socket. It returns error with syscall.EPERM for regular files and
+// directories, since they are always ready.
+//
+// Descriptor is made non-blocking, which affects f as well, since
+// descriptor holds a duplicate of f's file descriptor. Thus f could be
+// closed right after the call.
+func HandleFile(f *os.File, ev Event, opts ...DescOption) (*Desc, error) {
+	return handleFile(f, ev, opts, func(mode uint32) error {
+		if mode == unix.S_IFREG || mode == unix.S_IFDIR {
+			return syscall.EPERM
+		}
+		return nil
+	})
+}
+
+// handleFile creates descriptor holding a duplicate of f's file descriptor,
+// if check returns no error for the file type bits of its mode.
+func handleFile(f *os.File, ev Event, opts []DescOption, check func(mode uint32) error) (*Desc, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fd     = -1
+		ctlErr error
+	)
+	// Note that f.Fd() is not used, since it puts f into blocking mode.
+	err = rc.Control(func(sysfd uintptr) {
+		var st unix.Stat_t
+		if ctlErr = unix.Fstat(int(sysfd), &st); ctlErr != nil {
+			ctlErr = os.NewSyscallError("fstat", ctlErr)
+			return
+		}
+		if ctlErr = check(uint32(st.Mode) & unix.S_IFMT); ctlErr != nil {
+			ctlErr = wrapErr("handle", int(sysfd), ev, ctlErr)
+			return
+		}
+		syscall.ForkLock.RLock()
+		fd, ctlErr = unix.Dup(int(sysfd))
+		if ctlErr == nil {
+			unix.CloseOnExec(fd)
+		}
+		syscall.ForkLock.RUnlock()
+		if ctlErr != nil {
+			ctlErr = os.NewSyscallError("dup", ctlErr)
+		}
+	})
+	if err == nil {
+		err = ctlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), f.Name())
+
+	desc, err := newDesc(file, ev, resolveDescOptions(opts))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return desc, nil
+}
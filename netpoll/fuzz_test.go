@@ -0,0 +1,54 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/troian/easygo/netpoll"
+	"github.com/troian/easygo/netpoll/netpolltest"
+)
+
+func TestFuzz(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping fuzzing in short mode")
+	}
+	for _, test := range []struct {
+		name string
+		new  func() (netpoll.EventPoll, error)
+	}{
+		{"poller", func() (netpoll.EventPoll, error) {
+			return netpoll.New(nil)
+		}},
+		{"dispatcher", func() (netpoll.EventPoll, error) {
+			return netpoll.New(&netpoll.Config{
+				Dispatcher: netpoll.GoDispatcher,
+			})
+		}},
+		{"pool", func() (netpoll.EventPoll, error) {
+			return netpoll.NewPool(&netpoll.PoolConfig{Size: 4})
+		}},
+		{"uring", func() (netpoll.EventPoll, error) {
+			return netpoll.New(&netpoll.Config{
+				Backend: netpoll.BackendUring,
+			})
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := test.new()
+			if err == netpoll.ErrUnsupported {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			netpolltest.Fuzz(t, poller, netpolltest.FuzzOptions{
+				Duration: 500 * time.Millisecond,
+			})
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package netpoll
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// groupStopper is implemented by the pollers which could stop the group
+// members (or any other set of descriptors) at once.
+type groupStopper interface {
+	// stopDescs stops descs with given reason and closes them if close is
+	// true, including the ones that are not registered anymore.
+	stopDescs(descs []*Desc, reason StopReason, close bool) error
+}
+
+// Group is a set of descriptors started within the same poller which are
+// stopped at once, e.g. the descriptors of a single logical session. It is
+// created by EventPoll NewGroup() method and is cheap enough to be created
+// per session.
+//
+// Descriptor belongs to at most one group. It remains a member until
+// StopAll() or Remove() is called, regardless of the registration being
+// resumed, modified or even stopped in the meantime.
+//
+// Group methods are safe for concurrent use, including from within the
+// members' callbacks.
+type Group struct {
+	poller  EventPoll
+	stopper groupStopper
+
+	mu      sync.Mutex
+	members map[*Desc]struct{}
+
+	// stops is the number of StopAll() calls made for the group.
+	stops uint64
+}
+
+func newGroup(poller EventPoll, stopper groupStopper) *Group {
+	return &Group{
+		poller:  poller,
+		stopper: stopper,
+	}
+}
+
+// Start starts desc within the group's poller and adds it to the group.
+// It returns ErrGroupMember if desc already belongs to some group.
+func (g *Group) Start(desc *Desc, cb CallbackFn) error {
+	return g.StartWithOptions(desc, cb)
+}
+
+// StartWithOptions is like Start() but registers desc with given options,
+// the same as EventPoll StartWithOptions() method does.
+func (g *Group) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	// Membership is reserved under the lock, while desc is started without
+	// it, such that the group is not locked by the poller's calls.
+	g.mu.Lock()
+	if !desc.join(g) {
+		g.mu.Unlock()
+		return ErrGroupMember
+	}
+	if g.members == nil {
+		g.members = make(map[*Desc]struct{})
+	}
+	g.members[desc] = struct{}{}
+	stops := g.stops
+	g.mu.Unlock()
+
+	err := g.poller.StartWithOptions(desc, cb, opts...)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, member := g.members[desc]
+	switch {
+	case err != nil && member:
+		delete(g.members, desc)
+		desc.leave(g)
+	case err == nil && !member && g.stops != stops:
+		// StopAll() was called while desc was being started, thus it
+		// did not find desc registered. Stop it the same way it would.
+		return g.stopper.stopDescs([]*Desc{desc}, StopGroup, false)
+	}
+	return err
+}
+
+// GroupStats contains statistics of callback calls made for the members of
+// a group. It is intended to find the noisy descriptor of a group.
+//
+// The calls are counted only if the poller was created with Config.Metrics
+// set, for the descriptors which were group members when started.
+type GroupStats struct {
+	// Fired is the total number of callback calls made for the current
+	// members.
+	Fired uint64
+
+	// Members holds the number of callback calls made for each member since
+	// it joined the group.
+	Members map[*Desc]uint64
+
+	// Noisiest is the member with the most callback calls, or nil if no
+	// callback was called. NoisiestFired is the number of its calls.
+	Noisiest      *Desc
+	NoisiestFired uint64
+}
+
+// Stats returns statistics of the callback calls made for the members of
+// the group.
+func (g *Group) Stats() GroupStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s := GroupStats{
+		Members: make(map[*Desc]uint64, len(g.members)),
+	}
+	for desc := range g.members {
+		n := atomic.LoadUint64(&desc.fired)
+		s.Members[desc] = n
+		s.Fired += n
+		if n > s.NoisiestFired {
+			s.Noisiest, s.NoisiestFired = desc, n
+		}
+	}
+	return s
+}
+
+// Remove removes desc from the group without stopping it. It returns
+// ErrNotRegistered if desc is not a member of the group.
+func (g *Group) Remove(desc *Desc) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, has := g.members[desc]; !has {
+		return ErrNotRegistered
+	}
+	delete(g.members, desc)
+	desc.leave(g)
+
+	return nil
+}
+
+// Len returns the number of descriptors in the group.
+func (g *Group) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+// StopAll stops all members of the group and empties it. Their OnStop hooks
+// are called with StopGroup reason. If close is true, members are closed as
+// well: the ones being run by the callback are closed right after it (and
+// the OnStop hook) returns, as StopAndClose() does, while members stopped
+// before are closed right away.
+//
+// It returns the first error of stopping or closing members, while all of
+// them are handled anyway.
+func (g *Group) StopAll(close bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stops++
+	descs := make([]*Desc, 0, len(g.members))
+	for desc := range g.members {
+		desc.leave(g)
+		descs = append(descs, desc)
+	}
+	g.members = nil
+
+	if len(descs) == 0 {
+		return nil
+	}
+	return g.stopper.stopDescs(descs, StopGroup, close)
+}
@@ -0,0 +1,417 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestGroup(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var (
+		mu      sync.Mutex
+		reasons = make(map[*Desc]StopReason)
+	)
+	onStop := WithOnStop(func(desc *Desc, reason StopReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[desc] = reason
+	})
+
+	g := poller.NewGroup()
+	var descs []*Desc
+	for i := 0; i < 3; i++ {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(w)
+		desc := Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+		if err = g.StartWithOptions(desc, func(Event) {}, onStop); err != nil {
+			t.Fatal(err)
+		}
+		descs = append(descs, desc)
+	}
+	if n := g.Len(); n != 3 {
+		t.Fatalf("Len() = %d; want 3", n)
+	}
+
+	// Descriptor belongs to at most one group.
+	if err = poller.NewGroup().Start(descs[0], func(Event) {}); err != ErrGroupMember {
+		t.Fatalf("Start() error is %v; want %v", err, ErrGroupMember)
+	}
+
+	// Membership survives Resume() and ModifyEvent().
+	if err = poller.Resume(descs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.ModifyEvent(descs[1], EventRead|EventWrite|EventOneShot); err != nil {
+		t.Fatal(err)
+	}
+	// Member stopped before is closed by StopAll() as well.
+	if err = poller.Stop(descs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Len(); n != 3 {
+		t.Fatalf("Len() = %d; want 3", n)
+	}
+
+	if err = g.StopAll(true); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Len(); n != 0 {
+		t.Fatalf("Len() = %d after StopAll(); want 0", n)
+	}
+	if n := poller.Stats().Registered; n != 0 {
+		t.Fatalf("%d descriptors are left registered", n)
+	}
+	mu.Lock()
+	for i, desc := range descs {
+		exp := StopGroup
+		if i == 2 {
+			exp = StopExplicit
+		}
+		if act := reasons[desc]; act != exp {
+			t.Errorf("descriptor #%d is stopped with %s; want %s", i, act, exp)
+		}
+		if _, err := unix.FcntlInt(uintptr(desc.Fd()), unix.F_GETFD, 0); err != unix.EBADF {
+			t.Errorf("descriptor #%d is not closed", i)
+		}
+	}
+	mu.Unlock()
+
+	// Emptied group could be used again, and descriptors could join other
+	// groups after leaving.
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+	if err = g.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Remove(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = g.StopAll(false); err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatalf("removed descriptor is stopped by StopAll(): %v", err)
+	}
+	if err = poller.NewGroup().Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	poller.Stop(desc)
+}
+
+// startingPoller calls hook before starting descriptors.
+type startingPoller struct {
+	*poller
+	hook func()
+}
+
+func (p startingPoller) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	p.hook()
+	return p.poller.StartWithOptions(desc, cb, opts...)
+}
+
+func TestGroupStopAllWhileStarting(t *testing.T) {
+	ep, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.(io.Closer).Close()
+
+	var (
+		g      *Group
+		p      = startingPoller{poller: ep.(*poller)}
+		reason = make(chan StopReason, 1)
+	)
+	// Group must not be locked while its member is being started.
+	p.hook = func() {
+		if err := g.StopAll(false); err != nil {
+			t.Error(err)
+		}
+	}
+	g = newGroup(p, p.poller)
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	err = g.StartWithOptions(desc, func(Event) {}, WithOnStop(func(_ *Desc, r StopReason) {
+		reason <- r
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Len(); n != 0 {
+		t.Fatalf("Len() = %d; want 0", n)
+	}
+	if n := ep.Stats().Registered; n != 0 {
+		t.Fatalf("descriptor started during StopAll() is left registered")
+	}
+	select {
+	case r := <-reason:
+		if r != StopGroup {
+			t.Fatalf("descriptor is stopped with %s; want %s", r, StopGroup)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnStop hook is not called")
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	for _, metrics := range []bool{true, false} {
+		t.Run(fmt.Sprintf("metrics=%t", metrics), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Metrics = metrics
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			var (
+				g      = poller.NewGroup()
+				descs  []*Desc
+				writes []int
+				calls  = make(chan struct{}, 64)
+			)
+			for i := 0; i < 3; i++ {
+				r, w, err := socketPair()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer unix.Close(w)
+				desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+				defer desc.Close()
+				err = g.Start(desc, func(Event) {
+					var buf [64]byte
+					unix.Read(r, buf[:])
+					calls <- struct{}{}
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				descs = append(descs, desc)
+				writes = append(writes, w)
+			}
+			defer g.StopAll(false)
+
+			// The second member fires the most.
+			for i, n := range []int{1, 5, 2} {
+				for j := 0; j < n; j++ {
+					if _, err = unix.Write(writes[i], []byte("x")); err != nil {
+						t.Fatal(err)
+					}
+					select {
+					case <-calls:
+					case <-time.After(time.Second):
+						t.Fatalf("no callback call for member #%d", i)
+					}
+				}
+			}
+
+			s := g.Stats()
+			if !metrics {
+				if s.Fired != 0 || s.Noisiest != nil {
+					t.Fatalf("stats are collected without metrics: %+v", s)
+				}
+				return
+			}
+			if s.Fired != 8 {
+				t.Errorf("Fired = %d; want 8", s.Fired)
+			}
+			for i, exp := range []uint64{1, 5, 2} {
+				if act := s.Members[descs[i]]; act != exp {
+					t.Errorf("member #%d fired %d times; want %d", i, act, exp)
+				}
+			}
+			if s.Noisiest != descs[1] || s.NoisiestFired != 5 {
+				t.Errorf("noisiest member is %v with %d calls; want #1 with 5", s.Noisiest, s.NoisiestFired)
+			}
+		})
+	}
+}
+
+func TestGroupStopAllUnderLoad(t *testing.T) {
+	const (
+		sessions = 1000
+		members  = 3
+	)
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	if lim.Cur < sessions*members*2+100 {
+		t.Skipf("RLIMIT_NOFILE is too low: %d", lim.Cur)
+	}
+
+	for _, test := range []struct {
+		name string
+		new  func() (EventPoll, error)
+	}{
+		{"poller", func() (EventPoll, error) {
+			return New(config(t))
+		}},
+		{"pool", func() (EventPoll, error) {
+			return NewPool(&PoolConfig{
+				Config: config(t),
+				Size:   4,
+			})
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := test.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			type session struct {
+				group  *Group
+				reads  []int
+				writes []int
+			}
+			var (
+				all     = make([]session, sessions)
+				stopped sync.WaitGroup
+				stops   int32
+				wrong   int32
+			)
+			onStop := WithOnStop(func(desc *Desc, reason StopReason) {
+				atomic.AddInt32(&stops, 1)
+				if reason != StopGroup {
+					atomic.AddInt32(&wrong, 1)
+				}
+				stopped.Done()
+			})
+			defer func() {
+				for _, s := range all {
+					for _, fd := range s.writes {
+						unix.Close(fd)
+					}
+				}
+			}()
+			for i := range all {
+				s := &all[i]
+				s.group = poller.NewGroup()
+				for j := 0; j < members; j++ {
+					r, w, err := socketPair()
+					if err != nil {
+						t.Fatal(err)
+					}
+					s.reads = append(s.reads, r)
+					s.writes = append(s.writes, w)
+
+					desc := Must(NewDesc(uintptr(r), EventRead))
+					stopped.Add(1)
+					err = s.group.StartWithOptions(desc, func(Event) {
+						var buf [64]byte
+						for {
+							n, err := unix.Read(r, buf[:])
+							if n <= 0 || err != nil {
+								return
+							}
+						}
+					}, onStop)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			// Keep the descriptors busy while sessions are torn down.
+			done := make(chan struct{})
+			var writers sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				writers.Add(1)
+				go func(seed int64) {
+					defer writers.Done()
+					rnd := rand.New(rand.NewSource(seed))
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						s := all[rnd.Intn(sessions)]
+						unix.Write(s.writes[rnd.Intn(members)], []byte{'x'})
+					}
+				}(int64(i))
+			}
+
+			var (
+				order          = rand.Perm(sessions)
+				next     int32 = -1
+				teardown sync.WaitGroup
+			)
+			for i := 0; i < 8; i++ {
+				teardown.Add(1)
+				go func() {
+					defer teardown.Done()
+					for {
+						i := int(atomic.AddInt32(&next, 1))
+						if i >= sessions {
+							return
+						}
+						if err := all[order[i]].group.StopAll(true); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			teardown.Wait()
+			close(done)
+			writers.Wait()
+
+			waitDone := make(chan struct{})
+			go func() {
+				stopped.Wait()
+				close(waitDone)
+			}()
+			select {
+			case <-waitDone:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("OnStop called %d times; want %d", atomic.LoadInt32(&stops), sessions*members)
+			}
+			if n := atomic.LoadInt32(&wrong); n != 0 {
+				t.Errorf("%d descriptors stopped with other reason than %s", n, StopGroup)
+			}
+			if n := poller.Stats().Registered; n != 0 {
+				t.Errorf("%d descriptors are left registered", n)
+			}
+			for _, s := range all {
+				if n := s.group.Len(); n != 0 {
+					t.Fatalf("%d descriptors are left in the group", n)
+				}
+				for _, fd := range s.reads {
+					if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != unix.EBADF {
+						t.Fatalf("descriptor %d is not closed", fd)
+					}
+				}
+			}
+		})
+	}
+}
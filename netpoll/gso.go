@@ -0,0 +1,108 @@
+// +build linux
+
+package netpoll
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/udp.h.
+const (
+	solUDP     = 17
+	udpSegment = 103
+	udpGRO     = 104
+)
+
+// EnableGRO enables generic receive offload for UDP socket represented by
+// desc. Then the kernel may coalesce multiple datagrams of the same size
+// received from the same peer into a single buffer returned by ReadGRO().
+//
+// It returns ErrUnsupported if the kernel does not support UDP GRO.
+func EnableGRO(desc *Desc) error {
+	err := unix.SetsockoptInt(desc.Fd(), solUDP, udpGRO, 1)
+	if err == unix.ENOPROTOOPT {
+		return ErrUnsupported
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// SendGSO sends payload through connected UDP socket represented by desc,
+// letting the kernel to split it into datagrams of segSize bytes (the last
+// one may be shorter). That is, it sends multiple datagrams by a single
+// system call.
+//
+// It returns ErrUnsupported if the kernel does not support UDP generic
+// segmentation offload.
+func SendGSO(desc *Desc, payload []byte, segSize int) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(segSize)
+
+	var (
+		n   int
+		err error
+	)
+	for {
+		n, err = unix.SendmsgN(desc.Fd(), payload, oob, nil, 0)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == nil {
+		return n, nil
+	}
+	if err == unix.EINVAL || err == unix.ENOPROTOOPT {
+		// Older kernels reject unknown control messages with EINVAL.
+		if _, e := unix.GetsockoptInt(desc.Fd(), solUDP, udpSegment); e == unix.ENOPROTOOPT {
+			return 0, ErrUnsupported
+		}
+	}
+	return 0, err
+}
+
+// ReadGRO reads from UDP socket represented by desc, for which EnableGRO()
+// was called. Received buffer may contain multiple coalesced datagrams of
+// segSize bytes each (the last one may be shorter). If no coalescing was
+// made, segSize equals n.
+//
+// If there is no data available, it returns syscall.EAGAIN.
+func ReadGRO(desc *Desc, buf []byte) (n, segSize int, addr net.Addr, err error) {
+	var (
+		oob  = make([]byte, unix.CmsgSpace(4))
+		oobn int
+		from unix.Sockaddr
+	)
+	for {
+		n, oobn, _, from, err = unix.Recvmsg(desc.Fd(), buf, oob, 0)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	segSize = n
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, 0, nil, os.NewSyscallError("recvmsg", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == solUDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			segSize = int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+
+	return n, segSize, sockaddrToUDP(from), nil
+}
@@ -0,0 +1,125 @@
+// +build linux
+
+package netpoll
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestGSO(t *testing.T) {
+	const segSize = 100
+
+	payload := make([]byte, 3*segSize+50)
+	for i := range payload {
+		payload[i] = byte(i / segSize)
+	}
+
+	for _, test := range []struct {
+		name string
+		gro  bool
+	}{
+		{"segmented", false},
+		{"coalesced", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recv, send := udpPair(t)
+			defer recv.Close()
+			defer send.Close()
+
+			if test.gro {
+				if err := EnableGRO(recv); err == ErrUnsupported {
+					t.Skip(err)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := SendGSO(send, payload, segSize)
+			if err == ErrUnsupported {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(payload) {
+				t.Fatalf("SendGSO() sent %d bytes; want %d", n, len(payload))
+			}
+
+			var (
+				received []byte
+				segments []int
+				buf      = make([]byte, 64<<10)
+			)
+			for deadline := time.Now().Add(time.Second); len(received) < len(payload); {
+				if time.Now().After(deadline) {
+					t.Fatalf("received %d bytes; want %d", len(received), len(payload))
+				}
+				n, size, addr, err := ReadGRO(recv, buf)
+				if err == syscall.EAGAIN {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := addr.(*net.UDPAddr); !ok {
+					t.Errorf("unexpected peer address: %v", addr)
+				}
+				for p := buf[:n]; len(p) > 0; {
+					m := size
+					if m > len(p) {
+						m = len(p)
+					}
+					segments = append(segments, m)
+					p = p[m:]
+				}
+				received = append(received, buf[:n]...)
+			}
+			if !bytes.Equal(received, payload) {
+				t.Errorf("received data differs from sent")
+			}
+			exp := []int{segSize, segSize, segSize, 50}
+			if len(segments) != len(exp) {
+				t.Fatalf("received segments %v; want %v", segments, exp)
+			}
+			for i := range exp {
+				if segments[i] != exp[i] {
+					t.Fatalf("received segments %v; want %v", segments, exp)
+				}
+			}
+		})
+	}
+}
+
+// udpPair returns a pair of UDP sockets on loopback, where send is connected
+// to recv.
+func udpPair(tb testing.TB) (recv, send *Desc) {
+	socket := func() int {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return fd
+	}
+
+	r := socket()
+	if err := unix.Bind(r, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		tb.Fatal(err)
+	}
+	sa, err := unix.Getsockname(r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := socket()
+	if err = unix.Connect(s, sa); err != nil {
+		tb.Fatal(err)
+	}
+
+	return Must(NewDesc(uintptr(r), EventRead)), Must(NewDesc(uintptr(s), EventWrite))
+}
@@ -1,9 +1,14 @@
 package netpoll
 
 import (
+	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
 // filer describes an object that has ability to return os.File.
@@ -15,16 +20,73 @@ type filer interface {
 // Desc is a network connection within netpoll descriptor.
 // It's methods are not goroutine safe.
 type Desc struct {
+	// readData is the data field of the last EVFILT_READ kevent.
+	// Must be accessed atomically.
+	readData int64
+
+	// writeData is the data field of the last EVFILT_WRITE kevent.
+	// Must be accessed atomically.
+	writeData int64
+
+	// fired is the number of callback calls made for the descriptor since
+	// it joined a group. It is counted only if Config.Metrics is set.
+	// Must be accessed atomically.
+	fired uint64
+
+	// rawFlags holds the flags of the last kernel event received for the
+	// descriptor. Must be accessed atomically.
+	rawFlags uint32
+
 	file  *os.File
 	event Event
 	desc  int
+
+	// closer, if set, is closed instead of file. It is set for descriptors
+	// sharing file descriptor with its owner (e.g. net.Listener), when file
+	// is nil, for descriptors created by NewDescRaw() and for the ones not
+	// owning their fd (see DescOptions.Borrowed).
+	closer io.Closer
+
+	// tty is true for descriptors created by NewTTYDesc().
+	tty bool
+
+	// fifo is set for descriptors created by NewFIFODesc().
+	fifo *fifoState
+
+	// label holds the *string set by SetLabel(). Must be accessed
+	// atomically.
+	label unsafe.Pointer
+
+	// lifetime is the connection set by DescOptions.ConnLifetime.
+	lifetime syscall.RawConn
+
+	// owner is the poller desc is registered within.
+	ownerMu sync.Mutex
+	owner   *poller
+
+	// closeHook, if set, is called by Close() before the file is closed.
+	// It is guarded by ownerMu.
+	closeHook func()
+
+	// group is the Group descriptor belongs to. It is guarded by ownerMu.
+	group *Group
+
+	// deadlines holds the deadlines set by SetReadDeadline() and
+	// SetWriteDeadline().
+	deadlines deadlines
 }
 
 // NewDesc creates descriptor from custom fd.
-func NewDesc(fd uintptr, ev Event) (*Desc, error) {
+// Note that fd is made close-on-exec, unless WithCloseOnExec(false) is given.
+func NewDesc(fd uintptr, ev Event, opts ...DescOption) (*Desc, error) {
+	o := resolveDescOptions(opts)
+	if o.Borrowed {
+		// The fd must not be closed by the finalizer of os.File.
+		return newRawDesc(fd, ev, o)
+	}
 	file := os.NewFile(fd, "")
 
-	desc, err := newDesc(file, ev)
+	desc, err := newDesc(file, ev, o)
 	if err != nil {
 		file.Close()
 		return nil, err
@@ -32,13 +94,56 @@ func NewDesc(fd uintptr, ev Event) (*Desc, error) {
 	return desc, nil
 }
 
+// NewDescRaw creates descriptor from custom fd without wrapping it into
+// os.File, thus fd is neither touched by the Go runtime nor closed by the
+// os.File finalizer. Along with WithoutNonblock() the only system call it
+// makes is fcntl(2) setting close-on-exec flag (see WithCloseOnExec()).
+//
+// With WithoutOwnership() the descriptor does not own fd: Close() only
+// forgets it. Otherwise Close() closes fd.
+func NewDescRaw(fd uintptr, ev Event, opts ...DescOption) (*Desc, error) {
+	return newRawDesc(fd, ev, resolveDescOptions(opts))
+}
+
+func newRawDesc(fd uintptr, ev Event, opts DescOptions) (*Desc, error) {
+	desc := &Desc{
+		event:  ev,
+		desc:   int(fd),
+		closer: &rawCloser{fd: int(fd)},
+	}
+	return initDesc(desc, opts)
+}
+
 // newDesc creates descriptor from custom fd.
-func newDesc(file *os.File, ev Event) (*Desc, error) {
+func newDesc(file *os.File, ev Event, opts DescOptions) (*Desc, error) {
 	desc := &Desc{
 		file: file,
 		event: ev,
 		desc: int(file.Fd()),
 	}
+	return initDesc(desc, opts)
+}
+
+// initDesc applies opts to the just created desc.
+func initDesc(desc *Desc, opts DescOptions) (*Desc, error) {
+	ev := desc.event
+	if opts.Borrowed {
+		desc.closer = borrowedCloser{}
+	}
+	if opts.Label != "" {
+		desc.SetLabel(opts.Label)
+	}
+	if opts.ConnLifetime != nil {
+		sc, ok := opts.ConnLifetime.(syscall.Conn)
+		if !ok {
+			return nil, ErrNotFiler
+		}
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		desc.lifetime = rc
+	}
 
 	// Set the file back to non blocking mode since conn.File() sets underlying
 	// os.File to blocking mode. This is useful to get conn.Set{Read}Deadline
@@ -46,15 +151,67 @@ func newDesc(file *os.File, ev Event) (*Desc, error) {
 	//
 	// See https://golang.org/pkg/net/#TCPConn.File
 	// See /usr/local/go/src/net/net.go: conn.File()
-	if err := syscall.SetNonblock(desc.Fd(), true); err != nil {
-		return nil, os.NewSyscallError("setnonblock", err)
+	if !opts.SkipNonblock {
+		if err := setNonblock(desc.Fd(), true); err != nil {
+			return nil, wrapDescErr("handle", desc, ev, os.NewSyscallError("setnonblock", err))
+		}
+	}
+	if err := setCloseOnExec(desc.Fd(), !opts.Inherit); err != nil {
+		return nil, wrapDescErr("handle", desc, ev, os.NewSyscallError("fcntl", err))
 	}
 
 	return desc, nil
 }
 
+// setNonblock is syscall.SetNonblock. It is a variable to be replaced by
+// tests.
+var setNonblock = syscall.SetNonblock
+
+// rawCloser closes the file descriptor of the descriptor created by
+// NewDescRaw(). The fd is closed at most once, thus the second Close()
+// does not close the fd with the same number opened in the meantime.
+type rawCloser struct {
+	fd     int
+	closed int32
+}
+
+func (r *rawCloser) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return os.NewSyscallError("close", syscall.EBADF)
+	}
+	if err := syscall.Close(r.fd); err != nil {
+		return os.NewSyscallError("close", err)
+	}
+	return nil
+}
+
+// borrowedCloser is the closer of descriptors created with
+// WithoutOwnership(). It leaves the fd open.
+type borrowedCloser struct{}
+
+func (borrowedCloser) Close() error {
+	return nil
+}
+
 // Close closes underlying file.
+// Descriptor started by Channel() is stopped first. So is the descriptor
+// whose callback is running (e.g. Close is called from within the
+// callback): no more callbacks are made after the running one returns.
 func (h *Desc) Close() error {
+	h.ownerMu.Lock()
+	fn := h.closeHook
+	owner := h.owner
+	h.ownerMu.Unlock()
+	if fn != nil {
+		fn()
+	}
+	if owner != nil {
+		owner.descClosing(h)
+	}
+	h.setDeadline(EventRead|EventWrite, time.Time{})
+	if h.closer != nil {
+		return h.closer.Close()
+	}
 	return h.file.Close()
 }
 
@@ -66,6 +223,235 @@ func (h *Desc) Fd() int {
 
 	return h.desc
 }
+
+// Owner returns the poller descriptor is registered within, or nil if it is
+// not registered.
+func (h *Desc) Owner() EventPoll {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	if h.owner == nil {
+		return nil
+	}
+	return h.owner
+}
+
+// abandoned reports whether the connection set by DescOptions.ConnLifetime
+// was closed.
+func (h *Desc) abandoned() bool {
+	if h.lifetime == nil {
+		return false
+	}
+	// Control fails only if the connection is closed.
+	return h.lifetime.Control(func(uintptr) {}) != nil
+}
+
+// setCloseHook sets the function called by Close(). It returns the
+// previous one.
+func (h *Desc) setCloseHook(fn func()) (prev func()) {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	prev, h.closeHook = h.closeHook, fn
+	return prev
+}
+
+// acquire makes p to be the owner of the descriptor. It reports whether
+// descriptor was not owned by some other poller.
+func (h *Desc) acquire(p *poller) bool {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	if h.owner != nil && h.owner != p {
+		return false
+	}
+	h.owner = p
+
+	return true
+}
+
+// release resets the owner of the descriptor if it is p.
+func (h *Desc) release(p *poller) {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	if h.owner == p {
+		h.owner = nil
+	}
+}
+
+// join makes the descriptor a member of g. It reports false if descriptor
+// already belongs to another group.
+func (h *Desc) join(g *Group) bool {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	if h.group != nil && h.group != g {
+		return false
+	}
+	if h.group == nil {
+		atomic.StoreUint64(&h.fired, 0)
+	}
+	h.group = g
+
+	return true
+}
+
+// grouped reports whether the descriptor belongs to some group.
+func (h *Desc) grouped() bool {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	return h.group != nil
+}
+
+// leave resets the group of the descriptor if it is g.
+func (h *Desc) leave(g *Group) {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	if h.group == g {
+		h.group = nil
+	}
+}
+
+// SetLabel attaches a human readable label to the descriptor, e.g. the peer
+// address or the name of the upstream. The label is included in errors
+// (see Error.Label), in exported states and in recorded events, which makes
+// them meaningful long after the file descriptor number was reused.
+//
+// Unlike the other methods of Desc it is safe to call SetLabel()
+// concurrently, e.g. from within the callback.
+func (h *Desc) SetLabel(label string) {
+	atomic.StorePointer(&h.label, unsafe.Pointer(&label))
+}
+
+// Label returns the label set by SetLabel() or WithLabel().
+func (h *Desc) Label() string {
+	return loadLabel(&h.label)
+}
+
+// loadLabel returns the string p points to, if any.
+func loadLabel(p *unsafe.Pointer) string {
+	if s := (*string)(atomic.LoadPointer(p)); s != nil {
+		return *s
+	}
+	return ""
+}
+
+// Name returns the name of the underlying file. It is empty for descriptors
+// created by Listen().
+func (h *Desc) Name() string {
+	if h.file == nil {
+		return ""
+	}
+	return h.file.Name()
+}
+
+// PollNow asks the kernel for the current readiness of the descriptor by
+// poll(2) call with zero timeout. Returned event reflects the kernel's view
+// regardless of the events descriptor is registered for.
+//
+// It is intended for diagnostics: if descriptor is ready but its callback
+// was not called, then the event was missed by the poller.
+func (h *Desc) PollNow() (Event, error) {
+	return pollNow(h.Fd())
+}
+
+// Readiness returns the subset of EventRead, EventWrite and EventHup which
+// the descriptor is ready for at the moment. EventHup is set if the peer
+// closed the connection (at least its writing side) or an error is pending.
+//
+// It is a cheap non-registering probe made by poll(2) call with zero
+// timeout, which is useful e.g. to choose between handling data inline and
+// queueing it. It does not disturb the descriptor's registration within the
+// poller and does not consume its edge-triggered state.
+//
+// Note that the result is a snapshot: readiness could change right after
+// the call returns, thus the caller must still handle EAGAIN.
+func (h *Desc) Readiness() (Event, error) {
+	event, err := pollNow(h.Fd())
+	if err != nil {
+		return 0, err
+	}
+	if event&(EventReadHup|EventErr) != 0 {
+		event |= EventHup
+	}
+	return event & (EventRead | EventWrite | EventHup), nil
+}
+
+// LastKeventData returns the data field of the last EVFILT_READ kevent
+// received for the descriptor. That is the number of bytes available for
+// reading for sockets and pipes, or the size of the pending connections
+// queue for listening sockets (i.e. how many accept(2) calls are worth to
+// make).
+//
+// It is the information kqueue provides for free along with the event; it
+// is always zero on platforms without kqueue.
+func (h *Desc) LastKeventData() int64 {
+	return atomic.LoadInt64(&h.readData)
+}
+
+// RawFlags returns the flags of the last event the kernel reported for the
+// descriptor, before they were translated to Event. It is an escape hatch
+// for the platform-specific bits Event does not model: the events field of
+// struct epoll_event on Linux (e.g. EPOLLMSG), the flags field of struct
+// kevent on BSD (e.g. EV_EOF) and the revents field of struct pollfd on
+// AIX. Note that the filter flags of kevent (NOTE_*) are not included.
+//
+// It is best-effort and platform-specific: the value is overwritten by each
+// event, while events synthesized by the poller (e.g. initial readiness
+// checks or EventPollClosed) do not change it. It is zero if no event was
+// received yet.
+func (h *Desc) RawFlags() uint32 {
+	return atomic.LoadUint32(&h.rawFlags)
+}
+
+// LastWriteSpace returns the number of bytes that could be written to the
+// descriptor without blocking, as reported by the kernel along with the
+// last write event. It is intended to size the writes made from the
+// callback: neither too small nor exceeding the buffer space, which would
+// end up with EAGAIN and wasted copying.
+//
+// On kqueue platforms it is the data field of the last EVFILT_WRITE kevent
+// received for the descriptor. Where the kernel does not provide it along
+// with the event (e.g. epoll) or no write event was received yet, it is
+// approximated at the time of the call as WritableBytes() does. Zero means
+// that the space is unknown (or there is no space at all).
+func (h *Desc) LastWriteSpace() int {
+	if n := atomic.LoadInt64(&h.writeData); n > 0 {
+		return int(n)
+	}
+	n, _ := writableBytes(h.Fd())
+	return n
+}
+
+// ReadableBytes returns the number of bytes that could be read from the
+// descriptor without blocking.
+// It returns ErrUnsupported if the operating system does not provide such
+// information.
+func (h *Desc) ReadableBytes() (int, error) {
+	return readableBytes(h.Fd())
+}
+
+// WritableBytes returns the number of bytes that could be written to the
+// socket descriptor without blocking, that is the size of socket's send
+// buffer minus the number of bytes queued in it. It is an estimate, since
+// the kernel accounts the buffer's overhead along with the data; on linux
+// it tends to be less than the actual space.
+// It returns ErrUnsupported if the operating system does not provide such
+// information.
+func (h *Desc) WritableBytes() (int, error) {
+	return writableBytes(h.Fd())
+}
+
+func nonNegative(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
 // Must is a helper that wraps a call to a function returning (*Desc, error).
 // It panics if the error is non-nil and returns desc if not.
 // It is intended for use in short Desc initializations.
@@ -110,21 +496,120 @@ func HandleReadWrite(conn net.Conn) (*Desc, error) {
 // Handle creates new Desc with given conn and event.
 // Returned descriptor could be used as argument to Start(), Resume() and
 // Stop() methods of some EventPoll implementation.
-func Handle(conn net.Conn, event Event) (*Desc, error) {
-	desc, err := handle(conn, event)
+//
+// Note that descriptor holds a duplicate of the conn's file descriptor:
+// closing conn alone leaves the socket open and registered within the
+// poller, and the peer does not see the connection closed until the
+// descriptor is closed too. Pass WithConnLifetime(conn) to close the
+// descriptor automatically after conn is closed.
+func Handle(conn net.Conn, event Event, opts ...DescOption) (*Desc, error) {
+	desc, err := handle(conn, event, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return desc, nil
+}
+
+// HandlePreserving is like Handle(), but it also makes sure that conn stays
+// usable on its own after the file descriptor is duplicated. It is intended
+// for applications which keep using conn (e.g. for writes or with
+// deadlines) while the poller observes the descriptor.
+//
+// The file descriptor returned by conn.File() may be put into blocking mode
+// (depending on Go version), and it shares the file status flags with the
+// conn's one. Then writes made on conn block the whole thread and its
+// deadlines stop working. HandlePreserving records whether conn's file
+// descriptor was non-blocking before the duplication and restores that mode
+// explicitly on both descriptors afterwards.
+func HandlePreserving(conn net.Conn, event Event, opts ...DescOption) (*Desc, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrNotFiler
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		nonblock bool
+		ctlErr   error
+	)
+	err = rc.Control(func(fd uintptr) {
+		nonblock, ctlErr = isNonblock(int(fd))
+	})
+	if err == nil {
+		err = ctlErr
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	desc, err := handle(conn, event, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !nonblock {
+		return desc, nil
+	}
+	err = rc.Control(func(fd uintptr) {
+		ctlErr = syscall.SetNonblock(int(fd), true)
+	})
+	if err == nil {
+		err = ctlErr
+	}
+	if err != nil {
+		desc.Close()
+		return nil, wrapDescErr("handle", desc, event, os.NewSyscallError("setnonblock", err))
+	}
 	return desc, nil
 }
 
+// HandleSplit creates two descriptors for the same conn: one for reading
+// events and one for writing events. It makes possible to observe reading
+// and writing in different modes, e.g. reading in edge-triggered mode and
+// writing in level-triggered mode, which is not possible with a single
+// registration per file descriptor.
+//
+// EventWrite is cleared from readEv and EventRead is cleared from writeEv.
+//
+// Note that each descriptor holds its own duplicate of the conn's file
+// descriptor, thus HandleSplit costs one more file descriptor than Handle.
+// Use StopSplit() to stop both descriptors.
+func HandleSplit(conn net.Conn, readEv, writeEv Event) (r, w *Desc, err error) {
+	if r, err = handle(conn, readEv&^EventWrite, nil); err != nil {
+		return nil, nil, err
+	}
+	if w, err = handle(conn, writeEv&^EventRead, nil); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, w, nil
+}
+
+// StopSplit stops both descriptors returned by HandleSplit(). It returns the
+// first error occurred.
+func StopSplit(poller EventPoll, r, w *Desc) error {
+	errR := poller.Stop(r)
+	errW := poller.Stop(w)
+	if errR != nil {
+		return errR
+	}
+	return errW
+}
+
 // HandleListener returns descriptor for a net.Listener.
-func HandleListener(ln net.Listener, event Event) (*Desc, error) {
-	return handle(ln, event)
+// Listeners of the net package are supported: *net.TCPListener and
+// *net.UnixListener, the latter of both "unix" and "unixpacket" networks.
+//
+// Note that descriptor holds a duplicate of the listener's file descriptor.
+// The listener remains responsible for its socket file: closing
+// *net.UnixListener unlinks it even if descriptor is still open.
+func HandleListener(ln net.Listener, event Event, opts ...DescOption) (*Desc, error) {
+	return handle(ln, event, opts)
 }
 
-func handle(x interface{}, event Event) (*Desc, error) {
+func handle(x interface{}, event Event, opts []DescOption) (*Desc, error) {
 	f, ok := x.(filer)
 	if !ok {
 		return nil, ErrNotFiler
@@ -138,7 +623,7 @@ func handle(x interface{}, event Event) (*Desc, error) {
 
 	var desc *Desc
 
-	if desc, err = newDesc(file, event); err != nil {
+	if desc, err = newDesc(file, event, resolveDescOptions(opts)); err != nil {
 		file.Close()
 		return nil, err
 	}
@@ -0,0 +1,27 @@
+// +build dragonfly netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// _FIONREAD is _IOR('f', 127, int) from sys/filio.h.
+const _FIONREAD = 0x4004667f
+
+// _POLLRDHUP is not supported by poll(2) on this system.
+const _POLLRDHUP = 0
+
+func readableBytes(fd int) (int, error) {
+	n, err := unix.IoctlGetInt(fd, _FIONREAD)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return n, nil
+}
+
+func writableBytes(fd int) (int, error) {
+	return 0, ErrUnsupported
+}
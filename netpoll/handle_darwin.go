@@ -0,0 +1,35 @@
+// +build darwin
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// _FIONREAD is _IOR('f', 127, int) from sys/filio.h.
+const _FIONREAD = 0x4004667f
+
+// _POLLRDHUP is not supported by poll(2) on this system.
+const _POLLRDHUP = 0
+
+func readableBytes(fd int) (int, error) {
+	n, err := unix.IoctlGetInt(fd, _FIONREAD)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return n, nil
+}
+
+func writableBytes(fd int) (int, error) {
+	size, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return 0, os.NewSyscallError("getsockopt", err)
+	}
+	queued, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_NWRITE)
+	if err != nil {
+		return 0, os.NewSyscallError("getsockopt", err)
+	}
+	return nonNegative(size - queued), nil
+}
@@ -0,0 +1,34 @@
+// +build freebsd
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from sys/filio.h.
+const (
+	_FIONREAD  = 0x4004667f // _IOR('f', 127, int)
+	_FIONSPACE = 0x40046676 // _IOR('f', 118, int)
+)
+
+// _POLLRDHUP is not supported by poll(2) on this system.
+const _POLLRDHUP = 0
+
+func readableBytes(fd int) (int, error) {
+	n, err := unix.IoctlGetInt(fd, _FIONREAD)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return n, nil
+}
+
+func writableBytes(fd int) (int, error) {
+	n, err := unix.IoctlGetInt(fd, _FIONSPACE)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,49 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// _POLLRDHUP is not defined in golang.org/x/sys/unix.
+const _POLLRDHUP = 0x2000
+
+func readableBytes(fd int) (int, error) {
+	n, err := unix.IoctlGetInt(fd, unix.SIOCINQ)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return n, nil
+}
+
+// writableBytes estimates the free space of the socket's send buffer. Note
+// that the kernel reports SO_SNDBUF doubled to account for its bookkeeping
+// overhead, while SIOCOUTQ is the number of queued bytes (the payload of TCP
+// socket or the memory allocated for the queue of other ones). Thus half
+// of SO_SNDBUF is taken as the buffer's capacity, which makes the estimate
+// to err on the side of smaller writes.
+func writableBytes(fd int) (int, error) {
+	size, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return 0, os.NewSyscallError("getsockopt", err)
+	}
+	queued, err := unix.IoctlGetInt(fd, unix.SIOCOUTQ)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return nonNegative(size/2 - queued), nil
+}
+
+// processExitFd returns descriptor which becomes readable when process with
+// given pid exits, that is the pidfd of the process.
+func processExitFd(pid int) (int, error) {
+	fd, _, errno := unix.Syscall(_SYS_PIDFD_OPEN, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return -1, os.NewSyscallError("pidfd_open", errno)
+	}
+	unix.CloseOnExec(int(fd))
+	return int(fd), nil
+}
@@ -0,0 +1,45 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package netpoll
+
+func readableBytes(fd int) (int, error) {
+	return 0, ErrUnsupported
+}
+
+func writableBytes(fd int) (int, error) {
+	return 0, ErrUnsupported
+}
+
+func setCloseOnExec(fd int, on bool) error {
+	return nil
+}
+
+func isNonblock(fd int) (bool, error) {
+	return false, ErrUnsupported
+}
+
+func isStreamSocket(fd int) (bool, error) {
+	return false, ErrUnsupported
+}
+
+func pollNow(fd int) (Event, error) {
+	return 0, ErrUnsupported
+}
+
+// reusePortSupported reports whether SO_REUSEPORT is supported.
+const reusePortSupported = false
+
+func setListenerSockopts(fd int, opts ListenOptions) error {
+	if opts.ReuseAddr || (opts.ReusePort && !reusePortSupported) || opts.V6Only != nil {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+func setListenBacklog(fd, n int) error {
+	return ErrUnsupported
+}
+
+func processExitFd(pid int) (int, error) {
+	return -1, ErrUnsupported
+}
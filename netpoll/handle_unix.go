@@ -0,0 +1,109 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func setCloseOnExec(fd int, on bool) error {
+	var flag int
+	if on {
+		flag = unix.FD_CLOEXEC
+	}
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_SETFD, flag)
+	return err
+}
+
+// isNonblock reports whether fd is in non-blocking mode.
+func isNonblock(fd int) (bool, error) {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return false, os.NewSyscallError("fcntl", err)
+	}
+	return flags&unix.O_NONBLOCK != 0, nil
+}
+
+// isStreamSocket reports whether fd is a stream socket.
+func isStreamSocket(fd int) (bool, error) {
+	typ, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err == unix.ENOTSOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return typ == unix.SOCK_STREAM, nil
+}
+
+func pollNow(fd int) (Event, error) {
+	fds := []unix.PollFd{{
+		Fd:     int32(fd),
+		Events: unix.POLLIN | unix.POLLOUT | _POLLRDHUP,
+	}}
+	for {
+		_, err := unix.Poll(fds, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, os.NewSyscallError("poll", err)
+		}
+		break
+	}
+
+	var (
+		event   Event
+		revents = fds[0].Revents
+	)
+	if revents&unix.POLLIN != 0 {
+		event |= EventRead
+	}
+	if revents&unix.POLLOUT != 0 {
+		event |= EventWrite
+	}
+	if revents&unix.POLLHUP != 0 {
+		event |= EventHup
+	}
+	if revents&_POLLRDHUP != 0 {
+		event |= EventReadHup
+	}
+	if revents&(unix.POLLERR|unix.POLLNVAL) != 0 {
+		event |= EventErr
+	}
+	return event, nil
+}
+
+// reusePortSupported reports whether SO_REUSEPORT is supported.
+const reusePortSupported = true
+
+func setListenerSockopts(fd int, opts ListenOptions) error {
+	if opts.ReuseAddr {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.ReusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.V6Only != nil {
+		var v int
+		if *opts.V6Only {
+			v = 1
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+// setListenBacklog changes the pending connections queue length of the
+// listening socket fd by calling listen(2) again.
+func setListenBacklog(fd, n int) error {
+	return os.NewSyscallError("listen", unix.Listen(fd, n))
+}
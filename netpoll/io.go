@@ -0,0 +1,173 @@
+package netpoll
+
+import (
+	"io"
+	"sync"
+	"syscall"
+)
+
+// readBufferSize is the default size of buffers handed out by
+// Desc.GetBuffer().
+const readBufferSize = 32 * 1024
+
+// readBufferPool holds buffers of descriptors which are not registered
+// within any poller.
+var readBufferPool = newBufferPool(readBufferSize)
+
+// bufferPool is a pool of buffers of the same size.
+type bufferPool struct {
+	sync.Pool
+	size int
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		Pool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, size)
+			},
+		},
+		size: size,
+	}
+}
+
+// GetBuffer returns a buffer from the pool of the poller the descriptor is
+// registered within. Its size is Config.BufferSize of that poller, or 32KB
+// if descriptor is not registered. It is intended to be used as a read
+// buffer within the callback, without allocating one per call.
+//
+// The buffer must be returned by PutBuffer() when it is not needed anymore,
+// which is usually right before the callback returns. Neither the buffer nor
+// the slices of it must be retained after PutBuffer(): the same memory is
+// handed out to other callbacks, possibly running concurrently. Copy the
+// data that must outlive the callback.
+func (h *Desc) GetBuffer() []byte {
+	return h.bufferPool().Get().([]byte)
+}
+
+// PutBuffer returns the buffer obtained by GetBuffer() to the pool. Buffers
+// of other sizes (e.g. the ones returned after the descriptor was moved to
+// a poller with different Config.BufferSize) are dropped.
+func (h *Desc) PutBuffer(b []byte) {
+	pool := h.bufferPool()
+	if cap(b) != pool.size {
+		return
+	}
+	pool.Put(b[:pool.size])
+}
+
+// bufferPool returns the pool of the poller the descriptor is registered
+// within.
+func (h *Desc) bufferPool() *bufferPool {
+	h.ownerMu.Lock()
+	defer h.ownerMu.Unlock()
+
+	if h.owner == nil {
+		return readBufferPool
+	}
+	return h.owner.buffers
+}
+
+// DrainRead reads from desc until the kernel reports that there is no more
+// data available (EAGAIN), passing every read chunk to the into function.
+// It is intended to be called from the callback of edge-triggered
+// descriptor, which must be read until EAGAIN to receive the next event.
+//
+// The chunk passed to into is valid only until into returns; it must be
+// copied if it is needed after that. If into returns false, DrainRead stops
+// reading and returns nil. Note that in such case edge-triggered descriptor
+// will not receive next read event until the rest of the data is read.
+//
+// It returns nil when all available data was read and io.EOF when the peer
+// closed its side of the connection.
+func DrainRead(desc *Desc, into func([]byte) bool) error {
+	buf := desc.GetBuffer()
+	defer desc.PutBuffer(buf)
+
+	for {
+		n, err := syscall.Read(desc.Fd(), buf)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			return nil
+		case err != nil:
+			return err
+		case n == 0:
+			return io.EOF
+		}
+		if !into(buf[:n]) {
+			return nil
+		}
+	}
+}
+
+// WriteAll writes p to desc until it is written completely or the kernel
+// reports that the descriptor's buffer is full (EAGAIN). It is the write
+// analog of DrainRead() and returns the number of bytes written.
+//
+// If p could not be written completely, WriteAll adds EventWrite to the
+// events desc is registered for, thus the callback is called when there is
+// space available again; the caller must retry with the rest of the data
+// from there. When p is written completely, EventWrite is removed from the
+// registration to not receive spurious writability events. Note that
+// one-shot descriptors still must be resumed as usual.
+//
+// It returns ErrNotRegistered if EventWrite must be added, but desc is not
+// registered within a poller.
+func WriteAll(desc *Desc, p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := syscall.Write(desc.Fd(), p[written:])
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			return written, writeInterest(desc, true)
+		case err != nil:
+			return written, err
+		}
+		written += n
+	}
+	if err := writeInterest(desc, false); err != nil && err != ErrNotRegistered {
+		return written, err
+	}
+	return written, nil
+}
+
+// writeInterest adds or removes EventWrite from the events desc is
+// registered for.
+func writeInterest(desc *Desc, on bool) error {
+	p, ok := desc.Owner().(*poller)
+	if !ok {
+		return ErrNotRegistered
+	}
+	return p.writeInterest(desc, on)
+}
+
+// SetSocketLowWater sets the read low-water mark of the socket desc: its
+// callback is called for reading only when at least bytes are buffered (or
+// on hang up and errors). It is useful for the protocols with fixed size
+// messages or headers, which are not worth to be woken up for every partial
+// message. Zero resets the mark to the kernel's default of a single byte.
+//
+// It is the same as SetLowWater() of the poller desc is registered within,
+// for the code which does not hold the poller (e.g. protocol handlers given
+// only the descriptor). It returns ErrNotRegistered if desc is not
+// registered.
+//
+// On kqueue platforms the mark is passed as NOTE_LOWAT of the read filter
+// and applies to any stream socket. On linux SO_RCVLOWAT socket option is
+// set, which epoll honors for TCP sockets only; ErrInvalidLowWater is
+// returned for the others (e.g. unix sockets). Note that kernels older than
+// 2.6.28 ignore SO_RCVLOWAT in epoll at all, and kernels older than 4.18 do
+// not grow the receive buffer to fit the mark, so the mark larger than the
+// buffer may never be reached there. The option belongs to the socket, thus
+// it remains in effect after the descriptor is stopped.
+func SetSocketLowWater(desc *Desc, bytes int) error {
+	p := desc.Owner()
+	if p == nil {
+		return ErrNotRegistered
+	}
+	return p.SetLowWater(desc, bytes)
+}
@@ -7,6 +7,9 @@ import (
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -207,7 +210,33 @@ type KEventHandler func(KEvent)
 // KQueueConfig contains options for configuration kqueue instance.
 type KQueueConfig struct {
 	// OnWaitError will be called from goroutine, waiting for events.
-	OnWaitError func(error)
+	// If it returns true, the wait loop continues. Otherwise the loop stops
+	// and no more events are delivered.
+	//
+	// Use StopOnWaitError() to adapt handlers of the former func(error)
+	// signature.
+	OnWaitError func(error) bool
+
+	// ExternalLoop makes KQueueCreate() to not start the wait loop. Instead,
+	// the caller must call Iterate() when Fd() is ready for reading, e.g.
+	// when the instance is embedded into another event loop.
+	ExternalLoop bool
+
+	// metrics enables accounting of time spent in kevent(2).
+	metrics bool
+
+	// onIdle is called from the wait loop when no events were received
+	// for at least idleThreshold.
+	onIdle        func(time.Duration)
+	idleThreshold time.Duration
+
+	// onBatch is called after handlers of all events received by a single
+	// kevent(2) call were called.
+	onBatch func()
+
+	// onWakeup is called from the wait loop after the wakeup made by
+	// trigger() was received.
+	onWakeup func()
 }
 
 func (c *KQueueConfig) withDefaults() (config KQueueConfig) {
@@ -223,34 +252,86 @@ func (c *KQueueConfig) withDefaults() (config KQueueConfig) {
 // KQueue represents kqueue instance.
 type KQueue struct {
 	// mu     sync.RWMutex
-	fd     int
-	cb     sync.Map // map[uint64]KEventHandler
-	done   chan struct{}
-	closed bool
+	fd   int
+	cb   sync.Map // map[uint64]KEventHandler
+	done chan struct{}
+
+	external bool
+
+	// iterMu is held while events are received and handled. It makes the
+	// evs buffer to be used by a single goroutine.
+	iterMu sync.Mutex
+	evs    []unix.Kevent_t
+	rotate int
+
+	// waitNanos is the total time spent in kevent(2) waiting for events and
+	// waits is the number of such calls. They are updated only if metrics is
+	// true and must be accessed atomically.
+	metrics   bool
+	waitNanos uint64
+	waits     uint64
+
+	onBatch  func()
+	onWakeup func()
 }
 
 // KQueueCreate creates new kqueue instance.
-// It starts wait loop in a separate goroutine.
+// It starts wait loop in a separate goroutine, unless config's ExternalLoop
+// is set.
 func KQueueCreate(c *KQueueConfig) (*KQueue, error) {
 	config := c.withDefaults()
 
+	// Note that kqueue descriptors are not inherited by fork(2) children,
+	// but the flag is set anyway to be explicit about it.
+	syscall.ForkLock.RLock()
 	fd, err := unix.Kqueue()
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Register the user event used by trigger(). EV_CLEAR makes it to be
+	// reset once it is received, thus any number of triggers made before
+	// that is received as a single event.
+	_, err = unix.Kevent(fd, []unix.Kevent_t{{
+		Ident:  wakeupIdent,
+		Filter: unix.EVFILT_USER,
+		Flags:  unix.EV_ADD | unix.EV_CLEAR,
+	}}, nil, nil)
 	if err != nil {
+		unix.Close(fd)
 		return nil, err
 	}
 
 	kq := &KQueue{
-		fd:   fd,
-		done: make(chan struct{}),
+		fd:       fd,
+		done:     make(chan struct{}),
+		external: config.ExternalLoop,
+		metrics:  config.metrics,
+		onBatch:  config.onBatch,
+		onWakeup: config.onWakeup,
+		evs:      make([]unix.Kevent_t, maxWaitEventsBegin),
+	}
+	if kq.external {
+		return kq, nil
 	}
 
-	go kq.wait(config.OnWaitError)
+	go kq.wait(config.OnWaitError, idleTracker{
+		fn:        config.onIdle,
+		threshold: config.idleThreshold,
+	})
 
 	return kq, nil
 }
 
 // Close closes kqueue instance.
 // NOTE: not implemented yet.
+//
+// Note that in ExternalLoop mode it waits for the running Iterate() call, if
+// any.
 func (k *KQueue) Close() error {
 	// TODO(): implement close.
 	select {
@@ -259,14 +340,49 @@ func (k *KQueue) Close() error {
 	default:
 		close(k.done)
 	}
+	if k.external {
+		k.iterMu.Lock()
+		defer k.iterMu.Unlock()
+	}
 	return unix.Close(k.fd)
 }
 
+// wakeupIdent is the identifier of the EVFILT_USER event used by trigger().
+// User events do not share identifiers with file descriptors.
+const wakeupIdent = 0
+
+// trigger wakes up the wait loop, which calls onWakeup then.
+func (k *KQueue) trigger() error {
+	if k.isClosed() {
+		return ErrClosed
+	}
+	_, err := unix.Kevent(k.fd, []unix.Kevent_t{{
+		Ident:  wakeupIdent,
+		Filter: unix.EVFILT_USER,
+		Fflags: unix.NOTE_TRIGGER,
+	}}, nil, nil)
+	return err
+}
+
+// isClosed reports whether Close() was called.
+func (k *KQueue) isClosed() bool {
+	select {
+	case <-k.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // Add adds a event handler for identifier fd with given n events.
+// Filter flags and data of the events are passed to the kernel as is (e.g.
+// NOTE_LOWAT with the low-water mark for EVFILT_READ).
 func (k *KQueue) Add(fd int, events KEvents, n int, cb KEventHandler) error {
 	var kevs [filterCount]unix.Kevent_t
 	for i := 0; i < n; i++ {
 		kevs[i] = evGet(fd, events[i].Filter, events[i].Flags)
+		kevs[i].Fflags = events[i].Fflags
+		kevs[i].Data = events[i].Data
 	}
 
 	arr := unsafe.Pointer(&kevs)
@@ -277,7 +393,7 @@ func (k *KQueue) Add(fd int, events KEvents, n int, cb KEventHandler) error {
 	}
 	changes := *(*[]unix.Kevent_t)(unsafe.Pointer(hdr))
 
-	if k.closed {
+	if k.isClosed() {
 		return ErrClosed
 	}
 
@@ -285,16 +401,61 @@ func (k *KQueue) Add(fd int, events KEvents, n int, cb KEventHandler) error {
 		return ErrRegistered
 	}
 
-	_, err := unix.Kevent(k.fd, changes, nil, nil)
+	if err := keventChanges(k.fd, changes); err != nil {
+		// The kernel applies changes in order and stops at the failed one,
+		// thus the filters added before it must be deleted to leave fd not
+		// registered at all, as epoll does. Then let the fd to be added
+		// again, e.g. when the error is transient.
+		k.rollback(fd, changes)
+		k.cb.Delete(uint64(fd))
+		return err
+	}
+
+	return nil
+}
+
+// rollback deletes the filters of the changes made by the partially failed
+// Add() call. Filters which were not added are ignored.
+func (k *KQueue) rollback(fd int, changes []unix.Kevent_t) {
+	for i := range changes {
+		del := []unix.Kevent_t{evGet(fd, KeventFilter(changes[i].Filter), EV_DELETE)}
+		_, _ = unix.Kevent(k.fd, del, nil, nil)
+	}
+}
 
+// keventFault, if set, is called for each change submitted by Add(). If it
+// returns an error, the changes before the faulty one are applied and the
+// error is returned, as if the kernel failed to apply that change. It is set
+// by tests to inject errors.
+var keventFault func(change unix.Kevent_t) error
+
+// keventChanges submits changes to kqueue kq.
+func keventChanges(kq int, changes []unix.Kevent_t) error {
+	if fault := keventFault; fault != nil {
+		for i := range changes {
+			if err := fault(changes[i]); err != nil {
+				if i > 0 {
+					if _, e := unix.Kevent(kq, changes[:i], nil, nil); e != nil {
+						return e
+					}
+				}
+				return err
+			}
+		}
+	}
+	_, err := unix.Kevent(kq, changes, nil, nil)
 	return err
 }
 
 // Mod modifies events registered for fd.
+// Note that the kernel replaces filter flags and data of the filters with
+// the given ones.
 func (k *KQueue) Mod(fd int, events KEvents, n int) error {
 	var kevs [filterCount]unix.Kevent_t
 	for i := 0; i < n; i++ {
 		kevs[i] = evGet(fd, events[i].Filter, events[i].Flags)
+		kevs[i].Fflags = events[i].Fflags
+		kevs[i].Data = events[i].Data
 	}
 
 	arr := unsafe.Pointer(&kevs)
@@ -305,7 +466,7 @@ func (k *KQueue) Mod(fd int, events KEvents, n int) error {
 	}
 	changes := *(*[]unix.Kevent_t)(unsafe.Pointer(hdr))
 
-	if k.closed {
+	if k.isClosed() {
 		return ErrClosed
 	}
 	if _, has := k.cb.Load(uint64(fd)); !has {
@@ -320,7 +481,7 @@ func (k *KQueue) Mod(fd int, events KEvents, n int) error {
 // Del removes callback for fd. Note that it does not cleanups events for fd in
 // kqueue. You should close fd or call Mod() with EV_DELETE flag set.
 func (k *KQueue) Del(fd int) error {
-	if k.closed {
+	if k.isClosed() {
 		return ErrClosed
 	}
 
@@ -333,12 +494,12 @@ func (k *KQueue) Del(fd int) error {
 	return nil
 }
 
-func (k *KQueue) wait(onError func(error)) {
-	const (
-		maxWaitEventsBegin = 1 << 10 // 1024
-		maxWaitEventsStop  = 1 << 15 // 32768
-	)
+const (
+	maxWaitEventsBegin = 1 << 10 // 1024
+	maxWaitEventsStop  = 1 << 15 // 32768
+)
 
+func (k *KQueue) wait(onError func(error) bool, idle idleTracker) {
 	defer func() {
 		if err := unix.Close(k.fd); err != nil {
 			onError(err)
@@ -354,41 +515,134 @@ func (k *KQueue) wait(onError func(error)) {
 		}
 	}()
 
-	evs := make([]unix.Kevent_t, maxWaitEventsBegin)
-
+	var timeout *unix.Timespec
+	if d := idle.timeout(); d >= 0 {
+		t := unix.NsecToTimespec(int64(d))
+		timeout = &t
+	}
 	for {
-		n, err := unix.Kevent(k.fd, nil, evs, nil)
-		if n > len(evs) {
-			continue
+		var start int64
+		if idle.fn != nil {
+			start = nanotime()
 		}
+		k.iterMu.Lock()
+		n, err := k.poll(timeout)
+		k.iterMu.Unlock()
 		if err != nil {
 			if temporaryErr(err) {
 				continue
 			}
-			onError(err)
+			select {
+			case <-k.done:
+				// Instance was closed.
+				return
+			default:
+			}
+			if onError(err) {
+				continue
+			}
 			return
 		}
+		idle.observe(start, n)
 
-		for _, e := range evs[:n] {
-			if entry, has := k.cb.Load(e.Ident); has {
-				if handler, ok := entry.(KEventHandler); ok {
-					handler(KEvent{
-						Filter: KeventFilter(e.Filter),
-						Flags:  KeventFlag(e.Flags),
-						Data:   e.Data,
-						Fflags: e.Fflags,
-					})
-				}
-			}
-		}
+		// give more chance to other goroutine
+		runtime.Gosched()
+	}
+}
+
+// Fd returns the kqueue file descriptor. It could be used to embed the
+// instance into another event loop (see KQueueConfig.ExternalLoop).
+func (k *KQueue) Fd() int {
+	return k.fd
+}
+
+// Iterate waits for events for at most timeout and calls handlers of ready
+// identifiers. Negative timeout means infinite waiting.
+// It must be used only if instance was created with ExternalLoop option.
+func (k *KQueue) Iterate(timeout time.Duration) error {
+	if !k.external {
+		return ErrNotExternalLoop
+	}
+
+	k.iterMu.Lock()
+	defer k.iterMu.Unlock()
+
+	select {
+	case <-k.done:
+		return ErrClosed
+	default:
+	}
 
-		if n == len(evs) && n*2 <= maxWaitEventsStop {
-			evs = make([]unix.Kevent_t, n*2)
+	var ts *unix.Timespec
+	if timeout >= 0 {
+		t := unix.NsecToTimespec(int64(timeout))
+		ts = &t
+	}
+	_, err := k.poll(ts)
+	if err != nil && temporaryErr(err) {
+		return nil
+	}
+	return err
+}
+
+// poll makes single kevent() call and calls handlers of ready identifiers.
+// It returns the number of received events.
+// Note that k.iterMu must be held.
+//
+// Handlers are called starting from the rotating offset within the received
+// batch. Along with the kernel moving reported level-triggered events to the
+// tail of the active list, this makes every ready identifier to be serviced
+// in bounded time, even if some other identifiers are always ready.
+func (k *KQueue) poll(timeout *unix.Timespec) (int, error) {
+	var start int64
+	if k.metrics {
+		start = nanotime()
+	}
+	n, err := unix.Kevent(k.fd, nil, k.evs, timeout)
+	if k.metrics {
+		atomic.AddUint64(&k.waitNanos, uint64(nanotime()-start))
+		atomic.AddUint64(&k.waits, 1)
+	}
+	if n > len(k.evs) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, wrapErr("wait", k.fd, 0, err)
+	}
+
+	if n > 0 {
+		k.rotate++
+	}
+	var woken bool
+	for j := 0; j < n; j++ {
+		e := k.evs[(k.rotate+j)%n]
+		if e.Filter == unix.EVFILT_USER {
+			woken = true
+			continue
+		}
+		if entry, has := k.cb.Load(e.Ident); has {
+			if handler, ok := entry.(KEventHandler); ok {
+				handler(KEvent{
+					Filter: KeventFilter(e.Filter),
+					Flags:  KeventFlag(e.Flags),
+					Data:   e.Data,
+					Fflags: e.Fflags,
+				})
+			}
 		}
+	}
+	if woken && k.onWakeup != nil {
+		k.onWakeup()
+	}
+	if n > 0 && k.onBatch != nil {
+		k.onBatch()
+	}
 
-		// give more chance to other goroutine
-		runtime.Gosched()
+	if n == len(k.evs) && n*2 <= maxWaitEventsStop {
+		k.evs = make([]unix.Kevent_t, n*2)
 	}
+
+	return n, nil
 }
 
 func evGet(fd int, filter KeventFilter, flags KeventFlag) unix.Kevent_t {
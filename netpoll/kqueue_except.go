@@ -0,0 +1,11 @@
+// +build darwin dragonfly
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// _EVFILT_EXCEPT and _NOTE_OOB are used to observe EventPri.
+const (
+	_EVFILT_EXCEPT = KeventFilter(unix.EVFILT_EXCEPT)
+	_NOTE_OOB      = unix.NOTE_OOB
+)
@@ -0,0 +1,9 @@
+// +build freebsd netbsd openbsd
+
+package netpoll
+
+// EventPri is not supported on these platforms.
+const (
+	_EVFILT_EXCEPT KeventFilter = 0
+	_NOTE_OOB                   = 0
+)
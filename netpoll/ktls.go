@@ -0,0 +1,79 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/tls.h.
+const (
+	tlsGetRecordType = 2
+)
+
+// TLS record content types, as defined by RFC 8446.
+const (
+	TLSRecordAlert           uint8 = 21
+	TLSRecordHandshake       uint8 = 22
+	TLSRecordApplicationData uint8 = 23
+)
+
+// ReadKTLS reads a record from the socket represented by desc with kernel
+// TLS receive offload enabled (TCP_ULP "tls" with TLS_RX set). Records are
+// decrypted by the kernel, and the ones of different types are never
+// merged into a single read.
+//
+// The recordType is the content type of the record read. If it is other
+// than TLSRecordApplicationData (e.g. an alert or a key update), the record
+// payload is read into buf and ErrTLSControlRecord is returned along with
+// n and recordType. ErrTLSControlRecord with zero recordType means that the
+// kernel refused to pass a control record (EIO).
+//
+// The recordType is zero if the socket does not report record types, that
+// is if kernel TLS is not enabled for it. If there is no data available, it
+// returns ErrWouldBlock. Decryption failures are returned as
+// syscall.EBADMSG.
+func ReadKTLS(desc *Desc, buf []byte) (n int, recordType uint8, err error) {
+	var (
+		oob  = make([]byte, unix.CmsgSpace(1))
+		oobn int
+	)
+	for {
+		n, oobn, _, _, err = unix.Recvmsg(desc.Fd(), buf, oob, 0)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	switch err {
+	case nil:
+	case syscall.EAGAIN:
+		return 0, 0, ErrWouldBlock
+	case syscall.EIO:
+		return 0, 0, ErrTLSControlRecord
+	default:
+		return 0, 0, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, 0, os.NewSyscallError("recvmsg", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_TLS && msg.Header.Type == tlsGetRecordType && len(msg.Data) >= 1 {
+			recordType = msg.Data[0]
+		}
+	}
+	if recordType != 0 && recordType != TLSRecordApplicationData {
+		return n, recordType, ErrTLSControlRecord
+	}
+	return n, recordType, nil
+}
+
+// isKernelTLS reports whether fd is a socket with kernel TLS enabled.
+func isKernelTLS(fd int) bool {
+	ulp, err := unix.GetsockoptString(fd, unix.SOL_TCP, unix.TCP_ULP)
+	return err == nil && ulp == "tls"
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package netpoll
+
+// isKernelTLS reports whether fd is a socket with kernel TLS enabled.
+func isKernelTLS(fd int) bool {
+	return false
+}
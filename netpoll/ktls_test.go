@@ -0,0 +1,142 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/tls.h.
+const (
+	tlsTX            = 1
+	tlsRX            = 2
+	tlsSetRecordType = 1
+	tls12Version     = 0x0303
+	tlsAESGCM128     = 51
+)
+
+func TestReadKTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	send, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer send.Close()
+	recv, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+
+	sendFd := enableKTLS(t, send.(*net.TCPConn), tlsTX)
+	enableKTLS(t, recv.(*net.TCPConn), tlsRX)
+
+	desc, err := HandleRead(recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	if err = unix.SetNonblock(desc.Fd(), true); err != nil {
+		t.Fatal(err)
+	}
+	if !isKernelTLS(desc.Fd()) {
+		t.Fatal("kernel TLS is not detected")
+	}
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	type record struct {
+		data       string
+		recordType uint8
+		err        error
+	}
+	records := make(chan record, 4)
+	buf := make([]byte, 1024)
+	err = poller.Start(desc, func(Event) {
+		for {
+			n, recordType, err := ReadKTLS(desc, buf)
+			if err == ErrWouldBlock {
+				return
+			}
+			records <- record{string(buf[:n]), recordType, err}
+			if err != nil && err != ErrTLSControlRecord {
+				return
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if _, err = send.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// Send an alert record: close_notify of warning level.
+	oob := make([]byte, unix.CmsgSpace(1))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_TLS
+	h.Type = tlsSetRecordType
+	h.SetLen(unix.CmsgLen(1))
+	oob[unix.CmsgLen(0)] = TLSRecordAlert
+	if err = unix.Sendmsg(sendFd, []byte{1, 0}, oob, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []record{
+		{"hello", TLSRecordApplicationData, nil},
+		{"\x01\x00", TLSRecordAlert, ErrTLSControlRecord},
+	} {
+		select {
+		case act := <-records:
+			if act != exp {
+				t.Errorf("ReadKTLS() = %+v; want %+v", act, exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no record received; want %+v", exp)
+		}
+	}
+}
+
+// enableKTLS enables kernel TLS for conn in given direction with the
+// constant keys. It skips the test if kernel TLS is not available. It
+// returns the descriptor of conn.
+func enableKTLS(t *testing.T, conn *net.TCPConn, dir int) (fd int) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(x uintptr) {
+		fd = int(x)
+		if err = unix.SetsockoptString(fd, unix.SOL_TCP, unix.TCP_ULP, "tls"); err != nil {
+			t.Skipf("kernel TLS is not available: %v", err)
+		}
+		// struct tls12_crypto_info_aes_gcm_128: version and cipher type
+		// followed by iv[8], key[16], salt[4] and rec_seq[8].
+		info := make([]byte, 40)
+		*(*uint16)(unsafe.Pointer(&info[0])) = tls12Version
+		*(*uint16)(unsafe.Pointer(&info[2])) = tlsAESGCM128
+		for i := 4; i < 32; i++ {
+			info[i] = byte(i)
+		}
+		if err = unix.SetsockoptString(fd, unix.SOL_TLS, dir, string(info)); err != nil {
+			t.Skipf("kernel TLS cipher is not available: %v", err)
+		}
+	})
+	return fd
+}
@@ -0,0 +1,48 @@
+package netpoll
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket implements token bucket rate limiting in form of generic cell rate
+// algorithm. It allows rate events per second with bursts of the same size.
+type bucket struct {
+	mu       sync.Mutex
+	interval int64
+	capacity int64
+	tat      int64 // Theoretical arrival time of the next event.
+}
+
+func newBucket(rate int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	interval := int64(time.Second) / int64(rate)
+	if interval == 0 {
+		interval = 1
+	}
+	return &bucket{
+		interval: interval,
+		capacity: interval * int64(rate),
+	}
+}
+
+// take tries to take a token from the bucket at the time now. It returns
+// zero on success or a duration to wait until the next token is available.
+func (b *bucket) take(now int64) (wait int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tat := b.tat
+	if tat < now {
+		tat = now
+	}
+	tat += b.interval
+	if over := tat - now - b.capacity; over > 0 {
+		return over
+	}
+	b.tat = tat
+
+	return 0
+}
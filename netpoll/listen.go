@@ -0,0 +1,97 @@
+package netpoll
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ListenOptions contains options for Listen().
+type ListenOptions struct {
+	// Network and Addr are passed to net.Listen() as is.
+	Network string
+	Addr    string
+
+	// ReuseAddr sets SO_REUSEADDR option of the socket before it is bound.
+	// Note that net package sets it for TCP listeners by default anyway.
+	ReuseAddr bool
+
+	// ReusePort sets SO_REUSEPORT option of the socket before it is bound,
+	// making possible for multiple listeners to bind the same address.
+	// Listen() returns ErrUnsupported if operating system does not support
+	// it.
+	ReusePort bool
+
+	// V6Only, if not nil, sets IPV6_V6ONLY option of the IPv6 socket before
+	// it is bound. Setting it to false makes the listener bound to the "::"
+	// address to accept IPv4 connections as well (with v4-mapped addresses).
+	// If nil, the default of the net package is used.
+	V6Only *bool
+
+	// Backlog is the maximum length of the pending connections queue.
+	// If zero, the default of the net package is used (which is the
+	// system's maximum).
+	Backlog int
+
+	// Event is the event the returned descriptor is created with.
+	// If zero, EventRead is used.
+	Event Event
+}
+
+// Listen creates listener configured by opts and descriptor of it for
+// further use in EventPoll methods.
+//
+// The listening socket is non-blocking and close-on-exec from birth. Unlike
+// HandleListener(), descriptor does not hold a duplicate of the listener's
+// file descriptor, but shares the listener's one. Thus closing descriptor
+// closes the listener too; the listener must not be closed while descriptor
+// is registered.
+func Listen(opts ListenOptions) (*Desc, net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			ctrlErr := c.Control(func(fd uintptr) {
+				err = setListenerSockopts(int(fd), opts)
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		},
+	}
+	ln, err := lc.Listen(context.Background(), opts.Network, opts.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		ln.Close()
+		return nil, nil, ErrNotFiler
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	fd := -1
+	err = rc.Control(func(x uintptr) {
+		fd = int(x)
+		if opts.Backlog > 0 {
+			err = setListenBacklog(fd, opts.Backlog)
+		}
+	})
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	event := opts.Event
+	if event == 0 {
+		event = EventRead
+	}
+	desc := &Desc{
+		event:  event,
+		desc:   fd,
+		closer: ln,
+	}
+	return desc, ln, nil
+}
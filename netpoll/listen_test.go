@@ -0,0 +1,136 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenDualStack(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		v6only bool
+	}{
+		{"dual", false},
+		{"v6only", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			v6only := test.v6only
+			desc, ln, err := Listen(ListenOptions{
+				Network: "tcp",
+				Addr:    "[::]:0",
+				V6Only:  &v6only,
+				Backlog: 16,
+			})
+			if err != nil {
+				t.Skipf("could not listen IPv6 address: %v", err)
+			}
+			defer desc.Close()
+
+			port := ln.Addr().(*net.TCPAddr).Port
+			conn, err := net.DialTimeout("tcp4", (&net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: port,
+			}).String(), time.Second)
+			if v6only {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("IPv4 connection established to IPv6 only listener")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			accepted, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer accepted.Close()
+			if ip := accepted.RemoteAddr().(*net.TCPAddr).IP; ip.To4() == nil {
+				t.Errorf("accepted connection from %s; want v4-mapped address", ip)
+			}
+		})
+	}
+}
+
+func TestListenPoller(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, ln, err := Listen(ListenOptions{
+		Network:   "tcp",
+		Addr:      "127.0.0.1:0",
+		ReuseAddr: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	err = poller.Start(desc, func(event Event) {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = desc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Descriptor shares the listener's file descriptor.
+	if _, err = ln.Accept(); err == nil {
+		t.Errorf("listener is not closed along with descriptor")
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	opts := ListenOptions{
+		Network:   "tcp",
+		Addr:      "127.0.0.1:0",
+		ReusePort: true,
+	}
+	desc, ln, err := Listen(opts)
+	if !reusePortSupported {
+		if err != ErrUnsupported {
+			t.Fatalf("Listen() returned %v; want %v", err, ErrUnsupported)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	// The same address could be bound again.
+	opts.Addr = ln.Addr().String()
+	desc2, _, err := Listen(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc2.Close()
+}
@@ -0,0 +1,219 @@
+package netpoll
+
+import (
+	"io"
+	"strconv"
+)
+
+// migrator is implemented by EventPoll implementations which are able to
+// move registrations to another instance.
+type migrator interface {
+	// registered returns descriptors registered at the moment.
+	registered() []*Desc
+
+	// detach stops desc registration with StopMigrated reason and returns
+	// its state once the last callback has returned.
+	detach(desc *Desc) (*migration, error)
+
+	// attach registers desc with the state previously returned by detach().
+	attach(desc *Desc, m *migration) error
+}
+
+// migration holds the state of registration being moved between pollers.
+type migration struct {
+	cb    CallbackFn
+	opts  startOptions
+	event Event
+	armed bool
+	muted bool
+}
+
+// migrate moves desc registered within from into to. It implements
+// EventPoll.Migrate() method.
+func migrate(from migrator, desc *Desc, to EventPoll) error {
+	dst, ok := to.(migrator)
+	if !ok {
+		return ErrUnsupported
+	}
+	desc.ownerMu.Lock()
+	grouped := desc.group != nil
+	desc.ownerMu.Unlock()
+	if grouped {
+		return ErrGroupMember
+	}
+
+	m, err := from.detach(desc)
+	if err != nil {
+		return err
+	}
+	if err = dst.attach(desc, m); err != nil {
+		return reattach(from, []*Desc{desc}, []*migration{m}, err)
+	}
+	return nil
+}
+
+// MigrateError is returned by Migrate() and SwapInto() when descriptors
+// could be registered neither within the new poller nor back within the old
+// one. Such descriptors are not registered anywhere (while their OnStop
+// hooks were called with StopMigrated reason), thus they must be started
+// again or closed by the caller.
+type MigrateError struct {
+	// Err is the error which caused the descriptors to be registered back
+	// within the old poller.
+	Err error
+
+	// Lost holds the descriptors which are not registered anywhere, and
+	// Errs holds the error of registering each of them back.
+	Lost []*Desc
+	Errs []error
+}
+
+// Error implements error interface.
+func (e *MigrateError) Error() string {
+	return "netpoll: " + strconv.Itoa(len(e.Lost)) + " descriptors are lost while migrating: " +
+		e.Err.Error() + " (registering back: " + e.Errs[0].Error() + ")"
+}
+
+// Unwrap returns the error which caused the descriptors to be registered
+// back.
+func (e *MigrateError) Unwrap() error {
+	return e.Err
+}
+
+// SwapConfig contains options for SwapInto().
+type SwapConfig struct {
+	// BatchSize is the maximum number of descriptors being moved at the same
+	// time, that is the number of descriptors which are already stopped in
+	// the old poller but not yet registered in the new one.
+	// If zero, 64 is used.
+	BatchSize int
+
+	// OnProgress is called after each batch with the number of descriptors
+	// moved so far and the number of descriptors left in the old poller.
+	OnProgress func(migrated, remaining int)
+
+	// Abort aborts the swap when closed. The descriptors which are not moved
+	// yet are left within the old poller and SwapInto() returns
+	// ErrSwapAborted.
+	Abort <-chan struct{}
+}
+
+func (c *SwapConfig) withDefaults() (config SwapConfig) {
+	if c != nil {
+		config = *c
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 64
+	}
+	return config
+}
+
+// SwapInto moves every registration of the old poller into the new one and
+// then closes the old poller. It makes possible to change the poller
+// configuration which could not be changed live (e.g. the number of pollers
+// within Pool or the Dispatcher) without closing the connections.
+//
+// Each descriptor is moved with its callback, options and the armed state.
+// The last callback made by the old poller returns before the first
+// callback is made by the new one, thus callbacks of a descriptor are never
+// run concurrently. The events received by the descriptor while it is being
+// moved are not lost, since the kernel reports the current readiness on
+// registration (thus readiness which was delivered by the old poller but not
+// drained yet could be reported again). Note that OnStop hooks are called
+// with StopMigrated reason for every moved descriptor.
+//
+// If some descriptor could not be moved, the descriptors of its batch which
+// are not moved yet are registered back within the old poller and the error
+// is returned, or *MigrateError if some of them could not be registered back.
+//
+// Both pollers must be created by New() or NewPool(). Otherwise
+// ErrUnsupported is returned.
+//
+// Note that SwapInto() must not be called from within a callback of the old
+// poller. After it returns, descriptors must be resumed and stopped by the
+// new poller.
+func SwapInto(old, new EventPoll, c *SwapConfig) error {
+	from, ok := old.(migrator)
+	if !ok {
+		return ErrUnsupported
+	}
+	to, ok := new.(migrator)
+	if !ok {
+		return ErrUnsupported
+	}
+	config := c.withDefaults()
+
+	var (
+		migrated int
+		batch    = make([]*migration, 0, config.BatchSize)
+		detached = make([]*Desc, 0, config.BatchSize)
+	)
+	// Descriptors could be started within the old poller during the swap,
+	// so repeat until nothing is left.
+	for descs := from.registered(); len(descs) > 0; descs = from.registered() {
+		for len(descs) > 0 {
+			select {
+			case <-config.Abort:
+				return ErrSwapAborted
+			default:
+			}
+
+			n := config.BatchSize
+			if n > len(descs) {
+				n = len(descs)
+			}
+			batch, detached = batch[:0], detached[:0]
+			for _, desc := range descs[:n] {
+				m, err := from.detach(desc)
+				if err == ErrNotRegistered {
+					// Stopped concurrently.
+					continue
+				}
+				if err != nil {
+					// Leave the descriptors detached so far within the old
+					// poller.
+					return reattach(from, detached, batch, err)
+				}
+				batch = append(batch, m)
+				detached = append(detached, desc)
+			}
+			descs = descs[n:]
+
+			for i, desc := range detached {
+				if err := to.attach(desc, batch[i]); err != nil {
+					// Return this and the rest of the batch back.
+					return reattach(from, detached[i:], batch[i:], err)
+				}
+				migrated++
+			}
+			if config.OnProgress != nil {
+				config.OnProgress(migrated, len(descs))
+			}
+		}
+	}
+
+	if c, ok := old.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// reattach registers descriptors detached from the poller back within it
+// after their migration failed with err. It returns err if all of them are
+// registered back, or *MigrateError otherwise.
+func reattach(from migrator, descs []*Desc, batch []*migration, err error) error {
+	var lost *MigrateError
+	for i, desc := range descs {
+		if e := from.attach(desc, batch[i]); e != nil {
+			if lost == nil {
+				lost = &MigrateError{Err: err}
+			}
+			lost.Lost = append(lost.Lost, desc)
+			lost.Errs = append(lost.Errs, e)
+		}
+	}
+	if lost != nil {
+		return lost
+	}
+	return err
+}
@@ -0,0 +1,671 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSwapInto(t *testing.T) {
+	n := 20000
+	if testing.Short() {
+		n = 1000
+	}
+	if max := maxOpenFiles(t); 2*n+512 > max {
+		n = (max - 512) / 2
+	}
+
+	old, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.(io.Closer).Close()
+
+	cfg := config(t)
+	cfg.Dispatcher = GoDispatcher
+	pool, err := NewPool(&PoolConfig{
+		Size:   4,
+		Config: cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	echo := startEchoPairs(t, old, n)
+	defer echo.close()
+
+	var (
+		stop = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	for _, conns := range echo.split(32) {
+		wg.Add(1)
+		go func(conns []int) {
+			defer wg.Done()
+			var seq uint64
+			for {
+				for _, fd := range conns {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					seq++
+					if err := roundTrip(fd, seq); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(conns)
+	}
+
+	var (
+		calls    int
+		migrated int
+	)
+	err = SwapInto(old, pool, &SwapConfig{
+		BatchSize: 256,
+		OnProgress: func(m, _ int) {
+			calls++
+			migrated = m
+		},
+	})
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != n {
+		t.Errorf("migrated %d descriptors; want %d", migrated, n)
+	}
+	if exp := (n + 255) / 256; calls != exp {
+		t.Errorf("OnProgress() called %d times; want %d", calls, exp)
+	}
+	if err = old.Stop(echo.descs[0]); err != ErrClosed {
+		t.Errorf("old poller was not closed: Stop() error is %v", err)
+	}
+	if act := pool.Stats().Registered; act != n {
+		t.Errorf("%d descriptors registered within the new poller; want %d", act, n)
+	}
+
+	// Make sure every connection is served by the new poller.
+	for i, fd := range echo.conns {
+		if err = roundTrip(fd, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Logf("migrated %d live connections", n)
+}
+
+func TestSwapIntoAbort(t *testing.T) {
+	const n = 100
+
+	old, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.(io.Closer).Close()
+
+	next, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.(io.Closer).Close()
+
+	var stops uint32
+	echo := startEchoPairs(t, old, n, Options{
+		OnStop: func(_ *Desc, reason StopReason) {
+			if reason == StopMigrated {
+				atomic.AddUint32(&stops, 1)
+			}
+		},
+	})
+	defer echo.close()
+
+	var (
+		abort    = make(chan struct{})
+		migrated int
+	)
+	err = SwapInto(old, next, &SwapConfig{
+		BatchSize: 10,
+		Abort:     abort,
+		OnProgress: func(m, _ int) {
+			migrated = m
+			if m >= 30 {
+				close(abort)
+			}
+		},
+	})
+	if err != ErrSwapAborted {
+		t.Fatalf("SwapInto() error is %v; want %v", err, ErrSwapAborted)
+	}
+	if migrated != 30 {
+		t.Errorf("migrated %d descriptors; want %d", migrated, 30)
+	}
+	if act := next.Stats().Registered; act != migrated {
+		t.Errorf("%d descriptors registered within the new poller; want %d", act, migrated)
+	}
+	if act := old.Stats().Registered; act != n-migrated {
+		t.Errorf("%d descriptors left within the old poller; want %d", act, n-migrated)
+	}
+	if act := atomic.LoadUint32(&stops); int(act) != migrated {
+		t.Errorf("OnStop() called with StopMigrated %d times; want %d", act, migrated)
+	}
+	for i, fd := range echo.conns {
+		if err = roundTrip(fd, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSwapIntoDetachError(t *testing.T) {
+	const n = 10
+
+	p, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.(io.Closer).Close()
+
+	next, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.(io.Closer).Close()
+
+	echo := startEchoPairs(t, p, n)
+	defer echo.close()
+
+	errDetach := fmt.Errorf("detach error")
+	old := &failingDetach{
+		poller: p.(*poller),
+		desc:   echo.descs[n/2],
+		err:    errDetach,
+	}
+	if err = SwapInto(old, next, &SwapConfig{BatchSize: n}); err != errDetach {
+		t.Fatalf("SwapInto() error is %v; want %v", err, errDetach)
+	}
+	// The whole batch must be left within the old poller.
+	if act := next.Stats().Registered; act != 0 {
+		t.Errorf("%d descriptors registered within the new poller; want 0", act)
+	}
+	if act := p.Stats().Registered; act != n {
+		t.Errorf("%d descriptors left within the old poller; want %d", act, n)
+	}
+	for i, fd := range echo.conns {
+		if err = roundTrip(fd, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// failingDetach is a poller which fails to detach desc with err.
+type failingDetach struct {
+	*poller
+	desc *Desc
+	err  error
+}
+
+func (f *failingDetach) detach(desc *Desc) (*migration, error) {
+	if desc == f.desc {
+		return nil, f.err
+	}
+	return f.poller.detach(desc)
+}
+
+// failingAttach is a poller which fails to attach any descriptor with err.
+type failingAttach struct {
+	*poller
+	err error
+}
+
+func (f *failingAttach) attach(*Desc, *migration) error {
+	return f.err
+}
+
+func TestMigrateLost(t *testing.T) {
+	a, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.(io.Closer).Close()
+
+	b, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.(io.Closer).Close()
+
+	echo := startEchoPairs(t, a, 1)
+	defer echo.close()
+
+	var (
+		errFrom = fmt.Errorf("attach error of the old poller")
+		errTo   = fmt.Errorf("attach error of the new poller")
+		from    = &failingAttach{poller: a.(*poller), err: errFrom}
+		to      = &failingAttach{poller: b.(*poller), err: errTo}
+		desc    = echo.descs[0]
+	)
+	err = migrate(from, desc, to)
+	lost, ok := err.(*MigrateError)
+	if !ok {
+		t.Fatalf("migrate() error is %v; want *MigrateError", err)
+	}
+	if lost.Err != errTo {
+		t.Errorf("MigrateError.Err is %v; want %v", lost.Err, errTo)
+	}
+	if len(lost.Lost) != 1 || lost.Lost[0] != desc || lost.Errs[0] != errFrom {
+		t.Errorf("MigrateError lost %v with %v; want %v with %v", lost.Lost, lost.Errs, desc, errFrom)
+	}
+}
+
+// failingDel is a backend which fails to delete any descriptor with err.
+type failingDel struct {
+	backend
+	err error
+}
+
+func (f failingDel) del(int, Event) error {
+	return f.err
+}
+
+func TestMigrateDetachError(t *testing.T) {
+	a, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.(io.Closer).Close()
+	errDel := fmt.Errorf("del error")
+	pa := a.(*poller)
+	pa.backend = failingDel{pa.backend, errDel}
+	defer func() {
+		pa.backend = pa.backend.(failingDel).backend
+	}()
+
+	b, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+	if err = a.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Migrate(desc, b); err != errDel {
+		t.Fatalf("Migrate() error is %v; want %v", err, errDel)
+	}
+	if n := a.Stats().Registered; n != 1 {
+		t.Errorf("%d descriptors left within the old poller; want 1", n)
+	}
+	if n := b.Stats().Registered; n != 0 {
+		t.Errorf("%d descriptors registered within the new poller; want 0", n)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	const n = 16
+
+	a, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.(io.Closer).Close()
+
+	cfg := config(t)
+	cfg.Dispatcher = GoDispatcher
+	b, err := NewPool(&PoolConfig{
+		Size:   2,
+		Config: cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var stops uint32
+	echo := startEchoPairs(t, a, n, Options{
+		OnStop: func(_ *Desc, reason StopReason) {
+			if reason == StopMigrated {
+				atomic.AddUint32(&stops, 1)
+			}
+		},
+	})
+	defer echo.close()
+
+	var (
+		stop  = make(chan struct{})
+		wg    sync.WaitGroup
+		trips uint64
+	)
+	for _, fd := range echo.conns {
+		wg.Add(1)
+		go func(fd int) {
+			defer wg.Done()
+			for seq := uint64(0); ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := roundTrip(fd, seq); err != nil {
+					t.Error(err)
+					return
+				}
+				atomic.AddUint64(&trips, 1)
+			}
+		}(fd)
+	}
+
+	// Move descriptors back and forth while they are served. Lost event
+	// makes the client to time out.
+	var (
+		rounds   uint32
+		from, to = EventPoll(a), EventPoll(b)
+	)
+	for end := time.Now().Add(200 * time.Millisecond); time.Now().Before(end); rounds++ {
+		for _, desc := range echo.descs {
+			if err := from.Migrate(desc, to); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+		from, to = to, from
+	}
+	close(stop)
+	wg.Wait()
+	t.Logf("%d round trips made during %d rounds of migration", trips, rounds)
+
+	if act := atomic.LoadUint32(&stops); act != rounds*n {
+		t.Errorf("OnStop() called with StopMigrated %d times; want %d", act, rounds*n)
+	}
+	if act := from.Stats().Registered; act != n {
+		t.Errorf("%d descriptors registered within the last poller; want %d", act, n)
+	}
+	if act := to.Stats().Registered; act != 0 {
+		t.Errorf("%d descriptors left within the previous poller; want %d", act, 0)
+	}
+}
+
+func TestMigrateOneShot(t *testing.T) {
+	a, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.(io.Closer).Close()
+
+	b, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+	defer desc.Close()
+
+	called := make(chan struct{}, 2)
+	err = a.Start(desc, func(event Event) {
+		if event&EventRead != 0 {
+			called <- struct{}{}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCalls := func(exp int) {
+		t.Helper()
+		var act int
+		timeout := time.After(50 * time.Millisecond)
+	loop:
+		for {
+			select {
+			case <-called:
+				act++
+			case <-timeout:
+				break loop
+			}
+		}
+		if act != exp {
+			t.Fatalf("callback called %d times; want %d", act, exp)
+		}
+	}
+
+	// Make the descriptor disarmed by the one-shot event.
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(1)
+
+	if err = a.Migrate(desc, b); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(0)
+	if err = b.Resume(desc); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(1)
+
+	// Armed descriptor receives the readiness appeared while it was moved.
+	// The data is read before Resume(), otherwise it is reported by b.
+	unix.Read(r, make([]byte, 16))
+	if err = b.Resume(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Migrate(desc, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(1)
+	if err = a.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateError(t *testing.T) {
+	a, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.(io.Closer).Close()
+
+	closed, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.(io.Closer).Close()
+
+	echo := startEchoPairs(t, a, 2)
+	defer echo.close()
+
+	desc, free := echo.descs[0], echo.descs[1]
+	if err = a.Stop(free); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Migrate(free, a); err != ErrNotRegistered {
+		t.Errorf("Migrate() of stopped descriptor error is %v; want %v", err, ErrNotRegistered)
+	}
+	if err = a.Migrate(desc, struct{ EventPoll }{a}); err != ErrUnsupported {
+		t.Errorf("Migrate() into foreign poller error is %v; want %v", err, ErrUnsupported)
+	}
+
+	g := a.NewGroup()
+	if err = g.Start(free, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Migrate(free, a); err != ErrGroupMember {
+		t.Errorf("Migrate() of group member error is %v; want %v", err, ErrGroupMember)
+	}
+	if err = g.StopAll(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Descriptor is registered back when it could not be moved.
+	if err = a.Migrate(desc, closed); err == nil {
+		t.Fatalf("no error when moving into closed poller")
+	}
+	if desc.Owner() != a {
+		t.Errorf("descriptor is not registered back")
+	}
+	if err = roundTrip(echo.conns[0], 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echoPairs holds pairs of connected descriptors. Server ends are
+// registered within a poller and echo the received data back to the client
+// ends, which are blocking.
+type echoPairs struct {
+	descs []*Desc
+	peers []*Desc
+	conns []int
+}
+
+func startEchoPairs(tb testing.TB, poller EventPoll, n int, opts ...StartOption) *echoPairs {
+	e := &echoPairs{
+		descs: make([]*Desc, 0, n),
+		peers: make([]*Desc, 0, n),
+		conns: make([]int, 0, n),
+	}
+	for i := 0; i < n; i++ {
+		desc, peer, _, _, err := NewSyntheticPair()
+		if err != nil {
+			e.close()
+			tb.Fatal(err)
+		}
+		e.descs = append(e.descs, desc)
+
+		e.peers = append(e.peers, peer)
+
+		fd := peer.Fd()
+		e.conns = append(e.conns, fd)
+		if err = unix.SetNonblock(fd, false); err != nil {
+			e.close()
+			tb.Fatal(err)
+		}
+		tv := unix.NsecToTimeval(int64(5 * time.Second))
+		if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			e.close()
+			tb.Fatal(err)
+		}
+
+		buf := make([]byte, 64)
+		err = poller.StartWithOptions(desc, func(event Event) {
+			if event&EventRead == 0 {
+				return
+			}
+			n, err := unix.Read(desc.Fd(), buf)
+			if err != nil || n == 0 {
+				return
+			}
+			for p := buf[:n]; len(p) > 0; {
+				m, err := unix.Write(desc.Fd(), p)
+				if err == syscall.EAGAIN || err == syscall.EINTR {
+					continue
+				}
+				if err != nil {
+					return
+				}
+				p = p[m:]
+			}
+		}, opts...)
+		if err != nil {
+			e.close()
+			tb.Fatal(err)
+		}
+	}
+	return e
+}
+
+// split splits client ends into at most n groups.
+func (e *echoPairs) split(n int) (groups [][]int) {
+	size := (len(e.conns) + n - 1) / n
+	for p := e.conns; len(p) > 0; {
+		m := size
+		if m > len(p) {
+			m = len(p)
+		}
+		groups = append(groups, p[:m])
+		p = p[m:]
+	}
+	return groups
+}
+
+func (e *echoPairs) close() {
+	for _, desc := range e.descs {
+		desc.Close()
+	}
+	for _, peer := range e.peers {
+		peer.Close()
+	}
+}
+
+// roundTrip writes the message with given sequence number to the blocking
+// client end fd and checks that exactly the same bytes are echoed back.
+func roundTrip(fd int, seq uint64) error {
+	var msg, resp [16]byte
+	binary.LittleEndian.PutUint64(msg[:8], uint64(fd))
+	binary.LittleEndian.PutUint64(msg[8:], seq)
+
+	if _, err := unix.Write(fd, msg[:]); err != nil {
+		return err
+	}
+	for n := 0; n < len(resp); {
+		m, err := unix.Read(fd, resp[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		n += m
+	}
+	if !bytes.Equal(msg[:], resp[:]) {
+		return fmt.Errorf("echo mismatch: sent %x; received %x", msg, resp)
+	}
+	return nil
+}
+
+// maxOpenFiles raises the soft limit of open files up to the hard one and
+// returns it.
+func maxOpenFiles(tb testing.TB) int {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		tb.Fatal(err)
+	}
+	if lim.Cur < lim.Max {
+		lim.Cur = lim.Max
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return int(lim.Cur)
+}
@@ -41,13 +41,28 @@ The Poller describes os-dependent network poller:
 		}
 	})
 
+Within each batch of events received from the kernel, callbacks are called
+starting from a rotating offset, thus no descriptor is always serviced first.
+The poller does not age descriptors across batches itself: the fairness
+between batches is provided by the kernel, which puts reported
+level-triggered descriptors to the tail of its ready list. Thus a
+level-triggered descriptor which stays ready is serviced within a bounded
+number of wait cycles, even if more descriptors are ready all the time than
+fit in a single batch. Edge-triggered descriptors are reported once per
+readiness change anyway.
+
 Currently, Poller is implemented only for Linux.
 */
 package netpoll
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 var (
@@ -64,25 +79,202 @@ var (
 	// registered within the poller instance.
 	ErrRegistered = fmt.Errorf("file descriptor is already registered in poller instance")
 
+	// ErrAlreadyRegistered is returned by EventPoll Start() method to
+	// indicate that desc is registered within some other poller instance.
+	// Use Desc.Owner() to get that instance.
+	ErrAlreadyRegistered = fmt.Errorf("file descriptor is already registered in other poller instance")
+
 	// ErrNotRegistered is returned by EventPoll Stop() and Resume() methods to
 	// indicate that connection with the same underlying file descriptor was
 	// not registered before within the poller instance.
 	ErrNotRegistered = fmt.Errorf("file descriptor was not registered before in poller instance")
+
+	// ErrDescClosed is returned by EventPoll Resume() method to indicate
+	// that the descriptor's file was closed while it was registered. Such
+	// descriptor is removed from the poller.
+	ErrDescClosed = fmt.Errorf("file descriptor was closed while registered in poller instance")
+
+	// ErrNotExternalLoop is returned by Iterate() methods to indicate that
+	// instance runs its own wait loop.
+	ErrNotExternalLoop = fmt.Errorf("poller is not configured to be run by external loop")
+
+	// ErrSwapAborted is returned by SwapInto() to indicate that the swap was
+	// aborted and some descriptors are left within the old poller.
+	ErrSwapAborted = fmt.Errorf("poller swap aborted")
+
+	// ErrInvalidLowWater is returned by EventPoll StartWithOptions() method
+	// to indicate that Options.ReadLowWater is negative or the descriptor is
+	// not a stream socket.
+	ErrInvalidLowWater = fmt.Errorf("invalid read low-water mark")
+
+	// ErrWouldBlock is returned by read helpers to indicate that there is no
+	// data available at the moment.
+	ErrWouldBlock = fmt.Errorf("operation would block")
+
+	// ErrGroupMember is returned by Group Start() method to indicate that
+	// the descriptor already belongs to another group. It is also returned
+	// by Migrate(), since group members must stay within the same poller.
+	ErrGroupMember = fmt.Errorf("file descriptor already belongs to a group")
+
+	// ErrTLSControlRecord is returned by ReadKTLS() to indicate that a TLS
+	// control record (e.g. an alert) was read instead of application data.
+	ErrTLSControlRecord = fmt.Errorf("tls control record received")
+
+	// ErrWaitTimeout is returned by WaitOne() to indicate that no event was
+	// received within the timeout.
+	ErrWaitTimeout = fmt.Errorf("timed out waiting for event")
+
+	// ErrDrainTimeout is passed to the Drain() completion callback to
+	// indicate that the peer did not close its side of the connection
+	// within the timeout.
+	ErrDrainTimeout = fmt.Errorf("timed out draining connection")
+
+	// ErrUnsupportedEvent is returned by EventPoll Start() and Resume()
+	// methods to indicate that the backend could not observe the descriptor
+	// with given Event flags (e.g. EventEdgeTriggered on AIX, see
+	// Capabilities.EdgeTriggered).
+	ErrUnsupportedEvent = fmt.Errorf("event flags are not supported by poller backend")
+
+	// ErrUnsupported is returned to indicate that operation is not supported
+	// on current operating system.
+	ErrUnsupported = fmt.Errorf("operation is not supported on this operating system")
+
+	// ErrWatchLimit is returned by WatchLimitError.Unwrap(). It denotes that
+	// the per-user limit of epoll watches is reached.
+	ErrWatchLimit = fmt.Errorf("epoll watch limit reached")
+
+	// ErrDeadlineExceeded is returned by BlockingConn methods to indicate
+	// that the deadline set for the operation has expired. It implements
+	// net.Error with Timeout() reporting true.
+	ErrDeadlineExceeded error = deadlineExceededError{}
 )
 
+// deadlineExceededError is the type of ErrDeadlineExceeded.
+type deadlineExceededError struct{}
+
+func (deadlineExceededError) Error() string   { return "i/o timeout" }
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+// Error describes a failed operation on a descriptor, preserving the
+// context of the underlying system call error.
+//
+// Errors of the kernel calls made by EventPoll methods (e.g. EPERM returned
+// by epoll_ctl(2) for a regular file) and by descriptor constructors are
+// returned as *Error. Sentinel errors describing misuse of the poller (e.g.
+// ErrRegistered or ErrClosed) are returned as is.
+type Error struct {
+	// Op is the operation which caused the error, such as "start", "stop",
+	// "resume", "modify", "wait" or "handle".
+	Op string
+
+	// Fd is the file descriptor the operation was made on. It is the
+	// poller's descriptor for the "wait" operation.
+	Fd int
+
+	// Event is the set of events the operation was made with, if any.
+	Event Event
+
+	// Label is the label of the descriptor (see Desc.SetLabel()), if any.
+	Label string
+
+	// Err is the underlying error, usually syscall.Errno or
+	// *os.SyscallError.
+	Err error
+}
+
+func (e *Error) Error() string {
+	s := "netpoll: " + e.Op + " fd " + strconv.Itoa(e.Fd)
+	if e.Label != "" {
+		s += " " + strconv.Quote(e.Label)
+	}
+	if e.Event != 0 {
+		s += " (" + e.Event.String() + ")"
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the underlying error is temporary.
+func (e *Error) Temporary() bool {
+	return temporaryErr(e.Err)
+}
+
+// WatchLimitError is the underlying error of *Error returned by Start() on
+// linux when epoll_ctl(2) fails with ENOSPC (even after retries made due to
+// Config.CtlRetry), that is when the per-user limit of epoll watches is
+// exhausted. The limit is raised by the fs.epoll.max_user_watches sysctl.
+type WatchLimitError struct {
+	// Limit is the value of /proc/sys/fs/epoll/max_user_watches at the
+	// moment of the failure, or -1 if it could not be read.
+	Limit int
+}
+
+func (e *WatchLimitError) Error() string {
+	if e.Limit < 0 {
+		return ErrWatchLimit.Error() + " (see fs.epoll.max_user_watches sysctl)"
+	}
+	return ErrWatchLimit.Error() + " (fs.epoll.max_user_watches is " + strconv.Itoa(e.Limit) + ")"
+}
+
+// Unwrap returns ErrWatchLimit.
+func (e *WatchLimitError) Unwrap() error {
+	return ErrWatchLimit
+}
+
+// wrapErr wraps system call error err into *Error. Other errors (e.g.
+// sentinel ones) are returned as is.
+func wrapErr(op string, fd int, event Event, err error) error {
+	switch err.(type) {
+	case syscall.Errno, *os.SyscallError, *WatchLimitError:
+		return &Error{Op: op, Fd: fd, Event: event, Err: err}
+	}
+	return err
+}
+
+// wrapDescErr is like wrapErr, but it also attaches the label of desc.
+func wrapDescErr(op string, desc *Desc, event Event, err error) error {
+	err = wrapErr(op, desc.Fd(), event, err)
+	if e, ok := err.(*Error); ok {
+		e.Label = desc.Label()
+	}
+	return err
+}
+
 // Event represents netpoll configuration bit mask.
 type Event uint16
 
 // Event values that denote the type of events that caller want to receive.
 const (
 	EventRead  Event = 0x1
-	EventWrite       = 0x2
+	EventWrite Event = 0x2
+
+	// EventPri denotes priority data: TCP out-of-band (urgent) data or
+	// changes of some device and sysfs files (e.g. GPIO lines values). It
+	// maps to EPOLLPRI on linux and to EVFILT_EXCEPT with NOTE_OOB on darwin
+	// and dragonfly. Other platforms do not support it; Start() returns
+	// ErrUnsupported then (see Capabilities.Pri).
+	//
+	// Note that sysfs files report EventErr along with EventPri on each
+	// change. To receive the next change, the file must be read again from
+	// the beginning.
+	EventPri Event = 0x400
 )
 
 // Event values that configure the EventPoll's behavior.
 const (
 	EventOneShot       Event = 0x4
-	EventEdgeTriggered       = 0x8
+	EventEdgeTriggered Event = 0x8
+
+	// EventWakeup prevents the system from entering suspend while an event
+	// for the descriptor is pending or being handled. On linux it maps to
+	// EPOLLWAKEUP, which requires the CAP_BLOCK_SUSPEND capability; without it
+	// the kernel silently ignores the flag. It is a no-op on other platforms.
+	EventWakeup Event = 0x100
 )
 
 // Event values that could be passed to CallbackFn as additional information
@@ -93,17 +285,31 @@ const (
 	// Usually (depending on operating system and its version) the EventReadHup
 	// or EventWriteHup are also set int Event value.
 	EventHup      Event = 0x10
-	EventReadHup        = 0x20
-	EventWriteHup       = 0x40
-	EventErr            = 0x80
+	EventReadHup  Event = 0x20
+	EventWriteHup Event = 0x40
+	EventErr      Event = 0x80
+	// EventClosing is a synthetic event passed to every registered callback
+	// by CloseContext() before the EventPoll instance is closed. It makes
+	// possible for handlers to gracefully finish their connections (e.g.
+	// to send goodbye frames).
+	EventClosing Event = 0x4000
+	// EventTimeout is a synthetic event passed to the callback when the
+	// deadline set by Desc.SetReadDeadline() or Desc.SetWriteDeadline()
+	// expires. It is delivered along with EventRead or EventWrite (or both)
+	// denoting which deadline has expired.
+	EventTimeout Event = 0x800
 	// EventPollClosed is a special Event value the receipt of which means that the
 	// EventPoll instance is closed.
-	EventPollClosed = 0x8000
+	EventPollClosed Event = 0x8000
 )
 
-// String returns a string representation of Event.
+// String returns a string representation of Event in form of
+// "EventRead|EventEdgeTriggered". Bits without names are rendered as a hex
+// value, e.g. "EventRead|0x200". Zero Event is rendered as "0".
 func (ev Event) String() (str string) {
+	unknown := ev
 	name := func(event Event, name string) {
+		unknown &^= event
 		if ev&event == 0 {
 			return
 		}
@@ -115,41 +321,74 @@ func (ev Event) String() (str string) {
 
 	name(EventRead, "EventRead")
 	name(EventWrite, "EventWrite")
+	name(EventPri, "EventPri")
 	name(EventOneShot, "EventOneShot")
 	name(EventEdgeTriggered, "EventEdgeTriggered")
+	name(EventWakeup, "EventWakeup")
 	name(EventReadHup, "EventReadHup")
 	name(EventWriteHup, "EventWriteHup")
 	name(EventHup, "EventHup")
 	name(EventErr, "EventErr")
+	name(EventTimeout, "EventTimeout")
+	name(EventClosing, "EventClosing")
 	name(EventPollClosed, "EventPollClosed")
 
+	// Render the bits without names as a single hex value.
+	if unknown != 0 {
+		if str != "" {
+			str += "|"
+		}
+		str += fmt.Sprintf("%#x", uint16(unknown))
+	}
+	if str == "" {
+		str = "0"
+	}
+
 	return
 }
 
-// EventPoll describes an object that implements logic of polling connections for
-// i/o events such as availability of read() or write() operations.
-type EventPoll interface {
+// Starter is the core subset of EventPoll methods. Libraries which only
+// need to observe descriptors should accept Starter (or declare the same
+// interface by themselves) rather than EventPoll, and discover the other
+// features by type assertions to the optional interfaces such as Modifier,
+// BatchStarter or Closer. See ModifyIfSupported() for example.
+//
+// Compatibility policy: Starter and the optional interfaces are never
+// changed once released. EventPoll gets new methods as new features are
+// added, thus only packages implementing EventPoll by themselves (e.g.
+// wrappers and mocks) may break on upgrade.
+type Starter interface {
 	// Start adds desc to the observation list.
 	//
 	// Note that if desc was configured with OneShot event, then poller will
 	// remove it from its observation list. If you will be interested in
 	// receiving events after the callback, call Resume(desc).
 	//
-	// Note that Resume() call directly inside desc's callback could cause
-	// deadlock.
-	//
 	// Note that multiple calls with same desc will produce unexpected
 	// behavior.
 	Start(*Desc, CallbackFn) error
 
 	// Stop removes desc from the observation list.
 	//
+	// No callback of desc is started after Stop returns, even if its event
+	// was already received from the kernel within the batch being
+	// dispatched. The callback which is running at the moment Stop is
+	// called is not interrupted; use Options.OnStop hook to know when it
+	// returns.
+	//
+	// Stop could be called from within the callback of desc: it returns
+	// without waiting for the callback, which is the last one made for
+	// desc, and Options.AutoResume is cancelled. Then desc could be closed
+	// or started again right away. The same holds for StopAndClose() and
+	// desc.Close().
+	//
 	// Note that it does not call desc.Close().
 	Stop(*Desc) error
 
 	// Resume enables observation of desc.
 	//
-	// It is useful when desc was configured with EventOneShot.
+	// It is useful when desc was configured with EventOneShot or was muted
+	// after hang up event (see Options.StopOnHup).
 	// It should be called only after Start().
 	//
 	// Note that if there no need to observe desc anymore, you should call
@@ -157,6 +396,235 @@ type EventPoll interface {
 	Resume(*Desc) error
 }
 
+// Modifier is an optional interface of Starter implementations which could
+// change the events of registered descriptors in place.
+type Modifier interface {
+	// ModifyEvent changes the set of events desc is observed for. It
+	// affects the current registration only, desc itself is left unchanged.
+	//
+	// It returns ErrNotRegistered if desc was not started before.
+	ModifyEvent(*Desc, Event) error
+}
+
+// BatchStarter is an optional interface of Starter implementations which
+// could deliver ready descriptors in batches.
+type BatchStarter interface {
+	// SetBatchHandler switches the poller to the batch mode: instead of
+	// calling callbacks of descriptors one by one, all descriptors reported
+	// ready by a single wait iteration are passed to fn at once, each
+	// descriptor once with all its events received by the iteration. Passing
+	// nil switches back to the callbacks.
+	//
+	// Descriptors still must be started to be observed, but their callbacks
+	// may be nil then. In the batch mode events are delivered as they are
+	// received from the kernel: the per-descriptor features (coalescing,
+	// rate limits, muting after hang up and so on) are not applied, and
+	// one-shot descriptors must be resumed as usual. EventPollClosed is
+	// still passed to callbacks.
+	//
+	// The fn is called from the goroutine waiting for events (or from
+	// Iterate()). Pool calls it from the goroutines of all its pollers
+	// concurrently.
+	SetBatchHandler(fn BatchHandler)
+}
+
+// Closer is an optional interface of Starter implementations which could be
+// closed. All pollers of this package implement it.
+type Closer interface {
+	// Close stops the poller. EventPollClosed is passed to every registered
+	// callback.
+	Close() error
+}
+
+// EventPoll describes an object that implements logic of polling connections for
+// i/o events such as availability of read() or write() operations.
+//
+// EventPoll methods are safe for concurrent use by multiple goroutines,
+// including the callbacks being run by the poller. That is, Start(), Stop(),
+// Resume() and ModifyEvent() could be called from any goroutine at any time
+// without external synchronization. The exceptions are Barrier(), which must
+// not be called from within a callback, and Iterate(), which must not be
+// called concurrently with itself.
+type EventPoll interface {
+	Starter
+	Modifier
+	BatchStarter
+
+	// StopAndClose removes desc from the observation list and closes it,
+	// in the order that is easy to get wrong otherwise. If the callback is
+	// running (including the case when StopAndClose is called from within
+	// it), desc is closed right after it (and the OnStop hook) returns;
+	// otherwise it is closed before StopAndClose returns. Thus the file
+	// descriptor is never closed under the running callback and its number
+	// can not be reused by another file while some event is still handled.
+	//
+	// It returns ErrNotRegistered and leaves desc open if desc is not
+	// registered, e.g. when it is stopped concurrently by another teardown
+	// path; only the path that stopped desc closes it.
+	StopAndClose(*Desc) error
+
+	// StopAll stops all descriptors registered within the poller at the
+	// moment, the same as Stop() does, except that their OnStop hooks are
+	// called with StopReset reason. Unlike Close(), it leaves the poller
+	// running, thus new descriptors could be started right away, e.g. to
+	// reconfigure the poller without losing its wait loop.
+	//
+	// It returns the first error of stopping descriptors, while all of them
+	// are stopped anyway.
+	StopAll() error
+
+	// NewGroup creates an empty group of descriptors to be started within
+	// this poller and stopped at once by Group.StopAll().
+	NewGroup() *Group
+
+	// SetDeliveryMask sets the events desc's callback is allowed to
+	// receive. Events not in mask are dropped from the received ones before
+	// delivery, and the callback is not called at all if nothing is left.
+	// Unlike ModifyEvent() it does not touch the kernel's registration,
+	// thus it is cheap enough to be used for transient filtering, e.g. to
+	// ignore writability while there is nothing to write. Pass ^Event(0)
+	// to deliver everything again (which is the default).
+	//
+	// EventClosing and EventPollClosed are never dropped. Note that the
+	// kernel still reports masked events: level-triggered descriptor keeps
+	// being reported while ready, and one-shot descriptor must be resumed
+	// even if its event was dropped.
+	//
+	// It affects the current registration only and returns
+	// ErrNotRegistered if desc was not started before.
+	SetDeliveryMask(*Desc, Event) error
+
+	// SetCoalesce sets the coalescing window of desc, the same as
+	// Options.CoalesceWindow does at start: after the callback is called,
+	// readiness reported within the window is held and is delivered by a
+	// single callback when the window ends. Unlike the rate limits, no
+	// events are dropped but they are delayed by at most window. Zero
+	// window disables coalescing.
+	//
+	// The new window takes effect from the next callback. It affects the
+	// current registration only and returns ErrNotRegistered if desc was
+	// not started before.
+	SetCoalesce(desc *Desc, window time.Duration) error
+
+	// SetLowWater sets the read low-water mark of desc, the same as
+	// Options.ReadLowWater does at start: desc is reported as ready for
+	// reading only when at least n bytes are buffered. Zero resets the mark
+	// to the kernel's default of a single byte.
+	//
+	// On kqueue it sets NOTE_LOWAT of the read filter. On linux it sets
+	// SO_RCVLOWAT, which epoll honors for TCP sockets only; for the other
+	// sockets ErrInvalidLowWater is returned. It returns ErrUnsupported
+	// where read low-water marks are not supported at all (see
+	// Capabilities.ReadLowWater), and ErrNotRegistered if desc was not
+	// started before.
+	SetLowWater(desc *Desc, n int) error
+
+	// Park moves desc into the parked state, which is intended for the
+	// large number of mostly idle connections. Parked descriptor is
+	// observed for readability only, as a level-triggered one-shot one,
+	// just to detect any activity or the hang up of the connection. On the
+	// first event it is promoted back automatically: its registration is
+	// restored with all its events, and the event is passed to the
+	// callback, limited to the events desc is registered for, hang ups and
+	// errors. Writability is not observed while desc is parked; it is
+	// reported by the kernel after promotion.
+	//
+	// ModifyEvent() and SetLowWater() called for parked desc take effect on
+	// its promotion. Migrate() registers desc within another poller as
+	// promoted. Parking of the parked desc has no effect. See also
+	// Config.ParkIdle and Stats.Parked.
+	//
+	// It returns ErrNotRegistered if desc was not started before.
+	Park(desc *Desc) error
+
+	// Migrate moves desc with its callback, options, events and the armed
+	// state into the poller to, e.g. to rebalance the load between pollers.
+	// The registration is stopped with StopMigrated reason and the last
+	// callback made by this poller returns before desc is registered within
+	// to, thus callbacks are never run concurrently.
+	//
+	// Events are not lost: readiness which appeared while desc was being
+	// moved is reported by to on registration, the same as on Start(),
+	// while one-shot descriptor which was not resumed after its last event
+	// stays disarmed until Resume() is called on to. Note that the current
+	// readiness is reported on registration even if it was already
+	// delivered by this poller, e.g. edge-triggered readiness which was not
+	// drained yet is reported again.
+	//
+	// If desc could not be registered within to, it is registered within
+	// this poller back and the error is returned, or *MigrateError if that
+	// failed as well. It returns
+	// ErrNotRegistered if desc was not started before, ErrGroupMember if
+	// desc belongs to a Group and ErrUnsupported if to is not created by
+	// New() or NewPool().
+	//
+	// Note that it waits for the running callback of desc to return, thus
+	// it must not be called from that callback.
+	Migrate(desc *Desc, to EventPoll) error
+
+	// StartWithOptions adds desc to the observation list just like Start()
+	// does, but configures the registration with given options: Options
+	// value or single options like WithKey() or WithAutoResume(). Options
+	// are applied in order, so the later ones take precedence.
+	StartWithOptions(*Desc, CallbackFn, ...StartOption) error
+
+	// Stats returns runtime statistics of the poller.
+	Stats() Stats
+
+	// Capabilities returns features supported by the poller's backend on
+	// the running system.
+	Capabilities() Capabilities
+
+	// Wakeup wakes up the wait loop, which then calls Config.OnWakeup from
+	// its goroutine. It is cheap to be called frequently from many
+	// goroutines: calls made while the previous wakeup is not handled yet
+	// are coalesced without system calls, and the loop drains all pending
+	// wakeups by a single read. Thus every Wakeup() call is followed by at
+	// least one OnWakeup call, but not necessary by a separate one (see
+	// Stats.CoalescedWakeups).
+	Wakeup() error
+
+	// DumpEvents writes the callback calls recorded by the poller to w in
+	// chronological order. It writes nothing if Config.RecordEvents is
+	// zero.
+	DumpEvents(w io.Writer, format DumpFormat) error
+
+	// DumpEventsFor is like DumpEvents() but writes the records of desc's
+	// file descriptor only. Records of the previous registrations of the
+	// same file descriptor number are distinguished by their generation.
+	DumpEventsFor(w io.Writer, desc *Desc, format DumpFormat) error
+
+	// Barrier blocks until all callbacks being run at the moment return. If
+	// fn is not nil, it is called after that while no other callbacks are
+	// dispatched. That is, it gives a safe point to mutate the state shared
+	// with callbacks.
+	//
+	// Note that Barrier() call inside a callback causes deadlock.
+	Barrier(fn func())
+
+	// PollerFd returns the file descriptor of underlying epoll or kqueue
+	// instance. It becomes readable when some events are ready to be
+	// handled, thus the poller could be embedded into another event loop.
+	// See Config.ExternalLoop.
+	PollerFd() (int, error)
+
+	// Iterate waits for events for at most timeout and runs callbacks of
+	// ready descriptors. Negative timeout means infinite waiting.
+	//
+	// It must be called only when poller was created with
+	// Config.ExternalLoop set. Otherwise ErrNotExternalLoop is returned.
+	// It returns ErrClosed if the poller was closed.
+	//
+	// Note that Iterate() must not be called concurrently.
+	Iterate(timeout time.Duration) error
+
+	// Export returns the state of every registration made at the moment,
+	// e.g. to pass the descriptors to another process and re-register them
+	// there by Restore(). The descriptors the poller uses internally are
+	// not included.
+	Export() ([]DescState, error)
+}
+
 // CallbackFn is a function that will be called on kernel i/o event
 // notification.
 type CallbackFn func(Event)
@@ -164,7 +632,281 @@ type CallbackFn func(Event)
 // Config contains options for EventPoll configuration.
 type Config struct {
 	// OnWaitError will be called from goroutine, waiting for events.
-	OnWaitError func(error)
+	// If it returns true, the wait loop continues. Otherwise the loop stops
+	// and no more events are delivered.
+	//
+	// Use StopOnWaitError() to adapt handlers of the former func(error)
+	// signature.
+	OnWaitError func(error) bool
+
+	// Dispatcher is used to run callbacks of ready descriptors.
+	// If nil, InlineDispatcher is used.
+	Dispatcher Dispatcher
+
+	// MaxEventsPerSecond limits the aggregate rate of callback calls made by
+	// the poller. It works in the same way as Options.MaxEventsPerSecond.
+	MaxEventsPerSecond int
+
+	// OnThrottled is called when descriptor gets disarmed because its own or
+	// the poller's rate limit is exceeded. It may be used to close
+	// connections of misbehaving peers.
+	//
+	// Note that it is called from goroutine, waiting for events.
+	OnThrottled func(*Desc)
+
+	// OnDescError is called with errors of the operations the poller makes
+	// on its own for a registered descriptor, such as disarming and arming
+	// it again for Options.CoalesceWindow or rate limits. Such errors are
+	// not returned by any method, thus without this hook they are ignored.
+	// Kernel errors are passed as *Error.
+	//
+	// Errors of the methods called by user (e.g. Resume()) are returned to
+	// the caller and not passed here. It may be called from goroutine,
+	// waiting for events, or from timer goroutines.
+	OnDescError func(*Desc, error)
+
+	// ExternalLoop makes New() to not start a goroutine waiting for events.
+	// Instead, the caller must call Iterate() whenever the PollerFd() is
+	// readable, e.g. when the poller is embedded into another event loop.
+	// Close() works as usual in this mode.
+	ExternalLoop bool
+
+	// WakeupMethod chooses the mechanism the poller uses internally to wake
+	// up its wait loop. It is supported on linux only; New() returns
+	// ErrUnsupported for values other than WakeupDefault on other operating
+	// systems.
+	WakeupMethod WakeupMethod
+
+	// Metrics enables collection of timing statistics, such as
+	// Stats.WaitBlockedNanos and Stats.CallbackNanos. It is disabled by
+	// default to not make the extra clock readings on the hot path.
+	Metrics bool
+
+	// RecordEvents is the size of the ring buffer of the latest callback
+	// calls records, which are written by EventPoll.DumpEvents(). It is
+	// intended for post-mortem debugging, e.g. to find out why some
+	// connection stalled. Recording does not allocate and does not take
+	// locks; it costs two clock readings per callback call. If zero,
+	// events are not recorded.
+	RecordEvents int
+
+	// DebugScratch makes memory handed out by Scratch to be poisoned when
+	// the callback returns. Slices retained after the callback then contain
+	// garbage early, instead of being silently overwritten by the next
+	// callbacks. It is intended for debugging.
+	DebugScratch bool
+
+	// BufferSize is the size of buffers handed out by Desc.GetBuffer() for
+	// descriptors registered within the poller. If zero, 32KB is used.
+	BufferSize int
+
+	// OnIdle is called when the poller received no events for at least
+	// IdleThreshold. It is called repeatedly while the poller stays idle,
+	// with the total duration of the quiet period, so maintenance work
+	// could be piggybacked onto it without a separate timer. The period is
+	// reset by the first received event.
+	//
+	// Note that it is called from goroutine, waiting for events, thus no
+	// events are handled until it returns. It is not used in ExternalLoop
+	// mode.
+	OnIdle func(time.Duration)
+
+	// IdleThreshold is the duration of the quiet period after which OnIdle
+	// is called. If zero, one second is used.
+	IdleThreshold time.Duration
+
+	// StrictEdge enables the debug check of edge-triggered descriptors
+	// handling: after the callback of such descriptor returns for
+	// EventRead, the poller asks the kernel for the number of bytes left
+	// unread (by FIONREAD ioctl) and calls OnUndrained if there are any.
+	// Such descriptor does not receive the next EventRead until more data
+	// arrives, which is the most common bug of edge-triggered handling.
+	//
+	// It costs one system call per callback, thus it is intended to be
+	// enabled in development only.
+	StrictEdge bool
+
+	// OnUndrained is called when StrictEdge check finds n bytes left unread
+	// after the callback returned. If nil, the warning is logged.
+	OnUndrained func(desc *Desc, n int)
+
+	// Strict enables the debug checks of callbacks misusing the poller.
+	// Operations which deadlock when called from the callback run by
+	// InlineDispatcher panic with a descriptive message instead: Close()
+	// and CloseContext() of the poller running the callback, as well as
+	// the blocking helpers such as PollListener.Accept() and WaitOne().
+	// Start() of the descriptor from its own callback while it is
+	// registered panics too, as well as Migrate() of it, regardless of the
+	// Dispatcher.
+	//
+	// Also, when the callback of one-shot descriptor returns without
+	// reading its data, resuming or stopping it, OnStuck is called: such
+	// descriptor receives no more events, which is likely a hang.
+	//
+	// It costs finding out the goroutine id per callback call and a couple
+	// of system calls per EventRead of one-shot descriptor, thus it is
+	// intended to be enabled in development only.
+	Strict bool
+
+	// OnStuck is called when Strict check finds one-shot descriptor left
+	// disarmed by the callback called with event. If nil, the warning is
+	// logged.
+	OnStuck func(desc *Desc, event Event)
+
+	// OnWakeup is called from goroutine, waiting for events, after it was
+	// woken up by EventPoll.Wakeup(). No events are handled until it
+	// returns.
+	OnWakeup func()
+
+	// ConnLifetimeInterval is the interval the connections of descriptors
+	// created with DescOptions.ConnLifetime are checked at, while there are
+	// no events for them. If zero, one second is used.
+	ConnLifetimeInterval time.Duration
+
+	// EMFILEStrategy chooses how Acceptor created within the poller handles
+	// running out of file descriptors (EMFILE or ENFILE) while accepting.
+	// If zero, EMFILEBackoff is used.
+	EMFILEStrategy EMFILEStrategy
+
+	// CtlRetry makes Start() and ModifyEvent() to retry the kernel
+	// registration calls failed with transient errors. By default they are
+	// not retried.
+	CtlRetry CtlRetry
+
+	// CPUAffinity is a list of CPUs the OS thread of the wait loop is bound
+	// to by sched_setaffinity(2). The wait loop goroutine is locked to that
+	// thread, thus the inline callbacks are run on those CPUs too. It is
+	// intended for the per-core poller architectures, keeping each loop's
+	// cache hot on its core. The thread is bound before New() returns;
+	// binding error (e.g. none of the CPUs is available to the process) is
+	// returned by New().
+	//
+	// It is supported on linux only (see Capabilities.CPUAffinity): New()
+	// returns ErrUnsupported on other operating systems, as well as with
+	// Config.ExternalLoop, when there is no wait loop goroutine to bind.
+	CPUAffinity []int
+
+	// Backend chooses the kernel facility the poller is built on: epoll
+	// (BackendEpoll) or io_uring (BackendUring) on linux. BackendAuto uses
+	// io_uring where it is usable and falls back to epoll otherwise, e.g.
+	// on kernels older than 5.13 or when io_uring(7) is disabled or blocked
+	// by seccomp. If empty, the operating system's native facility is used,
+	// which is epoll on linux. See Capabilities.Backend for the chosen one.
+	//
+	// The io_uring backend delivers readiness through the completion queue,
+	// which is consumed without system calls while events keep coming. It
+	// does not support ExternalLoop and WakeupMethod; New() returns
+	// ErrUnsupported for BackendUring with them and BackendAuto uses epoll.
+	// Nor it reports EventPri (see Capabilities.Pri). Other names, as well
+	// as BackendEpoll and BackendUring on other operating systems, are
+	// rejected with ErrUnsupported.
+	Backend string
+
+	// ParkIdle makes descriptors whose callbacks were not called for at
+	// least ParkIdle to be parked automatically, the same as by
+	// EventPoll.Park(). Descriptors are checked every ParkIdle/2, thus
+	// descriptor is parked after at most 1.5x ParkIdle of inactivity. If
+	// zero, descriptors are parked only explicitly.
+	ParkIdle time.Duration
+
+	// cpus is a list of CPUs the wait loop is bound to. It is set by Pool
+	// (overriding CPUAffinity) and is supported on linux only.
+	cpus []int
+
+	// onStop is called with the descriptor whose registration was stopped
+	// by the poller itself rather than by EventPoll methods, e.g. after hang
+	// up or when the descriptor was closed. It is set by Pool.
+	onStop func(*Desc)
+}
+
+// Backend names that could be set in Config.
+const (
+	BackendEpoll = "epoll"
+	BackendUring = "uring"
+	BackendAuto  = "auto"
+)
+
+// WakeupMethod describes a mechanism used to wake up the poller's wait loop.
+type WakeupMethod uint8
+
+// WakeupMethod values that could be set in Config.
+const (
+	// WakeupDefault uses the operating system's preferred mechanism: eventfd
+	// on linux, falling back to pipe if eventfd is not available.
+	WakeupDefault WakeupMethod = iota
+
+	// WakeupPipe uses a pipe, which costs two file descriptors.
+	WakeupPipe
+
+	// WakeupEventfd uses eventfd(2), which costs one file descriptor and is
+	// slightly faster than pipe. There is no fallback if it is not
+	// available.
+	WakeupEventfd
+)
+
+// EMFILEStrategy describes how running out of file descriptors is handled
+// while accepting connections. Connection which could not be accepted stays
+// in the listener's backlog and keeps the listener readable, thus accept
+// loop must either get rid of it or stop observing the listener for a while.
+// Otherwise it spins, and with edge-triggered listener the readiness is
+// never reported again.
+type EMFILEStrategy uint8
+
+// EMFILEStrategy values that could be set in Config.
+const (
+	// EMFILEBackoff makes accept loop to sleep with exponentially growing
+	// delays until a descriptor is available. Note that it blocks the
+	// listener's callback, which is run by the wait loop by default.
+	EMFILEBackoff EMFILEStrategy = iota
+
+	// EMFILESpareFd makes acceptor to keep a spare file descriptor open.
+	// When descriptors are exhausted, the spare one is closed to accept the
+	// pending connection and close it immediately, and is opened again.
+	// That is, peers are disconnected instead of waiting in the backlog
+	// while the process stays at its limit. If the spare descriptor could
+	// not be opened again, EMFILEDisable is used until it could.
+	EMFILESpareFd
+
+	// EMFILEDisable makes acceptor to stop observing the listener and to
+	// start it again after exponentially growing delays, while pending
+	// connections wait in the backlog. Acceptor is reported as paused in
+	// the meantime.
+	EMFILEDisable
+)
+
+// CtlRetry configures retrying of the kernel registration calls (e.g.
+// epoll_ctl(2)) failed with ENOMEM or ENOSPC. Both are transient on the
+// memory-pressured hosts: ENOMEM is returned when the kernel could not
+// allocate memory for the registration, and ENOSPC (on linux) when the
+// per-user limit of epoll watches is reached, until other descriptors are
+// closed. Other errors are never retried.
+//
+// Note that retries are made within the calling goroutine, which sleeps in
+// between. Thus the wait loop is blocked for that time if Start() is called
+// from the callback (e.g. by Acceptor) with InlineDispatcher.
+type CtlRetry struct {
+	// Attempts is the maximum number of retries made after the first call
+	// failed. Zero disables retrying.
+	Attempts int
+
+	// Backoff is the delay before the first retry. It doubles for each next
+	// one. If zero, one millisecond is used.
+	Backoff time.Duration
+}
+
+// internalFder is implemented by the pollers which own file descriptors for
+// their internal needs, e.g. the epoll instance and its wakeup eventfd. Such
+// descriptors are not registrations: they are neither counted by
+// Stats().Registered nor returned by Export(). It is intended for debugging
+// of descriptor leaks and accounting.
+type internalFder interface {
+	internalFds() []int
+}
+
+// emfileStrategist is implemented by the pollers which provide
+// Config.EMFILEStrategy to Acceptor.
+type emfileStrategist interface {
+	emfileStrategy() EMFILEStrategy
 }
 
 func (c *Config) withDefaults() (config Config) {
@@ -175,9 +917,52 @@ func (c *Config) withDefaults() (config Config) {
 	if config.OnWaitError == nil {
 		config.OnWaitError = defaultOnWaitError
 	}
+	if config.Dispatcher == nil {
+		config.Dispatcher = InlineDispatcher
+	}
+	if config.OnIdle != nil && config.IdleThreshold <= 0 {
+		config.IdleThreshold = time.Second
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = readBufferSize
+	}
+	if config.StrictEdge && config.OnUndrained == nil {
+		config.OnUndrained = defaultOnUndrained
+	}
+	if config.Strict && config.OnStuck == nil {
+		config.OnStuck = defaultOnStuck
+	}
+	if config.ConnLifetimeInterval <= 0 {
+		config.ConnLifetimeInterval = time.Second
+	}
+	if len(config.cpus) == 0 && len(config.CPUAffinity) > 0 {
+		config.cpus = append([]int(nil), config.CPUAffinity...)
+	}
+	if config.CtlRetry.Backoff <= 0 {
+		config.CtlRetry.Backoff = time.Millisecond
+	}
 	return config
 }
 
-func defaultOnWaitError(err error) {
+func defaultOnWaitError(err error) bool {
 	log.Printf("netpoll: wait loop error: %s", err)
+	return false
+}
+
+func defaultOnUndrained(desc *Desc, n int) {
+	log.Printf("netpoll: fd %d: %d bytes left unread by edge-triggered callback", desc.Fd(), n)
+}
+
+func defaultOnStuck(desc *Desc, event Event) {
+	log.Printf("netpoll: fd %d: one-shot descriptor is neither read, resumed nor stopped by callback of %s", desc.Fd(), event)
+}
+
+// StopOnWaitError returns OnWaitError handler which calls fn and stops the
+// wait loop. That is, it makes fn to behave as OnWaitError handlers did
+// before they were able to continue the loop.
+func StopOnWaitError(fn func(error)) func(error) bool {
+	return func(err error) bool {
+		fn(err)
+		return false
+	}
 }
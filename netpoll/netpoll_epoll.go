@@ -2,63 +2,143 @@
 
 package netpoll
 
-// New creates new epoll-based EventPoll instance with given config.
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported reports whether EventPoll is implemented for the target
+// operating system. It is true here, since New() is backed by epoll.
+const Supported = true
+
+// New creates new EventPoll instance with given config. It is backed by
+// epoll, or by io_uring if Config.Backend asks for it.
 func New(c *Config) (EventPoll, error) {
 	cfg := c.withDefaults()
+	if len(cfg.CPUAffinity) > 0 && cfg.ExternalLoop {
+		return nil, ErrUnsupported
+	}
+	switch cfg.Backend {
+	case "", BackendEpoll:
+	case BackendUring:
+		p, err := newUringPoller(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case BackendAuto:
+		if p, err := newUringPoller(cfg); err == nil {
+			return p, nil
+		}
+	default:
+		return nil, ErrUnsupported
+	}
+	p := newPoller(cfg)
 
 	epoll, err := EpollCreate(&EpollConfig{
-		OnWaitError: cfg.OnWaitError,
+		OnWaitError:  p.onWaitError,
+		ExternalLoop: cfg.ExternalLoop,
+		WakeupMethod: cfg.WakeupMethod,
+		metrics:      cfg.Metrics,
+		cpus:         cfg.cpus,
+
+		onIdle:        cfg.OnIdle,
+		idleThreshold: cfg.IdleThreshold,
+		onBatch:       p.flushBatch,
+		onWakeup:      p.onWakeup,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return poller{epoll}, nil
+	p.backend = epollBackend{epoll}
+
+	return p, nil
 }
 
-// poller implements EventPoll interface.
-type poller struct {
+// epollBackend implements backend interface on top of Epoll.
+type epollBackend struct {
 	*Epoll
 }
 
-// Start implements EventPoll.Start() method.
-func (ep poller) Start(desc *Desc, cb CallbackFn) error {
-	return ep.Add(desc.Fd(), toEpollEvent(desc.event),
-		func(ep EpollEvent) {
-			var event Event
-
-			if ep&EPOLLHUP != 0 {
-				event |= EventHup
-			}
-			if ep&EPOLLRDHUP != 0 {
-				event |= EventReadHup
-			}
-			if ep&EPOLLIN != 0 {
-				event |= EventRead
-			}
-			if ep&EPOLLOUT != 0 {
-				event |= EventWrite
-			}
-			if ep&EPOLLERR != 0 {
-				event |= EventErr
-			}
-			if ep&_EPOLLCLOSED != 0 {
-				event |= EventPollClosed
-			}
-
-			cb(event)
-		},
-	)
+func (ep epollBackend) add(fd int, event Event, cb func(Event, int64, uint32)) error {
+	err := ep.Add(fd, toEpollEvent(event), func(ev EpollEvent) {
+		cb(fromEpollEvent(ev), 0, uint32(ev))
+	})
+	if err == unix.ENOSPC {
+		return &WatchLimitError{Limit: maxUserWatches()}
+	}
+	return err
+}
+
+// maxUserWatches returns the per-user limit of epoll watches, or -1 if it
+// could not be read.
+func maxUserWatches() int {
+	data, err := ioutil.ReadFile("/proc/sys/fs/epoll/max_user_watches")
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return n
 }
 
-// Stop implements EventPoll.Stop() method.
-func (ep poller) Stop(desc *Desc) error {
-	return ep.Del(desc.Fd())
+func (ep epollBackend) lowWater(fd int, n int) error {
+	return socketLowWater(fd, n)
 }
 
-// Resume implements EventPoll.Resume() method.
-func (ep poller) Resume(desc *Desc) error {
-	return ep.Mod(desc.Fd(), toEpollEvent(desc.event))
+// socketLowWater sets SO_RCVLOWAT of fd to n.
+func socketLowWater(fd int, n int) error {
+	if n == 0 {
+		// The default mark of SO_RCVLOWAT.
+		n = 1
+	}
+	// Readiness reported by epoll honors SO_RCVLOWAT for TCP sockets only.
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return err
+	}
+	if domain != unix.AF_INET && domain != unix.AF_INET6 {
+		return ErrInvalidLowWater
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVLOWAT, n)
+}
+
+func (ep epollBackend) del(fd int, _ Event) error {
+	return ep.Del(fd)
+}
+
+func (ep epollBackend) mod(fd int, event Event) error {
+	return ep.Mod(fd, toEpollEvent(event))
+}
+
+func (ep epollBackend) change(fd int, _, event Event) error {
+	return ep.Mod(fd, toEpollEvent(event))
+}
+
+func (ep epollBackend) disarm(fd int, _ Event) error {
+	// EPOLLHUP and EPOLLERR are reported for fd regardless of the event
+	// mask. Use EPOLLONESHOT to get them reported at most once.
+	return ep.Mod(fd, EPOLLONESHOT)
+}
+
+func (ep epollBackend) internalFds() []int {
+	fds := []int{ep.fd, ep.wakeR}
+	if ep.wakeW != ep.wakeR {
+		// The pipe is used instead of eventfd.
+		fds = append(fds, ep.wakeW)
+	}
+	return fds
+}
+
+func (ep epollBackend) waitBlocked() (nanos, calls uint64) {
+	return atomic.LoadUint64(&ep.waitNanos), atomic.LoadUint64(&ep.waits)
 }
 
 func toEpollEvent(event Event) (ep EpollEvent) {
@@ -68,11 +148,42 @@ func toEpollEvent(event Event) (ep EpollEvent) {
 	if event&EventWrite != 0 {
 		ep |= EPOLLOUT
 	}
+	if event&EventPri != 0 {
+		ep |= EPOLLPRI
+	}
 	if event&EventOneShot != 0 {
 		ep |= EPOLLONESHOT
 	}
 	if event&EventEdgeTriggered != 0 {
 		ep |= EPOLLET
 	}
+	if event&EventWakeup != 0 {
+		ep |= EPOLLWAKEUP
+	}
 	return ep
 }
+
+func fromEpollEvent(ep EpollEvent) (event Event) {
+	if ep&EPOLLHUP != 0 {
+		event |= EventHup
+	}
+	if ep&EPOLLRDHUP != 0 {
+		event |= EventReadHup
+	}
+	if ep&EPOLLIN != 0 {
+		event |= EventRead
+	}
+	if ep&EPOLLOUT != 0 {
+		event |= EventWrite
+	}
+	if ep&EPOLLPRI != 0 {
+		event |= EventPri
+	}
+	if ep&EPOLLERR != 0 {
+		event |= EventErr
+	}
+	if ep&_EPOLLCLOSED != 0 {
+		event |= EventPollClosed
+	}
+	return event
+}
@@ -0,0 +1,949 @@
+// +build linux
+
+package netpoll
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPoolShardCPUs(t *testing.T) {
+	pool, err := NewPool(&PoolConfig{
+		Config:    config(t),
+		ShardCPUs: [][]int{{0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	cpus := make(chan unix.CPUSet, 1)
+	err = pool.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			t.Error(err)
+		}
+		select {
+		case cpus <- set:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case set := <-cpus:
+		if set.Count() != 1 || !set.IsSet(0) {
+			t.Errorf("callback was run on unexpected CPUs set: %v", set)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no callback call")
+	}
+}
+
+func TestPollerCPUAffinity(t *testing.T) {
+	c := config(t)
+	c.CPUAffinity = []int{0}
+	poller, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	cpus := make(chan unix.CPUSet, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			t.Error(err)
+		}
+		select {
+		case cpus <- set:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case set := <-cpus:
+		if set.Count() != 1 || !set.IsSet(0) {
+			t.Errorf("callback was run on unexpected CPUs set: %v", set)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no callback call")
+	}
+
+	for _, test := range []struct {
+		name   string
+		cpus   []int
+		extern bool
+		err    error
+	}{
+		{"negative", []int{0, -1}, false, os.NewSyscallError("sched_setaffinity", unix.EINVAL)},
+		{"overflow", []int{1 << 20}, false, os.NewSyscallError("sched_setaffinity", unix.EINVAL)},
+		{"external", []int{0}, true, ErrUnsupported},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := config(t)
+			c.CPUAffinity = test.cpus
+			c.ExternalLoop = test.extern
+			poller, err := New(c)
+			if err == nil {
+				poller.(io.Closer).Close()
+				t.Fatalf("no error")
+			}
+			if err.Error() != test.err.Error() {
+				t.Errorf("New() error is %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPollerDispatchAllocs(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		dispatcher Dispatcher
+	}{
+		{"inline", InlineDispatcher},
+		{"custom", DispatcherFunc(func(fn func()) { fn() })},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config(t)
+			cfg.Dispatcher = test.dispatcher
+
+			p, desc, w, done := startPingPong(t, cfg)
+			// Close the poller first to not receive hang up events.
+			defer unix.Close(w)
+			defer desc.Close()
+			defer p.(io.Closer).Close()
+
+			ping := []byte{'x'}
+			allocs := testing.AllocsPerRun(1000, func() {
+				if _, err := unix.Write(w, ping); err != nil {
+					t.Fatal(err)
+				}
+				<-done
+			})
+			if allocs != 0 {
+				t.Errorf("event delivery made %v allocations; want 0", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkPollerDispatch(b *testing.B) {
+	for _, test := range []struct {
+		name       string
+		dispatcher Dispatcher
+	}{
+		{"inline", InlineDispatcher},
+		{"goroutine", GoDispatcher},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			cfg := config(b)
+			cfg.Dispatcher = test.dispatcher
+
+			p, desc, w, done := startPingPong(b, cfg)
+			// Close the poller first to not receive hang up events.
+			defer unix.Close(w)
+			defer desc.Close()
+			defer p.(io.Closer).Close()
+
+			ping := []byte{'x'}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := unix.Write(w, ping); err != nil {
+					b.Fatal(err)
+				}
+				<-done
+			}
+		})
+	}
+}
+
+func BenchmarkPollerBatch(b *testing.B) {
+	const n = 64
+	for _, test := range []struct {
+		name  string
+		batch bool
+	}{
+		{"callback", false},
+		{"batch", true},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			p, err := New(config(b))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.(io.Closer).Close()
+
+			var (
+				done  = make(chan struct{}, 1)
+				left  int32
+				buf   = make([]byte, 1)
+				ws    = make([]int, n)
+				ready = func(desc *Desc) {
+					if _, err := unix.Read(desc.Fd(), buf); err != nil {
+						b.Error(err)
+					}
+					if atomic.AddInt32(&left, -1) == 0 {
+						done <- struct{}{}
+					}
+				}
+			)
+			if test.batch {
+				p.SetBatchHandler(func(batch []Ready) {
+					for _, r := range batch {
+						ready(r.Desc)
+					}
+				})
+			}
+			for i := range ws {
+				r, w, err := socketPair()
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer unix.Close(w)
+				desc := Must(NewDesc(uintptr(r), EventRead))
+				defer desc.Close()
+
+				var cb CallbackFn
+				if !test.batch {
+					cb = func(event Event) {
+						if event&EventRead != 0 {
+							ready(desc)
+						}
+					}
+				}
+				if err = p.Start(desc, cb); err != nil {
+					b.Fatal(err)
+				}
+				// Stop before the descriptor is closed to not receive hang
+				// up events.
+				defer p.Stop(desc)
+				ws[i] = w
+			}
+
+			ping := []byte{'x'}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				atomic.StoreInt32(&left, n)
+				for _, w := range ws {
+					if _, err := unix.Write(w, ping); err != nil {
+						b.Fatal(err)
+					}
+				}
+				<-done
+			}
+		})
+	}
+}
+
+func BenchmarkPollerWakeup(b *testing.B) {
+	const (
+		descs  = 10000
+		active = 100
+	)
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		b.Fatal(err)
+	}
+	if need := uint64(2*descs + 256); lim.Cur < need {
+		lim.Cur = need
+		if lim.Max < need || unix.Setrlimit(unix.RLIMIT_NOFILE, &lim) != nil {
+			b.Skipf("need %d open files", need)
+		}
+	}
+	for _, producers := range []int{0, 64} {
+		b.Run(fmt.Sprintf("producers=%d", producers), func(b *testing.B) {
+			p, err := New(config(b))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.(io.Closer).Close()
+
+			var (
+				left int32
+				done = make(chan struct{}, 1)
+				buf  = make([]byte, 1)
+				ws   = make([]int, descs)
+			)
+			for i := range ws {
+				r, w, err := socketPair()
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer unix.Close(w)
+				desc := Must(NewDesc(uintptr(r), EventRead))
+				defer desc.Close()
+
+				err = p.Start(desc, func(event Event) {
+					if event&EventRead == 0 {
+						return
+					}
+					if n, _ := unix.Read(r, buf); n == 0 {
+						return
+					}
+					if atomic.AddInt32(&left, -1) == 0 {
+						done <- struct{}{}
+					}
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer p.Stop(desc)
+				ws[i] = w
+			}
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < producers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							p.Wakeup()
+							// Let the loop to run on machines with few
+							// CPUs.
+							runtime.Gosched()
+						}
+					}
+				}()
+			}
+
+			ping := []byte{'x'}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				atomic.StoreInt32(&left, active)
+				for j := 0; j < active; j++ {
+					if _, err := unix.Write(ws[(i*active+j)%descs], ping); err != nil {
+						b.Fatal(err)
+					}
+				}
+				<-done
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+
+			if s := p.Stats(); s.Wakeups > 0 {
+				b.Logf("%d wakeups, %.1f%% coalesced", s.Wakeups,
+					100*float64(s.CoalescedWakeups)/float64(s.Wakeups),
+				)
+			}
+		})
+	}
+}
+
+func TestPollerFairness(t *testing.T) {
+	const (
+		quiet = 64
+		batch = 8
+		// bound is the number of wait cycles each ready descriptor must
+		// be serviced within. It takes (quiet+1)/batch cycles to report
+		// all of them once.
+		bound  = 2 * (quiet + batch) / batch
+		cycles = 4 * bound
+	)
+
+	cfg := config(t)
+	cfg.ExternalLoop = true
+	ep, err := New(cfg)
+	skipUnsupported(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.(io.Closer).Close()
+
+	// Make more descriptors ready than fit in a single batch.
+	epoll := ep.(*poller).backend.(epollBackend).Epoll
+	epoll.iterMu.Lock()
+	epoll.events = make([]unix.EpollEvent, batch)
+	epoll.maxEvents = batch
+	epoll.iterMu.Unlock()
+
+	var (
+		cycle int
+		order []int
+		last  = make([]int, quiet+1)
+		calls = make([]int, quiet+1)
+	)
+	start := func(i int, desc *Desc, cb func()) {
+		err := ep.Start(desc, func(event Event) {
+			if event&EventRead == 0 {
+				return
+			}
+			if gap := cycle - last[i]; gap > bound {
+				t.Errorf("descriptor #%d was not serviced for %d cycles; want at most %d", i, gap, bound)
+			}
+			last[i] = cycle
+			calls[i]++
+			order = append(order, i)
+			if cb != nil {
+				cb()
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Chatty descriptor is written right after each read, thus it is always
+	// ready.
+	chatty, _, r, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chatty.Close()
+	defer w.Close()
+	if _, err = w.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	start(0, chatty, func() {
+		p := make([]byte, 1)
+		if _, err := r.Read(p); err != nil {
+			t.Error(err)
+		}
+		if _, err := w.Write(p); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Quiet descriptors are never read, thus they stay ready.
+	for i := 1; i <= quiet; i++ {
+		desc, _, _, w, err := NewSyntheticPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer desc.Close()
+		defer w.Close()
+		if _, err = w.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		start(i, desc, nil)
+	}
+
+	var firsts = make(map[int]bool)
+	for cycle = 1; cycle <= cycles; cycle++ {
+		order = order[:0]
+		if err = ep.Iterate(0); err != nil {
+			t.Fatal(err)
+		}
+		if len(order) > 0 {
+			firsts[order[0]] = true
+		}
+	}
+	for i, n := range calls {
+		if n == 0 {
+			t.Errorf("descriptor #%d was never serviced", i)
+		}
+		if gap := cycles - last[i]; gap > bound {
+			t.Errorf("descriptor #%d was not serviced for last %d cycles; want at most %d", i, gap, bound)
+		}
+	}
+	if len(firsts) < 2 {
+		t.Errorf("dispatch order was not rotated: always started with %v", firsts)
+	}
+}
+
+func TestDescWritableBytesFull(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		pair func(t *testing.T) (desc *Desc, closer io.Closer)
+	}{
+		{"unix", func(t *testing.T) (*Desc, io.Closer) {
+			_, desc, ra, _, err := NewSyntheticPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return desc, ra
+		}},
+		{"tcp", func(t *testing.T) (*Desc, io.Closer) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			peer, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Keep buffers small to fill them up quickly.
+			if err = peer.(*net.TCPConn).SetReadBuffer(4096); err != nil {
+				t.Fatal(err)
+			}
+			if err = conn.(*net.TCPConn).SetWriteBuffer(16 * 1024); err != nil {
+				t.Fatal(err)
+			}
+			desc, err := HandleWrite(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return desc, peer
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			desc, peer := test.pair(t)
+			defer peer.Close()
+			defer desc.Close()
+
+			before, err := desc.WritableBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			filled, err := fillSendBuffer(desc.Fd())
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := desc.WritableBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if before == 0 {
+				t.Errorf("WritableBytes() = 0 before writing; want positive")
+			}
+			if after != 0 {
+				t.Errorf("WritableBytes() = %d after writing %d bytes to fill the buffer; want 0", after, filled)
+			}
+		})
+	}
+}
+
+func TestPollerScratch(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		worker bool
+	}{
+		{"inline", false},
+		{"worker", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config(t)
+			cfg.DebugScratch = true
+			if test.worker {
+				d := NewWorkerDispatcher(2)
+				defer d.Close()
+				cfg.Dispatcher = d
+			}
+
+			p, desc, w, done := startJSONEcho(t, cfg, true)
+			defer unix.Close(w)
+			defer desc.Close()
+			defer p.(io.Closer).Close()
+
+			req := []byte(`{"id":1}`)
+			resp := make([]byte, 64)
+			allocs := testing.AllocsPerRun(1000, func() {
+				if _, err := unix.Write(w, req); err != nil {
+					t.Fatal(err)
+				}
+				<-done
+				n, err := unix.Read(w, resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if exp := `{"echo":{"id":1}}`; string(resp[:n]) != exp {
+					t.Fatalf("unexpected response: %q; want %q", resp[:n], exp)
+				}
+			})
+			if allocs != 0 {
+				t.Errorf("event delivery made %v allocations; want 0", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkPollerScratch(b *testing.B) {
+	for _, test := range []struct {
+		name    string
+		scratch bool
+		worker  bool
+	}{
+		{"heap", false, false},
+		{"scratch", true, false},
+		{"heap-worker", false, true},
+		{"scratch-worker", true, true},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			cfg := config(b)
+			if test.worker {
+				d := NewWorkerDispatcher(2)
+				defer d.Close()
+				cfg.Dispatcher = d
+			}
+			p, desc, w, done := startJSONEcho(b, cfg, test.scratch)
+			defer unix.Close(w)
+			defer desc.Close()
+			defer p.(io.Closer).Close()
+
+			req := []byte(`{"id":1,"method":"echo","params":["hello","world"]}`)
+			resp := make([]byte, 128)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := unix.Write(w, req); err != nil {
+					b.Fatal(err)
+				}
+				<-done
+				if _, err := unix.Read(w, resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// startJSONEcho creates poller with given config and registers descriptor
+// within it. The callback reads a JSON request, validates it and writes it
+// back wrapped into another object. Buffers are taken from the Scratch or
+// from the heap, depending on scratch value.
+func startJSONEcho(tb testing.TB, cfg *Config, scratch bool) (p EventPoll, desc *Desc, w int, done chan struct{}) {
+	p, err := New(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r, w, err := socketPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	desc = Must(NewDesc(uintptr(r), EventRead))
+
+	done = make(chan struct{}, 1)
+	echo := func(event Event, s *Scratch) {
+		if event&EventRead == 0 {
+			return
+		}
+		var buf []byte
+		if s != nil {
+			buf = s.Bytes(512)
+		} else {
+			buf = make([]byte, 512)
+		}
+		n, err := unix.Read(r, buf)
+		if err == unix.EAGAIN {
+			// Request was already handled by the previous call which
+			// ran concurrently with the wait loop.
+			return
+		}
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		if !json.Valid(buf[:n]) {
+			tb.Errorf("invalid request: %q", buf[:n])
+		}
+		var resp []byte
+		if s != nil {
+			resp = s.Bytes(n + 10)[:0]
+		} else {
+			resp = make([]byte, 0, n+10)
+		}
+		resp = append(resp, `{"echo":`...)
+		resp = append(resp, buf[:n]...)
+		resp = append(resp, '}')
+		if _, err = unix.Write(r, resp); err != nil {
+			tb.Error(err)
+		}
+		select {
+		case done <- struct{}{}:
+		default:
+		}
+	}
+	if scratch {
+		err = StartWithScratch(p, desc, echo)
+	} else {
+		err = p.Start(desc, func(event Event) {
+			echo(event, nil)
+		})
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return p, desc, w, done
+}
+
+// startPingPong creates poller with given config and registers one-shot
+// descriptor within it. The callback reads single byte from the descriptor,
+// resumes it and then signals to the returned channel.
+func startPingPong(tb testing.TB, cfg *Config) (p EventPoll, desc *Desc, w int, done chan struct{}) {
+	p, err := New(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r, w, err := socketPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	desc = Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+
+	done = make(chan struct{}, 1)
+	buf := make([]byte, 1)
+	err = p.Start(desc, func(event Event) {
+		if event&EventPollClosed != 0 {
+			return
+		}
+		if _, err := unix.Read(r, buf); err != nil {
+			tb.Error(err)
+		}
+		if err := p.Resume(desc); err != nil {
+			tb.Error(err)
+		}
+		select {
+		case done <- struct{}{}:
+		default:
+			// Not waited anymore, e.g. after write end is closed.
+		}
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return p, desc, w, done
+}
+
+func TestPollerStartError(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	f, err := ioutil.TempFile("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(fd), EventRead))
+	defer desc.Close()
+
+	// Regular files are not supported by epoll.
+	err = poller.Start(desc, func(Event) {})
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Start() error is %#v; want *Error", err)
+	}
+	if e.Op != "start" || e.Fd != desc.Fd() || e.Event != EventRead || e.Err != unix.EPERM {
+		t.Errorf("unexpected error: %#v", e)
+	}
+	if e.Unwrap() != unix.EPERM {
+		t.Errorf("Unwrap() = %v; want %v", e.Unwrap(), unix.EPERM)
+	}
+	if n := poller.Stats().Registered; n != 0 {
+		t.Errorf("%d descriptors registered after error; want 0", n)
+	}
+
+	// Sentinel errors are not wrapped.
+	if err = poller.Stop(desc); err != ErrNotRegistered {
+		t.Errorf("Stop() error is %v; want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestPollerCtlRetry(t *testing.T) {
+	if *testBackend != "" && *testBackend != BackendEpoll {
+		t.Skipf("epoll_ctl() is not used by %q backend", *testBackend)
+	}
+	defer func() {
+		epollCtlFault = nil
+	}()
+
+	for _, test := range []struct {
+		name     string
+		op       int
+		errno    unix.Errno
+		failures int
+		attempts int
+		calls    int
+		fail     bool
+	}{
+		{"add/recovered", unix.EPOLL_CTL_ADD, unix.ENOSPC, 2, 3, 3, false},
+		{"add/exhausted", unix.EPOLL_CTL_ADD, unix.ENOSPC, 10, 2, 3, true},
+		{"add/nomem", unix.EPOLL_CTL_ADD, unix.ENOMEM, 1, 1, 2, false},
+		{"add/disabled", unix.EPOLL_CTL_ADD, unix.ENOMEM, 1, 0, 1, true},
+		{"add/permanent", unix.EPOLL_CTL_ADD, unix.EPERM, 1, 3, 1, true},
+		{"mod/recovered", unix.EPOLL_CTL_MOD, unix.ENOMEM, 2, 2, 3, false},
+		{"mod/permanent", unix.EPOLL_CTL_MOD, unix.EINVAL, 1, 3, 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := config(t)
+			c.CtlRetry = CtlRetry{
+				Attempts: test.attempts,
+				Backoff:  time.Microsecond,
+			}
+			poller, err := New(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+
+			var calls, failures int
+			epollCtlFault = func(op, fd int) error {
+				if fd != r || op != test.op {
+					return nil
+				}
+				calls++
+				if failures < test.failures {
+					failures++
+					return test.errno
+				}
+				return nil
+			}
+
+			err = poller.Start(desc, func(Event) {})
+			if test.op == unix.EPOLL_CTL_MOD {
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = poller.ModifyEvent(desc, EventRead|EventWrite)
+			}
+			if calls != test.calls {
+				t.Errorf("epoll_ctl() called %d times; want %d", calls, test.calls)
+			}
+			if !test.fail {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("error is %#v; want *Error", err)
+			}
+			if test.errno != unix.ENOSPC {
+				if e.Err != test.errno {
+					t.Errorf("underlying error is %v; want %v", e.Err, test.errno)
+				}
+				return
+			}
+			wl, ok := e.Err.(*WatchLimitError)
+			if !ok {
+				t.Fatalf("underlying error is %#v; want *WatchLimitError", e.Err)
+			}
+			if exp := maxUserWatches(); exp <= 0 || wl.Limit != exp {
+				t.Errorf("limit is %d; want %d", wl.Limit, exp)
+			}
+			if wl.Unwrap() != ErrWatchLimit {
+				t.Errorf("Unwrap() = %v; want %v", wl.Unwrap(), ErrWatchLimit)
+			}
+			if !strings.Contains(e.Error(), "max_user_watches is "+strconv.Itoa(wl.Limit)) {
+				t.Errorf("error message does not contain the limit: %s", e)
+			}
+			if n := poller.Stats().Registered; n != 0 {
+				t.Errorf("%d descriptors registered after error; want 0", n)
+			}
+		})
+	}
+}
+
+func TestDescRawFlags(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+
+	if raw := desc.RawFlags(); raw != 0 {
+		t.Fatalf("RawFlags() = %#x before any event; want 0", raw)
+	}
+	flags := make(chan uint32, 2)
+	err = poller.Start(desc, func(Event) {
+		flags <- desc.RawFlags()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	receive := func(exp EpollEvent) {
+		select {
+		case raw := <-flags:
+			if EpollEvent(raw)&exp != exp {
+				t.Fatalf("RawFlags() = %s; want %s to be set", EpollEvent(raw), exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+	}
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	receive(EPOLLIN)
+
+	if err = unix.Shutdown(w, unix.SHUT_WR); err != nil {
+		t.Fatal(err)
+	}
+	receive(EPOLLIN | EPOLLRDHUP)
+}
@@ -2,77 +2,169 @@
 
 package netpoll
 
+import (
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported reports whether EventPoll is implemented for the target
+// operating system. It is true here, since New() is backed by kqueue.
+const Supported = true
+
 // New creates new kqueue-based EventPoll instance with given config.
 func New(c *Config) (EventPoll, error) {
 	cfg := c.withDefaults()
+	if cfg.WakeupMethod != WakeupDefault || len(cfg.CPUAffinity) > 0 {
+		return nil, ErrUnsupported
+	}
+	if cfg.Backend != "" && cfg.Backend != BackendAuto {
+		return nil, ErrUnsupported
+	}
+	p := newPoller(cfg)
 
 	kq, err := KQueueCreate(&KQueueConfig{
-		OnWaitError: cfg.OnWaitError,
+		OnWaitError:  p.onWaitError,
+		ExternalLoop: cfg.ExternalLoop,
+		metrics:      cfg.Metrics,
+
+		onIdle:        cfg.OnIdle,
+		idleThreshold: cfg.IdleThreshold,
+		onBatch:       p.flushBatch,
+		onWakeup:      p.onWakeup,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return poller{kq}, nil
+	p.backend = kqueueBackend{kq, new(sync.Map)}
+
+	return p, nil
 }
 
-type poller struct {
+// kqueueBackend implements backend interface on top of KQueue.
+type kqueueBackend struct {
 	*KQueue
+
+	// lowat holds read low-water marks of descriptors. It must be applied
+	// to each change of the read filter, since kernel resets it otherwise.
+	lowat *sync.Map // map[int]int64
+}
+
+func (k kqueueBackend) lowWater(fd int, n int) error {
+	if n == 0 {
+		k.lowat.Delete(fd)
+		return nil
+	}
+	k.lowat.Store(fd, int64(n))
+	return nil
 }
 
-func (p poller) Start(desc *Desc, cb CallbackFn) error {
-	n, events := toKevents(desc.event, true)
-	return p.Add(desc.Fd(), events, n, func(kev KEvent) {
-		var (
-			event Event
+func (k kqueueBackend) add(fd int, event Event, cb func(Event, int64, uint32)) error {
+	n, events := k.kevents(fd, event, true)
+	err := k.Add(fd, events, n, func(kev KEvent) {
+		cb(fromKevent(kev), kev.Data, uint32(kev.Flags))
+	})
+	if err != nil {
+		k.lowat.Delete(fd)
+	}
+	return err
+}
 
-			flags  = kev.Flags
-			filter = kev.Filter
-		)
+func (k kqueueBackend) del(fd int, event Event) error {
+	n, events := toKevents(event, false)
+	// Filters could be already deleted by the kernel (e.g. after EV_ONESHOT
+	// delivery), so we do not care much about the error here.
+	_ = k.Mod(fd, events, n)
+	k.lowat.Delete(fd)
+	return k.Del(fd)
+}
 
-		// Set EventHup for any EOF flag. Below will be more precise detection
-		// of what exactly HUP occurred.
-		if flags&EV_EOF != 0 {
-			event |= EventHup
-		}
+func (k kqueueBackend) mod(fd int, event Event) error {
+	n, events := k.kevents(fd, event, true)
+	return k.Mod(fd, events, n)
+}
 
-		if filter == EVFILT_READ {
-			event |= EventRead
-			if flags&EV_EOF != 0 {
-				event |= EventReadHup
-			}
-		}
-		if filter == EVFILT_WRITE {
-			event |= EventWrite
-			if flags&EV_EOF != 0 {
-				event |= EventWriteHup
-			}
+func (k kqueueBackend) change(fd int, prev, event Event) error {
+	// Filters are changed independently, so delete the ones which are not
+	// needed anymore.
+	if removed := prev &^ event; removed&(EventRead|EventWrite|EventPri) != 0 {
+		n, events := toKevents(removed, false)
+		_ = k.Mod(fd, events, n)
+	}
+	return k.mod(fd, event)
+}
+
+func (k kqueueBackend) disarm(fd int, event Event) error {
+	n, events := k.kevents(fd, event, false)
+	for i := 0; i < n; i++ {
+		events[i].Flags = EV_DISABLE
+	}
+	return k.Mod(fd, events, n)
+}
+
+// kevents is like toKevents() but also applies the read low-water mark of
+// fd, if any.
+func (k kqueueBackend) kevents(fd int, event Event, add bool) (n int, ks KEvents) {
+	n, ks = toKevents(event, add)
+	v, ok := k.lowat.Load(fd)
+	if !ok {
+		return n, ks
+	}
+	for i := 0; i < n; i++ {
+		if ks[i].Filter == EVFILT_READ {
+			ks[i].Fflags |= unix.NOTE_LOWAT
+			ks[i].Data = v.(int64)
 		}
-		if flags&EV_ERROR != 0 {
-			event |= EventErr
+	}
+	return n, ks
+}
+
+func fromKevent(kev KEvent) (event Event) {
+	var (
+		flags  = kev.Flags
+		filter = kev.Filter
+	)
+
+	// Set EventHup for any EOF flag. Below will be more precise detection
+	// of what exactly HUP occurred.
+	if flags&EV_EOF != 0 {
+		event |= EventHup
+	}
+
+	if filter == EVFILT_READ {
+		event |= EventRead
+		if flags&EV_EOF != 0 {
+			event |= EventReadHup
 		}
-		if filter == _EVFILT_CLOSED {
-			event |= EventPollClosed
+	}
+	if filter == EVFILT_WRITE {
+		event |= EventWrite
+		if flags&EV_EOF != 0 {
+			event |= EventWriteHup
 		}
+	}
+	if _EVFILT_EXCEPT != 0 && filter == _EVFILT_EXCEPT {
+		event |= EventPri
+	}
+	if flags&EV_ERROR != 0 {
+		event |= EventErr
+	}
+	if filter == _EVFILT_CLOSED {
+		event |= EventPollClosed
+	}
 
-		cb(event)
-	})
+	return event
 }
 
-func (p poller) Stop(desc *Desc) error {
-	n, events := toKevents(desc.event, false)
-	if err := p.Del(desc.Fd()); err != nil {
-		return err
-	}
-	if err := p.Mod(desc.Fd(), events, n); err != nil && err != ErrNotRegistered {
-		return err
-	}
-	return nil
+func (k kqueueBackend) internalFds() []int {
+	// The loop is woken up by EVFILT_USER event, which needs no descriptor.
+	return []int{k.fd}
 }
 
-func (p poller) Resume(desc *Desc) error {
-	n, events := toKevents(desc.event, true)
-	return p.Mod(desc.Fd(), events, n)
+func (k kqueueBackend) waitBlocked() (nanos, calls uint64) {
+	return atomic.LoadUint64(&k.waitNanos), atomic.LoadUint64(&k.waits)
 }
 
 func toKevents(event Event, add bool) (n int, ks KEvents) {
@@ -98,5 +190,11 @@ func toKevents(event Event, add bool) (n int, ks KEvents) {
 		ks[n].Filter = EVFILT_WRITE
 		n++
 	}
+	if event&EventPri != 0 && _EVFILT_EXCEPT != 0 {
+		ks[n].Flags = flags
+		ks[n].Filter = _EVFILT_EXCEPT
+		ks[n].Fflags = _NOTE_OOB
+		n++
+	}
 	return
 }
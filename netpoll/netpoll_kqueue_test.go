@@ -0,0 +1,176 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDescLastKeventData(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	data := make(chan int64, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		select {
+		case data <- desc.LastKeventData():
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-data:
+		if n != 5 {
+			t.Errorf("LastKeventData() = %d; want %d", n, 5)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestListenerLastKeventData(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	desc, err := HandleListener(ln, EventRead|EventOneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	const n = 3
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	// Let the kernel to complete the handshakes.
+	time.Sleep(50 * time.Millisecond)
+
+	backlog := make(chan int64, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead != 0 {
+			backlog <- desc.LastKeventData()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	select {
+	case act := <-backlog:
+		if act != n {
+			t.Errorf("LastKeventData() = %d; want %d", act, n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestKQueueAddRollback(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventWrite))
+	defer desc.Close()
+
+	// Make the write filter to fail after the read one is added.
+	defer func() {
+		keventFault = nil
+	}()
+	keventFault = func(change unix.Kevent_t) error {
+		if int(change.Ident) == r && change.Filter == unix.EVFILT_WRITE {
+			return syscall.ENOMEM
+		}
+		return nil
+	}
+	called := make(chan Event, 1)
+	cb := func(event Event) {
+		select {
+		case called <- event:
+		default:
+		}
+	}
+	err = poller.Start(desc, cb)
+	if e, ok := err.(*Error); !ok || e.Err != syscall.ENOMEM {
+		t.Fatalf("Start() error is %v; want *Error with %v", err, syscall.ENOMEM)
+	}
+	keventFault = nil
+
+	// The read filter must be deleted along with the failed write one.
+	kq, err := poller.PollerFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []int16{unix.EVFILT_READ, unix.EVFILT_WRITE} {
+		del := []unix.Kevent_t{evGet(r, KeventFilter(filter), EV_DELETE)}
+		if _, err = unix.Kevent(kq, del, nil, nil); err != unix.ENOENT {
+			t.Errorf("filter %s is left registered: %v", KeventFilter(filter), err)
+		}
+	}
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-called:
+		t.Fatalf("callback called with %s after failed Start()", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The descriptor could be started again.
+	if err = poller.Start(desc, cb); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("no callback call")
+	}
+	poller.Stop(desc)
+}
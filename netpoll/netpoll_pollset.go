@@ -0,0 +1,430 @@
+// +build aix
+
+package netpoll
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported reports whether EventPoll is implemented for the target
+// operating system. It is true here, since New() is backed by pollset.
+const Supported = true
+
+// New creates new pollset-based EventPoll instance with given config.
+//
+// The pollset(3) interface is level-triggered only. Descriptors with
+// EventEdgeTriggered are rejected by Start() with ErrUnsupportedEvent instead
+// of being observed in level-triggered mode silently. EventOneShot is
+// emulated: descriptor is removed from the pollset before its callback is
+// called and is added back by Resume(). EventPri, read low-water marks,
+// Config.ExternalLoop and Config.CPUAffinity are not supported.
+func New(c *Config) (EventPoll, error) {
+	cfg := c.withDefaults()
+	if cfg.WakeupMethod != WakeupDefault || cfg.ExternalLoop || len(cfg.CPUAffinity) > 0 {
+		return nil, ErrUnsupported
+	}
+	if cfg.Backend != "" && cfg.Backend != BackendAuto {
+		return nil, ErrUnsupported
+	}
+	p := newPoller(cfg)
+
+	ps, err := newPollset(cfg.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	ps.onBatch = p.flushBatch
+	ps.onWakeup = p.onWakeup
+	go ps.wait(p.onWaitError, idleTracker{
+		fn:        cfg.OnIdle,
+		threshold: cfg.IdleThreshold,
+	})
+
+	p.backend = ps
+
+	return p, nil
+}
+
+// pollset implements backend interface on top of the AIX pollset.
+type pollset struct {
+	// waitNanos is the total time spent in pollset_poll() calls and waits
+	// is the number of them. Must be accessed atomically.
+	waitNanos uint64
+	waits     uint64
+
+	// triggered is set to 1 by trigger() until the wait loop calls
+	// onWakeup. Must be accessed atomically.
+	triggered int32
+
+	mu sync.RWMutex
+
+	ps       int
+	wakeR    int
+	wakeW    int
+	closed   bool
+	metrics  bool
+	waitDone chan struct{}
+	onBatch  func()
+	onWakeup func()
+
+	entries map[int]*pollsetEntry
+}
+
+// pollsetEntry holds the state of a descriptor registered within pollset.
+type pollsetEntry struct {
+	event Event
+	cb    func(Event, int64, uint32)
+
+	// armed is false if descriptor is removed from the pollset after the
+	// one-shot delivery or by disarm().
+	armed bool
+}
+
+func newPollset(metrics bool) (*pollset, error) {
+	ps, err := pollsetCreate(-1)
+	if err != nil {
+		return nil, os.NewSyscallError("pollset_create", err)
+	}
+
+	// pollset has no user events, so the wait loop is woken up by a write
+	// to the pipe.
+	var p [2]int
+	if err = unix.Pipe(p[:]); err != nil {
+		pollsetDestroy(ps)
+		return nil, os.NewSyscallError("pipe", err)
+	}
+	for _, fd := range p {
+		if err == nil {
+			err = unix.SetNonblock(fd, true)
+		}
+		if err == nil {
+			_, err = unix.FcntlInt(uintptr(fd), unix.F_SETFD, unix.FD_CLOEXEC)
+		}
+	}
+	if err == nil {
+		err = pollsetCtl(ps, _PS_ADD, p[0], unix.POLLIN)
+	}
+	if err != nil {
+		unix.Close(p[0])
+		unix.Close(p[1])
+		pollsetDestroy(ps)
+		return nil, err
+	}
+
+	return &pollset{
+		ps:       ps,
+		wakeR:    p[0],
+		wakeW:    p[1],
+		metrics:  metrics,
+		waitDone: make(chan struct{}),
+		entries:  make(map[int]*pollsetEntry),
+	}, nil
+}
+
+func (s *pollset) add(fd int, event Event, cb func(Event, int64, uint32)) error {
+	if event&EventEdgeTriggered != 0 {
+		return ErrUnsupportedEvent
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if _, has := s.entries[fd]; has {
+		return ErrRegistered
+	}
+	if err := pollsetCtl(s.ps, _PS_ADD, fd, toPollEvents(event)); err != nil {
+		return err
+	}
+	s.entries[fd] = &pollsetEntry{
+		event: event,
+		cb:    cb,
+		armed: true,
+	}
+
+	return s.wakeup()
+}
+
+func (s *pollset) lowWater(fd int, n int) error {
+	return ErrUnsupported
+}
+
+func (s *pollset) del(fd int, _ Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	e, ok := s.entries[fd]
+	if !ok {
+		return ErrNotRegistered
+	}
+	delete(s.entries, fd)
+	if !e.armed {
+		return nil
+	}
+	return pollsetCtl(s.ps, _PS_DELETE, fd, 0)
+}
+
+func (s *pollset) mod(fd int, event Event) error {
+	if event&EventEdgeTriggered != 0 {
+		return ErrUnsupportedEvent
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	e, ok := s.entries[fd]
+	if !ok {
+		return ErrNotRegistered
+	}
+	// PS_MOD adds events to the ones descriptor is registered with, so the
+	// descriptor is removed and added again to replace them.
+	if e.armed {
+		if err := pollsetCtl(s.ps, _PS_DELETE, fd, 0); err != nil {
+			return err
+		}
+		e.armed = false
+	}
+	if err := pollsetCtl(s.ps, _PS_ADD, fd, toPollEvents(event)); err != nil {
+		return err
+	}
+	e.event = event
+	e.armed = true
+
+	return s.wakeup()
+}
+
+func (s *pollset) change(fd int, _, event Event) error {
+	return s.mod(fd, event)
+}
+
+func (s *pollset) disarm(fd int, _ Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	e, ok := s.entries[fd]
+	if !ok {
+		return ErrNotRegistered
+	}
+	if !e.armed {
+		return nil
+	}
+	e.armed = false
+	return pollsetCtl(s.ps, _PS_DELETE, fd, 0)
+}
+
+// Fd returns the pollset identifier. Note that it is not a file descriptor.
+func (s *pollset) Fd() int {
+	return s.ps
+}
+
+func (s *pollset) Iterate(time.Duration) error {
+	return ErrNotExternalLoop
+}
+
+func (s *pollset) internalFds() []int {
+	// Note that the pollset identifier is not a file descriptor.
+	return []int{s.wakeR, s.wakeW}
+}
+
+func (s *pollset) waitBlocked() (nanos, calls uint64) {
+	return atomic.LoadUint64(&s.waitNanos), atomic.LoadUint64(&s.waits)
+}
+
+// wakeup makes the running pollset_poll() call to return, so the changes
+// made by pollset_ctl() are taken into account by the next call.
+// Note that s.mu must be held.
+func (s *pollset) wakeup() error {
+	_, err := unix.Write(s.wakeW, []byte{1})
+	if err == unix.EAGAIN {
+		// The pipe is full, thus the loop is already woken up.
+		return nil
+	}
+	return err
+}
+
+// trigger wakes up the wait loop, which calls onWakeup then.
+func (s *pollset) trigger() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	atomic.StoreInt32(&s.triggered, 1)
+	return s.wakeup()
+}
+
+// Close stops wait loop and closes all underlying resources.
+func (s *pollset) Close() (err error) {
+	s.mu.Lock()
+	{
+		if s.closed {
+			s.mu.Unlock()
+			return ErrClosed
+		}
+		s.closed = true
+
+		if err = s.wakeup(); err != nil {
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	<-s.waitDone
+
+	if err = unix.Close(s.wakeR); err == nil {
+		err = unix.Close(s.wakeW)
+	}
+
+	s.mu.Lock()
+	entries := s.entries
+	s.entries = nil
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		e.cb(EventPollClosed, 0, 0)
+	}
+
+	return err
+}
+
+const (
+	maxPollsetEventsBegin = 1024
+	maxPollsetEventsStop  = 32768
+)
+
+func (s *pollset) wait(onError func(error) bool, idle idleTracker) {
+	defer func() {
+		if err := pollsetDestroy(s.ps); err != nil {
+			onError(os.NewSyscallError("pollset_destroy", err))
+		}
+		close(s.waitDone)
+	}()
+
+	var (
+		fds     = make([]unix.PollFd, maxPollsetEventsBegin)
+		timeout = timeoutMillis(idle.timeout())
+	)
+	for {
+		var start int64
+		if s.metrics || idle.fn != nil {
+			start = nanotime()
+		}
+		n, err := pollsetPoll(s.ps, fds, timeout)
+		if s.metrics {
+			atomic.AddUint64(&s.waitNanos, uint64(nanotime()-start))
+			atomic.AddUint64(&s.waits, 1)
+		}
+		if err != nil {
+			err = wrapErr("wait", s.ps, 0, err)
+			if temporaryErr(err) || onError(err) {
+				continue
+			}
+			return
+		}
+		idle.observe(start, n)
+
+		for i := 0; i < n; i++ {
+			fd := int(fds[i].Fd)
+			if fd == s.wakeR {
+				if s.drainWakeup() {
+					return
+				}
+				if atomic.SwapInt32(&s.triggered, 0) == 1 && s.onWakeup != nil {
+					s.onWakeup()
+				}
+				continue
+			}
+			s.handle(fd, fds[i].Revents)
+		}
+		if n > 0 && s.onBatch != nil {
+			s.onBatch()
+		}
+
+		if n == len(fds) && n*2 <= maxPollsetEventsStop {
+			fds = make([]unix.PollFd, n*2)
+		}
+
+		// give more chance to other goroutine
+		runtime.Gosched()
+	}
+}
+
+// drainWakeup reads all pending wakeups. It reports whether instance is
+// closed.
+func (s *pollset) drainWakeup() (closed bool) {
+	var buf [64]byte
+	for {
+		if _, err := unix.Read(s.wakeR, buf[:]); err != nil {
+			break
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// handle calls the callback of fd. Descriptor's entry is looked up at the
+// time of the call, so the callback of the descriptor removed while the
+// received batch is being handled is not called.
+func (s *pollset) handle(fd int, revents uint16) {
+	s.mu.Lock()
+	e, ok := s.entries[fd]
+	if !ok || !e.armed {
+		s.mu.Unlock()
+		return
+	}
+	if e.event&EventOneShot != 0 {
+		// Emulate one-shot delivery: the descriptor is added back by the
+		// next mod() call.
+		e.armed = false
+		_ = pollsetCtl(s.ps, _PS_DELETE, fd, 0)
+	}
+	cb := e.cb
+	s.mu.Unlock()
+
+	cb(fromPollEvents(revents), 0, uint32(revents))
+}
+
+func toPollEvents(event Event) (events int16) {
+	if event&EventRead != 0 {
+		events |= unix.POLLIN
+	}
+	if event&EventWrite != 0 {
+		events |= unix.POLLOUT
+	}
+	return events
+}
+
+func fromPollEvents(revents uint16) (event Event) {
+	if revents&unix.POLLIN != 0 {
+		event |= EventRead
+	}
+	if revents&unix.POLLOUT != 0 {
+		event |= EventWrite
+	}
+	if revents&unix.POLLHUP != 0 {
+		event |= EventHup
+	}
+	if revents&(unix.POLLERR|unix.POLLNVAL) != 0 {
+		event |= EventErr
+	}
+	return event
+}
@@ -0,0 +1,260 @@
+// +build aix
+
+package netpoll
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPollsetReadOnce(t *testing.T) {
+	poller, err := New(pollsetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := pollsetPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead|EventOneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	var (
+		data     = []byte("hello")
+		done     = make(chan struct{})
+		received = make([]byte, 0, len(data))
+	)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		bts := make([]byte, 128)
+		n, err := unix.Read(desc.Fd(), bts)
+		switch {
+		case err == nil && n == 0:
+			poller.Stop(desc)
+			close(done)
+
+		case err != nil:
+			t.Error(err)
+
+		default:
+			received = append(received, bts[:n]...)
+			if err := poller.Resume(desc); err != nil {
+				t.Errorf("poller.Resume() error: %v", err)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		if _, err = unix.Write(w, data[i:i+1]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	unix.Close(w)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("no hangup received")
+	}
+	if !bytes.Equal(data, received) {
+		t.Errorf("bytes are not equal:\ngot:  %v\nwant: %v\n", received, data)
+	}
+}
+
+func TestPollsetOneShotEmulation(t *testing.T) {
+	poller, err := New(pollsetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := pollsetPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead|EventOneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	events := make(chan Event, 16)
+	err = poller.Start(desc, func(event Event) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data is left unread, thus level-triggered pollset reports descriptor
+	// again and again, unless it is removed after the delivery.
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event before Resume()", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = poller.Resume(desc); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("no event received after Resume()")
+	}
+}
+
+func TestPollsetWrite(t *testing.T) {
+	poller, err := New(pollsetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := pollsetPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+
+	desc, err := NewDesc(uintptr(w), EventWrite|EventOneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	events := make(chan Event, 1)
+	err = poller.Start(desc, func(event Event) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event&EventWrite == 0 {
+			t.Errorf("received %s; want %s", event, EventWrite)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestPollsetEdgeTriggered(t *testing.T) {
+	poller, err := New(pollsetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	if caps := poller.Capabilities(); caps.EdgeTriggered || !caps.OneShot {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+
+	r, w, err := pollsetPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	if err = poller.Start(desc, func(Event) {}); err != ErrUnsupportedEvent {
+		t.Fatalf("Start() = %v; want %v", err, ErrUnsupportedEvent)
+	}
+}
+
+func TestPollsetClose(t *testing.T) {
+	poller, err := New(pollsetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := pollsetPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(uintptr(r), EventRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	events := make(chan Event, 1)
+	err = poller.Start(desc, func(event Event) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close must wake up the wait loop.
+	closed := make(chan error)
+	go func() { closed <- poller.(io.Closer).Close() }()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() was blocked")
+	}
+	if event := <-events; event&EventPollClosed == 0 {
+		t.Errorf("received %s; want %s", event, EventPollClosed)
+	}
+}
+
+func pollsetPair() (r, w int, err error) {
+	fd, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, -1, os.NewSyscallError("socketpair", err)
+	}
+	if err = unix.SetNonblock(fd[1], true); err != nil {
+		unix.Close(fd[0])
+		unix.Close(fd[1])
+		return -1, -1, err
+	}
+	return fd[0], fd[1], nil
+}
+
+func pollsetConfig(tb testing.TB) *Config {
+	return &Config{
+		OnWaitError: func(err error) bool {
+			tb.Fatal(err)
+			return false
+		},
+	}
+}
@@ -1,9 +1,15 @@
-// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!aix
 
 package netpoll
 
 import "fmt"
 
+// Supported reports whether EventPoll is implemented for the target
+// operating system. It is false here, thus code which must build everywhere
+// could branch on it at compile time instead of discovering the error of
+// New() at run time.
+const Supported = false
+
 // New always returns an error to indicate that EventPoll is not implemented for
 // current operating system.
 func New(*Config) (EventPoll, error) {
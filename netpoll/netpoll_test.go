@@ -0,0 +1,131 @@
+package netpoll
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEventString(t *testing.T) {
+	for _, test := range []struct {
+		event Event
+		exp   string
+	}{
+		{0, "0"},
+		{EventRead, "EventRead"},
+		{EventRead | EventEdgeTriggered | EventReadHup, "EventRead|EventEdgeTriggered|EventReadHup"},
+		{EventWrite | EventOneShot | EventWakeup, "EventWrite|EventOneShot|EventWakeup"},
+		{EventHup | EventReadHup | EventWriteHup | EventErr, "EventReadHup|EventWriteHup|EventHup|EventErr"},
+		{EventPollClosed, "EventPollClosed"},
+		{EventRead | EventPri, "EventRead|EventPri"},
+		{0x200, "0x200"},
+		{EventRead | 0x200 | 0x1000, "EventRead|0x1200"},
+	} {
+		if act := test.event.String(); act != test.exp {
+			t.Errorf("Event(%#x).String() = %q; want %q", uint16(test.event), act, test.exp)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	for _, test := range []struct {
+		err       *Error
+		exp       string
+		temporary bool
+	}{
+		{
+			&Error{Op: "stop", Fd: 3, Err: syscall.EBADF},
+			"netpoll: stop fd 3: " + syscall.EBADF.Error(),
+			false,
+		},
+		{
+			&Error{Op: "start", Fd: 4, Event: EventRead, Err: syscall.EAGAIN},
+			"netpoll: start fd 4 (EventRead): " + syscall.EAGAIN.Error(),
+			true,
+		},
+		{
+			&Error{Op: "handle", Fd: 5, Err: os.NewSyscallError("setnonblock", syscall.EINTR)},
+			"netpoll: handle fd 5: setnonblock: " + syscall.EINTR.Error(),
+			true,
+		},
+	} {
+		t.Run(test.exp, func(t *testing.T) {
+			if act := test.err.Error(); act != test.exp {
+				t.Errorf("Error() = %q; want %q", act, test.exp)
+			}
+			if act := test.err.Temporary(); act != test.temporary {
+				t.Errorf("Temporary() = %t; want %t", act, test.temporary)
+			}
+			if act := test.err.Unwrap(); act != test.err.Err {
+				t.Errorf("Unwrap() = %v; want %v", act, test.err.Err)
+			}
+		})
+	}
+}
+
+func TestWrapErr(t *testing.T) {
+	if err := wrapErr("stop", 1, 0, nil); err != nil {
+		t.Errorf("wrapErr(nil) = %v; want nil", err)
+	}
+	if err := wrapErr("stop", 1, 0, ErrNotRegistered); err != ErrNotRegistered {
+		t.Errorf("wrapErr(ErrNotRegistered) = %v; want it as is", err)
+	}
+	if _, ok := wrapErr("stop", 1, 0, syscall.EBADF).(*Error); !ok {
+		t.Errorf("wrapErr(EBADF) is not *Error")
+	}
+}
+
+func TestSupported(t *testing.T) {
+	poller, err := New(nil)
+	if Supported != (err == nil) {
+		t.Fatalf("New() error is %v while Supported is %t", err, Supported)
+	}
+	if err == nil {
+		poller.(io.Closer).Close()
+	}
+}
+
+func TestResolveStartOptions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []StartOption
+		exp  Options
+	}{
+		{"coalesce", []StartOption{WithCoalesce(time.Second)}, Options{CoalesceWindow: time.Second}},
+		{"rate limit", []StartOption{WithRateLimit(10)}, Options{MaxEventsPerSecond: 10}},
+		{"stop on hup", []StartOption{WithStopOnHup()}, Options{StopOnHup: true}},
+		{"initial readiness", []StartOption{WithInitialReadinessCheck()}, Options{CheckInitialReadiness: true}},
+		{"low water", []StartOption{WithReadLowWater(4)}, Options{ReadLowWater: 4}},
+		{"auto resume", []StartOption{WithAutoResume()}, Options{AutoResume: true}},
+		{
+			name: "options then single",
+			opts: []StartOption{Options{StopOnHup: true, ReadLowWater: 8}, WithReadLowWater(4)},
+			exp:  Options{StopOnHup: true, ReadLowWater: 4},
+		},
+		{
+			name: "single then options",
+			opts: []StartOption{WithReadLowWater(4), Options{StopOnHup: true}},
+			exp:  Options{StopOnHup: true},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if act := resolveStartOptions(test.opts).Options; !reflect.DeepEqual(act, test.exp) {
+				t.Errorf("unexpected options: %+v; want %+v", act, test.exp)
+			}
+		})
+	}
+
+	var called bool
+	s := resolveStartOptions([]StartOption{
+		WithOnStop(func(*Desc, StopReason) { called = true }),
+	})
+	if s.OnStop == nil {
+		t.Fatal("OnStop is not set")
+	}
+	if s.OnStop(nil, StopExplicit); !called {
+		t.Errorf("OnStop is not the given function")
+	}
+}
@@ -4,10 +4,17 @@ package netpoll
 
 import (
 	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -109,6 +116,51 @@ func TestPollerReadOnce(t *testing.T) {
 	}
 }
 
+func TestPollerOneShotParity(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventWrite|EventOneShot))
+	defer desc.Close()
+
+	var calls uint32
+	err = poller.Start(desc, func(event Event) {
+		if event&EventPollClosed == 0 {
+			atomic.AddUint32(&calls, 1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Descriptor is both writable and readable after the writes below.
+	for _, msg := range []string{"hello", "world"} {
+		if _, err = unix.Write(w, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadUint32(&calls); n != 1 {
+		t.Fatalf("callback called %d times before Resume(); want 1", n)
+	}
+
+	if err = poller.Resume(desc); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadUint32(&calls); n != 2 {
+		t.Fatalf("callback called %d times after Resume(); want 2", n)
+	}
+}
+
 func TestPollerWriteOnce(t *testing.T) {
 	poller, err := New(config(t))
 	if err != nil {
@@ -207,75 +259,3926 @@ func TestPollerWriteOnce(t *testing.T) {
 	}
 }
 
-func emptyRecvBuffer(fd int, k int) (n int, err error) {
-	for eagain := 0; eagain < 10; {
-		var x int
-		p := make([]byte, k+1)
-		x, err = unix.Read(fd, p)
-		if err != nil {
+func TestPollerCoalesce(t *testing.T) {
+	const (
+		window   = 500 * time.Microsecond
+		duration = 200 * time.Millisecond
+		rate     = 100000 // Events per second.
+	)
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var fds [2]int
+	if err = unix.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	r, w := fds[0], fds[1]
+	defer unix.Close(w)
+	if err = unix.SetNonblock(w, true); err != nil {
+		t.Fatal(err)
+	}
+
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	var (
+		callbacks uint32
+		received  uint32
+	)
+	err = poller.StartWithOptions(desc, func(event Event) {
+		atomic.AddUint32(&callbacks, 1)
+		buf := make([]byte, 4096)
+		for {
+			n, err := unix.Read(r, buf)
+			if n <= 0 || err != nil {
+				return
+			}
+			atomic.AddUint32(&received, uint32(n))
+		}
+	}, Options{
+		CoalesceWindow: window,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent uint32
+	begin := time.Now()
+	for i := 0; time.Since(begin) < duration; i++ {
+		if i%(rate/1000) == 0 {
+			// Keep the rate near to the desired one.
+			time.Sleep(time.Until(begin.Add(time.Duration(i) * time.Second / rate)))
+		}
+		if _, err := unix.Write(w, []byte{'x'}); err != nil {
 			if err == syscall.EAGAIN {
-				err = nil
-				eagain++
 				continue
 			}
-			return
+			t.Fatal(err)
 		}
-		n += x
+		sent++
 	}
-	return
+	elapsed := time.Since(begin)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint32(&received) != sent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if act := atomic.LoadUint32(&received); act != sent {
+		t.Errorf("received %d bytes; want %d", act, sent)
+	}
+
+	var (
+		calls = atomic.LoadUint32(&callbacks)
+		limit = uint32(elapsed/window) + 2
+	)
+	if calls > limit {
+		t.Errorf("callback called %d times; want at most %d", calls, limit)
+	}
+	if stats := poller.Stats(); stats.Suppressed == 0 {
+		t.Errorf("no events were suppressed: %+v", stats)
+	}
+	t.Logf("sent %d events within %s; made %d callbacks", sent, elapsed, calls)
 }
 
-func fillSendBuffer(fd int) (n int, err error) {
-	p := bytes.Repeat([]byte{'x'}, 1)
-	for eagain := 0; eagain < 10; {
-		var x int
-		x, err = unix.Write(fd, p)
-		if err != nil {
-			if err == syscall.EAGAIN {
-				err = nil
-				eagain++
-				continue
+func TestPollerSetCoalesce(t *testing.T) {
+	const window = 50 * time.Millisecond
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var fds [2]int
+	if err = unix.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	r, w := fds[0], fds[1]
+	defer unix.Close(w)
+
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	if err = poller.SetCoalesce(desc, window); err != ErrNotRegistered {
+		t.Fatalf("SetCoalesce() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	type call struct {
+		data string
+		at   time.Time
+	}
+	calls := make(chan call, 16)
+	err = poller.Start(desc, func(event Event) {
+		buf := make([]byte, 64)
+		n, _ := unix.Read(r, buf)
+		if n > 0 {
+			calls <- call{string(buf[:n]), time.Now()}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if err = poller.SetCoalesce(desc, window); err != nil {
+		t.Fatal(err)
+	}
+	receive := func(exp string) call {
+		select {
+		case c := <-calls:
+			if c.data != exp {
+				t.Fatalf("callback read %q; want %q", c.data, exp)
+			}
+			return c
+		case <-time.After(time.Second):
+			t.Fatalf("no callback for %q", exp)
+		}
+		return call{}
+	}
+
+	unix.Write(w, []byte("a"))
+	first := receive("a")
+
+	// Readiness within the window is held and merged into a single
+	// callback made at the window end.
+	unix.Write(w, []byte("b"))
+	time.Sleep(window / 5)
+	unix.Write(w, []byte("c"))
+	if c := receive("bc"); c.at.Sub(first.at) < window*9/10 {
+		t.Errorf("held callback made after %s; want at least %s", c.at.Sub(first.at), window)
+	}
+
+	// Disabled coalescing delivers the events right away.
+	if err = poller.SetCoalesce(desc, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(window)
+	begin := time.Now()
+	unix.Write(w, []byte("d"))
+	receive("d")
+	unix.Write(w, []byte("e"))
+	if c := receive("e"); c.at.Sub(begin) >= window {
+		t.Errorf("callback made after %s; want it right away", c.at.Sub(begin))
+	}
+}
+
+func TestPollerMetrics(t *testing.T) {
+	const (
+		idle  = 20 * time.Millisecond
+		sleep = 20 * time.Millisecond
+	)
+	for _, test := range []struct {
+		name    string
+		metrics bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := config(t)
+			c.Metrics = test.metrics
+			poller, err := New(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			desc, _, _, w, err := NewSyntheticPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+			defer w.Close()
+
+			done := make(chan struct{}, 1)
+			err = poller.Start(desc, func(Event) {
+				time.Sleep(sleep)
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(idle)
+			if _, err = w.Write([]byte{'x'}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("no event received")
+			}
+			if err = poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+
+			stats := poller.Stats()
+			if !test.metrics {
+				if stats.WaitBlockedNanos != 0 || stats.CallbackNanos != 0 || stats.Waits != 0 {
+					t.Errorf("unexpected timing statistics: %+v", stats)
+				}
+				return
+			}
+			if act := time.Duration(stats.WaitBlockedNanos); act < idle {
+				t.Errorf("WaitBlockedNanos is %s; want at least %s", act, idle)
 			}
+			if stats.Waits == 0 {
+				t.Errorf("Waits is zero")
+			}
+			if act := time.Duration(stats.CallbackNanos); act < sleep {
+				t.Errorf("CallbackNanos is %s; want at least %s", act, sleep)
+			}
+		})
+	}
+}
+
+func TestPollerOnIdle(t *testing.T) {
+	const threshold = 20 * time.Millisecond
+
+	idle := make(chan time.Duration, 128)
+	c := config(t)
+	c.IdleThreshold = threshold
+	c.OnIdle = func(d time.Duration) {
+		select {
+		case idle <- d:
+		default:
+		}
+	}
+	poller, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	done := make(chan struct{}, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
 			return
 		}
-		n += x
+		DrainRead(desc, func([]byte) bool { return true })
+		select {
+		case done <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() time.Duration {
+		select {
+		case d := <-idle:
+			return d
+		case <-time.After(time.Second):
+			t.Fatalf("OnIdle() was not called")
+		}
+		return 0
+	}
+	var prev time.Duration
+	for i := 0; i < 3; i++ {
+		d := next()
+		if d < threshold {
+			t.Errorf("OnIdle() called with %s; want at least %s", d, threshold)
+		}
+		if d <= prev {
+			t.Errorf("OnIdle() called with %s after %s; want growing idle time", d, prev)
+		}
+		prev = d
+	}
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	// Callbacks and OnIdle are called by the same goroutine, thus values
+	// sent before the event are already in the channel.
+	for len(idle) > 0 {
+		<-idle
+	}
+	if d := next(); d >= prev {
+		t.Errorf("OnIdle() called with %s after event; want idle time to be reset", d)
 	}
-	return
 }
 
-func socketPair() (r, w int, err error) {
-	fd, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+func TestPollerOnDescError(t *testing.T) {
+	type descError struct {
+		desc *Desc
+		err  error
+	}
+	errs := make(chan descError, 1)
+	c := config(t)
+	c.OnDescError = func(desc *Desc, err error) {
+		select {
+		case errs <- descError{desc, err}:
+		default:
+		}
+	}
+	poller, err := New(c)
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
+	defer poller.(io.Closer).Close()
 
-	if err = unix.SetNonblock(fd[0], true); err != nil {
-		return
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err = unix.SetNonblock(fd[1], true); err != nil {
-		return
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+
+	called := make(chan struct{}, 1)
+	err = poller.StartWithOptions(desc, func(Event) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+	}, Options{
+		CoalesceWindow: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Level-triggered descriptor is reported again right after the first
+	// callback, making the poller to disarm it until the window ends.
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
 	}
+	<-called
+	time.Sleep(10 * time.Millisecond)
 
-	buf := 4096
-	if err = unix.SetsockoptInt(fd[0], unix.SOL_SOCKET, unix.SO_SNDBUF, buf); err != nil {
-		return
+	// Close the descriptor without stopping it, so arming it again fails.
+	fd := desc.Fd()
+	if err = desc.Close(); err != nil {
+		t.Fatal(err)
 	}
-	if err = unix.SetsockoptInt(fd[1], unix.SOL_SOCKET, unix.SO_SNDBUF, buf); err != nil {
-		return
+
+	select {
+	case e := <-errs:
+		if e.desc != desc {
+			t.Errorf("OnDescError() called with unexpected descriptor")
+		}
+		x, ok := e.err.(*Error)
+		if !ok {
+			t.Fatalf("OnDescError() called with %#v; want *Error", e.err)
+		}
+		if x.Op != "rearm" || x.Fd != fd || x.Err != unix.EBADF {
+			t.Errorf("unexpected error: %v", x)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnDescError() was not called")
 	}
-	if err = unix.SetsockoptInt(fd[0], unix.SOL_SOCKET, unix.SO_RCVBUF, buf); err != nil {
-		return
+}
+
+func TestPollerRateLimit(t *testing.T) {
+	const (
+		limit    = 100
+		duration = 300 * time.Millisecond
+	)
+	for _, test := range []struct {
+		name   string
+		config func(*Config)
+		opts   Options
+	}{
+		{
+			name: "desc",
+			opts: Options{MaxEventsPerSecond: limit},
+		},
+		{
+			name: "poller",
+			config: func(c *Config) {
+				c.MaxEventsPerSecond = limit
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var throttled uint32
+			cfg := config(t)
+			cfg.OnThrottled = func(*Desc) {
+				atomic.AddUint32(&throttled, 1)
+			}
+			if test.config != nil {
+				test.config(cfg)
+			}
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			var fds [2]int
+			if err = unix.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			r, w := fds[0], fds[1]
+			defer unix.Close(w)
+
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+
+			var (
+				callbacks uint32
+				received  uint32
+			)
+			err = poller.StartWithOptions(desc, func(event Event) {
+				if event&EventPollClosed != 0 {
+					return
+				}
+				atomic.AddUint32(&callbacks, 1)
+				DrainRead(desc, func(p []byte) bool {
+					atomic.AddUint32(&received, uint32(len(p)))
+					return true
+				})
+			}, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Flood the descriptor with single bytes.
+			var sent uint32
+			begin := time.Now()
+			for time.Since(begin) < duration {
+				if _, err := unix.Write(w, []byte{'x'}); err != nil {
+					t.Fatal(err)
+				}
+				sent++
+				time.Sleep(10 * time.Microsecond)
+			}
+			elapsed := time.Since(begin)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for atomic.LoadUint32(&received) != sent && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if act := atomic.LoadUint32(&received); act != sent {
+				t.Errorf("received %d bytes; want %d", act, sent)
+			}
+			// Allow a burst of limit events plus limit events per second.
+			max := uint32(limit + limit*elapsed/time.Second + 1)
+			if n := atomic.LoadUint32(&callbacks); n > max {
+				t.Errorf("callback called %d times; want at most %d", n, max)
+			}
+			if atomic.LoadUint32(&throttled) == 0 {
+				t.Errorf("OnThrottled was not called")
+			}
+			if stats := poller.Stats(); stats.Throttled == 0 {
+				t.Errorf("no throttling in stats: %+v", stats)
+			}
+		})
 	}
-	if err = unix.SetsockoptInt(fd[1], unix.SOL_SOCKET, unix.SO_RCVBUF, buf); err != nil {
-		return
+}
+
+func TestPollerDispatcher(t *testing.T) {
+	var dispatched uint32
+	cfg := config(t)
+	cfg.Dispatcher = DispatcherFunc(func(fn func()) {
+		atomic.AddUint32(&dispatched, 1)
+		GoDispatcher.Dispatch(fn)
+	})
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+
+	var (
+		running  int32
+		received []byte
+		once     sync.Once
+		done     = make(chan struct{})
+	)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventPollClosed != 0 {
+			return
+		}
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Errorf("callbacks are running concurrently")
+		}
+		defer atomic.AddInt32(&running, -1)
+
+		// Give a chance for the next event to be dispatched concurrently.
+		time.Sleep(time.Millisecond)
+
+		err := DrainRead(desc, func(p []byte) bool {
+			received = append(received, p...)
+			return true
+		})
+		if err == io.EOF {
+			once.Do(func() { close(done) })
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello, dispatcher!")
+	for i := range data {
+		if _, err := unix.Write(w, data[i:i+1]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	unix.Close(w)
+	<-done
+
+	// Wait for callbacks which could be dispatched after EOF before closing
+	// the descriptor.
+	if err := poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&running) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	desc.Close()
+
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %q; want %q", received, data)
+	}
+	if atomic.LoadUint32(&dispatched) == 0 {
+		t.Errorf("custom dispatcher was not used")
+	}
+}
+
+func TestPollerHupStorm(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts Options
+	}{
+		{"mute", Options{}},
+		{"stop", Options{StopOnHup: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			var fds [2]int
+			if err = unix.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			desc := Must(NewDesc(uintptr(fds[1]), EventWrite))
+			defer desc.Close()
+
+			var calls uint32
+			err = poller.StartWithOptions(desc, func(event Event) {
+				if event&EventPollClosed == 0 {
+					atomic.AddUint32(&calls, 1)
+				}
+			}, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Wait for the initial writable event.
+			time.Sleep(10 * time.Millisecond)
+			atomic.StoreUint32(&calls, 0)
+
+			if err = unix.Close(fds[0]); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if n := atomic.LoadUint32(&calls); n != 1 {
+				t.Fatalf("callback called %d times after read end close; want 1", n)
+			}
+
+			if test.opts.StopOnHup {
+				if n := poller.Stats().Registered; n != 0 {
+					t.Fatalf("%d descriptors registered after hang up; want 0", n)
+				}
+				return
+			}
+			if err = poller.Resume(desc); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if n := atomic.LoadUint32(&calls); n != 2 {
+				t.Fatalf("callback called %d times after Resume(); want 2", n)
+			}
+		})
+	}
+}
+
+func TestPollerOnStop(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		reason StopReason
+		stop   func(t *testing.T, poller EventPoll, desc *Desc, peer int)
+	}{
+		{
+			name:   "explicit",
+			reason: StopExplicit,
+			stop: func(t *testing.T, poller EventPoll, desc *Desc, _ int) {
+				if err := poller.Stop(desc); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:   "hangup",
+			reason: StopHangup,
+			stop: func(t *testing.T, _ EventPoll, _ *Desc, peer int) {
+				if err := unix.Close(peer); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:   "closed",
+			reason: StopPollerClosed,
+			stop: func(t *testing.T, poller EventPoll, _ *Desc, _ int) {
+				if err := poller.(io.Closer).Close(); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:   "error",
+			reason: StopError,
+			stop: func(t *testing.T, poller EventPoll, desc *Desc, peer int) {
+				// Make the wait loop fail. Note that closing the fd does not
+				// interrupt the running wait call, so trigger an event by
+				// making the full pipe writable again.
+				fd, err := poller.PollerFd()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = unix.Close(fd); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 4096)
+				for {
+					if _, err = unix.Write(desc.Fd(), buf); err == syscall.EAGAIN {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err = unix.Read(peer, buf); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(&Config{
+				OnWaitError: func(error) bool { return false },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			var fds [2]int
+			if err = unix.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(fds[0])
+			desc := Must(NewDesc(uintptr(fds[1]), EventWrite|EventEdgeTriggered))
+			defer desc.Close()
+
+			var (
+				running int32
+				stops   = make(chan StopReason, 2)
+			)
+			err = poller.StartWithOptions(desc, func(Event) {
+				atomic.StoreInt32(&running, 1)
+				time.Sleep(time.Millisecond)
+				atomic.StoreInt32(&running, 0)
+			}, Options{
+				StopOnHup: true,
+				OnStop: func(d *Desc, reason StopReason) {
+					if d != desc {
+						t.Errorf("OnStop() called with unexpected descriptor")
+					}
+					if atomic.LoadInt32(&running) != 0 {
+						t.Errorf("OnStop() called while callback is running")
+					}
+					stops <- reason
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Wait for the initial writable event.
+			time.Sleep(10 * time.Millisecond)
+
+			test.stop(t, poller, desc, fds[0])
+
+			select {
+			case reason := <-stops:
+				if reason != test.reason {
+					t.Errorf("OnStop() reason is %s; want %s", reason, test.reason)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("OnStop() was not called")
+			}
+
+			// Stop again in every possible way.
+			poller.Stop(desc)
+			poller.(io.Closer).Close()
+			time.Sleep(10 * time.Millisecond)
+			if n := len(stops); n != 0 {
+				t.Errorf("OnStop() called %d more times; want once", n)
+			}
+		})
+	}
+}
+
+func TestPollerOnStopInFlight(t *testing.T) {
+	cfg := config(t)
+	cfg.Dispatcher = GoDispatcher
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	var (
+		entered  = make(chan struct{})
+		release  = make(chan struct{})
+		returned int32
+		stops    = make(chan StopReason, 2)
+	)
+	err = poller.StartWithOptions(desc, func(event Event) {
+		if event&EventPollClosed != 0 {
+			return
+		}
+		select {
+		case entered <- struct{}{}:
+			<-release
+		default:
+		}
+		atomic.StoreInt32(&returned, 1)
+	}, Options{
+		OnStop: func(_ *Desc, reason StopReason) {
+			if atomic.LoadInt32(&returned) == 0 {
+				t.Errorf("OnStop() called before the in-flight callback returned")
+			}
+			stops <- reason
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = w.Write([]byte{'x'}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- poller.(io.Closer).Close()
+	}()
+	if err = <-closed; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stops:
+		t.Fatal("OnStop() called while callback is running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case reason := <-stops:
+		if reason != StopPollerClosed {
+			t.Errorf("OnStop() reason is %s; want %s", reason, StopPollerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnStop() was not called")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(stops); n != 0 {
+		t.Errorf("OnStop() called %d more times; want once", n)
+	}
+}
+
+func TestPollerResumeClosed(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		new  func(*testing.T) EventPoll
+	}{
+		{"poller", func(t *testing.T) EventPoll {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return poller
+		}},
+		{"pool", func(t *testing.T) EventPoll {
+			pool, err := NewPool(&PoolConfig{Size: 2, Config: config(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pool
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller := test.new(t)
+			defer poller.(io.Closer).Close()
+
+			var fds [2]int
+			if err := unix.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(fds[1])
+			desc := Must(NewDesc(uintptr(fds[0]), EventRead|EventOneShot))
+
+			stops := make(chan StopReason, 1)
+			err := poller.StartWithOptions(desc, func(Event) {}, Options{
+				OnStop: func(_ *Desc, reason StopReason) {
+					stops <- reason
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Close the descriptor out from under the poller.
+			if err = desc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err = poller.Resume(desc); err != ErrDescClosed {
+				t.Fatalf("Resume() error is %v; want %v", err, ErrDescClosed)
+			}
+			if n := poller.Stats().Registered; n != 0 {
+				t.Errorf("%d descriptors registered after Resume(); want 0", n)
+			}
+			select {
+			case reason := <-stops:
+				if reason != StopError {
+					t.Errorf("OnStop() reason is %s; want %s", reason, StopError)
+				}
+			default:
+				t.Errorf("OnStop() was not called")
+			}
+			if err = poller.Resume(desc); err != ErrNotRegistered {
+				t.Errorf("second Resume() error is %v; want %v", err, ErrNotRegistered)
+			}
+		})
+	}
+}
+
+func TestPollerExternalLoop(t *testing.T) {
+	outer, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.(io.Closer).Close()
+
+	if err = outer.Iterate(0); err != ErrNotExternalLoop {
+		t.Fatalf("Iterate() error is %v; want %v", err, ErrNotExternalLoop)
+	}
+
+	cfg := config(t)
+	cfg.ExternalLoop = true
+	inner, err := New(cfg)
+	skipUnsupported(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Register the inner poller's fd within the outer one. Note that we
+	// use a duplicate to not let the Desc to close the inner poller's fd.
+	fd, err := inner.PollerFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := unix.Dup(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerDesc := Must(NewDesc(uintptr(dup), EventRead))
+	defer innerDesc.Close()
+
+	iterated := make(chan error, 1)
+	err = outer.Start(innerDesc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		err := inner.Iterate(0)
+		select {
+		case iterated <- err:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	received := make(chan Event, 1)
+	err = inner.Start(desc, func(event Event) {
+		select {
+		case received <- event:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-received:
+		if event&EventRead == 0 {
+			t.Errorf("inner callback called with %s; want %s", event, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no events received through the outer poller")
+	}
+	if err = <-iterated; err != nil {
+		t.Errorf("Iterate() error: %v", err)
+	}
+
+	if err = outer.Stop(innerDesc); err != nil {
+		t.Fatal(err)
+	}
+	if err = inner.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = inner.Iterate(0); err != ErrClosed {
+		t.Errorf("Iterate() after Close() error is %v; want %v", err, ErrClosed)
+	}
+}
+
+func TestPollerModifyEvent(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, peer, _, _, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer peer.Close()
+
+	if err = poller.ModifyEvent(desc, EventWrite); err != ErrNotRegistered {
+		t.Fatalf("ModifyEvent() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	events := make(chan Event, 16)
+	err = poller.Start(desc, func(event Event) {
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %s", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err = poller.ModifyEvent(desc, EventWrite|EventOneShot); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event&EventWrite == 0 {
+			t.Errorf("callback called with %s; want %s", event, Event(EventWrite))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received after ModifyEvent()")
+	}
+}
+
+func TestPollerConcurrentUse(t *testing.T) {
+	const (
+		descs   = 16
+		workers = 8
+		ops     = 500
+	)
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var (
+		all   = make([]*Desc, descs)
+		peers = make([]io.ReadWriteCloser, descs)
+	)
+	for i := range all {
+		desc, _, _, w, err := NewSyntheticPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer desc.Close()
+		defer w.Close()
+		desc.event = EventRead | EventOneShot
+		all[i], peers[i] = desc, w
+	}
+	// Note that callbacks call poller methods too.
+	callback := func(desc *Desc, r io.Reader) CallbackFn {
+		return func(event Event) {
+			if event&EventPollClosed != 0 {
+				return
+			}
+			p := make([]byte, 64)
+			r.Read(p)
+			poller.Resume(desc)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(seed int) {
+			defer wg.Done()
+			for j := 0; j < ops; j++ {
+				k := (seed*31 + j*7) % descs
+				desc := all[k]
+				switch j % 5 {
+				case 0:
+					poller.Start(desc, callback(desc, descConn{desc}))
+				case 1:
+					poller.Stop(desc)
+				case 2:
+					poller.Resume(desc)
+				case 3:
+					poller.ModifyEvent(desc, EventRead|EventWrite|EventOneShot)
+				case 4:
+					peers[k].Write([]byte("x"))
+				}
+				poller.Stats()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, desc := range all {
+		poller.Stop(desc)
+	}
+	if n := poller.Stats().Registered; n != 0 {
+		t.Errorf("%d descriptors registered after all were stopped", n)
+	}
+}
+
+func TestPollerCheckInitialReadiness(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		event Event
+	}{
+		{"edge", EventRead | EventEdgeTriggered},
+		{"oneshot", EventRead | EventOneShot},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The wait loop is not run until the probe is checked, thus
+			// the readiness reported by the kernel on registration can not
+			// be mistaken for the probe's one.
+			cfg := config(t)
+			cfg.ExternalLoop = true
+			poller, err := New(cfg)
+			skipUnsupported(t, err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			desc, _, _, w, err := NewSyntheticPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+			defer w.Close()
+			desc.event = test.event
+
+			// Data arrives before registration.
+			if _, err = w.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			var calls uint32
+			err = poller.StartWithOptions(desc, func(event Event) {
+				if event&EventRead != 0 {
+					atomic.AddUint32(&calls, 1)
+				}
+			}, Options{
+				CheckInitialReadiness: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&calls) == 0; {
+				if time.Now().After(deadline) {
+					t.Fatalf("callback was not called for data received before registration")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if test.event&EventOneShot == 0 {
+				return
+			}
+
+			// One-shot descriptor is disarmed by the probe, thus the
+			// readiness reported by the kernel must not be delivered.
+			if err = poller.Iterate(50 * time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadUint32(&calls); n != 1 {
+				t.Fatalf("callback called %d times; want 1 for one-shot descriptor", n)
+			}
+		})
+	}
+}
+
+func TestHandleSplit(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	r, w, err := HandleSplit(conn, EventRead|EventEdgeTriggered, EventWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if r.Fd() == w.Fd() {
+		t.Fatalf("descriptors share the same fd")
+	}
+
+	var reads, writes uint32
+	err = poller.Start(r, func(event Event) {
+		if event&EventWrite != 0 {
+			t.Errorf("read descriptor received %s", event)
+		}
+		if event&EventRead != 0 {
+			atomic.AddUint32(&reads, 1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = poller.Start(w, func(event Event) {
+		if event&EventRead != 0 {
+			t.Errorf("write descriptor received %s", event)
+		}
+		if event&EventWrite != 0 {
+			atomic.AddUint32(&writes, 1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err = StopSplit(poller, r, w); err != nil {
+		t.Fatal(err)
+	}
+	// Edge-triggered reading is reported once for the data which is never
+	// read, while level-triggered writing is reported repeatedly.
+	if n := atomic.LoadUint32(&reads); n != 1 {
+		t.Errorf("read callback called %d times; want 1", n)
+	}
+	if n := atomic.LoadUint32(&writes); n < 2 {
+		t.Errorf("write callback called %d times; want at least 2", n)
+	}
+	if n := poller.Stats().Registered; n != 0 {
+		t.Errorf("%d descriptors registered after StopSplit()", n)
+	}
+}
+
+func TestPollerReadLowWater(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	desc := Must(Handle(conn, EventRead|EventOneShot))
+	defer desc.Close()
+
+	events := make(chan Event, 1)
+	err = poller.StartWithOptions(desc, func(event Event) {
+		events <- event
+	}, Options{
+		ReadLowWater: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dribble the header byte by byte.
+	for i := 0; i < 7; i++ {
+		if _, err = peer.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("callback called with %s before the low-water mark is reached", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err = peer.Write([]byte{7}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event&EventRead == 0 {
+			t.Errorf("callback called with %s; want %s", event, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("callback was not called after the low-water mark is reached")
+	}
+}
+
+func TestPollerSetLowWater(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	desc := Must(Handle(conn, EventRead))
+	defer desc.Close()
+
+	if err = poller.SetLowWater(desc, 8); err != ErrNotRegistered {
+		t.Fatalf("SetLowWater() error is %v; want %v", err, ErrNotRegistered)
+	}
+	received := make(chan int, 1)
+	err = poller.Start(desc, func(event Event) {
+		var (
+			buf [64]byte
+			n   int
+		)
+		for {
+			m, err := unix.Read(desc.Fd(), buf[:])
+			if m <= 0 || err != nil {
+				break
+			}
+			n += m
+		}
+		received <- n
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if err = poller.SetLowWater(desc, -1); err != ErrInvalidLowWater {
+		t.Fatalf("SetLowWater() error is %v; want %v", err, ErrInvalidLowWater)
+	}
+	if err = poller.SetLowWater(desc, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dribble the header byte by byte.
+	for i := 0; i < 7; i++ {
+		if _, err = peer.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("callback called with %d bytes buffered before the low-water mark is reached", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = peer.Write([]byte{7}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != 8 {
+			t.Errorf("callback read %d bytes; want %d", n, 8)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback was not called after the low-water mark is reached")
+	}
+
+	// Reset mark makes a single byte to be reported again.
+	if err = poller.SetLowWater(desc, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.Write([]byte{8}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != 1 {
+			t.Errorf("callback read %d bytes; want %d", n, 1)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback was not called after the low-water mark is reset")
+	}
+}
+
+func TestSetSocketLowWater(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	desc := Must(Handle(conn, EventRead))
+	defer desc.Close()
+
+	if err = SetSocketLowWater(desc, 4); err != ErrNotRegistered {
+		t.Fatalf("SetSocketLowWater() error is %v; want %v", err, ErrNotRegistered)
+	}
+	received := make(chan int, 1)
+	err = poller.Start(desc, func(event Event) {
+		var buf [64]byte
+		n, _ := unix.Read(desc.Fd(), buf[:])
+		received <- n
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if err = SetSocketLowWater(desc, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.Write([]byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("callback called with %d bytes buffered before the low-water mark is reached", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = peer.Write([]byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != 4 {
+			t.Errorf("callback read %d bytes; want %d", n, 4)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback was not called after the low-water mark is reached")
+	}
+}
+
+func TestPollerAutoResume(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+	defer desc.Close()
+
+	const n = 5
+	var (
+		calls int32
+		done  = make(chan struct{})
+	)
+	err = poller.StartWithOptions(desc, func(event Event) {
+		var buf [1]byte
+		unix.Read(desc.Fd(), buf[:])
+		if atomic.AddInt32(&calls, 1) == n {
+			poller.Stop(desc)
+			close(done)
+		}
+	}, WithAutoResume())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n+1; i++ {
+		if _, err = unix.Write(w, []byte{'x'}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("callback called %d times; want %d", atomic.LoadInt32(&calls), n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if act := atomic.LoadInt32(&calls); act != n {
+		t.Errorf("callback called %d times after Stop(); want %d", act, n)
+	}
+}
+
+func TestPollerReadLowWaterInvalid(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	var fds [2]int
+	if err = unix.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	for _, test := range []struct {
+		name string
+		desc *Desc
+		n    int
+	}{
+		{"negative", Must(Handle(conn, EventRead)), -1},
+		{"datagram", Must(Handle(udp.(net.Conn), EventRead)), 8},
+		{"pipe", Must(NewDesc(uintptr(fds[0]), EventRead)), 8},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer test.desc.Close()
+
+			err := poller.StartWithOptions(test.desc, func(Event) {}, Options{
+				ReadLowWater: test.n,
+			})
+			if err != ErrInvalidLowWater {
+				t.Fatalf("StartWithOptions() error is %v; want %v", err, ErrInvalidLowWater)
+			}
+			if n := poller.Stats().Registered; n != 0 {
+				t.Errorf("%d descriptors registered after failed start", n)
+			}
+			// Descriptor must be still usable.
+			if err = poller.Start(test.desc, func(Event) {}); err != nil {
+				t.Fatal(err)
+			}
+			if err = poller.Stop(test.desc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandleListenerUnix(t *testing.T) {
+	for _, network := range []string{"unix", "unixpacket"} {
+		t.Run(network, func(t *testing.T) {
+			if network == "unixpacket" && runtime.GOOS == "darwin" {
+				t.Skipf("%s is not supported on %s", network, runtime.GOOS)
+			}
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			dir, err := ioutil.TempDir("", "netpoll")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			ln, err := net.ListenUnix(network, &net.UnixAddr{
+				Name: filepath.Join(dir, "sock"),
+				Net:  network,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			desc, err := HandleListener(ln, EventRead|EventOneShot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			accepted := make(chan net.Conn, 1)
+			err = poller.Start(desc, func(event Event) {
+				if event&EventRead == 0 {
+					t.Errorf("listener callback called with %s", event)
+					return
+				}
+				conn, err := ln.Accept()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				accepted <- conn
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := net.Dial(network, ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var peer net.Conn
+			select {
+			case peer = <-accepted:
+			case <-time.After(time.Second):
+				t.Fatalf("no connection accepted")
+			}
+			defer peer.Close()
+
+			if _, err = conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(peer, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "hello" {
+				t.Errorf("accepted connection received %q; want %q", buf, "hello")
+			}
+			if err = poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPollerOwner(t *testing.T) {
+	a, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.(io.Closer).Close()
+	b, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.(io.Closer).Close()
+
+	desc, peer, _, _, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer peer.Close()
+
+	noop := func(Event) {}
+	if err = a.Start(desc, noop); err != nil {
+		t.Fatal(err)
+	}
+	if owner := desc.Owner(); owner != a {
+		t.Errorf("Owner() is %v; want %v", owner, a)
+	}
+	if err = a.Start(desc, noop); err != ErrRegistered {
+		t.Errorf("second Start() error is %v; want %v", err, ErrRegistered)
+	}
+	if err = b.Start(desc, noop); err != ErrAlreadyRegistered {
+		t.Errorf("Start() within other poller error is %v; want %v", err, ErrAlreadyRegistered)
+	}
+
+	if err = a.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if owner := desc.Owner(); owner != nil {
+		t.Errorf("Owner() is %v after Stop(); want nil", owner)
+	}
+	if err = b.Start(desc, noop); err != nil {
+		t.Fatalf("Start() within other poller after Stop() error: %v", err)
+	}
+	if owner := desc.Owner(); owner != b {
+		t.Errorf("Owner() is %v; want %v", owner, b)
+	}
+}
+
+func TestPollerBarrier(t *testing.T) {
+	cfg := config(t)
+	cfg.Dispatcher = GoDispatcher
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+	defer desc.Close()
+
+	var (
+		running  int32
+		returned int32
+		started  = make(chan struct{})
+	)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventPollClosed != 0 {
+			return
+		}
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	var called bool
+	poller.Barrier(func() {
+		called = true
+		if n := atomic.LoadInt32(&running); n != 0 {
+			t.Errorf("%d callbacks are running within barrier", n)
+		}
+	})
+	if !called {
+		t.Errorf("barrier function was not called")
+	}
+	if atomic.LoadInt32(&returned) == 0 {
+		t.Errorf("barrier returned before callback")
+	}
+}
+
+func TestSyntheticPair(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	a, b, ra, rb, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	received := make(chan []byte, 1)
+	err = poller.Start(a, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		p := make([]byte, 128)
+		n, err := ra.Read(p)
+		if err != nil {
+			return
+		}
+		received <- p[:n]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	if _, err = rb.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if !bytes.Equal(p, data) {
+			t.Errorf("received %q; want %q", p, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data received")
+	}
+	if err = poller.Stop(a); err != nil {
+		t.Fatal(err)
+	}
+
+	assertHupOnClose(t, poller, b, a)
+
+	if n, err := ra.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read() after peer close = %d, %v; want 0, EOF", n, err)
+	}
+}
+
+func TestDescCloseOnExec(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []DescOption
+		exp  bool
+	}{
+		{"default", nil, true},
+		{"enabled", []DescOption{WithCloseOnExec(true)}, true},
+		{"disabled", []DescOption{WithCloseOnExec(false)}, false},
+		{"inherit", []DescOption{DescOptions{Inherit: true}}, false},
+		{"options", []DescOption{DescOptions{Label: "conn"}}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var fds [2]int
+			if err := unix.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(fds[1])
+
+			desc, err := NewDesc(uintptr(fds[0]), EventRead, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			if act := closeOnExec(t, desc.Fd()); act != test.exp {
+				t.Errorf("close-on-exec is %t; want %t", act, test.exp)
+			}
+		})
+	}
+}
+
+func TestNewDescRaw(t *testing.T) {
+	var calls int
+	defer func(fn func(int, bool) error) {
+		setNonblock = fn
+	}(setNonblock)
+	setNonblock = func(fd int, nonblocking bool) error {
+		calls++
+		return syscall.SetNonblock(fd, nonblocking)
+	}
+
+	for _, test := range []struct {
+		name     string
+		new      func(uintptr, Event, ...DescOption) (*Desc, error)
+		opts     []DescOption
+		nonblock bool
+		owned    bool
+	}{
+		{"default", NewDescRaw, nil, true, true},
+		{"nonblock", NewDescRaw, []DescOption{WithoutNonblock()}, false, true},
+		{"borrowed", NewDescRaw, []DescOption{WithoutOwnership()}, true, false},
+		{"desc", NewDesc, []DescOption{WithoutNonblock(), WithoutOwnership()}, false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			calls = 0
+			var fds [2]int
+			if err := unix.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(fds[1])
+
+			desc, err := test.new(uintptr(fds[0]), EventRead, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act, exp := calls, map[bool]int{true: 1}[test.nonblock]; act != exp {
+				t.Errorf("SetNonblock() called %d times; want %d", act, exp)
+			}
+			if act := nonblock(t, fds[0]); act != test.nonblock {
+				t.Errorf("fd is non-blocking: %t; want %t", act, test.nonblock)
+			}
+			if !closeOnExec(t, fds[0]) {
+				t.Errorf("fd is not close-on-exec")
+			}
+			if err = desc.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Non-owning descriptor leaves the fd usable.
+			_, err = unix.FcntlInt(uintptr(fds[0]), unix.F_GETFD, 0)
+			if test.owned {
+				if err != syscall.EBADF {
+					t.Fatalf("fcntl() on closed fd error is %v; want %v", err, syscall.EBADF)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = unix.Write(fds[1], []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1)
+			if n, err := unix.Read(fds[0], buf); err != nil || n != 1 {
+				t.Fatalf("read from borrowed fd: %d, %v", n, err)
+			}
+			unix.Close(fds[0])
+		})
+	}
+}
+
+func TestHandleConnLifetime(t *testing.T) {
+	cfg := config(t)
+	cfg.ConnLifetimeInterval = 10 * time.Millisecond
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, test := range []struct {
+		name     string
+		lifetime bool
+	}{
+		{"default", false},
+		{"lifetime", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			peer, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+
+			var opts []DescOption
+			if test.lifetime {
+				opts = append(opts, WithConnLifetime(conn))
+			}
+			desc, err := Handle(conn, EventRead|EventEdgeTriggered, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			stopped := make(chan StopReason, 1)
+			err = poller.StartWithOptions(desc, func(Event) {}, WithOnStop(func(_ *Desc, reason StopReason) {
+				stopped <- reason
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.Stop(desc)
+
+			// Close the original connection only.
+			if err = conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+			peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = peer.Read(make([]byte, 1))
+
+			if !test.lifetime {
+				// The duplicate keeps the connection alive.
+				if e, ok := err.(net.Error); !ok || !e.Timeout() {
+					t.Fatalf("peer's Read() error is %v; want timeout", err)
+				}
+				select {
+				case reason := <-stopped:
+					t.Fatalf("descriptor is stopped with %s", reason)
+				default:
+				}
+				return
+			}
+			if err != io.EOF {
+				t.Fatalf("peer's Read() error is %v; want %v", err, io.EOF)
+			}
+			select {
+			case reason := <-stopped:
+				if reason != StopPeerAbandoned {
+					t.Errorf("descriptor is stopped with %s; want %s", reason, StopPeerAbandoned)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("descriptor is not stopped")
+			}
+		})
+	}
+}
+
+func TestHandleNonblock(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			addr := "127.0.0.1:0"
+			if network == "unix" {
+				dir, err := ioutil.TempDir("", "netpoll")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				addr = filepath.Join(dir, "sock")
+			}
+			ln, err := net.Listen(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			conn, err := net.Dial(network, ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			peer, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+
+			desc, err := Handle(conn, EventRead|EventEdgeTriggered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			// File() returns a duplicate sharing the file status flags with
+			// the original descriptor, thus both must be non-blocking.
+			if !nonblock(t, desc.Fd()) {
+				t.Errorf("descriptor is in blocking mode")
+			}
+			rc, err := conn.(syscall.Conn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc.Control(func(fd uintptr) {
+				if !nonblock(t, int(fd)) {
+					t.Errorf("conn's descriptor is in blocking mode")
+				}
+			})
+
+			// Deadlines of the original conn must still work, which is not
+			// the case if its descriptor is in blocking mode.
+			if err = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			read := make(chan error, 1)
+			go func() {
+				_, err := conn.Read(make([]byte, 1))
+				read <- err
+			}()
+			select {
+			case err = <-read:
+				if e, ok := err.(net.Error); !ok || !e.Timeout() {
+					t.Errorf("Read() returned %v; want timeout error", err)
+				}
+			case <-time.After(time.Second):
+				peer.Close()
+				t.Fatal("Read() was not interrupted by the deadline")
+			}
+		})
+	}
+}
+
+func TestHandlePreserving(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Emulate File() of Go versions which put the original descriptor into
+	// blocking mode.
+	desc, err := HandlePreserving(blockingFiler{conn.(*net.TCPConn)}, EventRead|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	if !nonblock(t, desc.Fd()) {
+		t.Errorf("descriptor is in blocking mode")
+	}
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		if !nonblock(t, int(fd)) {
+			t.Errorf("conn's descriptor is in blocking mode")
+		}
+	})
+
+	// Writes on the original conn must not block forever when the peer does
+	// not read.
+	if err = conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		p := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(p); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-written:
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Errorf("Write() returned %v; want timeout error", err)
+		}
+	case <-time.After(5 * time.Second):
+		peer.Close()
+		conn.Close()
+		t.Fatal("Write() was not interrupted by the deadline")
+	}
+}
+
+type blockingFiler struct {
+	*net.TCPConn
+}
+
+func (b blockingFiler) File() (*os.File, error) {
+	f, err := b.TCPConn.File()
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.SetNonblock(int(f.Fd()), false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func nonblock(tb testing.TB, fd int) bool {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return flags&unix.O_NONBLOCK != 0
+}
+
+func TestPollerCloseOnExec(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	fd, err := poller.PollerFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closeOnExec(t, fd) {
+		t.Errorf("poller's descriptor is not close-on-exec")
+	}
+}
+
+func closeOnExec(tb testing.TB, fd int) bool {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return flags&unix.FD_CLOEXEC != 0
+}
+
+func TestDescPollNow(t *testing.T) {
+	a, b, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	event, err := a.PollNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != EventWrite {
+		t.Errorf("PollNow() = %s; want %s", event, Event(EventWrite))
+	}
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if event, err = a.PollNow(); err != nil {
+		t.Fatal(err)
+	}
+	if event&EventRead == 0 {
+		t.Errorf("PollNow() = %s; want %s to be set", event, EventRead)
+	}
+
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if event, err = a.PollNow(); err != nil {
+		t.Fatal(err)
+	}
+	if event&EventHup == 0 {
+		t.Errorf("PollNow() = %s; want %s to be set", event, EventHup)
+	}
+}
+
+func TestDescReadiness(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	rd, wd, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	readiness := func(desc *Desc) Event {
+		event, err := desc.Readiness()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	if event := readiness(rd); event != EventWrite {
+		t.Errorf("Readiness() = %s; want %s", event, EventWrite)
+	}
+
+	// Observe the descriptor in edge-triggered mode to make sure that
+	// Readiness() does not consume the edge.
+	var (
+		mu    sync.Mutex
+		ready = make(chan struct{}, 1)
+	)
+	mu.Lock()
+	err = poller.Start(rd, func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event&EventRead != 0 {
+			select {
+			case ready <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(rd)
+	if err = poller.ModifyEvent(rd, EventRead|EventEdgeTriggered); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if event := readiness(rd); event&EventRead == 0 {
+		t.Errorf("Readiness() = %s; want %s to be set", event, EventRead)
+	}
+	mu.Unlock()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("no event received after Readiness() call")
+	}
+
+	if _, err = fillSendBuffer(wd.Fd()); err != nil {
+		t.Fatal(err)
+	}
+	if event := readiness(wd); event&EventWrite != 0 {
+		t.Errorf("Readiness() = %s; want %s to be clear", event, EventWrite)
+	}
+
+	if err = wd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if event := readiness(rd); event&EventHup == 0 {
+		t.Errorf("Readiness() = %s; want %s to be set", event, EventHup)
+	}
+}
+
+func TestDescReadableWritableBytes(t *testing.T) {
+	rd, wd, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	defer wd.Close()
+
+	before, err := wd.WritableBytes()
+	if err == ErrUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rd.ReadableBytes(); err != nil || n != len(data) {
+		t.Errorf("ReadableBytes() = %d, %v; want %d", n, err, len(data))
+	}
+
+	filled, err := fillSendBuffer(wd.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := wd.WritableBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Errorf("WritableBytes() = %d after writing %d bytes; want less than %d", after, filled, before)
+	}
+}
+
+func TestDrainRead(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+
+	data := bytes.Repeat([]byte("hello, drain!"), 1000)
+	go func() {
+		for p := data; len(p) > 0; {
+			n, err := unix.Write(w, p)
+			if err == syscall.EAGAIN {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			p = p[n:]
+		}
+		unix.Close(w)
+	}()
+
+	var received []byte
+	for {
+		err := DrainRead(desc, func(p []byte) bool {
+			received = append(received, p...)
+			return true
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes; want %d", len(received), len(data))
+	}
+}
+
+func TestDrainReadStop(t *testing.T) {
+	desc, _, _, w, err := NewSyntheticPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	defer w.Close()
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	err = DrainRead(desc, func(p []byte) bool {
+		calls++
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times; want 1", calls)
+	}
+}
+
+func TestWriteAll(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	desc := Must(NewDesc(uintptr(w), EventRead))
+	defer desc.Close()
+
+	data := bytes.Repeat([]byte("hello, write!"), 10000)
+
+	// Not registered descriptor could not be armed.
+	n, err := WriteAll(desc, data)
+	if err != ErrNotRegistered {
+		t.Fatalf("WriteAll() of not registered descriptor returned %v; want %v", err, ErrNotRegistered)
+	}
+	if n == 0 || n == len(data) {
+		t.Fatalf("WriteAll() wrote %d bytes; want partial write", n)
+	}
+	rest := data[n:]
+
+	var (
+		mu   sync.Mutex
+		done = make(chan struct{})
+	)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventWrite == 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		n, err := WriteAll(desc, rest)
+		if err != nil {
+			t.Error(err)
+		}
+		rest = rest[n:]
+		if len(rest) == 0 {
+			close(done)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	events := func() Event {
+		states, err := poller.Export()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return states[0].Event
+	}
+	mu.Lock()
+	n, err = WriteAll(desc, rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest = rest[n:]
+	mu.Unlock()
+	if ev := events(); ev&EventWrite == 0 {
+		t.Fatalf("descriptor is registered for %s after partial write; want %s set", ev, EventWrite)
+	}
+
+	received := make([]byte, 0, len(data))
+	for len(received) < len(data) {
+		buf := make([]byte, 4096)
+		n, err := unix.Read(r, buf)
+		if err == syscall.EAGAIN {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("data was not written completely")
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes; want %d", len(received), len(data))
+	}
+	if ev := events(); ev != EventRead {
+		t.Errorf("descriptor is registered for %s after complete write; want %s", ev, EventRead)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	for _, test := range []struct {
+		name string
+		peer func(t *testing.T, w int, stop <-chan struct{})
+		err  error
+	}{
+		{
+			name: "eof",
+			peer: func(t *testing.T, w int, _ <-chan struct{}) {
+				unix.Write(w, []byte("in-flight"))
+				// Wait for the FIN sent by Drain().
+				var buf [64]byte
+				for {
+					n, err := unix.Read(w, buf[:])
+					if err == unix.EAGAIN {
+						time.Sleep(time.Millisecond)
+						continue
+					}
+					if n <= 0 {
+						break
+					}
+				}
+				unix.Close(w)
+			},
+		},
+		{
+			name: "eof before drain",
+		},
+		{
+			name: "timeout",
+			peer: func(t *testing.T, w int, stop <-chan struct{}) {
+				defer unix.Close(w)
+				data := make([]byte, 1024)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, err := unix.Write(w, data); err == unix.EAGAIN {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			},
+			err: ErrDrainTimeout,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+			if err = poller.Start(desc, func(Event) {}); err != nil {
+				t.Fatal(err)
+			}
+			if test.peer == nil {
+				unix.Write(w, []byte("bye"))
+				unix.Close(w)
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			done := make(chan error, 1)
+			Drain(poller, desc, 100*time.Millisecond, func(err error) {
+				done <- err
+			})
+			stop := make(chan struct{})
+			defer close(stop)
+			if test.peer != nil {
+				go test.peer(t, w, stop)
+			}
+			select {
+			case err := <-done:
+				if err != test.err {
+					t.Errorf("Drain() completed with %v; want %v", err, test.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Drain() was not completed")
+			}
+			if desc.Owner() != nil {
+				t.Errorf("descriptor is still registered after Drain()")
+			}
+			if _, err = unix.FcntlInt(uintptr(r), unix.F_GETFD, 0); err != unix.EBADF {
+				t.Errorf("descriptor is not closed after Drain()")
+			}
+		})
+	}
+}
+
+func TestDescBuffer(t *testing.T) {
+	c := config(t)
+	c.BufferSize = 100
+	poller, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	if n := len(desc.GetBuffer()); n != readBufferSize {
+		t.Errorf("buffer of unregistered descriptor has size %d; want %d", n, readBufferSize)
+	}
+
+	received := make(chan string, 1)
+	err = poller.Start(desc, func(event Event) {
+		buf := desc.GetBuffer()
+		defer desc.PutBuffer(buf)
+		if len(buf) != c.BufferSize {
+			t.Errorf("buffer has size %d; want %d", len(buf), c.BufferSize)
+		}
+		n, _ := unix.Read(desc.Fd(), buf)
+		received <- string(buf[:n])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if _, err = unix.Write(w, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if p != "hello" {
+			t.Errorf("received %q; want %q", p, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	// Buffers of other sizes are not put into the pool.
+	desc.PutBuffer(make([]byte, 10))
+	for i := 0; i < 10; i++ {
+		if n := len(desc.GetBuffer()); n != c.BufferSize {
+			t.Fatalf("buffer has size %d; want %d", n, c.BufferSize)
+		}
+	}
+}
+
+func TestWaitOne(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+
+	if _, err = WaitOne(desc, 10*time.Millisecond); err != ErrWaitTimeout {
+		t.Fatalf("WaitOne() returned %v; want %v", err, ErrWaitTimeout)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		unix.Write(w, []byte("hello"))
+	}()
+	for i := 0; i < 2; i++ {
+		// Descriptor must be deregistered after the first call, so the
+		// second one receives the event again.
+		event, err := WaitOne(desc, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event&EventRead == 0 {
+			t.Fatalf("WaitOne() returned %s; want %s", event, EventRead)
+		}
+	}
+	if desc.Owner() != nil {
+		t.Errorf("descriptor is still registered after WaitOne()")
+	}
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+	if _, err = WaitOne(desc, time.Second); err != ErrAlreadyRegistered {
+		t.Errorf("WaitOne() of registered descriptor returned %v; want %v", err, ErrAlreadyRegistered)
+	}
+}
+
+func TestPollerStopMidBatch(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	const n = 64
+	var (
+		descs = make([]*Desc, n)
+		peers = make([]int, n)
+	)
+	for i := range descs {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(w)
+		descs[i] = Must(NewDesc(uintptr(r), EventRead))
+		defer descs[i].Close()
+		peers[i] = w
+	}
+
+	var (
+		mu      sync.Mutex
+		stopped bool
+		calls   int
+	)
+	for _, desc := range descs {
+		err := poller.Start(desc, func(Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if stopped {
+				return
+			}
+			// Stop all descriptors from within the first callback. Events
+			// of the same batch must not be delivered after that.
+			stopped = true
+			for _, desc := range descs {
+				if err := poller.Stop(desc); err != nil && err != ErrNotRegistered {
+					t.Error(err)
+				}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make all descriptors ready at once, so their events are likely
+	// received within a single batch.
+	for _, w := range peers {
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("callbacks called %d times; want 1", calls)
+	}
+}
+
+func TestPollerCloseContext(t *testing.T) {
+	n := 10000
+	if max := maxOpenFiles(t) - 1024; max < n*2 {
+		n = max / 2
+	}
+	for _, test := range []struct {
+		name string
+		new  func() (EventPoll, error)
+	}{
+		{"inline", func() (EventPoll, error) {
+			return New(config(t))
+		}},
+		{"dispatcher", func() (EventPoll, error) {
+			c := config(t)
+			c.Dispatcher = GoDispatcher
+			return New(c)
+		}},
+		{"pool", func() (EventPoll, error) {
+			return NewPool(&PoolConfig{Size: 4, Config: config(t)})
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := test.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(r)
+			defer unix.Close(w)
+
+			var (
+				closing = make([]int32, n)
+				stopped int32
+			)
+			for i := 0; i < n; i++ {
+				fd, err := unix.Dup(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				desc := Must(NewDesc(uintptr(fd), EventRead|EventEdgeTriggered))
+				defer desc.Close()
+
+				i := i
+				err = poller.StartWithOptions(desc, func(event Event) {
+					if event&EventClosing != 0 {
+						atomic.AddInt32(&closing[i], 1)
+					}
+				}, Options{
+					OnStop: func(*Desc, StopReason) {
+						if c := atomic.LoadInt32(&closing[i]); c != 1 {
+							t.Errorf("OnStop hook #%d called after %d EventClosing; want 1", i, c)
+						}
+						atomic.AddInt32(&stopped, 1)
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err = poller.(interface {
+				CloseContext(context.Context) error
+			}).CloseContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("CloseContext() returned after deadline")
+			}
+			// OnStop hooks of callbacks dispatched with EventPollClosed are
+			// called after they return.
+			for end := time.Now().Add(time.Second); time.Now().Before(end); {
+				if int(atomic.LoadInt32(&stopped)) == n {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if s := atomic.LoadInt32(&stopped); int(s) != n {
+				t.Errorf("%d OnStop hooks called; want %d", s, n)
+			}
+		})
+	}
+}
+
+func TestPollerCapabilities(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	caps := poller.Capabilities()
+	t.Logf("capabilities: %+v", caps)
+	if caps.Backend == "" || !caps.EdgeTriggered || !caps.OneShot {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+	if runtime.GOOS == "linux" {
+		if !caps.Timerfd {
+			t.Errorf("timerfd is reported as not supported")
+		}
+		var uts unix.Utsname
+		if err := unix.Uname(&uts); err != nil {
+			t.Fatal(err)
+		}
+		if exp := kernelAtLeast(uts.Release[:], 4, 5); caps.Exclusive != exp {
+			t.Errorf("Exclusive is %t for kernel %s; want %t", caps.Exclusive, uts.Release[:], exp)
+		}
+	}
+
+	pool, err := NewPool(&PoolConfig{Size: 2, Config: config(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if c := pool.Capabilities(); c != caps {
+		t.Errorf("pool capabilities are %+v; want %+v", c, caps)
+	}
+}
+
+// kernelAtLeast reports whether kernel release is at least major.minor.
+func kernelAtLeast(release []byte, major, minor int) bool {
+	var v [2]int
+	for i, j := 0, 0; i < len(release) && j < len(v); i++ {
+		switch c := release[i]; {
+		case c >= '0' && c <= '9':
+			v[j] = v[j]*10 + int(c-'0')
+		case c == '.':
+			j++
+		default:
+			j = len(v)
+		}
+	}
+	return v[0] > major || v[0] == major && v[1] >= minor
+}
+
+func TestPollerRecordEvents(t *testing.T) {
+	c := config(t)
+	c.RecordEvents = 4
+	poller, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+
+	// Each registration gets its own generation.
+	for i := 0; i < 6; i++ {
+		called := make(chan struct{})
+		err := poller.Start(desc, func(Event) {
+			DrainRead(desc, func([]byte) bool { return true })
+			close(called)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+		if err = poller.Stop(desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = poller.DumpEventsFor(&buf, desc, DumpText); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("dumped %d records; want 4:\n%s", len(lines), buf.String())
+	}
+	var prev uint64
+	for _, line := range lines {
+		var (
+			ts  string
+			fd  int
+			gen uint64
+		)
+		if _, err := fmt.Sscanf(line, "%s fd=%d gen=%d", &ts, &fd, &gen); err != nil {
+			t.Fatalf("could not parse %q: %v", line, err)
+		}
+		if fd != r || gen <= prev {
+			t.Errorf("unexpected record: %q", line)
+		}
+		prev = gen
+	}
+}
+
+func TestDescLabel(t *testing.T) {
+	c := config(t)
+	c.RecordEvents = 4
+	poller, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered, WithLabel("upstream")))
+	defer desc.Close()
+	if s := desc.Label(); s != "upstream" {
+		t.Fatalf("Label() = %q; want %q", s, "upstream")
+	}
+
+	called := make(chan struct{}, 1)
+	err = poller.Start(desc, func(event Event) {
+		DrainRead(desc, func([]byte) bool { return true })
+		// Labels could be changed from within the callback.
+		desc.SetLabel("upstream 10.0.0.1")
+		called <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = poller.DumpEventsFor(&buf, desc, DumpText); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `label="upstream"`) {
+		t.Errorf("no label in dump:\n%s", buf.String())
+	}
+
+	// Force the start error by registering already closed descriptor.
+	fd, err := unix.Dup(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := Must(NewDesc(uintptr(fd), EventRead, WithLabel("bad")))
+	bad.Close()
+	err = poller.Start(bad, func(Event) {})
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Start() error is %v; want *Error", err)
+	}
+	if e.Label != "bad" || !strings.Contains(e.Error(), `"bad"`) {
+		t.Errorf("Start() error has no label: %v", e)
+	}
+}
+
+func TestPollerEventPri(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	desc, err := Handle(conn, EventPri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	pri := make(chan Event, 1)
+	err = poller.Start(desc, func(event Event) {
+		select {
+		case pri <- event:
+		default:
+		}
+	})
+	if !poller.Capabilities().Pri {
+		if err != ErrUnsupported {
+			t.Fatalf("Start() returned %v; want %v", err, ErrUnsupported)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	// Regular data must not be reported.
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-pri:
+		t.Fatalf("unexpected event %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rc, err := client.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sendErr error
+	err = rc.Control(func(fd uintptr) {
+		_, sendErr = unix.SendmsgN(int(fd), []byte{'!'}, nil, nil, unix.MSG_OOB)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+	select {
+	case event := <-pri:
+		if event&EventPri == 0 {
+			t.Errorf("received %s; want %s", event, EventPri)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+// assertHupOnClose closes the closer and asserts that peer descriptor
+// receives hang up event.
+func assertHupOnClose(tb testing.TB, poller EventPoll, closer io.Closer, peer *Desc) {
+	tb.Helper()
+
+	hup := make(chan Event, 1)
+	err := poller.Start(peer, func(event Event) {
+		if event&(EventHup|EventReadHup) != 0 {
+			select {
+			case hup <- event:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer poller.Stop(peer)
+
+	if err = closer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	select {
+	case <-hup:
+	case <-time.After(time.Second):
+		tb.Fatalf("no hang up event received after close")
+	}
+}
+
+func emptyRecvBuffer(fd int, k int) (n int, err error) {
+	for eagain := 0; eagain < 10; {
+		var x int
+		p := make([]byte, k+1)
+		x, err = unix.Read(fd, p)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				err = nil
+				eagain++
+				continue
+			}
+			return
+		}
+		n += x
+	}
+	return
+}
+
+func fillSendBuffer(fd int) (n int, err error) {
+	p := bytes.Repeat([]byte{'x'}, 1)
+	for eagain := 0; eagain < 10; {
+		var x int
+		x, err = unix.Write(fd, p)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				err = nil
+				eagain++
+				continue
+			}
+			return
+		}
+		n += x
+	}
+	return
+}
+
+func TestDescLastWriteSpace(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	// Leave enough space for the socket to stay writable after writes.
+	if err = unix.SetsockoptInt(w, unix.SOL_SOCKET, unix.SO_SNDBUF, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(w), EventWrite|EventOneShot))
+	defer desc.Close()
+
+	space := make(chan int, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventWrite != 0 {
+			space <- desc.LastWriteSpace()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	next := func() int {
+		select {
+		case n := <-space:
+			return n
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+		return 0
+	}
+	prev := next()
+	if prev == 0 {
+		t.Skip("write space is not reported on this platform")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = unix.Write(w, make([]byte, 256)); err != nil {
+			t.Fatal(err)
+		}
+		if err = poller.Resume(desc); err != nil {
+			t.Fatal(err)
+		}
+		n := next()
+		if n >= prev {
+			t.Fatalf("LastWriteSpace() = %d after write; want less than %d", n, prev)
+		}
+		prev = n
+	}
+}
+
+func TestPollerSetDeliveryMask(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventWrite))
+	defer desc.Close()
+
+	if err = poller.SetDeliveryMask(desc, EventRead); err != ErrNotRegistered {
+		t.Fatalf("SetDeliveryMask() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	events := make(chan Event, 1024)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead != 0 {
+			unix.Read(r, make([]byte, 16))
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	// Socket is always writable, thus callback is called continuously.
+	select {
+	case event := <-events:
+		if event&EventWrite == 0 {
+			t.Fatalf("received %s; want %s", event, EventWrite)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	if err = poller.SetDeliveryMask(desc, EventRead); err != nil {
+		t.Fatal(err)
+	}
+	poller.Barrier(func() {
+		for len(events) > 0 {
+			<-events
+		}
+	})
+
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(100 * time.Millisecond)
+	var read bool
+	for done := false; !done; {
+		select {
+		case event := <-events:
+			if event&EventWrite != 0 {
+				t.Fatalf("received masked %s", EventWrite)
+			}
+			read = read || event&EventRead != 0
+		case <-timeout:
+			done = true
+		}
+	}
+	if !read {
+		t.Fatalf("no %s received", EventRead)
+	}
+
+	if err = poller.SetDeliveryMask(desc, ^Event(0)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event&EventWrite == 0 {
+			t.Fatalf("received %s; want %s", event, EventWrite)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received after unmasking")
+	}
+}
+
+func TestPollerWakeup(t *testing.T) {
+	var woken int64
+	cfg := config(t)
+	cfg.OnWakeup = func() {
+		atomic.AddInt64(&woken, 1)
+	}
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	const (
+		producers = 8
+		calls     = 1000
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				if err := poller.Wakeup(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := poller.Stats()
+	if stats.Wakeups != producers*calls {
+		t.Fatalf("Stats.Wakeups = %d; want %d", stats.Wakeups, producers*calls)
+	}
+	// Every wakeup which was not coalesced results in a separate OnWakeup
+	// call.
+	want := int64(stats.Wakeups - stats.CoalescedWakeups)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&woken) != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("OnWakeup called %d times; want %d", atomic.LoadInt64(&woken), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Wakeup after the previous one was handled wakes the loop again.
+	if err = poller.Wakeup(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&woken) != want+1; {
+		if time.Now().After(deadline) {
+			t.Fatal("OnWakeup is not called")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	poller.(io.Closer).Close()
+	if err = poller.Wakeup(); err != ErrClosed {
+		t.Fatalf("Wakeup() error after Close() is %v; want %v", err, ErrClosed)
+	}
+}
+
+func TestModifyIfSupported(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	for _, test := range []struct {
+		name    string
+		starter Starter
+	}{
+		{"native", poller},
+		{"fallback", starterOnly{poller}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+
+			events := make(chan Event, 1)
+			cb := func(event Event) {
+				select {
+				case events <- event:
+				default:
+				}
+			}
+			if err = test.starter.Start(desc, cb); err != nil {
+				t.Fatal(err)
+			}
+			defer test.starter.Stop(desc)
+
+			if err = ModifyIfSupported(test.starter, desc, EventWrite, cb); err != nil {
+				t.Fatal(err)
+			}
+			if desc.event != EventRead {
+				t.Errorf("descriptor's event is changed to %s", desc.event)
+			}
+			select {
+			case event := <-events:
+				if event&EventWrite == 0 {
+					t.Fatalf("received %s; want %s", event, EventWrite)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no event received")
+			}
+		})
+	}
+	if err = CloseIfSupported(starterOnly{poller}); err != ErrUnsupported {
+		t.Errorf("CloseIfSupported() error is %v; want %v", err, ErrUnsupported)
+	}
+	if err = CloseIfSupported(poller); err != nil {
+		t.Errorf("CloseIfSupported() error is %v", err)
+	}
+}
+
+// starterOnly hides the methods of EventPoll other than the Starter ones.
+type starterOnly struct {
+	p Starter
+}
+
+func (s starterOnly) Start(desc *Desc, cb CallbackFn) error { return s.p.Start(desc, cb) }
+func (s starterOnly) Stop(desc *Desc) error                 { return s.p.Stop(desc) }
+func (s starterOnly) Resume(desc *Desc) error               { return s.p.Resume(desc) }
+
+func TestPollerStopAll(t *testing.T) {
+	const n = 8
+	for _, test := range []struct {
+		name string
+		new  func() (EventPoll, error)
+	}{
+		{"poller", func() (EventPoll, error) {
+			return New(config(t))
+		}},
+		{"pool", func() (EventPoll, error) {
+			return NewPool(&PoolConfig{Size: 4, Config: config(t)})
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := test.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			if err = poller.StopAll(); err != nil {
+				t.Fatalf("StopAll() of empty poller returned %v", err)
+			}
+
+			var (
+				mu      sync.Mutex
+				reasons = make(map[*Desc]StopReason)
+				descs   = make([]*Desc, n)
+			)
+			for i := range descs {
+				r, w, err := socketPair()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer unix.Close(w)
+				desc := Must(NewDesc(uintptr(r), EventRead))
+				defer desc.Close()
+				descs[i] = desc
+
+				err = poller.StartWithOptions(desc, func(Event) {}, WithOnStop(func(desc *Desc, reason StopReason) {
+					mu.Lock()
+					reasons[desc] = reason
+					mu.Unlock()
+				}))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = poller.StopAll(); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			for _, desc := range descs {
+				if reason, ok := reasons[desc]; !ok || reason != StopReset {
+					t.Errorf("descriptor is stopped with %s (%t); want %s", reason, ok, StopReset)
+				}
+			}
+			mu.Unlock()
+			if s := poller.Stats(); s.Registered != 0 {
+				t.Errorf("%d descriptors left registered", s.Registered)
+			}
+			if err = poller.Stop(descs[0]); err != ErrNotRegistered {
+				t.Errorf("Stop() after StopAll() returned %v; want %v", err, ErrNotRegistered)
+			}
+
+			// Poller must remain usable.
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+
+			called := make(chan struct{}, 1)
+			err = poller.Start(desc, func(event Event) {
+				var buf [64]byte
+				unix.Read(r, buf[:])
+				select {
+				case called <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.Stop(desc)
+
+			if _, err = unix.Write(w, []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-called:
+			case <-time.After(time.Second):
+				t.Fatal("no callback call after StopAll()")
+			}
+		})
+	}
+}
+
+func TestPollerStopAndClose(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	// closed reports whether the peer's end of w is closed.
+	closed := func(w int) bool {
+		n, err := unix.Read(w, make([]byte, 1))
+		return n == 0 && err == nil
+	}
+
+	t.Run("outside", func(t *testing.T) {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(w)
+		desc := Must(NewDesc(uintptr(r), EventRead))
+		if err = poller.Start(desc, func(Event) {}); err != nil {
+			t.Fatal(err)
+		}
+		if err = poller.StopAndClose(desc); err != nil {
+			t.Fatal(err)
+		}
+		if !closed(w) {
+			t.Fatalf("descriptor is not closed")
+		}
+		if err = poller.StopAndClose(desc); err != ErrNotRegistered {
+			t.Fatalf("second StopAndClose() error is %v; want %v", err, ErrNotRegistered)
+		}
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(w)
+		desc := Must(NewDesc(uintptr(r), EventRead))
+
+		var (
+			open    = make(chan bool, 1)
+			stopped = make(chan struct{})
+		)
+		err = poller.StartWithOptions(desc, func(event Event) {
+			if event&EventRead == 0 {
+				return
+			}
+			if err := poller.StopAndClose(desc); err != nil {
+				t.Error(err)
+			}
+			// The descriptor must stay open until the callback returns.
+			_, err := unix.FcntlInt(uintptr(r), unix.F_GETFD, 0)
+			open <- err == nil
+		}, WithOnStop(func(*Desc, StopReason) {
+			close(stopped)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ok := <-open:
+			if !ok {
+				t.Fatalf("descriptor is closed under the running callback")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+		<-stopped
+		for deadline := time.Now().Add(time.Second); !closed(w); {
+			if time.Now().After(deadline) {
+				t.Fatalf("descriptor is not closed after callback returned")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestPollerStrictEdge(t *testing.T) {
+	undrained := make(chan int, 1)
+	cfg := config(t)
+	cfg.StrictEdge = true
+	cfg.OnUndrained = func(_ *Desc, n int) {
+		undrained <- n
+	}
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+
+	var drain int32
+	called := make(chan struct{}, 1)
+	err = poller.Start(desc, func(event Event) {
+		if atomic.LoadInt32(&drain) == 1 {
+			DrainRead(desc, func([]byte) bool { return true })
+		} else {
+			// Read less than available.
+			unix.Read(r, make([]byte, 1))
+		}
+		called <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	write := func() {
+		if _, err := unix.Write(w, []byte("xxx")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	write()
+	select {
+	case n := <-undrained:
+		if n != 2 {
+			t.Errorf("OnUndrained called with %d bytes; want 2", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnUndrained is not called")
+	}
+
+	atomic.StoreInt32(&drain, 1)
+	write()
+	// Wait for the check made after the callback returned.
+	poller.Barrier(nil)
+	select {
+	case n := <-undrained:
+		t.Fatalf("OnUndrained called with %d bytes after drain", n)
+	default:
+	}
+}
+
+func TestPollerBatchHandler(t *testing.T) {
+	cfg := config(t)
+	cfg.ExternalLoop = true
+	poller, err := New(cfg)
+	skipUnsupported(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var (
+		descs     []*Desc
+		writes    []int
+		callbacks int32
+	)
+	for i := 0; i < 3; i++ {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(w)
+		desc := Must(NewDesc(uintptr(r), EventRead))
+		defer desc.Close()
+
+		// Only the first descriptor has callback, which must not be
+		// called in the batch mode.
+		var cb CallbackFn
+		if i == 0 {
+			cb = func(event Event) {
+				if event&EventRead != 0 {
+					atomic.AddInt32(&callbacks, 1)
+				}
+			}
+		}
+		if err = poller.Start(desc, cb); err != nil {
+			t.Fatal(err)
+		}
+		defer poller.Stop(desc)
+
+		descs = append(descs, desc)
+		writes = append(writes, w)
+	}
+
+	var (
+		calls int
+		first *Ready
+		seen  = make(map[*Desc]Event)
+	)
+	poller.SetBatchHandler(func(batch []Ready) {
+		calls++
+		if calls == 1 {
+			first = &batch[0]
+		} else if &batch[0] != first {
+			t.Errorf("batch slice is not reused between calls")
+		}
+		for _, r := range batch {
+			seen[r.Desc] |= r.Events
+		}
+	})
+
+	for _, w := range writes {
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Descriptors are level-triggered and not read, thus both iterations
+	// must report all of them.
+	for i := 0; i < 2; i++ {
+		if err = poller.Iterate(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("batch handler called %d times; want 2", calls)
+	}
+	if n := atomic.LoadInt32(&callbacks); n != 0 {
+		t.Errorf("callback called %d times in batch mode; want 0", n)
+	}
+	for i, desc := range descs {
+		if seen[desc]&EventRead == 0 {
+			t.Errorf("descriptor #%d is not reported ready", i)
+		}
+	}
+
+	// Switch back to the callbacks; descriptors without callback must be
+	// silently skipped.
+	poller.SetBatchHandler(nil)
+	if err = poller.Iterate(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("batch handler called after reset")
+	}
+	if n := atomic.LoadInt32(&callbacks); n != 1 {
+		t.Errorf("callback called %d times after reset; want 1", n)
+	}
+}
+
+func TestPollerMergeEvents(t *testing.T) {
+	cfg := config(t)
+	cfg.ExternalLoop = true
+	ep, err := New(cfg)
+	skipUnsupported(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+	defer desc.Close()
+
+	var events []Event
+	err = ep.Start(desc, func(event Event) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Stop(desc)
+
+	// Peer writes and hangs up at once: the data and the hang up must be
+	// delivered by a single callback call.
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Close(w); err != nil {
+		t.Fatal(err)
+	}
+	if err = ep.Iterate(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("callback called with %v; want single call", events)
+	}
+	if exp := EventRead | EventReadHup; events[0]&exp != exp {
+		t.Fatalf("callback called with %s; want %s", events[0], exp)
+	}
+
+	// Events reported separately by the backend within the iteration are
+	// merged as well.
+	events = events[:0]
+	p := ep.(*poller)
+	reg := p.regs[desc]
+	reg.notify(EventRead, 1, 0)
+	reg.notify(EventReadHup, 0, 0)
+	p.flushBatch()
+	if len(events) != 1 || events[0] != EventRead|EventReadHup {
+		t.Fatalf("callback called with %v; want single call with %s", events, EventRead|EventReadHup)
+	}
+}
+
+func socketPair() (r, w int, err error) {
+	fd, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return
+	}
+
+	if err = unix.SetNonblock(fd[0], true); err != nil {
+		return
+	}
+	if err = unix.SetNonblock(fd[1], true); err != nil {
+		return
+	}
+
+	buf := 4096
+	if err = unix.SetsockoptInt(fd[0], unix.SOL_SOCKET, unix.SO_SNDBUF, buf); err != nil {
+		return
+	}
+	if err = unix.SetsockoptInt(fd[1], unix.SOL_SOCKET, unix.SO_SNDBUF, buf); err != nil {
+		return
+	}
+	if err = unix.SetsockoptInt(fd[0], unix.SOL_SOCKET, unix.SO_RCVBUF, buf); err != nil {
+		return
+	}
+	if err = unix.SetsockoptInt(fd[1], unix.SOL_SOCKET, unix.SO_RCVBUF, buf); err != nil {
+		return
+	}
+	return fd[0], fd[1], nil
+}
+
+// testBackend is the backend the tests are run against.
+var testBackend = flag.String("netpoll.backend", "", "backend of the pollers created by tests")
+
+// skipUnsupported skips the test if err is ErrUnsupported returned by the
+// backend selected by -netpoll.backend flag.
+func skipUnsupported(tb testing.TB, err error) {
+	if err == ErrUnsupported && *testBackend != "" {
+		tb.Skipf("not supported by %q backend", *testBackend)
 	}
-	return fd[0], fd[1], nil
 }
 
 func config(tb testing.TB) *Config {
 	return &Config{
-		OnWaitError: func(err error) {
+		Backend: *testBackend,
+		OnWaitError: func(err error) bool {
 			tb.Fatal(err)
+			return false
 		},
 	}
 }
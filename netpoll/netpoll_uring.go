@@ -0,0 +1,560 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newUringPoller creates poller backed by io_uring. It returns
+// ErrUnsupported if the kernel is older than 5.13, which added multishot
+// poll requests.
+func newUringPoller(cfg Config) (*poller, error) {
+	if cfg.ExternalLoop || cfg.WakeupMethod != WakeupDefault || !kernelVersionAtLeast(5, 13) {
+		return nil, ErrUnsupported
+	}
+	p := newPoller(cfg)
+	p.caps.Backend = BackendUring
+	// Poll requests are not completed by the arrival of urgent data alone.
+	p.caps.Pri = false
+
+	ur, err := newUringBackend(cfg.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	ur.onBatch = p.flushBatch
+	ur.onWakeup = p.onWakeup
+
+	started := make(chan error, 1)
+	go ur.wait(p.onWaitError, cfg.cpus, idleTracker{
+		fn:        cfg.OnIdle,
+		threshold: cfg.IdleThreshold,
+	}, started)
+	if err = <-started; err != nil {
+		// The wait loop has exited and closed the ring.
+		return nil, err
+	}
+
+	p.backend = ur
+
+	return p, nil
+}
+
+// uringBackend implements backend interface on top of io_uring. Descriptors
+// are observed by poll requests: multishot ones for edge-triggered
+// descriptors, and single-shot ones for the others.
+// Readiness is delivered through the completion queue, which is consumed
+// without system calls while it is not empty.
+//
+// Poll request holds a reference to the file, thus closing the descriptor
+// does not remove it from observation, unlike epoll. Desc.Close() cancels
+// the request of the registered descriptor by unpin() to close the file
+// actually.
+type uringBackend struct {
+	// waitNanos is the total time spent in io_uring_enter(2) waiting for
+	// completions and waits is the number of such calls. They are updated
+	// only if metrics is true and must be accessed atomically.
+	waitNanos uint64
+	waits     uint64
+
+	// triggered is set to 1 by trigger() until the wait loop calls
+	// onWakeup. Must be accessed atomically.
+	triggered int32
+
+	mu sync.Mutex
+
+	ring     *uring
+	fd       int
+	closed   bool
+	gen      uint32
+	metrics  bool
+	waitDone chan struct{}
+	onBatch  func()
+	onWakeup func()
+
+	entries map[int]*uringEntry
+}
+
+// uringEntry holds the state of a descriptor registered within uring.
+type uringEntry struct {
+	cb func(Event, int64, uint32)
+
+	// gen is the generation of the poll request being in flight, or zero if
+	// there is no such request (e.g. one-shot request was completed).
+	// Completions of other generations are stale and are ignored.
+	gen uint32
+
+	// poll is the events of the last submitted poll request.
+	poll Event
+
+	// rearm is set when the single-shot request of level-triggered
+	// descriptor is completed and must be made again after the callback.
+	rearm bool
+
+	// handling is set while the wait loop calls the callback of the
+	// descriptor.
+	handling bool
+
+	// unpinned is set by unpin() when the descriptor is about to be closed.
+	unpinned bool
+}
+
+// User data of the requests is the generation in the upper half and the
+// descriptor in the lower one. Generation is never zero for poll requests
+// of descriptors, thus the values below are used for internal requests.
+const (
+	uringWakeupData = 1
+	uringRemoveData = 2
+)
+
+func newUringBackend(metrics bool) (*uringBackend, error) {
+	ring, err := newUring()
+	if err != nil {
+		return nil, err
+	}
+	return &uringBackend{
+		ring:     ring,
+		fd:       ring.fd,
+		metrics:  metrics,
+		waitDone: make(chan struct{}),
+		entries:  make(map[int]*uringEntry),
+	}, nil
+}
+
+func (s *uringBackend) add(fd int, event Event, cb func(Event, int64, uint32)) error {
+	// Poll requests report errors asynchronously, so check the descriptor
+	// up front to fail the same way as epoll_ctl(2) does.
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if mode := st.Mode & unix.S_IFMT; mode == unix.S_IFREG || mode == unix.S_IFDIR {
+		return unix.EPERM
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if _, has := s.entries[fd]; has {
+		return ErrRegistered
+	}
+	e := &uringEntry{cb: cb}
+	if err := s.arm(fd, e, event); err != nil {
+		return err
+	}
+	s.entries[fd] = e
+
+	return nil
+}
+
+func (s *uringBackend) lowWater(fd int, n int) error {
+	// Poll requests honor SO_RCVLOWAT the same way as epoll does.
+	return socketLowWater(fd, n)
+}
+
+func (s *uringBackend) del(fd int, _ Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	e, ok := s.entries[fd]
+	if !ok {
+		return ErrNotRegistered
+	}
+	delete(s.entries, fd)
+	if e.unpinned {
+		// Closed descriptor is removed from the epoll set by the kernel,
+		// thus epoll_ctl(2) fails with EBADF then.
+		return unix.EBADF
+	}
+	s.cancel(fd, e)
+	return s.ring.submit()
+}
+
+func (s *uringBackend) mod(fd int, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.entry(fd)
+	if err != nil {
+		return err
+	}
+	s.cancel(fd, e)
+	if e.handling && level(event) {
+		// Level-triggered request is made again after the callback, the
+		// same as on completion. Otherwise it would report the readiness
+		// which is about to be consumed by the callback, e.g. when parked
+		// descriptor is promoted, while epoll rechecks it on wait.
+		e.poll = event
+		e.rearm = true
+		return nil
+	}
+	return s.arm(fd, e, event)
+}
+
+func (s *uringBackend) change(fd int, _, event Event) error {
+	return s.mod(fd, event)
+}
+
+func (s *uringBackend) disarm(fd int, _ Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.entry(fd)
+	if err != nil {
+		return err
+	}
+	s.cancel(fd, e)
+	// Hang ups and errors are reported for any poll request, thus request
+	// them once, the same as EPOLLONESHOT without events does.
+	return s.arm(fd, e, EventOneShot)
+}
+
+// unpin cancels the poll request of fd, which is about to be closed. It
+// implements filePinner interface.
+func (s *uringBackend) unpin(fd int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.entry(fd)
+	if err != nil {
+		return
+	}
+	e.unpinned = true
+	e.rearm = false
+	if e.gen != 0 {
+		s.cancel(fd, e)
+		s.ring.submit()
+	}
+}
+
+// entry returns the entry of registered fd. Note that s.mu must be held.
+func (s *uringBackend) entry(fd int) (*uringEntry, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	e, ok := s.entries[fd]
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	if e.unpinned {
+		return nil, unix.EBADF
+	}
+	return e, nil
+}
+
+// arm submits the poll request of fd for given events. If it could not be
+// submitted, it is cancelled and fd is left disarmed.
+// Note that s.mu must be held.
+func (s *uringBackend) arm(fd int, e *uringEntry, event Event) error {
+	if err := s.prep(fd, e, event); err != nil {
+		return err
+	}
+	if err := s.ring.submit(); err != nil {
+		// The request is left queued, thus make it to be removed right
+		// after it is submitted.
+		s.cancel(fd, e)
+		return err
+	}
+	return nil
+}
+
+// prep queues the poll request of fd for given events. Edge-triggered
+// descriptors are observed by multishot requests. Level-triggered ones are
+// observed by single-shot requests which are made again by the wait loop
+// after the callback is called, thus the kernel reports the readiness
+// again and again until it is consumed, the same as epoll does.
+// Note that s.mu must be held.
+func (s *uringBackend) prep(fd int, e *uringEntry, event Event) error {
+	sqe := s.sqe()
+	if sqe == nil {
+		return unix.EBUSY
+	}
+	if s.gen++; s.gen == 0 {
+		s.gen++
+	}
+	e.gen = s.gen
+	e.poll = event
+	e.rearm = false
+
+	sqe.opcode = _IORING_OP_POLL_ADD
+	sqe.fd = int32(fd)
+	sqe.pollEvents = uint32(toEpollEvent(event) &^ (EPOLLET | EPOLLONESHOT | EPOLLWAKEUP))
+	sqe.userData = uint64(e.gen)<<32 | uint64(uint32(fd))
+	if multishot(event) {
+		sqe.len = _IORING_POLL_ADD_MULTI
+	}
+	return nil
+}
+
+// multishot reports whether descriptor registered with event is observed by
+// multishot poll request.
+func multishot(event Event) bool {
+	return event&(EventEdgeTriggered|EventOneShot) == EventEdgeTriggered
+}
+
+// level reports whether descriptor registered with event is level-triggered.
+func level(event Event) bool {
+	return event&(EventEdgeTriggered|EventOneShot) == 0
+}
+
+// cancel queues the removal of the poll request of fd, if any. The request
+// is submitted by the next submit() call.
+// Note that s.mu must be held.
+func (s *uringBackend) cancel(fd int, e *uringEntry) {
+	e.rearm = false
+	if e.gen == 0 {
+		return
+	}
+	if sqe := s.sqe(); sqe != nil {
+		sqe.opcode = _IORING_OP_POLL_REMOVE
+		sqe.fd = -1
+		sqe.addr = uint64(e.gen)<<32 | uint64(uint32(fd))
+		sqe.userData = uringRemoveData
+	}
+	// The completions of the request are ignored from now on anyway.
+	e.gen = 0
+}
+
+// sqe returns the next submission queue entry, submitting the queued ones if
+// the queue is full. Note that s.mu must be held.
+func (s *uringBackend) sqe() *uringSQE {
+	if sqe := s.ring.sqe(); sqe != nil {
+		return sqe
+	}
+	if s.ring.submit() != nil {
+		return nil
+	}
+	return s.ring.sqe()
+}
+
+// Fd returns the io_uring file descriptor.
+func (s *uringBackend) Fd() int {
+	return s.fd
+}
+
+func (s *uringBackend) Iterate(time.Duration) error {
+	return ErrNotExternalLoop
+}
+
+func (s *uringBackend) internalFds() []int {
+	// The loop is woken up by no-op request, which needs no descriptor.
+	return []int{s.fd}
+}
+
+func (s *uringBackend) waitBlocked() (nanos, calls uint64) {
+	return atomic.LoadUint64(&s.waitNanos), atomic.LoadUint64(&s.waits)
+}
+
+// wakeup submits no-op request, the completion of which wakes up the wait
+// loop. Note that s.mu must be held.
+func (s *uringBackend) wakeup() error {
+	sqe := s.sqe()
+	if sqe == nil {
+		return unix.EBUSY
+	}
+	sqe.opcode = _IORING_OP_NOP
+	sqe.fd = -1
+	sqe.userData = uringWakeupData
+	return s.ring.submit()
+}
+
+// trigger wakes up the wait loop, which calls onWakeup then.
+func (s *uringBackend) trigger() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	atomic.StoreInt32(&s.triggered, 1)
+	return s.wakeup()
+}
+
+// Close stops wait loop and closes all underlying resources.
+func (s *uringBackend) Close() (err error) {
+	s.mu.Lock()
+	{
+		if s.closed {
+			s.mu.Unlock()
+			return ErrClosed
+		}
+		s.closed = true
+
+		if err = s.wakeup(); err != nil {
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	<-s.waitDone
+
+	s.mu.Lock()
+	entries := s.entries
+	s.entries = nil
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		e.cb(EventPollClosed, 0, 0)
+	}
+
+	return nil
+}
+
+// wait runs the wait loop. The result of binding the loop to cpus is sent
+// to started, which must be buffered, before the loop begins.
+func (s *uringBackend) wait(onError func(error) bool, cpus []int, idle idleTracker, started chan<- error) {
+	defer func() {
+		if err := s.ring.close(); err != nil {
+			onError(os.NewSyscallError("close", err))
+		}
+		close(s.waitDone)
+	}()
+
+	if len(cpus) > 0 {
+		if err := bindThread(cpus); err != nil {
+			started <- err
+			return
+		}
+	}
+	started <- nil
+
+	var (
+		cqes    = make([]uringCQE, len(s.ring.cqes))
+		timeout = int64(idle.timeout())
+		start   int64
+	)
+	for {
+		n := s.ring.reap(cqes)
+		if n == 0 {
+			if s.metrics || idle.fn != nil {
+				start = nanotime()
+			}
+			err := s.ring.wait(timeout)
+			if s.metrics {
+				atomic.AddUint64(&s.waitNanos, uint64(nanotime()-start))
+				atomic.AddUint64(&s.waits, 1)
+			}
+			switch err {
+			case nil, unix.EINTR:
+			case unix.ETIME:
+				idle.observe(start, 0)
+			default:
+				err = wrapErr("wait", s.fd, 0, os.NewSyscallError("io_uring_enter", err))
+				if temporaryErr(err) || onError(err) {
+					continue
+				}
+				return
+			}
+			continue
+		}
+		idle.observe(start, n)
+
+		var woken bool
+		for i := range cqes[:n] {
+			switch cqes[i].userData {
+			case uringWakeupData:
+				woken = true
+			case uringRemoveData:
+			default:
+				s.handle(cqes[i])
+			}
+		}
+		if woken {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			if atomic.SwapInt32(&s.triggered, 0) == 1 && s.onWakeup != nil {
+				s.onWakeup()
+			}
+		}
+		if s.onBatch != nil {
+			s.onBatch()
+		}
+		if err := s.flush(); err != nil {
+			err = wrapErr("wait", s.fd, 0, err)
+			if !temporaryErr(err) && !onError(err) {
+				return
+			}
+		}
+
+		// give more chance to other goroutine
+		runtime.Gosched()
+	}
+}
+
+// flush submits the requests made again by handle(). They are submitted by
+// the next wait() call, if there are no completions to be handled before
+// it.
+func (s *uringBackend) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ring.ready() == 0 {
+		s.ring.publish()
+		return nil
+	}
+	return s.ring.submit()
+}
+
+// handle calls the callback of the descriptor the completion cqe belongs to.
+// Descriptor's entry is looked up at the time of the call, thus the
+// callback of the descriptor removed or modified after the request was
+// completed is not called.
+func (s *uringBackend) handle(cqe uringCQE) {
+	fd := int(uint32(cqe.userData))
+	gen := uint32(cqe.userData >> 32)
+
+	s.mu.Lock()
+	e, ok := s.entries[fd]
+	if !ok || e.gen != gen {
+		s.mu.Unlock()
+		return
+	}
+	if cqe.flags&_IORING_CQE_F_MORE == 0 {
+		e.gen = 0
+	}
+	if cqe.res == -int32(unix.ECANCELED) || (cqe.res >= 0 && e.gen == 0 && multishot(e.poll)) {
+		// The request was cancelled by the kernel, e.g. when the thread
+		// which submitted it has exited, or the multishot request was
+		// terminated (e.g. due to overflow of the completion queue). Make
+		// it again: the current readiness is reported then.
+		_ = s.prep(fd, e, e.poll)
+		if cqe.res < 0 {
+			s.mu.Unlock()
+			return
+		}
+	}
+	e.rearm = e.gen == 0 && level(e.poll)
+	e.handling = true
+	cb := e.cb
+	s.mu.Unlock()
+
+	event := fromEpollEvent(EpollEvent(cqe.res))
+	if cqe.res < 0 {
+		event = EventErr
+	}
+	cb(event, 0, uint32(cqe.res))
+
+	s.mu.Lock()
+	e.handling = false
+	if e.rearm && !s.closed && s.entries[fd] == e {
+		_ = s.prep(fd, e, e.poll)
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,227 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newUringTest creates poller backed by io_uring or skips the test if it is
+// not supported.
+func newUringTest(tb testing.TB, cfg *Config) EventPoll {
+	cfg.Backend = BackendUring
+	poller, err := New(cfg)
+	if err == ErrUnsupported {
+		tb.Skip("io_uring backend is not supported")
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return poller
+}
+
+func TestBackend(t *testing.T) {
+	uring := true
+	if p, err := New(&Config{Backend: BackendUring}); err == nil {
+		p.(io.Closer).Close()
+	} else {
+		uring = false
+	}
+	auto := BackendEpoll
+	if uring {
+		auto = BackendUring
+	}
+	for _, test := range []struct {
+		name    string
+		cfg     Config
+		backend string
+		err     error
+	}{
+		{name: "default", backend: BackendEpoll},
+		{name: "epoll", cfg: Config{Backend: BackendEpoll}, backend: BackendEpoll},
+		{name: "auto", cfg: Config{Backend: BackendAuto}, backend: auto},
+		{
+			name:    "auto external loop",
+			cfg:     Config{Backend: BackendAuto, ExternalLoop: true},
+			backend: BackendEpoll,
+		},
+		{
+			name:    "auto wakeup method",
+			cfg:     Config{Backend: BackendAuto, WakeupMethod: WakeupPipe},
+			backend: BackendEpoll,
+		},
+		{
+			name: "uring external loop",
+			cfg:  Config{Backend: BackendUring, ExternalLoop: true},
+			err:  ErrUnsupported,
+		},
+		{name: "kqueue", cfg: Config{Backend: "kqueue"}, err: ErrUnsupported},
+		{name: "unknown", cfg: Config{Backend: "select"}, err: ErrUnsupported},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(&test.cfg)
+			if err != test.err {
+				t.Fatalf("New() error is %v; want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			defer poller.(io.Closer).Close()
+
+			if act := poller.Capabilities().Backend; act != test.backend {
+				t.Errorf("backend is %q; want %q", act, test.backend)
+			}
+		})
+	}
+}
+
+func TestUringDescClose(t *testing.T) {
+	poller := newUringTest(t, config(t))
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	// Poll request holds the file, thus the peer sees the hang up only if
+	// the request is cancelled by Close().
+	if err = desc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fds := []unix.PollFd{{Fd: int32(w), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 1000); err != nil || n != 1 {
+		t.Fatalf("peer is not notified about close: %d, %v", n, err)
+	}
+	if fds[0].Revents&unix.POLLHUP == 0 {
+		t.Errorf("peer received %#x; want POLLHUP", fds[0].Revents)
+	}
+	if err = poller.Stop(desc); err == nil {
+		t.Errorf("Stop() of closed desc returned no error")
+	}
+}
+
+func TestUringLevelTriggered(t *testing.T) {
+	poller := newUringTest(t, config(t))
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	var (
+		calls int32
+		read  = make(chan struct{})
+	)
+	err = poller.Start(desc, func(event Event) {
+		// Consume the data on the third call only: the readiness must be
+		// reported again until then.
+		if atomic.AddInt32(&calls, 1) == 3 {
+			var buf [64]byte
+			unix.Read(r, buf[:])
+			close(read)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatalf("callback called %d times", atomic.LoadInt32(&calls))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("callback called %d times; want 3", n)
+	}
+}
+
+// BenchmarkPollerBackend compares the number of system calls made to wait
+// for events by epoll and io_uring backends, when the events keep coming.
+func BenchmarkPollerBackend(b *testing.B) {
+	const n = 64
+	for _, backend := range []string{BackendEpoll, BackendUring} {
+		b.Run(backend, func(b *testing.B) {
+			cfg := config(b)
+			cfg.Metrics = true
+			cfg.Backend = backend
+			p, err := New(cfg)
+			if err == ErrUnsupported {
+				b.Skipf("%s backend is not supported", backend)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.(io.Closer).Close()
+
+			var (
+				done = make(chan struct{}, 1)
+				left int32
+				ws   = make([]int, n)
+			)
+			for i := range ws {
+				r, w, err := socketPair()
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer unix.Close(w)
+				desc := Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+				defer desc.Close()
+
+				err = p.Start(desc, func(event Event) {
+					var buf [64]byte
+					unix.Read(r, buf[:])
+					if atomic.AddInt32(&left, -1) == 0 {
+						done <- struct{}{}
+					}
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Stop before the descriptor is closed to not receive hang
+				// up events.
+				defer p.Stop(desc)
+				ws[i] = w
+			}
+
+			ping := []byte{'x'}
+			before := p.Stats()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				atomic.StoreInt32(&left, n)
+				for _, w := range ws {
+					if _, err := unix.Write(w, ping); err != nil {
+						b.Fatal(err)
+					}
+				}
+				<-done
+			}
+			b.StopTimer()
+
+			after := p.Stats()
+			if events := after.Callbacks - before.Callbacks; events > 0 {
+				waits := after.Waits - before.Waits
+				b.Logf("%d wait calls per 1M events", waits*1e6/events)
+			}
+		})
+	}
+}
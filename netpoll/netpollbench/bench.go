@@ -0,0 +1,73 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpollbench
+
+import (
+	"net"
+	"testing"
+
+	"github.com/troian/easygo/netpoll"
+	"golang.org/x/sys/unix"
+)
+
+// Benchmark serves connections by Server configured with c within poller
+// and measures it by Load: b.N requests are made over opts.Conns
+// connections, opened before the timer is started. The opts.Requests and
+// opts.Duration options are ignored.
+//
+// The results are logged, since they are not expressed by the time per
+// request alone. The benchmark is skipped if RLIMIT_NOFILE does not allow
+// to open enough file descriptors.
+func Benchmark(b *testing.B, poller netpoll.EventPoll, c *ServerConfig, opts LoadOptions) {
+	b.Helper()
+
+	o := opts.withDefaults()
+	o.Requests = b.N
+	checkFileLimit(b, o.Conns)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewServer(poller, ln, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	clients, err := Dial(ln.Addr().String(), o)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clients.Close()
+
+	b.SetBytes(int64(2 * o.Size))
+	b.ResetTimer()
+	res, err := clients.Run(o)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Log(res)
+}
+
+// filesPerConn is the number of file descriptors used per connection: the
+// client's one and the server's one along with the duplicate made while
+// accepting.
+const filesPerConn = 3
+
+// checkFileLimit skips the benchmark if conns connections could not be
+// opened without hitting RLIMIT_NOFILE.
+func checkFileLimit(b *testing.B, conns int) {
+	b.Helper()
+
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		b.Fatal(err)
+	}
+	if need := uint64(conns*filesPerConn + 64); uint64(lim.Cur) < need {
+		b.Skipf("RLIMIT_NOFILE is %d; need at least %d for %d connections", lim.Cur, need, conns)
+	}
+}
@@ -0,0 +1,37 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpollbench
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/troian/easygo/netpoll"
+)
+
+func BenchmarkEcho(b *testing.B) {
+	benchmarkConns(b, nil)
+}
+
+func BenchmarkChargen(b *testing.B) {
+	benchmarkConns(b, &ServerConfig{
+		NewHandler: Chargen,
+	})
+}
+
+func benchmarkConns(b *testing.B, c *ServerConfig) {
+	for _, conns := range []int{1000, 10000, 50000} {
+		b.Run(fmt.Sprintf("conns=%d", conns), func(b *testing.B) {
+			poller, err := netpoll.New(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			Benchmark(b, poller, c, LoadOptions{
+				Conns: conns,
+			})
+		})
+	}
+}
@@ -0,0 +1,34 @@
+/*
+Package netpollbench provides an echo server built on top of netpoll, a load
+generator and a benchmark harness made of them. It is intended to compare
+the poller with the goroutine-per-connection model on a particular workload
+and to catch performance regressions, both of the poller and of the
+handlers built on it.
+
+Server accepts connections with netpoll.Acceptor and serves them from the
+poller's callbacks: it reads until EAGAIN, passes the data to the Handler
+and writes the replies, queueing them while the socket's buffer is full.
+Idle connections are closed after ServerConfig.IdleTimeout.
+
+Load opens the given number of connections and makes request-reply round
+trips over all of them concurrently, reporting the connection rate, the
+requests per second and the latency percentiles. Dial and Clients.Run split
+it in two, so the same connections may be measured repeatedly.
+
+Benchmark combines them for use with go test -bench:
+
+	func BenchmarkMyHandler(b *testing.B) {
+		poller, err := netpoll.New(nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer poller.(io.Closer).Close()
+
+		netpollbench.Benchmark(b, poller, &netpollbench.ServerConfig{
+			NewHandler: newMyHandler,
+		}, netpollbench.LoadOptions{
+			Conns: 1000,
+		})
+	}
+*/
+package netpollbench
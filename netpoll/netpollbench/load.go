@@ -0,0 +1,334 @@
+package netpollbench
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadOptions contains options for Load.
+type LoadOptions struct {
+	// Conns is the number of connections requests are made over.
+	// If zero, 1 is used.
+	Conns int
+
+	// Requests is the total number of requests made over all connections.
+	// If zero, requests are made for Duration.
+	Requests int
+
+	// Duration is the time requests are made for, if Requests is zero.
+	// If zero, one second is used.
+	Duration time.Duration
+
+	// Size is the size of each request in bytes. Reply of the same size is
+	// expected for each request. If zero, 64 is used.
+	Size int
+
+	// Dialers is the number of goroutines opening connections
+	// concurrently. If zero, 64 is used.
+	Dialers int
+}
+
+func (o LoadOptions) withDefaults() LoadOptions {
+	if o.Conns <= 0 {
+		o.Conns = 1
+	}
+	if o.Requests <= 0 && o.Duration <= 0 {
+		o.Duration = time.Second
+	}
+	if o.Size <= 0 {
+		o.Size = 64
+	}
+	if o.Dialers <= 0 {
+		o.Dialers = 64
+	}
+	return o
+}
+
+// LoadResult contains measurements made by Load.
+type LoadResult struct {
+	// Conns is the number of connections opened and ConnectTime is the time
+	// it took to open all of them.
+	Conns       int
+	ConnectTime time.Duration
+
+	// Requests is the number of request-reply round trips made and Elapsed
+	// is the time it took to make all of them.
+	Requests int
+	Elapsed  time.Duration
+
+	// P50, P99 and Max are the percentiles of the round trip latency. They
+	// are accurate to 1/16 of the value.
+	P50 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// ConnsPerSecond returns the rate connections were opened with.
+func (r *LoadResult) ConnsPerSecond() float64 {
+	return float64(r.Conns) / r.ConnectTime.Seconds()
+}
+
+// RequestsPerSecond returns the rate round trips were made with.
+func (r *LoadResult) RequestsPerSecond() float64 {
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// String returns a one line summary of the result.
+func (r *LoadResult) String() string {
+	return fmt.Sprintf(
+		"%d conns (%.0f conns/s), %d requests (%.0f req/s), latency p50 %s p99 %s max %s",
+		r.Conns, r.ConnsPerSecond(), r.Requests, r.RequestsPerSecond(), r.P50, r.P99, r.Max,
+	)
+}
+
+// Load opens connections to the server listening on TCP address addr and
+// makes request-reply round trips over them concurrently, each connection
+// from its own goroutine. It stops at the first error. Connections are
+// closed before Load returns.
+func Load(addr string, opts LoadOptions) (*LoadResult, error) {
+	c, err := Dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.Run(opts)
+}
+
+// Clients is a set of connections opened by Dial.
+type Clients struct {
+	conns       []net.Conn
+	connectTime time.Duration
+}
+
+// Dial opens opts.Conns connections to the server listening on TCP address
+// addr from opts.Dialers goroutines. The other options are ignored.
+//
+// It is useful to exclude opening of the connections from the measurement
+// made by Run().
+func Dial(addr string, opts LoadOptions) (*Clients, error) {
+	o := opts.withDefaults()
+	conns, connectTime, err := dialAll(addr, o.Conns, o.Dialers)
+	if err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return &Clients{
+		conns:       conns,
+		connectTime: connectTime,
+	}, nil
+}
+
+// Close closes the connections.
+func (c *Clients) Close() error {
+	var err error
+	for _, conn := range c.conns {
+		if e := conn.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Run makes request-reply round trips over the connections as Load does.
+// The opts.Conns and opts.Dialers options are ignored.
+func (c *Clients) Run(opts LoadOptions) (*LoadResult, error) {
+	o := opts.withDefaults()
+	conns := c.conns
+
+	var (
+		left     = int64(o.Requests)
+		deadline time.Time
+		hists    = make([]histogram, len(conns))
+		errOnce  sync.Once
+		firstErr error
+		failed   int32
+		wg       sync.WaitGroup
+		start    = make(chan struct{})
+	)
+	more := func() bool {
+		if atomic.LoadInt32(&failed) != 0 {
+			return false
+		}
+		if o.Requests > 0 {
+			return atomic.AddInt64(&left, -1) >= 0
+		}
+		return time.Now().Before(deadline)
+	}
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn, h *histogram) {
+			defer wg.Done()
+			var (
+				req   = make([]byte, o.Size)
+				reply = make([]byte, o.Size)
+			)
+			for i := range req {
+				req[i] = byte(i)
+			}
+			<-start
+			for more() {
+				begin := time.Now()
+				_, err := conn.Write(req)
+				if err == nil {
+					_, err = io.ReadFull(conn, reply)
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					atomic.StoreInt32(&failed, 1)
+					return
+				}
+				h.add(time.Since(begin))
+			}
+		}(conn, &hists[i])
+	}
+
+	begin := time.Now()
+	deadline = begin.Add(o.Duration)
+	close(start)
+	wg.Wait()
+	elapsed := time.Since(begin)
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	var h histogram
+	for i := range hists {
+		h.merge(&hists[i])
+	}
+	return &LoadResult{
+		Conns:       len(conns),
+		ConnectTime: c.connectTime,
+		Requests:    int(h.n),
+		Elapsed:     elapsed,
+		P50:         h.quantile(0.5),
+		P99:         h.quantile(0.99),
+		Max:         time.Duration(h.max),
+	}, nil
+}
+
+// dialAll opens n connections to addr from the given number of goroutines.
+// It returns the connections opened, even if some dial failed.
+func dialAll(addr string, n, dialers int) ([]net.Conn, time.Duration, error) {
+	var (
+		conns = make([]net.Conn, n)
+		next  = int64(-1)
+		mu    sync.Mutex
+		err   error
+		wg    sync.WaitGroup
+	)
+	if dialers > n {
+		dialers = n
+	}
+	begin := time.Now()
+	for i := 0; i < dialers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				conn, e := net.Dial("tcp", addr)
+				if e != nil {
+					mu.Lock()
+					if err == nil {
+						err = e
+					}
+					mu.Unlock()
+					return
+				}
+				conns[i] = conn
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(begin)
+
+	opened := conns[:0]
+	for _, conn := range conns {
+		if conn != nil {
+			opened = append(opened, conn)
+		}
+	}
+	return opened, elapsed, err
+}
+
+// histogram counts durations within buckets growing exponentially: each
+// range between powers of two is split into 16 linear buckets, so the
+// quantiles are accurate to 1/16 of the value with a fixed memory. Note that
+// durations have at most 63 significant bits, thus 60 ranges are enough.
+type histogram struct {
+	counts [60 * 16]uint64
+	n      uint64
+	max    int64
+}
+
+func (h *histogram) add(d time.Duration) {
+	v := uint64(d)
+	if int64(v) > h.max {
+		h.max = int64(v)
+	}
+	h.n++
+	h.counts[bucket(v)]++
+}
+
+func (h *histogram) merge(x *histogram) {
+	for i, n := range x.counts {
+		h.counts[i] += n
+	}
+	h.n += x.n
+	if x.max > h.max {
+		h.max = x.max
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the q-quantile.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.n))
+	if rank >= h.n {
+		rank = h.n - 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		if seen += n; seen > rank {
+			if v := bucketMax(i); int64(v) < h.max {
+				return time.Duration(v)
+			}
+			return time.Duration(h.max)
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// bucket returns the index of the bucket holding v. Values below 32 have
+// their own buckets; the others are bucketed by their five most significant
+// bits.
+func bucket(v uint64) int {
+	if v < 32 {
+		return int(v)
+	}
+	e := uint(bits.Len64(v) - 5)
+	return int(e)*16 + int(v>>e)
+}
+
+// bucketMax returns the largest value of the bucket i.
+func bucketMax(i int) uint64 {
+	if i < 32 {
+		return uint64(i)
+	}
+	e := uint(i/16 - 1)
+	m := uint64(i%16 + 16)
+	return (m+1)<<e - 1
+}
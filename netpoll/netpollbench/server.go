@@ -0,0 +1,315 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpollbench
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/troian/easygo/netpoll"
+)
+
+// Handler handles the data read from a connection and returns the reply to
+// be written back, which may be empty. The in slice is valid only until
+// Handler returns, while the reply may alias it.
+//
+// Handler is called from the connection's callback, thus calls for the same
+// connection are never made concurrently.
+type Handler func(in []byte) (reply []byte)
+
+// Echo is a Handler which replies with the data it received.
+func Echo(in []byte) []byte {
+	return in
+}
+
+// chargenPattern is the pattern of RFC 864: 95 printable ASCII characters.
+const chargenPattern = ` !"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\]^_` +
+	"`abcdefghijklmnopqrstuvwxyz{|}~"
+
+// Chargen returns Handler which replies to each read with as many bytes as
+// were received, taken from the character generator pattern of RFC 864.
+// Consequent replies continue the pattern where the previous one ended.
+//
+// Unlike the RFC 864 server it does not write unless asked, which makes it
+// measurable by Load in the same way as Echo.
+func Chargen() Handler {
+	var (
+		pos int
+		out []byte
+	)
+	return func(in []byte) []byte {
+		out = out[:0]
+		for len(out) < len(in) {
+			n := len(in) - len(out)
+			if rest := len(chargenPattern) - pos; n > rest {
+				n = rest
+			}
+			out = append(out, chargenPattern[pos:pos+n]...)
+			pos = (pos + n) % len(chargenPattern)
+		}
+		return out
+	}
+}
+
+// ServerConfig contains options for Server.
+type ServerConfig struct {
+	// NewHandler creates Handler for each accepted connection.
+	// If nil, all connections are served by Echo.
+	NewHandler func() Handler
+
+	// IdleTimeout is the time after which connection without any reads or
+	// writes is closed. If zero, connections are never closed by server.
+	IdleTimeout time.Duration
+
+	// MaxWriteQueue is the number of bytes queued for writing after which
+	// server stops reading from the connection until the peer reads the
+	// replies. If zero, 1MB is used.
+	MaxWriteQueue int
+
+	// Acceptor contains options for the connections acceptor.
+	Acceptor *netpoll.AcceptorConfig
+}
+
+func (c *ServerConfig) withDefaults() (config ServerConfig) {
+	if c != nil {
+		config = *c
+	}
+	if config.NewHandler == nil {
+		config.NewHandler = func() Handler { return Echo }
+	}
+	if config.MaxWriteQueue <= 0 {
+		config.MaxWriteQueue = 1 << 20
+	}
+	return config
+}
+
+// Server serves connections of a listener from the callbacks of EventPoll.
+type Server struct {
+	poller   netpoll.EventPoll
+	acceptor *netpoll.Acceptor
+	config   ServerConfig
+
+	mu     sync.Mutex
+	conns  map[*serverConn]struct{}
+	closed bool
+	done   chan struct{}
+}
+
+// NewServer starts serving connections of ln within poller.
+//
+// The listener is not closed by Server.
+func NewServer(poller netpoll.EventPoll, ln net.Listener, c *ServerConfig) (*Server, error) {
+	s := &Server{
+		poller: poller,
+		config: c.withDefaults(),
+		conns:  make(map[*serverConn]struct{}),
+		done:   make(chan struct{}),
+	}
+	a, err := netpoll.NewAcceptor(poller, ln, s.accept, s.config.Acceptor)
+	if err != nil {
+		return nil, err
+	}
+	s.acceptor = a
+
+	if s.config.IdleTimeout > 0 {
+		go s.reap()
+	}
+	return s, nil
+}
+
+// Conns returns the number of connections being served.
+func (s *Server) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Close stops accepting new connections and closes the served ones.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return netpoll.ErrClosed
+	}
+	s.closed = true
+	close(s.done)
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+
+	err := s.acceptor.Close()
+	for c := range conns {
+		c.stop()
+	}
+	return err
+}
+
+func (s *Server) accept(conn net.Conn) {
+	// The descriptor holds a duplicate of conn's file descriptor, which is
+	// the only one needed from now on.
+	desc, err := netpoll.Handle(conn, netpoll.EventRead|netpoll.EventEdgeTriggered)
+	conn.Close()
+	if err != nil {
+		return
+	}
+	c := &serverConn{
+		server:  s,
+		desc:    desc,
+		handler: s.config.NewHandler(),
+		active:  nanotime(),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		desc.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	if err = s.poller.Start(desc, c.handle); err != nil {
+		s.remove(c)
+		desc.Close()
+	}
+}
+
+// remove removes c from the served connections. It reports false if c was
+// removed before.
+func (s *Server) remove(c *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, has := s.conns[c]; !has {
+		return false
+	}
+	delete(s.conns, c)
+	return true
+}
+
+// reap closes the connections which are idle for longer than
+// ServerConfig.IdleTimeout.
+func (s *Server) reap() {
+	timeout := s.config.IdleTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	var idle []*serverConn
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		deadline := nanotime() - int64(timeout)
+
+		s.mu.Lock()
+		for c := range s.conns {
+			if atomic.LoadInt64(&c.active) < deadline {
+				idle = append(idle, c)
+			}
+		}
+		s.mu.Unlock()
+
+		for i, c := range idle {
+			c.close()
+			idle[i] = nil
+		}
+		idle = idle[:0]
+	}
+}
+
+// serverConn is a connection served by Server.
+type serverConn struct {
+	// active is the time of the last read or write, in nanoseconds. Must be
+	// accessed atomically, thus it goes first to be 64-bit aligned on 32-bit
+	// platforms.
+	active int64
+
+	server  *Server
+	desc    *netpoll.Desc
+	handler Handler
+
+	// queue holds the replies which could not be written yet. It is
+	// accessed from the callback only.
+	queue []byte
+}
+
+func (c *serverConn) handle(event netpoll.Event) {
+	if event&netpoll.EventPollClosed != 0 {
+		if c.server.remove(c) {
+			c.desc.Close()
+		}
+		return
+	}
+	atomic.StoreInt64(&c.active, nanotime())
+
+	if len(c.queue) > 0 && event&netpoll.EventWrite != 0 {
+		if err := c.flush(); err != nil {
+			c.close()
+			return
+		}
+	}
+	if len(c.queue) > c.server.config.MaxWriteQueue {
+		// Wait for the peer to read the replies.
+		return
+	}
+	// Read even if no read event is received: reading could be stopped by
+	// the full queue, while edge-triggered descriptor is not reported again
+	// until drained.
+	var werr error
+	err := netpoll.DrainRead(c.desc, func(p []byte) bool {
+		if werr = c.write(c.handler(p)); werr != nil {
+			return false
+		}
+		return len(c.queue) <= c.server.config.MaxWriteQueue
+	})
+	if err != nil || werr != nil {
+		c.close()
+	}
+}
+
+// write writes the reply, queueing the part which could not be written.
+func (c *serverConn) write(p []byte) error {
+	if len(c.queue) > 0 {
+		c.queue = append(c.queue, p...)
+		return nil
+	}
+	n, err := netpoll.WriteAll(c.desc, p)
+	if err != nil {
+		return err
+	}
+	if n < len(p) {
+		c.queue = append(c.queue, p[n:]...)
+	}
+	return nil
+}
+
+// flush writes the queued replies.
+func (c *serverConn) flush() error {
+	n, err := netpoll.WriteAll(c.desc, c.queue)
+	c.queue = c.queue[:copy(c.queue, c.queue[n:])]
+	return err
+}
+
+// close stops serving the connection and closes it.
+func (c *serverConn) close() {
+	if c.server.remove(c) {
+		c.stop()
+	}
+}
+
+// stop closes the connection's descriptor, right after the callback returns
+// if it is running.
+func (c *serverConn) stop() {
+	if c.server.poller.StopAndClose(c.desc) == netpoll.ErrNotRegistered {
+		// Descriptor is not started yet or is stopped by the poller.
+		c.desc.Close()
+	}
+}
+
+func nanotime() int64 {
+	return time.Now().UnixNano()
+}
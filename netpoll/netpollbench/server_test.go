@@ -0,0 +1,179 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpollbench
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/troian/easygo/netpoll"
+)
+
+func TestServerEcho(t *testing.T) {
+	poller, ln, s := serve(t, nil)
+	defer poller.(io.Closer).Close()
+	defer ln.Close()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Large enough to get some of the reply queued.
+	req := bytes.Repeat([]byte("hello, netpoll! "), 1<<16)
+	go conn.Write(req)
+
+	resp := make([]byte, len(req))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, req) {
+		t.Fatalf("unexpected reply")
+	}
+
+	res, err := Load(ln.Addr().String(), LoadOptions{
+		Conns:    16,
+		Requests: 1000,
+		Size:     128,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Conns != 16 || res.Requests != 1000 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if res.P50 > res.P99 || res.P99 > res.Max {
+		t.Errorf("unexpected latencies: %s", res)
+	}
+}
+
+func TestServerChargen(t *testing.T) {
+	poller, ln, s := serve(t, &ServerConfig{
+		NewHandler: Chargen,
+	})
+	defer poller.(io.Closer).Close()
+	defer ln.Close()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var resp []byte
+	for _, n := range []int{1, 50, 100, 300} {
+		if _, err = conn.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, n)
+		if _, err = io.ReadFull(conn, p); err != nil {
+			t.Fatal(err)
+		}
+		resp = append(resp, p...)
+	}
+	for i, c := range resp {
+		if exp := chargenPattern[i%len(chargenPattern)]; c != exp {
+			t.Fatalf("unexpected character at %d: %q; want %q", i, c, exp)
+		}
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	poller, ln, s := serve(t, &ServerConfig{
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	defer poller.(io.Closer).Close()
+	defer ln.Close()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unexpected Read() error: %v; want %v", err, io.EOF)
+	}
+	if n := s.Conns(); n != 0 {
+		t.Errorf("unexpected number of connections: %d", n)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	poller, ln, s := serve(t, nil)
+	defer poller.(io.Closer).Close()
+	defer ln.Close()
+
+	c, err := Dial(ln.Addr().String(), LoadOptions{Conns: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Run(LoadOptions{Requests: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != netpoll.ErrClosed {
+		t.Errorf("unexpected second Close() error: %v; want %v", err, netpoll.ErrClosed)
+	}
+	if _, err = c.Run(LoadOptions{Requests: 8}); err == nil {
+		t.Errorf("no error after server is closed")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Microsecond)
+	}
+	for _, test := range []struct {
+		q   float64
+		exp time.Duration
+	}{
+		{0.5, 500 * time.Microsecond},
+		{0.99, 990 * time.Microsecond},
+		{1, 1000 * time.Microsecond},
+	} {
+		act := h.quantile(test.q)
+		if act < test.exp || act > test.exp+test.exp/16 {
+			t.Errorf("quantile(%v) is %s; want %s within 1/16", test.q, act, test.exp)
+		}
+	}
+	for v := uint64(0); v < 1<<20; v += 1 + v/7 {
+		if i := bucket(v); bucketMax(i) < v || i > 0 && bucketMax(i-1) >= v {
+			t.Fatalf("value %d is put in bucket %d of [%d, %d]", v, i, bucketMax(i-1)+1, bucketMax(i))
+		}
+	}
+}
+
+func serve(tb testing.TB, c *ServerConfig) (netpoll.EventPoll, net.Listener, *Server) {
+	tb.Helper()
+
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		poller.(io.Closer).Close()
+		tb.Fatal(err)
+	}
+	s, err := NewServer(poller, ln, c)
+	if err != nil {
+		ln.Close()
+		poller.(io.Closer).Close()
+		tb.Fatal(err)
+	}
+	return poller, ln, s
+}
@@ -0,0 +1,554 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpolltest
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/troian/easygo/netpoll"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// expectTimeout is the time an expected event is waited for.
+	expectTimeout = time.Second
+
+	// quietPeriod is the time no event is expected to be delivered for.
+	quietPeriod = 50 * time.Millisecond
+)
+
+// Conformance runs the specification every EventPoll implementation must
+// hold against the pollers made by newPoller, each check as a named subtest
+// with its own poller:
+//
+//   - OneShot: one-shot descriptor fires once until it is resumed;
+//   - EdgeTriggered: unread data is not reported again, new data is;
+//   - LevelTriggered: unread data is reported until it is consumed;
+//   - HupWithData: data buffered before the peer hung up is not lost and
+//     the hang up is reported;
+//   - StopFromCallback: Stop() called from within the callback returns no
+//     error, the OnStop hook is called after the callback returns and no
+//     callback is run after it;
+//   - CloseWithPending: closing the poller with events pending passes
+//     EventPollClosed to every callback once and stops registrations with
+//     StopPollerClosed reason;
+//   - DescriptorReuse: callback of the stopped descriptor is not called for
+//     the descriptor which reuses its number;
+//   - ModifyEvent: events are reported according to the modified set;
+//   - Errors: methods return ErrRegistered, ErrNotRegistered and ErrClosed
+//     sentinels where expected.
+//
+// The test is skipped if newPoller returns netpoll.ErrUnsupported, thus
+// the backends which are not available on the system could be listed
+// unconditionally.
+func Conformance(t *testing.T, newPoller func() (netpoll.EventPoll, error)) {
+	for _, test := range conformanceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p, err := newPoller()
+			if err == netpoll.ErrUnsupported {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &conformer{
+				p:      p,
+				errorf: t.Errorf,
+				fatalf: t.Fatalf,
+			}
+			defer c.cleanup()
+
+			test.check(c)
+		})
+	}
+}
+
+var conformanceTests = []struct {
+	name  string
+	check func(*conformer)
+}{
+	{"OneShot", checkOneShot},
+	{"EdgeTriggered", checkEdgeTriggered},
+	{"LevelTriggered", checkLevelTriggered},
+	{"HupWithData", checkHupWithData},
+	{"StopFromCallback", checkStopFromCallback},
+	{"CloseWithPending", checkCloseWithPending},
+	{"DescriptorReuse", checkDescriptorReuse},
+	{"ModifyEvent", checkModifyEvent},
+	{"Errors", checkErrors},
+}
+
+// conform runs the checks of Conformance against the pollers made by
+// newPoller without testing.T and returns the failures of each check by its
+// name. Checks which pass are not listed.
+func conform(newPoller func() (netpoll.EventPoll, error)) (map[string][]string, error) {
+	failures := make(map[string][]string)
+	for _, test := range conformanceTests {
+		p, err := newPoller()
+		if err != nil {
+			return nil, err
+		}
+		var (
+			mu   sync.Mutex
+			done = make(chan struct{})
+			fail = func(format string, args ...interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				failures[test.name] = append(failures[test.name], fmt.Sprintf(format, args...))
+			}
+		)
+		c := &conformer{
+			p:      p,
+			errorf: fail,
+			fatalf: func(format string, args ...interface{}) {
+				fail(format, args...)
+				runtime.Goexit()
+			},
+		}
+		go func(check func(*conformer)) {
+			defer close(done)
+			defer c.cleanup()
+			check(c)
+		}(test.check)
+		<-done
+	}
+	return failures, nil
+}
+
+// conformer holds the state of a single conformance check.
+type conformer struct {
+	p      netpoll.EventPoll
+	errorf func(format string, args ...interface{})
+	fatalf func(format string, args ...interface{})
+
+	closed bool
+	pairs  []*conformancePair
+}
+
+// conformancePair is a socket pair with one end wrapped by desc.
+type conformancePair struct {
+	desc *netpoll.Desc
+	peer int
+
+	// mu is held by the callback while it is running. The closed flag is
+	// set by cleanup() before desc is closed, thus the callback which is
+	// run after that (e.g. the one with EventPollClosed, which is dispatched
+	// asynchronously by some pollers) does not touch the descriptor which
+	// could already reuse the number of desc.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// pair creates new socket pair with desc for given events. It is closed by
+// cleanup().
+func (c *conformer) pair(event netpoll.Event) *conformancePair {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		c.fatalf("socketpair error: %v", err)
+	}
+	unix.CloseOnExec(fds[1])
+	if err = unix.SetNonblock(fds[1], true); err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		c.fatalf("setnonblock error: %v", err)
+	}
+	desc, err := netpoll.NewDesc(uintptr(fds[0]), event)
+	if err != nil {
+		unix.Close(fds[1])
+		c.fatalf("NewDesc() error: %v", err)
+	}
+	x := &conformancePair{desc: desc, peer: fds[1]}
+	c.pairs = append(c.pairs, x)
+	return x
+}
+
+// write writes data to the peer end of x.
+func (c *conformer) write(x *conformancePair, data string) {
+	if _, err := unix.Write(x.peer, []byte(data)); err != nil {
+		c.fatalf("write error: %v", err)
+	}
+}
+
+// closePeer closes the peer end of x.
+func (x *conformancePair) closePeer() {
+	if x.peer >= 0 {
+		unix.Close(x.peer)
+		x.peer = -1
+	}
+}
+
+// start starts x.desc with callback which passes the events to the
+// returned channel, after calling fn, if not nil.
+func (c *conformer) start(x *conformancePair, fn netpoll.CallbackFn, opts ...netpoll.StartOption) <-chan netpoll.Event {
+	events := make(chan netpoll.Event, 64)
+	err := c.p.StartWithOptions(x.desc, func(event netpoll.Event) {
+		x.mu.RLock()
+		defer x.mu.RUnlock()
+		if x.closed {
+			return
+		}
+		if fn != nil {
+			fn(event)
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	}, opts...)
+	if err != nil {
+		c.fatalf("Start() error: %v", err)
+	}
+	return events
+}
+
+// expect waits for the event described by what.
+func (c *conformer) expect(events <-chan netpoll.Event, what string) netpoll.Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(expectTimeout):
+		c.fatalf("no %s received", what)
+		return 0
+	}
+}
+
+// quiet checks that no event described by what is received for a while.
+func (c *conformer) quiet(events <-chan netpoll.Event, what string) {
+	select {
+	case event := <-events:
+		c.errorf("unexpected %s: %s", what, event)
+	case <-time.After(quietPeriod):
+	}
+}
+
+// settle discards the events received until none is received for
+// quietPeriod, e.g. the ones which were merged while the callback was running
+// and are delivered right after it returns. It fails if events described by
+// what keep coming for expectTimeout.
+func (c *conformer) settle(events <-chan netpoll.Event, what string) {
+	deadline := time.After(expectTimeout)
+	for {
+		select {
+		case <-events:
+		case <-time.After(quietPeriod):
+			return
+		case <-deadline:
+			c.fatalf("%s keeps coming", what)
+			return
+		}
+	}
+}
+
+// close closes the poller.
+func (c *conformer) close() error {
+	c.closed = true
+	return c.p.(io.Closer).Close()
+}
+
+func (c *conformer) cleanup() {
+	if !c.closed {
+		c.close()
+	}
+	for _, x := range c.pairs {
+		x.mu.Lock()
+		x.closed = true
+		x.mu.Unlock()
+		x.desc.Close()
+		x.closePeer()
+	}
+}
+
+func checkOneShot(c *conformer) {
+	x := c.pair(netpoll.EventRead | netpoll.EventOneShot)
+	events := c.start(x, func(netpoll.Event) {
+		drain(x.desc.Fd())
+	})
+
+	c.write(x, "x")
+	if event := c.expect(events, "event of armed one-shot descriptor"); event&netpoll.EventRead == 0 {
+		c.errorf("one-shot descriptor received %s; want %s", event, netpoll.EventRead)
+	}
+	c.write(x, "x")
+	c.quiet(events, "event of fired one-shot descriptor")
+
+	if err := c.p.Resume(x.desc); err != nil {
+		c.fatalf("Resume() error: %v", err)
+	}
+	if event := c.expect(events, "event of resumed one-shot descriptor"); event&netpoll.EventRead == 0 {
+		c.errorf("resumed descriptor received %s; want %s", event, netpoll.EventRead)
+	}
+}
+
+func checkEdgeTriggered(c *conformer) {
+	x := c.pair(netpoll.EventRead | netpoll.EventEdgeTriggered)
+	events := c.start(x, nil)
+
+	c.write(x, "x")
+	c.expect(events, "event of edge-triggered descriptor")
+	c.quiet(events, "repeated event of unread data")
+
+	c.write(x, "x")
+	c.expect(events, "event of new data arrival")
+}
+
+func checkLevelTriggered(c *conformer) {
+	const reads = 3
+
+	x := c.pair(netpoll.EventRead)
+	var calls int32
+	events := c.start(x, func(netpoll.Event) {
+		// Consume the data on the last call only.
+		if atomic.AddInt32(&calls, 1) == reads {
+			drain(x.desc.Fd())
+		}
+	})
+
+	c.write(x, "x")
+	for i := 0; i < reads; i++ {
+		c.expect(events, "event of unread data")
+	}
+	// Events received while the last call was running could still be
+	// delivered after it consumed the data, but no more than that.
+	c.settle(events, "event of consumed data")
+	c.quiet(events, "event of consumed data")
+}
+
+func checkHupWithData(c *conformer) {
+	x := c.pair(netpoll.EventRead)
+	c.write(x, "bye")
+	x.closePeer()
+
+	var (
+		mu       sync.Mutex
+		received []byte
+		union    netpoll.Event
+		stopped  = make(chan struct{})
+	)
+	c.start(x, func(event netpoll.Event) {
+		var buf [64]byte
+		for {
+			n, err := unix.Read(x.desc.Fd(), buf[:])
+			if n <= 0 || err != nil {
+				break
+			}
+			mu.Lock()
+			received = append(received, buf[:n]...)
+			mu.Unlock()
+		}
+		mu.Lock()
+		union |= event
+		mu.Unlock()
+		if event&(netpoll.EventReadHup|netpoll.EventHup) != 0 {
+			c.p.Stop(x.desc)
+		}
+	}, netpoll.WithOnStop(func(*netpoll.Desc, netpoll.StopReason) {
+		close(stopped)
+	}))
+
+	select {
+	case <-stopped:
+	case <-time.After(expectTimeout):
+		c.fatalf("hang up is not reported")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if string(received) != "bye" {
+		c.errorf("received %q before hang up; want %q", received, "bye")
+	}
+	if union&netpoll.EventRead == 0 {
+		c.errorf("received %s; want %s along with hang up", union, netpoll.EventRead)
+	}
+}
+
+func checkStopFromCallback(c *conformer) {
+	x := c.pair(netpoll.EventRead)
+	var (
+		calls   int32
+		running int32
+		done    int32
+		stopped = make(chan struct{})
+	)
+	c.start(x, func(netpoll.Event) {
+		atomic.StoreInt32(&running, 1)
+		defer atomic.StoreInt32(&running, 0)
+
+		if atomic.LoadInt32(&done) != 0 {
+			c.errorf("callback called after OnStop hook")
+		}
+		// Unread data keeps the descriptor ready.
+		if atomic.AddInt32(&calls, 1) == 1 {
+			if err := c.p.Stop(x.desc); err != nil {
+				c.errorf("Stop() from callback error: %v", err)
+			}
+		}
+	}, netpoll.WithOnStop(func(*netpoll.Desc, netpoll.StopReason) {
+		if atomic.LoadInt32(&running) != 0 {
+			c.errorf("OnStop hook called while callback is running")
+		}
+		if atomic.AddInt32(&done, 1) == 1 {
+			close(stopped)
+		} else {
+			c.errorf("OnStop hook called more than once")
+		}
+	}))
+
+	c.write(x, "x")
+	select {
+	case <-stopped:
+	case <-time.After(expectTimeout):
+		c.fatalf("OnStop hook is not called")
+	}
+	time.Sleep(quietPeriod)
+}
+
+func checkCloseWithPending(c *conformer) {
+	const n = 4
+
+	type state struct {
+		closed  int32
+		done    int32
+		stopped chan struct{}
+	}
+	var (
+		states = make([]state, n)
+		events = make([]<-chan netpoll.Event, n)
+	)
+	for i := range states {
+		x := c.pair(netpoll.EventRead)
+		s := &states[i]
+		s.stopped = make(chan struct{})
+		events[i] = c.start(x, func(event netpoll.Event) {
+			if atomic.LoadInt32(&s.done) != 0 {
+				c.errorf("callback called with %s after OnStop hook", event)
+			}
+			if event&netpoll.EventPollClosed != 0 {
+				atomic.AddInt32(&s.closed, 1)
+			}
+		}, netpoll.WithOnStop(func(_ *netpoll.Desc, reason netpoll.StopReason) {
+			if reason != netpoll.StopPollerClosed {
+				c.errorf("OnStop hook called with %s; want %s", reason, netpoll.StopPollerClosed)
+			}
+			if atomic.AddInt32(&s.done, 1) == 1 {
+				close(s.stopped)
+			}
+		}))
+		// Unread data keeps the events pending.
+		c.write(x, "x")
+	}
+	for i := range events {
+		c.expect(events[i], "event of unread data")
+	}
+
+	if err := c.close(); err != nil {
+		c.fatalf("Close() error: %v", err)
+	}
+	for i := range states {
+		s := &states[i]
+		select {
+		case <-s.stopped:
+		case <-time.After(expectTimeout):
+			c.fatalf("OnStop hook is not called after Close() returned")
+		}
+		if n := atomic.LoadInt32(&s.closed); n != 1 {
+			c.errorf("callback received %s %d times; want once", netpoll.EventPollClosed, n)
+		}
+	}
+	if err := c.p.(io.Closer).Close(); err == nil {
+		c.errorf("second Close() returned no error")
+	}
+}
+
+func checkDescriptorReuse(c *conformer) {
+	a := c.pair(netpoll.EventRead)
+	stopped := make(chan struct{})
+	old := c.start(a, nil, netpoll.WithOnStop(func(*netpoll.Desc, netpoll.StopReason) {
+		close(stopped)
+	}))
+	if err := c.p.Stop(a.desc); err != nil {
+		c.fatalf("Stop() error: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(expectTimeout):
+		c.fatalf("OnStop hook is not called after Stop() returned")
+	}
+	a.desc.Close()
+	a.closePeer()
+
+	// The numbers of closed descriptors are likely to be reused by the
+	// next socket pair.
+	b := c.pair(netpoll.EventRead)
+	events := c.start(b, func(netpoll.Event) {
+		drain(b.desc.Fd())
+	})
+	c.write(b, "x")
+	c.expect(events, "event of descriptor reusing the number")
+	c.quiet(old, "event of stopped descriptor")
+}
+
+func checkModifyEvent(c *conformer) {
+	const et = netpoll.EventEdgeTriggered
+
+	x := c.pair(netpoll.EventRead | et)
+	events := c.start(x, func(event netpoll.Event) {
+		if event&netpoll.EventRead != 0 {
+			drain(x.desc.Fd())
+		}
+	})
+	c.quiet(events, "event of idle descriptor")
+
+	if err := c.p.ModifyEvent(x.desc, netpoll.EventRead|netpoll.EventWrite|et); err != nil {
+		c.fatalf("ModifyEvent() error: %v", err)
+	}
+	if event := c.expect(events, "event of added interest"); event&netpoll.EventWrite == 0 {
+		c.errorf("received %s after writability was added; want %s", event, netpoll.EventWrite)
+	}
+
+	if err := c.p.ModifyEvent(x.desc, netpoll.EventRead|et); err != nil {
+		c.fatalf("ModifyEvent() error: %v", err)
+	}
+	c.write(x, "x")
+	event := c.expect(events, "event of new data arrival")
+	if event&netpoll.EventRead == 0 {
+		c.errorf("received %s; want %s", event, netpoll.EventRead)
+	}
+	if event&netpoll.EventWrite != 0 {
+		c.errorf("received %s after writability was removed", event)
+	}
+}
+
+func checkErrors(c *conformer) {
+	x := c.pair(netpoll.EventRead)
+	if err := c.p.Stop(x.desc); err != netpoll.ErrNotRegistered {
+		c.errorf("Stop() of not registered descriptor returned %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+	if err := c.p.ModifyEvent(x.desc, netpoll.EventWrite); err != netpoll.ErrNotRegistered {
+		c.errorf("ModifyEvent() of not registered descriptor returned %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+
+	c.start(x, nil)
+	if err := c.p.Start(x.desc, func(netpoll.Event) {}); err != netpoll.ErrRegistered {
+		c.errorf("Start() of registered descriptor returned %v; want %v", err, netpoll.ErrRegistered)
+	}
+	if err := c.p.Stop(x.desc); err != nil {
+		c.fatalf("Stop() error: %v", err)
+	}
+	if err := c.p.Stop(x.desc); err != netpoll.ErrNotRegistered {
+		c.errorf("Stop() of stopped descriptor returned %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+
+	if err := c.close(); err != nil {
+		c.fatalf("Close() error: %v", err)
+	}
+	y := c.pair(netpoll.EventRead)
+	if err := c.p.Start(y.desc, func(netpoll.Event) {}); err != netpoll.ErrClosed {
+		c.errorf("Start() within closed poller returned %v; want %v", err, netpoll.ErrClosed)
+	}
+}
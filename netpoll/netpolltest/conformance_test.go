@@ -0,0 +1,75 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpolltest
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/troian/easygo/netpoll"
+)
+
+// brokenPoller violates the specification: it never resumes one-shot
+// descriptors and does not report stopping of not registered ones.
+type brokenPoller struct {
+	netpoll.EventPoll
+}
+
+func (b brokenPoller) Resume(*netpoll.Desc) error {
+	return nil
+}
+
+func (b brokenPoller) Stop(desc *netpoll.Desc) error {
+	if err := b.EventPoll.Stop(desc); err != netpoll.ErrNotRegistered {
+		return err
+	}
+	return nil
+}
+
+func (b brokenPoller) Close() error {
+	return b.EventPoll.(io.Closer).Close()
+}
+
+func TestConformanceBroken(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		new    func() (netpoll.EventPoll, error)
+		failed []string
+	}{
+		{
+			name: "poller",
+			new: func() (netpoll.EventPoll, error) {
+				return netpoll.New(nil)
+			},
+		},
+		{
+			name: "broken",
+			new: func() (netpoll.EventPoll, error) {
+				p, err := netpoll.New(nil)
+				if err != nil {
+					return nil, err
+				}
+				return brokenPoller{p}, nil
+			},
+			failed: []string{"Errors", "OneShot"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			failures, err := conform(test.new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var failed []string
+			for name, msgs := range failures {
+				failed = append(failed, name)
+				t.Logf("%s: %q", name, msgs)
+			}
+			sort.Strings(failed)
+			if !reflect.DeepEqual(failed, test.failed) {
+				t.Errorf("failed checks are %q; want %q", failed, test.failed)
+			}
+		})
+	}
+}
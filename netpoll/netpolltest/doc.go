@@ -0,0 +1,32 @@
+/*
+Package netpolltest provides utilities for testing netpoll.EventPoll
+implementations and the code built on top of them.
+
+Fuzz makes randomized interleavings of descriptors lifecycle operations from
+many goroutines and checks the invariants EventPoll implementations must
+hold:
+
+	func TestPollerFuzz(t *testing.T) {
+		if testing.Short() {
+			t.Skip("skipping in short mode")
+		}
+		poller, err := netpoll.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer poller.(io.Closer).Close()
+
+		netpolltest.Fuzz(t, poller, netpolltest.FuzzOptions{})
+	}
+
+Conformance runs the specification of EventPoll behavior (one-shot and
+edge-triggered semantics, hang ups, stopping, closing, error sentinels)
+against the pollers made by the given function, one subtest per check:
+
+	func TestPollerConformance(t *testing.T) {
+		netpolltest.Conformance(t, func() (netpoll.EventPoll, error) {
+			return netpoll.New(nil)
+		})
+	}
+*/
+package netpolltest
@@ -0,0 +1,434 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpolltest
+
+import (
+	"flag"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/troian/easygo/netpoll"
+	"golang.org/x/sys/unix"
+)
+
+var seed = flag.Int64("netpolltest.seed", 0, "seed of the netpolltest.Fuzz random source; if zero, it is derived from the test name")
+
+// FuzzOptions contains options for Fuzz.
+type FuzzOptions struct {
+	// Pairs is the number of socket pairs operations are made on.
+	// If zero, 16 is used.
+	Pairs int
+
+	// Workers is the number of goroutines making operations concurrently.
+	// If zero, 8 is used.
+	Workers int
+
+	// Duration is the time the operations are made for.
+	// If zero, one second is used.
+	Duration time.Duration
+
+	// Seed is the seed of the random source. If zero, it is derived from
+	// the test name, that is the same test run by -run flag makes the same
+	// sequence of operations within each worker. It is overridden by the
+	// -netpolltest.seed flag, if set.
+	//
+	// Note that interleaving of the workers is still up to the scheduler.
+	Seed int64
+}
+
+func (o FuzzOptions) withDefaults() FuzzOptions {
+	if o.Pairs <= 0 {
+		o.Pairs = 16
+	}
+	if o.Workers <= 0 {
+		o.Workers = 8
+	}
+	if o.Duration <= 0 {
+		o.Duration = time.Second
+	}
+	return o
+}
+
+// Fuzz makes random operations on descriptors registered within p from
+// multiple goroutines: Start(), Stop(), Resume(), ModifyEvent(), closing
+// descriptors, writing data and closing peers. It checks that:
+//
+//	- callbacks of a registration are never run concurrently;
+//	- no callback is run after OnStop hook is called, which must happen
+//	  exactly once and soon after Stop() returns;
+//	- methods return the expected errors;
+//	- there are no panics;
+//	- the number of registered descriptors is consistent;
+//	- no file descriptors are leaked.
+//
+// The seed of the random source is logged. Note that file descriptors
+// leak check is not reliable if tests are run in parallel.
+func Fuzz(t *testing.T, p netpoll.EventPoll, opts FuzzOptions) {
+	t.Helper()
+
+	o := opts.withDefaults()
+	s := o.Seed
+	if *seed != 0 {
+		s = *seed
+	}
+	if s == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(t.Name()))
+		s = int64(h.Sum64())
+	}
+	t.Logf("netpolltest: fuzzing with seed %d", s)
+
+	f := &fuzzer{
+		t:     t,
+		p:     p,
+		pairs: make([]*pair, o.Pairs),
+	}
+	for i := range f.pairs {
+		f.pairs[i] = &pair{peer: -1}
+	}
+
+	// Make the runtime to open the descriptors it opens lazily (e.g. for
+	// its own poller), so they are not reported as leaked.
+	f.open(f.pairs[0], rand.New(rand.NewSource(s)))
+	f.retire(f.pairs[0])
+
+	var (
+		files      = openFiles()
+		registered = p.Stats().Registered
+		deadline   = time.Now().Add(o.Duration)
+		wg         sync.WaitGroup
+	)
+	for i := 0; i < o.Workers; i++ {
+		wg.Add(1)
+		go func(rnd *rand.Rand) {
+			defer wg.Done()
+			defer f.recover()
+			for time.Now().Before(deadline) && !t.Failed() {
+				f.step(rnd)
+			}
+		}(rand.New(rand.NewSource(s + int64(i))))
+	}
+	wg.Wait()
+
+	var active int
+	for _, x := range f.pairs {
+		if x.reg != nil {
+			active++
+		}
+	}
+	if n := p.Stats().Registered; n != registered+active {
+		f.errorf("%d descriptors registered; want %d", n, registered+active)
+	}
+	for _, x := range f.pairs {
+		f.retire(x)
+	}
+	if n := p.Stats().Registered; n != registered {
+		f.errorf("%d descriptors registered after all stopped; want %d", n, registered)
+	}
+	if files >= 0 {
+		// Files of other tests could be closed by finalizers meanwhile, so
+		// only the growth is reported.
+		if n := openFiles(); n > files {
+			f.errorf("%d files are open; want at most %d", n, files)
+		}
+	}
+}
+
+type fuzzer struct {
+	t     *testing.T
+	p     netpoll.EventPoll
+	pairs []*pair
+}
+
+// pair is a socket pair with one end registered within the poller.
+type pair struct {
+	mu    sync.Mutex
+	desc  *netpoll.Desc
+	event netpoll.Event
+	peer  int
+	reg   *registration
+}
+
+// registration holds the state of a single Start() call.
+type registration struct {
+	desc    *netpoll.Desc
+	event   netpoll.Event
+	running int32
+	stopped int32
+	done    chan struct{}
+}
+
+var ops = []func(*fuzzer, *pair, *rand.Rand){
+	(*fuzzer).start,
+	(*fuzzer).stop,
+	(*fuzzer).resume,
+	(*fuzzer).modify,
+	(*fuzzer).write,
+	(*fuzzer).write,
+	(*fuzzer).write,
+	(*fuzzer).closePeer,
+	(*fuzzer).closePair,
+}
+
+func (f *fuzzer) step(rnd *rand.Rand) {
+	x := f.pairs[rnd.Intn(len(f.pairs))]
+	op := ops[rnd.Intn(len(ops))]
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	op(f, x, rnd)
+}
+
+func (f *fuzzer) start(x *pair, rnd *rand.Rand) {
+	if x.reg != nil {
+		if err := f.p.Start(x.desc, func(netpoll.Event) {}); err != netpoll.ErrRegistered {
+			f.errorf("Start() of registered descriptor returned %v; want %v", err, netpoll.ErrRegistered)
+		}
+		return
+	}
+	if x.desc == nil && !f.open(x, rnd) {
+		return
+	}
+	r := &registration{
+		desc:  x.desc,
+		event: x.event,
+		done:  make(chan struct{}),
+	}
+	err := f.p.StartWithOptions(x.desc, f.callback(r), netpoll.Options{
+		OnStop: r.onStop(f),
+	})
+	if err != nil {
+		f.errorf("Start() error: %v", err)
+		return
+	}
+	x.reg = r
+}
+
+func (f *fuzzer) stop(x *pair, _ *rand.Rand) {
+	if x.reg != nil {
+		f.stopRegistration(x)
+		return
+	}
+	if x.desc != nil {
+		if err := f.p.Stop(x.desc); err != netpoll.ErrNotRegistered {
+			f.errorf("Stop() of stopped descriptor returned %v; want %v", err, netpoll.ErrNotRegistered)
+		}
+	}
+}
+
+func (f *fuzzer) stopRegistration(x *pair) {
+	r := x.reg
+	x.reg = nil
+	if err := f.p.Stop(r.desc); err != nil {
+		f.errorf("Stop() error: %v", err)
+		return
+	}
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		f.errorf("OnStop hook is not called after Stop() returned")
+	}
+}
+
+func (f *fuzzer) resume(x *pair, _ *rand.Rand) {
+	if x.reg == nil {
+		return
+	}
+	if err := f.p.Resume(x.desc); err != nil {
+		f.errorf("Resume() error: %v", err)
+	}
+}
+
+func (f *fuzzer) modify(x *pair, _ *rand.Rand) {
+	if x.reg == nil {
+		return
+	}
+	event := x.reg.event ^ netpoll.EventWrite
+	if event&(netpoll.EventEdgeTriggered|netpoll.EventOneShot) == 0 {
+		// Level-triggered writability is reported continuously.
+		event &^= netpoll.EventWrite
+	}
+	if err := f.p.ModifyEvent(x.desc, event); err != nil {
+		f.errorf("ModifyEvent() error: %v", err)
+		return
+	}
+	x.reg.event = event
+}
+
+func (f *fuzzer) write(x *pair, rnd *rand.Rand) {
+	if x.peer < 0 {
+		return
+	}
+	buf := make([]byte, 1+rnd.Intn(512))
+	rnd.Read(buf)
+	_, err := unix.Write(x.peer, buf)
+	if err != nil && err != unix.EAGAIN {
+		f.errorf("write error: %v", err)
+	}
+}
+
+func (f *fuzzer) closePeer(x *pair, _ *rand.Rand) {
+	if x.peer < 0 {
+		return
+	}
+	unix.Close(x.peer)
+	x.peer = -1
+}
+
+func (f *fuzzer) closePair(x *pair, _ *rand.Rand) {
+	f.retire(x)
+}
+
+// open creates new socket pair for x with random events.
+func (f *fuzzer) open(x *pair, rnd *rand.Rand) bool {
+	call := "socketpair"
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fds[1])
+		call = "setnonblock"
+		err = unix.SetNonblock(fds[1], true)
+		if err != nil {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+		}
+	}
+	if err != nil {
+		f.errorf("%s error: %v", call, err)
+		return false
+	}
+
+	event := netpoll.EventRead
+	if rnd.Intn(2) == 0 {
+		event |= netpoll.EventWrite
+	}
+	switch rnd.Intn(4) {
+	case 0:
+		if event&netpoll.EventWrite != 0 {
+			// Level-triggered writability is reported continuously.
+			event |= netpoll.EventEdgeTriggered
+		}
+	case 1:
+		event |= netpoll.EventEdgeTriggered
+	case 2:
+		event |= netpoll.EventOneShot
+	case 3:
+		event |= netpoll.EventEdgeTriggered | netpoll.EventOneShot
+	}
+	desc, err := netpoll.NewDesc(uintptr(fds[0]), event)
+	if err != nil {
+		unix.Close(fds[1])
+		f.errorf("NewDesc() error: %v", err)
+		return false
+	}
+	x.desc = desc
+	x.event = event
+	x.peer = fds[1]
+
+	return true
+}
+
+// retire stops and closes x, if needed.
+func (f *fuzzer) retire(x *pair) {
+	if x.reg != nil {
+		f.stopRegistration(x)
+	}
+	if x.desc != nil {
+		x.desc.Close()
+		x.desc = nil
+	}
+	if x.peer >= 0 {
+		unix.Close(x.peer)
+		x.peer = -1
+	}
+}
+
+func (f *fuzzer) callback(r *registration) netpoll.CallbackFn {
+	oneShot := r.event&netpoll.EventOneShot != 0
+	return func(event netpoll.Event) {
+		defer f.recover()
+		if atomic.AddInt32(&r.running, 1) != 1 {
+			f.errorf("callbacks of a registration run concurrently")
+		}
+		defer atomic.AddInt32(&r.running, -1)
+
+		if atomic.LoadInt32(&r.stopped) != 0 {
+			f.errorf("callback called with %s after OnStop hook", event)
+		}
+		if event&netpoll.EventRead != 0 {
+			drain(r.desc.Fd())
+		}
+		if !oneShot {
+			return
+		}
+		// Resume may race with Stop() made by some worker.
+		switch err := f.p.Resume(r.desc); err {
+		case nil, netpoll.ErrNotRegistered:
+		default:
+			f.errorf("Resume() from callback error: %v", err)
+		}
+	}
+}
+
+func (r *registration) onStop(f *fuzzer) func(*netpoll.Desc, netpoll.StopReason) {
+	return func(desc *netpoll.Desc, reason netpoll.StopReason) {
+		if atomic.AddInt32(&r.stopped, 1) != 1 {
+			f.errorf("OnStop hook called more than once")
+			return
+		}
+		if desc != r.desc {
+			f.errorf("OnStop hook called with unexpected descriptor")
+		}
+		if reason != netpoll.StopExplicit {
+			f.errorf("OnStop hook called with %s; want %s", reason, netpoll.StopExplicit)
+		}
+		if atomic.LoadInt32(&r.running) != 0 {
+			f.errorf("OnStop hook called while callback is running")
+		}
+		close(r.done)
+	}
+}
+
+func (f *fuzzer) recover() {
+	if err := recover(); err != nil {
+		f.errorf("panic: %v\n%s", err, debug.Stack())
+	}
+}
+
+func (f *fuzzer) errorf(format string, args ...interface{}) {
+	f.t.Errorf("netpolltest: "+format, args...)
+}
+
+// drain reads fd until there is no more data.
+func drain(fd int) {
+	var buf [4096]byte
+	for i := 0; i < 16; i++ {
+		n, err := unix.Read(fd, buf[:])
+		if n <= 0 || err != nil {
+			return
+		}
+	}
+}
+
+// openFiles returns the number of files open by the process or -1 if it
+// could not be determined.
+func openFiles() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		d, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err == nil {
+			return len(names)
+		}
+	}
+	return -1
+}
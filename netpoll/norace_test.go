@@ -0,0 +1,5 @@
+// +build !race
+
+package netpoll
+
+const raceEnabled = false
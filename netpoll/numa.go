@@ -0,0 +1,74 @@
+package netpoll
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// NUMANode describes a single NUMA node of the machine.
+type NUMANode struct {
+	// ID is the node number.
+	ID int
+
+	// CPUs contains numbers of CPUs local to the node.
+	CPUs []int
+}
+
+// NUMATopology describes NUMA nodes of the machine.
+type NUMATopology struct {
+	Nodes []NUMANode
+}
+
+// ShardCPUs proposes Pool placement with one poller per NUMA node, bound to
+// the CPUs of that node. The result is intended for PoolConfig.ShardCPUs.
+func (t NUMATopology) ShardCPUs() [][]int {
+	ret := make([][]int, len(t.Nodes))
+	for i, node := range t.Nodes {
+		ret[i] = append([]int(nil), node.CPUs...)
+	}
+	return ret
+}
+
+// singleNode returns topology with one node holding all CPUs.
+func singleNode() NUMATopology {
+	cpus := make([]int, runtime.NumCPU())
+	for i := range cpus {
+		cpus[i] = i
+	}
+	return NUMATopology{
+		Nodes: []NUMANode{{ID: 0, CPUs: cpus}},
+	}
+}
+
+// parseCPUList parses list in format used by linux sysfs, such as
+// "0-3,8,10-11".
+func parseCPUList(s string) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		var (
+			lo, hi int
+			err    error
+		)
+		if i := strings.IndexByte(part, '-'); i != -1 {
+			if lo, err = strconv.Atoi(part[:i]); err == nil {
+				hi, err = strconv.Atoi(part[i+1:])
+			}
+		} else {
+			lo, err = strconv.Atoi(part)
+			hi = lo
+		}
+		if err != nil || lo < 0 || hi < lo {
+			return nil, fmt.Errorf("malformed cpu list: %q", s)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
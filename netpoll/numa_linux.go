@@ -0,0 +1,66 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sysNodePath = "/sys/devices/system/node"
+
+// DetectNUMATopology returns NUMA topology of the machine.
+// Nodes without CPUs (e.g. memory-only ones) are omitted. If topology could
+// not be detected, a single node with all CPUs is returned.
+func DetectNUMATopology() (NUMATopology, error) {
+	return detectNUMATopology(sysNodePath)
+}
+
+func detectNUMATopology(root string) (NUMATopology, error) {
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return singleNode(), nil
+	}
+	if err != nil {
+		return NUMATopology{}, err
+	}
+
+	var t NUMATopology
+	for _, dir := range dirs {
+		name := dir.Name()
+		if !dir.IsDir() || !strings.HasPrefix(name, "node") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(name, "node"))
+		if err != nil {
+			continue
+		}
+		list, err := ioutil.ReadFile(filepath.Join(root, name, "cpulist"))
+		if err != nil {
+			return NUMATopology{}, err
+		}
+		cpus, err := parseCPUList(string(list))
+		if err != nil {
+			return NUMATopology{}, err
+		}
+		if len(cpus) == 0 {
+			continue
+		}
+		t.Nodes = append(t.Nodes, NUMANode{
+			ID:   id,
+			CPUs: cpus,
+		})
+	}
+	if len(t.Nodes) == 0 {
+		return singleNode(), nil
+	}
+	sort.Slice(t.Nodes, func(i, j int) bool {
+		return t.Nodes[i].ID < t.Nodes[j].ID
+	})
+
+	return t, nil
+}
@@ -0,0 +1,99 @@
+// +build linux
+
+package netpoll
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		exp  []int
+		fail bool
+	}{
+		{in: "", exp: nil},
+		{in: "0\n", exp: []int{0}},
+		{in: "0-3", exp: []int{0, 1, 2, 3}},
+		{in: "0-1,4,6-7", exp: []int{0, 1, 4, 6, 7}},
+		{in: "3-1", fail: true},
+		{in: "a", fail: true},
+		{in: "1-", fail: true},
+	} {
+		act, err := parseCPUList(test.in)
+		if test.fail {
+			if err == nil {
+				t.Errorf("parseCPUList(%q) = %v; want error", test.in, act)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCPUList(%q) unexpected error: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(act, test.exp) {
+			t.Errorf("parseCPUList(%q) = %v; want %v", test.in, act, test.exp)
+		}
+	}
+}
+
+func TestDetectNUMATopology(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		root string
+		exp  NUMATopology
+		fail bool
+	}{
+		{
+			name: "two nodes",
+			root: "testdata/numa/two-nodes",
+			exp: NUMATopology{
+				Nodes: []NUMANode{
+					{ID: 0, CPUs: []int{0, 1, 2, 3, 8, 9, 10, 11}},
+					{ID: 1, CPUs: []int{4, 5, 6, 7, 12, 13, 14, 15}},
+				},
+			},
+		},
+		{
+			name: "no sysfs",
+			root: "testdata/numa/missing",
+			exp:  singleNode(),
+		},
+		{
+			name: "malformed",
+			root: "testdata/numa/malformed",
+			fail: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			act, err := detectNUMATopology(test.root)
+			if test.fail {
+				if err == nil {
+					t.Fatalf("expected error; got %v", act)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(act, test.exp) {
+				t.Errorf("unexpected topology:\nact: %+v\nexp: %+v", act, test.exp)
+			}
+		})
+	}
+}
+
+func TestNUMATopologyShardCPUs(t *testing.T) {
+	topology, err := detectNUMATopology("testdata/numa/two-nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]int{
+		{0, 1, 2, 3, 8, 9, 10, 11},
+		{4, 5, 6, 7, 12, 13, 14, 15},
+	}
+	if act := topology.ShardCPUs(); !reflect.DeepEqual(act, exp) {
+		t.Errorf("ShardCPUs() = %v; want %v", act, exp)
+	}
+}
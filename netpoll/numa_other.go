@@ -0,0 +1,9 @@
+// +build !linux
+
+package netpoll
+
+// DetectNUMATopology returns NUMA topology of the machine.
+// On this operating system it always returns a single node with all CPUs.
+func DetectNUMATopology() (NUMATopology, error) {
+	return singleNode(), nil
+}
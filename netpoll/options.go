@@ -0,0 +1,383 @@
+package netpoll
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// Options contains options for descriptor registration within EventPoll.
+// The zero value makes the descriptor to be registered exactly as Start()
+// does.
+type Options struct {
+	// CoalesceWindow enables coalescing of events for the descriptor.
+	//
+	// After the callback is called, no other calls are made for the
+	// descriptor during the window. Events received within the window are
+	// suppressed and at most one trailing callback is made after the window
+	// ends if the descriptor is still ready.
+	//
+	// It is useful for descriptors that are ready thousands times a second
+	// while each event does negligible work, such that it is cheaper to
+	// handle them in batches.
+	CoalesceWindow time.Duration
+
+	// MaxEventsPerSecond limits the rate of callback calls for the
+	// descriptor. Bursts of the same size are allowed.
+	//
+	// When the limit is exceeded, descriptor is disarmed until it is allowed
+	// to receive next event. Then it is armed again, making the kernel to
+	// report it if it is still ready. That is, no readiness is lost but the
+	// events are delayed.
+	MaxEventsPerSecond int
+
+	// StopOnHup makes the descriptor to be stopped right after the callback
+	// is called with hang up or error event.
+	//
+	// By default such descriptor is muted instead: after the callback is
+	// called once with EventHup or EventErr and without EventRead, no other
+	// events are delivered until Resume() is called. This prevents a dead
+	// descriptor (e.g. write end of a pipe with closed read end) from
+	// spinning the loop, since the kernel reports such events continuously.
+	StopOnHup bool
+
+	// CheckInitialReadiness makes the poller to probe the descriptor's
+	// readiness right after it is registered. If the descriptor is ready, a
+	// synthetic event is delivered to the callback asynchronously.
+	//
+	// It is useful for edge-triggered descriptors which could receive data
+	// before registration, since no edge may be ever reported for such data.
+	// The synthetic event is subject to the same rules as the kernel ones:
+	// it counts as the one shot for EventOneShot descriptors and is never
+	// delivered concurrently with other events of the descriptor.
+	CheckInitialReadiness bool
+
+	// ReadLowWater makes the descriptor to be reported as ready for reading
+	// only when at least ReadLowWater bytes are buffered (or on hang up and
+	// errors). It is useful for protocols with fixed size headers, which are
+	// not worth to be woken up for every single byte. Zero means the
+	// kernel's default, that is a single byte.
+	//
+	// It is supported for stream sockets only. On kqueue it is mapped to the
+	// NOTE_LOWAT filter flag of the registration. On linux it is emulated by
+	// setting SO_RCVLOWAT socket option, which epoll honors for TCP sockets
+	// only; thus the mark remains in effect after the descriptor is stopped.
+	//
+	// Note that in edge-triggered mode the edge is reported once the mark is
+	// reached: if the callback does not read the buffered data below the
+	// mark, the next event is not reported until more data arrives.
+	ReadLowWater int
+
+	// OnStop is called once the descriptor is deregistered from the poller,
+	// whatever the reason is. It is guaranteed to be called exactly once and
+	// after the last callback for the registration has returned. That is, it
+	// is a single place to release per-descriptor resources.
+	//
+	// It is called either by the goroutine that stops the registration (e.g.
+	// the one calling Stop() or Close()) or by the goroutine that runs the
+	// last callback.
+	OnStop func(desc *Desc, reason StopReason)
+
+	// AutoResume makes EventOneShot descriptor to be resumed right after
+	// the callback returns, unless it was stopped by the callback. That
+	// is, the descriptor is never handled concurrently while events are
+	// received without explicit Resume() calls.
+	//
+	// Descriptors muted after hang up or error event are not resumed.
+	AutoResume bool
+}
+
+// DescOptions contains options for descriptor creation.
+type DescOptions struct {
+	// Inherit clears FD_CLOEXEC flag of the file descriptor, so it is
+	// intentionally inherited by child processes. Otherwise the flag is
+	// set, that is the descriptor is closed on exec(2) and does not leak.
+	Inherit bool
+
+	// Label is the initial label of the descriptor (see Desc.SetLabel()).
+	Label string
+
+	// ConnLifetime binds the lifetime of the descriptor to the connection
+	// it was created from. Descriptors created by Handle() hold a duplicate
+	// of the connection's file descriptor, thus closing the connection alone
+	// does not close the socket: it stays open and registered until the
+	// descriptor is closed too. When ConnLifetime is set, the poller checks
+	// whether the connection was closed before each callback call and
+	// periodically (see Config.ConnLifetimeInterval). Once it is, the
+	// descriptor is stopped with StopPeerAbandoned reason and closed after
+	// the OnStop hook returns.
+	//
+	// The connection must implement syscall.Conn, otherwise ErrNotFiler is
+	// returned.
+	ConnLifetime net.Conn
+
+	// SkipNonblock leaves the blocking mode of the file descriptor as is,
+	// instead of putting it into non-blocking mode. It saves the fcntl(2)
+	// calls for the fd which is non-blocking already, and is required for
+	// the fd whose mode is managed by its owner (e.g. the fd shared with C
+	// code). Note that the callbacks must not make blocking calls on the
+	// blocking fd.
+	SkipNonblock bool
+
+	// Borrowed makes the descriptor to not own the file descriptor: Close()
+	// only forgets it, leaving the fd open and usable by its owner. The
+	// owner must not close the fd while the descriptor is registered.
+	Borrowed bool
+}
+
+// DescOption configures descriptor created by NewDesc() or similar
+// functions.
+type DescOption interface {
+	applyDesc(*DescOptions)
+}
+
+func resolveDescOptions(opts []DescOption) DescOptions {
+	var d DescOptions
+	for _, opt := range opts {
+		opt.applyDesc(&d)
+	}
+	return d
+}
+
+// applyDesc implements DescOption interface.
+// Note that it overrides all the options previously set by other DescOptions
+// value.
+func (opts DescOptions) applyDesc(d *DescOptions) {
+	*d = opts
+}
+
+// WithCloseOnExec returns DescOption that sets DescOptions.Inherit to the
+// opposite of on.
+func WithCloseOnExec(on bool) DescOption {
+	return closeOnExecOption(on)
+}
+
+type closeOnExecOption bool
+
+func (c closeOnExecOption) applyDesc(d *DescOptions) {
+	d.Inherit = !bool(c)
+}
+
+// WithLabel returns DescOption that sets DescOptions.Label.
+func WithLabel(label string) DescOption {
+	return labelOption(label)
+}
+
+type labelOption string
+
+func (l labelOption) applyDesc(d *DescOptions) {
+	d.Label = string(l)
+}
+
+// WithConnLifetime returns DescOption that sets DescOptions.ConnLifetime.
+func WithConnLifetime(conn net.Conn) DescOption {
+	return connLifetimeOption{conn}
+}
+
+type connLifetimeOption struct {
+	conn net.Conn
+}
+
+func (c connLifetimeOption) applyDesc(d *DescOptions) {
+	d.ConnLifetime = c.conn
+}
+
+// WithoutNonblock returns DescOption that sets DescOptions.SkipNonblock.
+func WithoutNonblock() DescOption {
+	return skipNonblockOption{}
+}
+
+type skipNonblockOption struct{}
+
+func (skipNonblockOption) applyDesc(d *DescOptions) {
+	d.SkipNonblock = true
+}
+
+// WithoutOwnership returns DescOption that sets DescOptions.Borrowed.
+func WithoutOwnership() DescOption {
+	return borrowedOption{}
+}
+
+type borrowedOption struct{}
+
+func (borrowedOption) applyDesc(d *DescOptions) {
+	d.Borrowed = true
+}
+
+// StopReason describes why descriptor registration was stopped.
+type StopReason uint8
+
+// StopReason values that are passed to Options.OnStop.
+const (
+	// StopExplicit means that Stop() was called for the descriptor.
+	StopExplicit StopReason = iota
+
+	// StopHangup means that descriptor was stopped after hang up or error
+	// event due to Options.StopOnHup.
+	StopHangup
+
+	// StopPollerClosed means that the poller was closed.
+	StopPollerClosed
+
+	// StopMigrated means that descriptor was moved to another poller.
+	StopMigrated
+
+	// StopError means that the poller stopped waiting for events due to an
+	// error (see Config.OnWaitError), thus no more events are delivered. It
+	// is also used when descriptor turns out to be closed while registered
+	// (see ErrDescClosed).
+	StopError
+
+	// StopPeerAbandoned means that the connection the descriptor was created
+	// from was closed by the application (see DescOptions.ConnLifetime).
+	// The descriptor is closed after the OnStop hook returns.
+	StopPeerAbandoned
+
+	// StopGroup means that descriptor was stopped by Group.StopAll().
+	StopGroup
+
+	// StopReset means that descriptor was stopped by EventPoll.StopAll()
+	// along with all the others.
+	StopReset
+)
+
+// String returns a string representation of StopReason.
+func (r StopReason) String() string {
+	switch r {
+	case StopExplicit:
+		return "StopExplicit"
+	case StopHangup:
+		return "StopHangup"
+	case StopPollerClosed:
+		return "StopPollerClosed"
+	case StopMigrated:
+		return "StopMigrated"
+	case StopError:
+		return "StopError"
+	case StopPeerAbandoned:
+		return "StopPeerAbandoned"
+	case StopGroup:
+		return "StopGroup"
+	case StopReset:
+		return "StopReset"
+	}
+	return "StopReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// StartOption configures descriptor registration made by
+// EventPoll.StartWithOptions().
+type StartOption interface {
+	applyStart(*startOptions)
+}
+
+// startOptions holds resolved StartOption values.
+type startOptions struct {
+	Options
+
+	key   uint64
+	keyed bool
+
+	// scratch is set by StartWithScratch() and replaces the callback.
+	scratch ScratchCallbackFn
+
+	// meta is the user metadata set by WithMetadata().
+	meta []byte
+}
+
+func resolveStartOptions(opts []StartOption) (s startOptions) {
+	for _, opt := range opts {
+		opt.applyStart(&s)
+	}
+	return s
+}
+
+// applyStart implements StartOption interface.
+// Note that it overrides all the options previously set by other Options
+// value.
+func (opts Options) applyStart(s *startOptions) {
+	s.Options = opts
+}
+
+// WithKey returns StartOption that sets the key of descriptor within Pool.
+// Descriptors with equal keys are registered within the same poller when
+// the Hash picker is used. Other EventPoll implementations ignore the key.
+func WithKey(key uint64) StartOption {
+	return keyOption(key)
+}
+
+type keyOption uint64
+
+func (k keyOption) applyStart(s *startOptions) {
+	s.key = uint64(k)
+	s.keyed = true
+}
+
+// WithMetadata returns StartOption that attaches opaque user metadata to
+// the registration. It is not interpreted by the poller and is returned
+// within DescState by EventPoll.Export().
+func WithMetadata(meta []byte) StartOption {
+	return metaOption(meta)
+}
+
+type metaOption []byte
+
+func (m metaOption) applyStart(s *startOptions) {
+	s.meta = []byte(m)
+}
+
+// startOptionFunc is a StartOption which sets a single field of Options.
+type startOptionFunc func(*startOptions)
+
+func (fn startOptionFunc) applyStart(s *startOptions) {
+	fn(s)
+}
+
+// WithCoalesce returns StartOption that sets Options.CoalesceWindow.
+func WithCoalesce(window time.Duration) StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.CoalesceWindow = window
+	})
+}
+
+// WithRateLimit returns StartOption that sets Options.MaxEventsPerSecond.
+func WithRateLimit(n int) StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.MaxEventsPerSecond = n
+	})
+}
+
+// WithStopOnHup returns StartOption that sets Options.StopOnHup.
+func WithStopOnHup() StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.StopOnHup = true
+	})
+}
+
+// WithInitialReadinessCheck returns StartOption that sets
+// Options.CheckInitialReadiness.
+func WithInitialReadinessCheck() StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.CheckInitialReadiness = true
+	})
+}
+
+// WithReadLowWater returns StartOption that sets Options.ReadLowWater.
+func WithReadLowWater(n int) StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.ReadLowWater = n
+	})
+}
+
+// WithOnStop returns StartOption that sets Options.OnStop.
+func WithOnStop(fn func(desc *Desc, reason StopReason)) StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.OnStop = fn
+	})
+}
+
+// WithAutoResume returns StartOption that sets Options.AutoResume.
+func WithAutoResume() StartOption {
+	return startOptionFunc(func(s *startOptions) {
+		s.AutoResume = true
+	})
+}
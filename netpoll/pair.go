@@ -0,0 +1,88 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// NewSyntheticPair creates a pair of connected descriptors on top of
+// socketpair(2). It is intended for tests of code using netpoll, which need
+// real file descriptors but do not want to deal with listeners and ports.
+//
+// Returned descriptors are non-blocking, close-on-exec and observed for
+// EventRead. The returned io.ReadWriteCloser values are simple views of each
+// end: a Read() made on a closed peer returns io.EOF, and Close() closes the
+// underlying descriptor.
+func NewSyntheticPair() (a, b *Desc, ra, rb io.ReadWriteCloser, err error) {
+	syscall.ForkLock.RLock()
+	fd, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fd[0])
+		unix.CloseOnExec(fd[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	if a, err = NewDesc(uintptr(fd[0]), EventRead); err != nil {
+		unix.Close(fd[1])
+		return nil, nil, nil, nil, err
+	}
+	if b, err = NewDesc(uintptr(fd[1]), EventRead); err != nil {
+		a.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	return a, b, descConn{a}, descConn{b}, nil
+}
+
+// descConn is an io.ReadWriteCloser view of a descriptor.
+type descConn struct {
+	desc *Desc
+}
+
+func (c descConn) Read(p []byte) (int, error) {
+	n, err := ignoringEINTR(func() (int, error) {
+		return unix.Read(c.desc.Fd(), p)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c descConn) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := ignoringEINTR(func() (int, error) {
+			return unix.Write(c.desc.Fd(), p[written:])
+		})
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c descConn) Close() error {
+	return c.desc.Close()
+}
+
+func ignoringEINTR(fn func() (int, error)) (int, error) {
+	for {
+		n, err := fn()
+		if err != syscall.EINTR {
+			return n, err
+		}
+	}
+}
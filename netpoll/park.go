@@ -0,0 +1,118 @@
+package netpoll
+
+import "sync/atomic"
+
+// parkEvent is the set of events parked descriptor is registered for. It is
+// enough to detect both incoming data and the hang up, and being one-shot it
+// is reported at most once, by the event which promotes the descriptor.
+const parkEvent = EventRead | EventOneShot
+
+// Park implements EventPoll.Park() method.
+func (p *poller) Park(desc *Desc) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+	return wrapDescErr("park", desc, parkEvent, r.park())
+}
+
+// park registers the descriptor with parkEvent, unless it is disarmed for
+// now: the parked interest is applied when it is armed again then.
+func (r *registration) park() error {
+	p := r.poller
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return ErrNotRegistered
+	}
+	if atomic.LoadInt32(&r.parked) == 1 {
+		return nil
+	}
+	// Mark the registration before the kernel call, thus the event
+	// received right after it is handled as the promoting one.
+	atomic.StoreInt32(&r.parked, 1)
+
+	event := r.events()
+	if !r.deferred && !r.muted &&
+		(event&EventOneShot == 0 || atomic.LoadInt32(&r.armed) == 1) {
+		if err := p.backend.change(r.desc.Fd(), event, parkEvent); err != nil {
+			atomic.StoreInt32(&r.parked, 0)
+			return err
+		}
+	}
+	atomic.AddInt64(&p.stats.parked, 1)
+
+	return nil
+}
+
+// promote restores the registration of the parked descriptor which received
+// event. It returns the part of event to be delivered to the callback.
+func (r *registration) promote(event Event) Event {
+	p := r.poller
+	registered := r.events()
+	event &= registered&(EventRead|EventWrite|EventPri) |
+		EventHup | EventReadHup | EventWriteHup | EventErr
+
+	r.mu.Lock()
+	if r.stopped || !atomic.CompareAndSwapInt32(&r.parked, 1, 0) {
+		r.mu.Unlock()
+		return event
+	}
+	atomic.AddInt64(&p.stats.parked, -1)
+	atomic.AddUint64(&p.stats.promoted, 1)
+	if p.config.ParkIdle > 0 {
+		atomic.StoreInt64(&r.active, nanotime())
+	}
+	var err error
+	// One-shot descriptor is left disarmed by the parked event, as if it
+	// was its own one, until Resume() is called. Unless the event is not
+	// delivered at all, in which case it would never be resumed.
+	if !r.deferred && !r.muted && (registered&EventOneShot == 0 || event == 0) {
+		err = p.backend.change(r.desc.Fd(), parkEvent, registered)
+	}
+	r.mu.Unlock()
+
+	r.report("promote", err)
+
+	return event
+}
+
+// interest returns the events descriptor is registered in the kernel for
+// while being armed.
+func (r *registration) interest() Event {
+	if atomic.LoadInt32(&r.parked) == 1 {
+		return parkEvent
+	}
+	return r.events()
+}
+
+// parkIdle parks descriptors whose callbacks were not called for
+// Config.ParkIdle and schedules the next check.
+func (p *poller) parkIdle() {
+	idle := p.config.ParkIdle
+	since := nanotime() - int64(idle)
+
+	var regs []*registration
+	p.mu.RLock()
+	for _, r := range p.regs {
+		if atomic.LoadInt32(&r.parked) == 0 && atomic.LoadInt64(&r.active) <= since {
+			regs = append(regs, r)
+		}
+	}
+	p.mu.RUnlock()
+
+	for _, r := range regs {
+		r.report("park", r.park())
+	}
+
+	p.mu.Lock()
+	if !p.closed {
+		p.parker.Reset(idle / 2)
+	}
+	p.mu.Unlock()
+}
@@ -0,0 +1,282 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPark(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		event Event
+	}{
+		{"level", EventRead},
+		{"edge", EventRead | EventEdgeTriggered},
+		{"oneshot", EventRead | EventOneShot},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), test.event))
+			defer desc.Close()
+
+			if err = poller.Park(desc); err != ErrNotRegistered {
+				t.Fatalf("Park() of not registered desc returned %v; want %v", err, ErrNotRegistered)
+			}
+
+			events := make(chan Event, 16)
+			err = poller.Start(desc, func(event Event) {
+				var buf [64]byte
+				unix.Read(r, buf[:])
+				events <- event
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				// Parking of the parked desc has no effect.
+				if err = poller.Park(desc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if s := poller.Stats(); s.Parked != 1 || s.Registered != 1 {
+				t.Fatalf("stats of parked desc: %+v", s)
+			}
+
+			for i := 0; i < 2; i++ {
+				if _, err = unix.Write(w, []byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case event := <-events:
+					if event&EventRead == 0 {
+						t.Fatalf("callback called with %s; want %s", event, EventRead)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("#%d: no callback call", i)
+				}
+				if s := poller.Stats(); s.Parked != 0 || s.Promoted != 1 {
+					t.Fatalf("#%d: stats of promoted desc: %+v", i, s)
+				}
+				if test.event&EventOneShot != 0 {
+					if err = poller.Resume(desc); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			// Stopping of the parked desc must not leave it counted.
+			if err = poller.Park(desc); err != nil {
+				t.Fatal(err)
+			}
+			if err = poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+			if s := poller.Stats(); s.Parked != 0 {
+				t.Fatalf("stopped desc is left parked: %+v", s)
+			}
+		})
+	}
+}
+
+func TestParkModifyEvent(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	events := make(chan Event, 16)
+	err = poller.Start(desc, func(event Event) {
+		var buf [64]byte
+		unix.Read(r, buf[:])
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Park(desc); err != nil {
+		t.Fatal(err)
+	}
+	// Writability is not observed while parked.
+	if err = poller.ModifyEvent(desc, EventRead|EventWrite|EventEdgeTriggered); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("parked desc received %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	for timeout := time.After(time.Second); event&EventWrite == 0; {
+		select {
+		case e := <-events:
+			event |= e
+		case <-timeout:
+			t.Fatalf("promoted desc received %s only", event)
+		}
+	}
+	if event&EventRead == 0 {
+		t.Fatalf("triggering %s event is lost", EventRead)
+	}
+}
+
+func TestParkIdle(t *testing.T) {
+	conf := config(t)
+	conf.ParkIdle = 20 * time.Millisecond
+	poller, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	called := make(chan struct{}, 1)
+	err = poller.Start(desc, func(event Event) {
+		var buf [64]byte
+		unix.Read(r, buf[:])
+		called <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitParked := func(n int) {
+		for deadline := time.Now().Add(time.Second); poller.Stats().Parked != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("descriptor is not parked: %+v", poller.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitParked(1)
+
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("no callback call")
+	}
+	if s := poller.Stats(); s.Promoted != 1 {
+		t.Fatalf("stats of promoted desc: %+v", s)
+	}
+	// Parked again once it is idle.
+	waitParked(1)
+}
+
+func TestParkSoak(t *testing.T) {
+	n := 100000
+	if testing.Short() {
+		n = 1000
+	}
+	if max := maxOpenFiles(t); 2*n+512 > max {
+		n = (max - 512) / 2
+	}
+	woken := n / 100
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var (
+		calls = make([]int32, n)
+		peers = make([]int, n)
+		descs = make([]*Desc, n)
+		done  = make(chan struct{}, n)
+	)
+	defer func() {
+		for i := range descs {
+			if descs[i] != nil {
+				descs[i].Close()
+				unix.Close(peers[i])
+			}
+		}
+	}()
+	for i := range descs {
+		r, w, err := socketPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, desc := i, Must(NewDesc(uintptr(r), EventRead|EventEdgeTriggered))
+		peers[i], descs[i] = w, desc
+		err = poller.Start(desc, func(event Event) {
+			var buf [64]byte
+			unix.Read(r, buf[:])
+			if atomic.AddInt32(&calls[i], 1) == 1 {
+				done <- struct{}{}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = poller.Park(desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := poller.Stats(); s.Parked != n {
+		t.Fatalf("parked %d descriptors; want %d", s.Parked, n)
+	}
+
+	for i := 0; i < woken; i++ {
+		if _, err = unix.Write(peers[i*100], []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < woken; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d parked descriptors woke up", i, woken)
+		}
+	}
+	for i := range calls {
+		if c := atomic.LoadInt32(&calls[i]); (i%100 == 0 && i/100 < woken) != (c > 0) {
+			t.Fatalf("descriptor #%d callback called %d times", i, c)
+		}
+	}
+	if s := poller.Stats(); s.Parked != n-woken || s.Promoted != uint64(woken) {
+		t.Fatalf("stats after wake up: parked %d, promoted %d; want %d and %d",
+			s.Parked, s.Promoted, n-woken, woken)
+	}
+}
@@ -0,0 +1,1559 @@
+package netpoll
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// backend describes an os-dependent i/o event notification facility on top
+// of which poller implements EventPoll interface.
+type backend interface {
+	// add registers fd with given events. The cb is called on each event
+	// received for fd along with the event's data provided by the kernel,
+	// if any (e.g. kevent's data field), and the raw flags the event was
+	// translated from.
+	add(fd int, event Event, cb func(Event, int64, uint32)) error
+
+	// lowWater sets the read low-water mark of fd. It is called before
+	// add() for fd, if any mark is given, and for registered fd by
+	// SetLowWater(), in which case the mark is applied by the next mod().
+	// Zero resets the mark to the kernel's default.
+	lowWater(fd int, n int) error
+
+	// del removes fd previously registered with given events.
+	del(fd int, event Event) error
+
+	// mod changes events fd is registered with.
+	mod(fd int, event Event) error
+
+	// disarm stops delivery of events registered for fd until next call to
+	// mod(). It does not remove fd from the observation list.
+	disarm(fd int, event Event) error
+
+	// Close closes the backend instance.
+	Close() error
+
+	// Fd returns the backend's file descriptor.
+	Fd() int
+
+	// change changes events fd is registered with from prev to event.
+	change(fd int, prev, event Event) error
+
+	// Iterate runs single wait-and-dispatch cycle when backend is run by
+	// external loop.
+	Iterate(timeout time.Duration) error
+
+	// waitBlocked returns the total time in nanoseconds spent waiting for
+	// events and the number of system calls made to wait. They are zero if
+	// backend was created without metrics.
+	waitBlocked() (nanos, calls uint64)
+
+	// trigger wakes up the wait loop, which then calls the wakeup hook
+	// given at creation. Triggers made before the loop handles them may be
+	// handled at once.
+	trigger() error
+
+	// internalFds returns the file descriptors owned by the backend: its
+	// own one, if any, and the ones used to wake up the wait loop. They are
+	// never registered as the user's descriptors.
+	internalFds() []int
+}
+
+// poller implements EventPoll interface on top of some backend.
+type poller struct {
+	// stats and gens are accessed by 64-bit atomic operations, thus they
+	// go first to be 64-bit aligned on 32-bit platforms.
+	stats stats
+
+	// gens is the last generation given to a registration. Must be
+	// accessed atomically.
+	gens uint64
+
+	backend backend
+	config  Config
+	inline  bool
+
+	// woken is set to 1 by Wakeup() until the wait loop handles the
+	// wakeup. Must be accessed atomically.
+	woken int32
+
+	// gate is held for reading while callback is running and for writing
+	// by Barrier().
+	gate sync.RWMutex
+
+	// limit is a poller-wide rate limit of callback calls.
+	limit *bucket
+
+	// scratcher is the Dispatcher if it implements ScratchDispatcher.
+	scratcher ScratchDispatcher
+
+	// arena is handed to callbacks started by StartWithScratch() and run
+	// inline. It is owned by the wait loop: callbacks run inline by other
+	// goroutines (e.g. by probes) while it is busy get a new Scratch.
+	arena Scratch
+
+	// arenaBusy is set to 1 while arena is in use. Must be accessed
+	// atomically.
+	arenaBusy int32
+
+	// buffers holds buffers of Config.BufferSize handed out by
+	// Desc.GetBuffer().
+	buffers *bufferPool
+
+	// batchFn holds batchHandler set by SetBatchHandler().
+	batchFn atomic.Value
+
+	// batch and batchRegs hold the events of the current wait iteration,
+	// merged per registration. They are used by the wait loop only.
+	batch     []Ready
+	batchRegs []*registration
+
+	// caps is probed when poller is created.
+	caps Capabilities
+
+	// recorder records callback calls if Config.RecordEvents is set.
+	recorder *recorder
+
+	mu   sync.RWMutex
+	regs map[*Desc]*registration
+
+	// parker is the timer parking idle descriptors if Config.ParkIdle is
+	// set. It is started by the first registration and is stopped once
+	// closed is set by Close(). Both are guarded by mu.
+	parker *time.Timer
+	closed bool
+}
+
+// epoch is a base of monotonic time returned by nanotime().
+var epoch = time.Now()
+
+// nanotime returns monotonic time in nanoseconds elapsed since epoch. It
+// reads the clock by time.Now() as well, but its result is a plain integer
+// which could be stored and compared atomically without allocations.
+func nanotime() int64 {
+	return int64(time.Since(epoch))
+}
+
+// newPoller creates poller with given config. The backend must be set by
+// the caller before poller is used. Note that the backend's wait loop must
+// report errors to p.onWaitError().
+func newPoller(config Config) *poller {
+	p := &poller{
+		config:   config,
+		inline:   config.Dispatcher == InlineDispatcher,
+		limit:    newBucket(config.MaxEventsPerSecond),
+		caps:     probedCapabilities(),
+		recorder: newRecorder(config.RecordEvents),
+		regs:     make(map[*Desc]*registration),
+		buffers:  newBufferPool(config.BufferSize),
+	}
+	p.scratcher, _ = config.Dispatcher.(ScratchDispatcher)
+	return p
+}
+
+// Start implements EventPoll.Start() method.
+func (p *poller) Start(desc *Desc, cb CallbackFn) error {
+	return p.start(desc, cb, startOptions{})
+}
+
+// StartWithOptions implements EventPoll.StartWithOptions() method.
+func (p *poller) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	return p.start(desc, cb, resolveStartOptions(opts))
+}
+
+func (p *poller) start(desc *Desc, cb CallbackFn, opts startOptions) error {
+	if p.config.Strict {
+		p.strictStart(desc)
+	}
+	err := p.attach(desc, &migration{
+		cb:    cb,
+		opts:  opts,
+		event: desc.event,
+		armed: true,
+	})
+	if err != nil {
+		return err
+	}
+	if opts.CheckInitialReadiness {
+		p.mu.RLock()
+		r := p.regs[desc]
+		p.mu.RUnlock()
+		if r != nil {
+			r.probe()
+		}
+	}
+	return nil
+}
+
+// attach registers desc with the state described by m.
+func (p *poller) attach(desc *Desc, m *migration) error {
+	r := &registration{
+		poller: p,
+		desc:   desc,
+		cb:     m.cb,
+		opts:   m.opts,
+		event:  uint32(m.event),
+		window: int64(m.opts.CoalesceWindow),
+		lowat:  m.opts.ReadLowWater,
+		limit:  newBucket(m.opts.MaxEventsPerSecond),
+		muted:  m.muted,
+		gen:    atomic.AddUint64(&p.gens, 1),
+		done:   make(chan struct{}),
+	}
+	if m.armed {
+		r.armed = 1
+	}
+	if p.config.ParkIdle > 0 {
+		r.active = nanotime()
+	}
+	if p.config.Metrics {
+		r.grouped = desc.grouped()
+	}
+	if !p.inline {
+		// Bind the method values once to not allocate on each dispatch.
+		r.dispatch = r.dispatched
+		if p.scratcher != nil && r.opts.scratch != nil {
+			r.dispatchScratch = r.dispatchedScratch
+		}
+	}
+
+	if !desc.acquire(p) {
+		return ErrAlreadyRegistered
+	}
+
+	p.mu.Lock()
+	if _, has := p.regs[desc]; has {
+		p.mu.Unlock()
+		return ErrRegistered
+	}
+	p.regs[desc] = r
+	if p.config.ParkIdle > 0 && p.parker == nil && !p.closed {
+		p.parker = time.AfterFunc(p.config.ParkIdle/2, p.parkIdle)
+	}
+	p.mu.Unlock()
+
+	err := p.checkEvent(m.event)
+	if err == nil {
+		err = p.setLowWater(desc.Fd(), m.opts.ReadLowWater)
+	}
+	if err == nil {
+		err = p.ctlRetry(func() error {
+			return p.backend.add(desc.Fd(), m.event, r.notify)
+		})
+	}
+	if err != nil {
+		p.mu.Lock()
+		delete(p.regs, desc)
+		p.mu.Unlock()
+		desc.release(p)
+		return wrapDescErr("start", desc, m.event, err)
+	}
+	if m.muted || (!m.armed && m.event&EventOneShot != 0) {
+		// Keep the descriptor disarmed until Resume() is called, as it was
+		// within the previous poller.
+		var err error
+		r.mu.Lock()
+		if !r.stopped {
+			err = p.backend.disarm(desc.Fd(), m.event)
+		}
+		r.mu.Unlock()
+		r.report("disarm", err)
+	}
+	if desc.lifetime != nil {
+		r.mu.Lock()
+		if !r.stopped {
+			r.lifetime = time.AfterFunc(p.config.ConnLifetimeInterval, r.checkLifetime)
+		}
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// checkLifetime stops the registration if the connection of the descriptor
+// was closed, or schedules the next check otherwise.
+func (r *registration) checkLifetime() {
+	if r.desc.abandoned() {
+		r.poller.stopRegistration(r, StopPeerAbandoned)
+		return
+	}
+	r.mu.Lock()
+	if !r.stopped {
+		r.lifetime.Reset(r.poller.config.ConnLifetimeInterval)
+	}
+	r.mu.Unlock()
+}
+
+// detach stops desc registration with StopMigrated reason and returns its
+// state once the last callback has returned. That is, it must not be called
+// from the descriptor's callback.
+func (p *poller) detach(desc *Desc) (*migration, error) {
+	if p.config.Strict {
+		p.strictDetach(desc)
+	}
+	p.mu.Lock()
+	r, has := p.regs[desc]
+	delete(p.regs, desc)
+	p.mu.Unlock()
+
+	if !has {
+		return nil, ErrNotRegistered
+	}
+	if err := p.backend.del(desc.Fd(), r.events()); err != nil {
+		// Leave the descriptor registered, since it is still observed.
+		p.mu.Lock()
+		if _, has := p.regs[desc]; !has {
+			p.regs[desc] = r
+		}
+		p.mu.Unlock()
+		return nil, wrapDescErr("stop", desc, r.events(), err)
+	}
+	desc.release(p)
+	r.stop(StopMigrated)
+	<-r.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	opts := r.opts
+	opts.CoalesceWindow = time.Duration(atomic.LoadInt64(&r.window))
+	opts.ReadLowWater = r.lowat
+
+	return &migration{
+		cb:    r.cb,
+		opts:  opts,
+		event: r.events(),
+		armed: atomic.LoadInt32(&r.armed) == 1,
+		muted: r.muted,
+	}, nil
+}
+
+// checkEvent returns ErrUnsupported or ErrUnsupportedEvent if event could not
+// be observed by the backend.
+func (p *poller) checkEvent(event Event) error {
+	if event&EventEdgeTriggered != 0 && !p.caps.EdgeTriggered {
+		return ErrUnsupportedEvent
+	}
+	if event&EventPri != 0 && !p.caps.Pri {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// setLowWater sets the read low-water mark n of fd, if it is not zero.
+func (p *poller) setLowWater(fd, n int) error {
+	if n == 0 {
+		return nil
+	}
+	if n < 0 {
+		return ErrInvalidLowWater
+	}
+	stream, err := isStreamSocket(fd)
+	if err != nil {
+		return err
+	}
+	if !stream {
+		return ErrInvalidLowWater
+	}
+	return p.backend.lowWater(fd, n)
+}
+
+// internalFds implements internalFder interface.
+func (p *poller) internalFds() []int {
+	return p.backend.internalFds()
+}
+
+// ctlRetry calls fn, which makes the kernel registration call, until it
+// succeeds, fails with non-transient error or Config.CtlRetry attempts are
+// exhausted.
+func (p *poller) ctlRetry(fn func() error) error {
+	err := fn()
+	delay := p.config.CtlRetry.Backoff
+	for i := 0; i < p.config.CtlRetry.Attempts && transientCtlErr(err); i++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = fn()
+	}
+	return err
+}
+
+// transientCtlErr reports whether the kernel registration call failed with
+// err could succeed if retried later.
+func transientCtlErr(err error) bool {
+	switch err {
+	case syscall.ENOMEM, syscall.ENOSPC:
+		return true
+	}
+	_, ok := err.(*WatchLimitError)
+	return ok
+}
+
+// Export implements EventPoll.Export() method.
+func (p *poller) Export() ([]DescState, error) {
+	p.mu.RLock()
+	states := make([]DescState, 0, len(p.regs))
+	for desc, r := range p.regs {
+		states = append(states, DescState{
+			Fd:    desc.Fd(),
+			Event: r.events(),
+			Label: desc.Label(),
+			Meta:  r.opts.meta,
+			Desc:  desc,
+		})
+	}
+	p.mu.RUnlock()
+
+	sortDescStates(states)
+
+	return states, nil
+}
+
+// registered implements migrator interface.
+func (p *poller) registered() []*Desc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	descs := make([]*Desc, 0, len(p.regs))
+	for desc := range p.regs {
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// Migrate implements EventPoll.Migrate() method.
+func (p *poller) Migrate(desc *Desc, to EventPoll) error {
+	return migrate(p, desc, to)
+}
+
+// emfileStrategy implements emfileStrategist interface.
+func (p *poller) emfileStrategy() EMFILEStrategy {
+	return p.config.EMFILEStrategy
+}
+
+// Stop implements EventPoll.Stop() method.
+func (p *poller) Stop(desc *Desc) error {
+	p.mu.Lock()
+	r, has := p.regs[desc]
+	delete(p.regs, desc)
+	p.mu.Unlock()
+
+	event := desc.event
+	if has {
+		event = r.events()
+		desc.release(p)
+	}
+	err := p.backend.del(desc.Fd(), event)
+	if has {
+		r.stop(StopExplicit)
+	}
+	return wrapDescErr("stop", desc, event, err)
+}
+
+// StopAndClose implements EventPoll.StopAndClose() method.
+func (p *poller) StopAndClose(desc *Desc) error {
+	p.mu.Lock()
+	r, has := p.regs[desc]
+	delete(p.regs, desc)
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	desc.release(p)
+	event := r.events()
+	err := p.backend.del(desc.Fd(), event)
+
+	r.mu.Lock()
+	r.closeDesc = true
+	r.mu.Unlock()
+	r.stop(StopExplicit)
+
+	return wrapDescErr("stop", desc, event, err)
+}
+
+// Resume implements EventPoll.Resume() method.
+func (p *poller) Resume(desc *Desc) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r != nil {
+		return r.resume()
+	}
+	err := p.backend.mod(desc.Fd(), desc.event)
+	if err == syscall.EBADF || err == syscall.ENOENT {
+		return ErrDescClosed
+	}
+	return wrapDescErr("resume", desc, desc.event, err)
+}
+
+// resume enables observation of the registered descriptor again. It holds
+// r.mu while calling the backend, thus the descriptor is never resumed once
+// the registration is stopped, even if Stop() is called concurrently (e.g.
+// with AutoResume of the running callback).
+func (r *registration) resume() error {
+	p := r.poller
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return ErrNotRegistered
+	}
+	r.muted = false
+	atomic.StoreInt32(&r.armed, 1)
+	if p.config.Strict {
+		atomic.AddUint32(&r.resumes, 1)
+	}
+	event := r.interest()
+	err := p.backend.mod(r.desc.Fd(), event)
+	r.mu.Unlock()
+
+	if err == syscall.EBADF || err == syscall.ENOENT {
+		// The descriptor was closed (and thus removed from the kernel's
+		// observation list) while being registered.
+		p.stopRegistration(r, StopError)
+		return ErrDescClosed
+	}
+	return wrapDescErr("resume", r.desc, event, err)
+}
+
+// ModifyEvent implements EventPoll.ModifyEvent() method.
+func (p *poller) ModifyEvent(desc *Desc, event Event) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return ErrNotRegistered
+	}
+	if err := p.checkEvent(event); err != nil {
+		return err
+	}
+	prev := r.events()
+	atomic.StoreUint32(&r.event, uint32(event))
+	if r.deferred || r.muted || atomic.LoadInt32(&r.parked) == 1 {
+		// New events will be applied by rearm(), Resume() or promotion.
+		return nil
+	}
+	atomic.StoreInt32(&r.armed, 1)
+
+	err := p.ctlRetry(func() error {
+		return p.backend.change(desc.Fd(), prev, event)
+	})
+	if err != nil {
+		atomic.StoreUint32(&r.event, uint32(prev))
+	}
+	return wrapDescErr("modify", desc, event, err)
+}
+
+// SetDeliveryMask implements EventPoll.SetDeliveryMask() method.
+func (p *poller) SetDeliveryMask(desc *Desc, mask Event) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+	atomic.StoreUint32(&r.masked, uint32(^mask))
+	return nil
+}
+
+// SetCoalesce implements EventPoll.SetCoalesce() method.
+func (p *poller) SetCoalesce(desc *Desc, window time.Duration) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+	if window < 0 {
+		window = 0
+	}
+	atomic.StoreInt64(&r.window, int64(window))
+	return nil
+}
+
+// SetLowWater implements EventPoll.SetLowWater() method.
+func (p *poller) SetLowWater(desc *Desc, n int) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+	if n < 0 {
+		return ErrInvalidLowWater
+	}
+	stream, err := isStreamSocket(desc.Fd())
+	if err != nil {
+		return wrapDescErr("lowat", desc, r.events(), err)
+	}
+	if !stream {
+		return ErrInvalidLowWater
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event := r.events()
+	if err = p.backend.lowWater(desc.Fd(), n); err != nil {
+		return wrapDescErr("lowat", desc, event, err)
+	}
+	r.lowat = n
+
+	// Re-register the descriptor to apply the mark, unless it is disarmed
+	// or parked for now: the mark is applied when it is armed again or
+	// promoted then.
+	if r.stopped || r.deferred || r.muted || atomic.LoadInt32(&r.parked) == 1 ||
+		(event&EventOneShot != 0 && atomic.LoadInt32(&r.armed) == 0) {
+		return nil
+	}
+	return wrapDescErr("lowat", desc, event, p.backend.mod(desc.Fd(), event))
+}
+
+// writeInterest adds or removes EventWrite from the events desc is
+// registered for, if needed.
+func (p *poller) writeInterest(desc *Desc, on bool) error {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+	prev := r.events()
+	event := prev &^ EventWrite
+	if on {
+		event |= EventWrite
+	}
+	if event == prev {
+		return nil
+	}
+	return p.ModifyEvent(desc, event)
+}
+
+// filePinner is implemented by backends which hold a reference to the files
+// of registered descriptors (e.g. by io_uring poll requests), thus closing
+// the descriptor does not remove it from observation, as it does with epoll
+// and kqueue.
+type filePinner interface {
+	// unpin stops observation of fd which is about to be closed. Further
+	// changes of its registration fail with EBADF, as they do for closed
+	// descriptors with epoll.
+	unpin(fd int)
+}
+
+// descClosing is called by Desc.Close() before the file is closed. If the
+// descriptor's callback is running (e.g. Close() is called from within it),
+// the registration is stopped, the same as by Stop(): no more callbacks are
+// made and AutoResume is cancelled, thus the closed file descriptor (whose
+// number could be reused already) is never touched after the callback
+// returns.
+func (p *poller) descClosing(desc *Desc) {
+	p.mu.RLock()
+	r := p.regs[desc]
+	p.mu.RUnlock()
+	if r == nil {
+		return
+	}
+	if f, ok := p.backend.(filePinner); ok {
+		f.unpin(desc.Fd())
+	}
+	r.mu.Lock()
+	running := r.running
+	r.mu.Unlock()
+	if running {
+		p.stopRegistration(r, StopExplicit)
+	}
+}
+
+// stopRegistration stops r if it is still registered within p.
+func (p *poller) stopRegistration(r *registration, reason StopReason) {
+	p.mu.Lock()
+	has := p.regs[r.desc] == r
+	if has {
+		delete(p.regs, r.desc)
+	}
+	p.mu.Unlock()
+
+	if has {
+		r.desc.release(p)
+		_ = p.backend.del(r.desc.Fd(), r.events())
+		r.stop(reason)
+		if fn := p.config.onStop; fn != nil {
+			fn(r.desc)
+		}
+	}
+}
+
+// NewGroup implements EventPoll.NewGroup() method.
+func (p *poller) NewGroup() *Group {
+	return newGroup(p, p)
+}
+
+// StopAll implements EventPoll.StopAll() method.
+func (p *poller) StopAll() error {
+	p.mu.RLock()
+	descs := make([]*Desc, 0, len(p.regs))
+	for desc := range p.regs {
+		descs = append(descs, desc)
+	}
+	p.mu.RUnlock()
+
+	return p.stopDescs(descs, StopReset, false)
+}
+
+// stopDescs implements groupStopper interface.
+func (p *poller) stopDescs(descs []*Desc, reason StopReason, close bool) error {
+	regs := make([]*registration, len(descs))
+	p.mu.Lock()
+	for i, desc := range descs {
+		if r, has := p.regs[desc]; has {
+			delete(p.regs, desc)
+			regs[i] = r
+		}
+	}
+	p.mu.Unlock()
+
+	var err error
+	for i, r := range regs {
+		desc := descs[i]
+		if r == nil {
+			// Descriptor was stopped before, so there is nothing to
+			// wait for.
+			if close {
+				if e := desc.Close(); err == nil {
+					err = e
+				}
+			}
+			continue
+		}
+		desc.release(p)
+		event := r.events()
+		if e := p.backend.del(desc.Fd(), event); e != nil && err == nil {
+			err = wrapDescErr("stop", desc, event, e)
+		}
+		if close {
+			r.mu.Lock()
+			r.closeDesc = true
+			r.mu.Unlock()
+		}
+		r.stop(reason)
+	}
+	return err
+}
+
+// Capabilities implements EventPoll.Capabilities() method.
+func (p *poller) Capabilities() Capabilities {
+	return p.caps
+}
+
+// DumpEvents implements EventPoll.DumpEvents() method.
+func (p *poller) DumpEvents(w io.Writer, format DumpFormat) error {
+	return dumpEvents(w, p.recorder.records(-1), format)
+}
+
+// DumpEventsFor implements EventPoll.DumpEventsFor() method.
+func (p *poller) DumpEventsFor(w io.Writer, desc *Desc, format DumpFormat) error {
+	return dumpEvents(w, p.recorder.records(desc.Fd()), format)
+}
+
+// Barrier implements EventPoll.Barrier() method.
+func (p *poller) Barrier(fn func()) {
+	p.gate.Lock()
+	defer p.gate.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+}
+
+// PollerFd implements EventPoll.PollerFd() method.
+func (p *poller) PollerFd() (int, error) {
+	return p.backend.Fd(), nil
+}
+
+// Wakeup implements EventPoll.Wakeup() method.
+func (p *poller) Wakeup() error {
+	atomic.AddUint64(&p.stats.wakeups, 1)
+	if !atomic.CompareAndSwapInt32(&p.woken, 0, 1) {
+		// The loop is not woken up yet by the previous call; it calls
+		// OnWakeup after that anyway.
+		atomic.AddUint64(&p.stats.coalesced, 1)
+		return nil
+	}
+	err := p.backend.trigger()
+	if err != nil {
+		atomic.StoreInt32(&p.woken, 0)
+	}
+	return err
+}
+
+// onWakeup is called by the wait loop after the wakeup was handled.
+func (p *poller) onWakeup() {
+	atomic.StoreInt32(&p.woken, 0)
+	if fn := p.config.OnWakeup; fn != nil {
+		fn()
+	}
+}
+
+// Iterate implements EventPoll.Iterate() method.
+func (p *poller) Iterate(timeout time.Duration) error {
+	return p.backend.Iterate(timeout)
+}
+
+// Stats implements EventPoll.Stats() method.
+func (p *poller) Stats() Stats {
+	p.mu.RLock()
+	n := len(p.regs)
+	p.mu.RUnlock()
+
+	s := p.stats.snapshot()
+	s.Registered = n
+	s.WaitBlockedNanos, s.Waits = p.backend.waitBlocked()
+
+	return s
+}
+
+// Close stops the poller and closes all underlying resources.
+// Note that EventPollClosed is passed to every registered callback.
+func (p *poller) Close() error {
+	if p.config.Strict {
+		p.strictClose("Close")
+	}
+	err := p.backend.Close()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.closed = true
+	if p.parker != nil {
+		p.parker.Stop()
+	}
+	p.mu.Unlock()
+	p.stopAll(StopPollerClosed)
+
+	return nil
+}
+
+// CloseContext closes poller gracefully. Before poller is closed, every
+// registered callback is called with EventClosing; then CloseContext waits
+// for these callbacks to return, or for the registrations to be stopped,
+// until ctx is done.
+//
+// Callbacks are run by the configured Dispatcher and are subject to the
+// usual serialization: if the callback is running, EventClosing is passed
+// to it right after it returns. InlineDispatcher runs them one by one
+// within the caller's goroutine. Note that no more EventClosing callbacks
+// are started after ctx is done.
+func (p *poller) CloseContext(ctx context.Context) error {
+	if p.config.Strict {
+		p.strictClose("CloseContext")
+	}
+	p.mu.RLock()
+	regs := make([]*registration, 0, len(p.regs))
+	for _, r := range p.regs {
+		regs = append(regs, r)
+	}
+	p.mu.RUnlock()
+
+	var notified []*registration
+	for _, r := range regs {
+		if ctx.Err() != nil {
+			break
+		}
+		if r.closing() {
+			notified = append(notified, r)
+		}
+	}
+wait:
+	for _, r := range notified {
+		select {
+		case <-r.closed:
+		case <-r.done:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	return p.Close()
+}
+
+// closing passes EventClosing to the callback. It reports whether the event
+// is about to be delivered. It does not call the backend.
+func (r *registration) closing() bool {
+	r.mu.Lock()
+	if r.stopped || r.closed != nil {
+		r.mu.Unlock()
+		return false
+	}
+	r.closed = make(chan struct{})
+	r.mu.Unlock()
+
+	p := r.poller
+	p.gate.RLock()
+	if !r.enter(EventClosing) {
+		p.gate.RUnlock()
+		return true
+	}
+	if p.inline {
+		r.run(EventClosing, nil)
+		p.gate.RUnlock()
+		return true
+	}
+	r.submit()
+	return true
+}
+
+// stopAll stops all registrations with given reason.
+func (p *poller) stopAll(reason StopReason) {
+	p.mu.Lock()
+	regs := p.regs
+	p.regs = make(map[*Desc]*registration)
+	p.mu.Unlock()
+
+	for _, r := range regs {
+		r.desc.release(p)
+		r.stop(reason)
+	}
+}
+
+// onWaitError wraps Config.OnWaitError. When the wait loop stops, all
+// registrations are stopped, since no more events are delivered for them.
+func (p *poller) onWaitError(err error) bool {
+	if p.config.OnWaitError(err) {
+		return true
+	}
+	p.stopAll(StopError)
+	return false
+}
+
+// registration holds the state of a single descriptor registered within
+// poller.
+type registration struct {
+	// The fields below must be accessed atomically, thus they go first to
+	// be 64-bit aligned on 32-bit platforms.
+
+	// window is the coalescing window in nanoseconds. It is initially the
+	// Options.CoalesceWindow and could be changed by SetCoalesce().
+	window int64
+
+	// active is the time the callback was called last time. It is tracked
+	// only if Config.ParkIdle is set.
+	active int64
+
+	poller   *poller
+	desc     *Desc
+	cb       CallbackFn
+	opts     startOptions
+	dispatch func()
+
+	// dispatchScratch is set instead of dispatch if the callback is started
+	// by StartWithScratch() and Dispatcher implements ScratchDispatcher.
+	dispatchScratch func(*Scratch)
+
+	// event is a set of events descriptor is registered for. It is initially
+	// the same as desc.event and could be changed by ModifyEvent(). Must be
+	// accessed atomically.
+	event uint32
+
+	// armed is set to 1 when one-shot descriptor is able to receive an
+	// event. Must be accessed atomically.
+	armed int32
+
+	// masked is a set of events dropped before delivery, that is the
+	// complement of the mask set by SetDeliveryMask(). Must be accessed
+	// atomically.
+	masked uint32
+
+	// limit is a rate limit of callback calls for the descriptor.
+	limit *bucket
+
+	// lowat is the read low-water mark set by Options.ReadLowWater or
+	// SetLowWater(). It is guarded by mu.
+	lowat int
+
+	// resumes is the number of Resume() calls made for the registration. It
+	// is counted for Config.Strict checks only. Must be accessed atomically.
+	resumes uint32
+
+	// parked is set to 1 while the descriptor is parked. It is changed
+	// with mu held. Must be accessed atomically.
+	parked int32
+
+	// grouped is set if the descriptor was a group member when started
+	// and Config.Metrics is set, that is if its callback calls are counted
+	// for GroupStats.
+	grouped bool
+
+	// batched is the 1-based index of the registration's entry within the
+	// poller's current batch, if any. It is used by the wait loop only.
+	batched int
+
+	mu       sync.Mutex
+	stopped  bool
+	muted    bool
+	running  bool
+	next     Event
+	pending  Event
+	deferred bool
+	until    int64
+	timer    *time.Timer
+
+	// closeDesc is set by StopAndClose() to close the descriptor after the
+	// OnStop hook returns.
+	closeDesc bool
+
+	// reason is the reason the registration was stopped with. The finished
+	// flag is set when the OnStop hook is due, that is when registration is
+	// stopped and callback is not running.
+	reason   StopReason
+	finished bool
+
+	// done is closed after the OnStop hook returns.
+	done chan struct{}
+
+	// closed is created when EventClosing is passed to the callback and is
+	// closed after the callback returns.
+	closed chan struct{}
+
+	// gen is the generation of the registration within poller.
+	gen uint64
+
+	// lifetime is the timer checking the connection of the descriptor
+	// created with DescOptions.ConnLifetime. It is guarded by mu.
+	lifetime *time.Timer
+
+	// received and pendingAt are the times the event being delivered and
+	// the pending events were received. They are tracked only if events
+	// are recorded.
+	received  int64
+	pendingAt int64
+}
+
+// notify is called by backend on each event received for r.desc. The
+// event is delivered after all events of the wait iteration are received,
+// merged with the other ones received for r.desc (see appendBatch()).
+func (r *registration) notify(event Event, data int64, raw uint32) {
+	if event&EventPollClosed == 0 {
+		atomic.StoreUint32(&r.desc.rawFlags, raw)
+	}
+	if event&EventRead != 0 {
+		atomic.StoreInt64(&r.desc.readData, data)
+	}
+	if event&EventWrite != 0 {
+		atomic.StoreInt64(&r.desc.writeData, data)
+	}
+	if atomic.LoadInt32(&r.parked) == 1 && event&EventPollClosed == 0 {
+		event = r.promote(event)
+	}
+	if event = r.filter(event); event == 0 {
+		return
+	}
+	if !r.poller.appendBatch(r, event) {
+		r.handle(event)
+	}
+}
+
+// filter drops the events masked by SetDeliveryMask() from event.
+// Poller's own events are never dropped.
+func (r *registration) filter(event Event) Event {
+	masked := Event(atomic.LoadUint32(&r.masked))
+	return event &^ (masked &^ (EventClosing | EventPollClosed))
+}
+
+// handle handles the event received for r.desc.
+func (r *registration) handle(event Event) {
+	if r.desc.tty && event&EventErr != 0 {
+		// Disconnected USB serial adapters are reported with error only.
+		event |= EventHup
+	}
+	window := atomic.LoadInt64(&r.window)
+	if event&EventPollClosed == 0 && window > 0 {
+		suppressed, err := r.coalesce(window)
+		r.report("disarm", err)
+		if suppressed {
+			atomic.AddUint64(&r.poller.stats.suppressed, 1)
+			return
+		}
+	}
+	if event&EventPollClosed == 0 && (r.limit != nil || r.poller.limit != nil) {
+		held, activated, err := r.throttle()
+		r.report("disarm", err)
+		if activated {
+			atomic.AddUint64(&r.poller.stats.throttled, 1)
+			if fn := r.poller.config.OnThrottled; fn != nil {
+				fn(r.desc)
+			}
+		}
+		if held {
+			return
+		}
+	}
+	if r.events()&EventOneShot != 0 && event&EventPollClosed == 0 &&
+		!atomic.CompareAndSwapInt32(&r.armed, 1, 0) {
+		// Some backends (e.g. kqueue) apply one-shot semantics per filter,
+		// thus descriptor registered for both reading and writing could
+		// receive two events before Resume() is called. Drop the second one
+		// to behave exactly as epoll's EPOLLONESHOT does.
+		return
+	}
+	if r.hangup(event) {
+		deliver, err := r.mute()
+		r.report("disarm", err)
+		if !deliver {
+			return
+		}
+	}
+	r.schedule(event)
+}
+
+// schedule runs the callback with given event inline or by the Dispatcher,
+// unless it is already running.
+func (r *registration) schedule(event Event) {
+	p := r.poller
+	p.gate.RLock()
+	if !r.enter(event) {
+		p.gate.RUnlock()
+		return
+	}
+	if p.inline {
+		r.run(event, nil)
+		p.gate.RUnlock()
+		return
+	}
+	r.submit()
+}
+
+// submit passes the callback previously entered to the Dispatcher.
+func (r *registration) submit() {
+	if r.dispatchScratch != nil {
+		r.poller.scratcher.DispatchScratch(r.dispatchScratch)
+		return
+	}
+	r.poller.config.Dispatcher.Dispatch(r.dispatch)
+}
+
+// events returns the set of events descriptor is registered for.
+func (r *registration) events() Event {
+	return Event(atomic.LoadUint32(&r.event))
+}
+
+// probe delivers synthetic event to the callback if descriptor is ready.
+func (r *registration) probe() {
+	event, err := r.desc.PollNow()
+	if err != nil {
+		r.report("probe", err)
+		return
+	}
+	event &= r.events()&(EventRead|EventWrite) | EventHup | EventReadHup | EventErr
+	if event = r.filter(event); event == 0 {
+		return
+	}
+	go r.handle(event)
+}
+
+// enter reports whether the caller must run the callback with given event.
+// If the callback is already running, event is merged with the pending ones
+// which will be passed to the callback right after it returns. This makes
+// callbacks of a single descriptor to be never run concurrently.
+func (r *registration) enter(event Event) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return false
+	}
+	if r.poller.recorder != nil {
+		now := nanotime()
+		if !r.running {
+			r.received = now
+		} else if r.pending == 0 {
+			r.pendingAt = now
+		}
+	}
+	if r.running {
+		r.pending |= event
+		return false
+	}
+	r.running = true
+	r.next = event
+
+	return true
+}
+
+// dispatched is passed to the Dispatcher to run the callback with event
+// previously passed to enter(). The event is not delivered if registration
+// was stopped in the meantime.
+func (r *registration) dispatched() {
+	r.dispatchedScratch(nil)
+}
+
+// dispatchedScratch is passed to the ScratchDispatcher just like
+// dispatched() is, but runs the callback with the worker's arena.
+func (r *registration) dispatchedScratch(s *Scratch) {
+	defer r.poller.gate.RUnlock()
+
+	r.mu.Lock()
+	event := r.next
+	if r.stopped && event&EventPollClosed == 0 {
+		r.running = false
+		r.pending = 0
+		finish := r.finish()
+		r.mu.Unlock()
+		if finish {
+			r.finalize()
+		}
+		return
+	}
+	r.mu.Unlock()
+
+	r.run(event, s)
+}
+
+// run calls the callback with given event and then with events received
+// while it was running, if any. The s is the arena of the worker running
+// the callback, if any.
+func (r *registration) run(event Event, s *Scratch) {
+	for {
+		if f := r.desc.fifo; f != nil && f.reopen && hangup(event) {
+			r.reopen(f)
+		} else {
+			r.deliver(event, s)
+		}
+
+		r.mu.Lock()
+		if event&EventClosing != 0 {
+			close(r.closed)
+		}
+		event, r.pending = r.pending, 0
+		r.received = r.pendingAt
+		if event == 0 || (r.stopped && event&EventPollClosed == 0) {
+			r.running = false
+			finish := r.finish()
+			r.mu.Unlock()
+			if finish {
+				r.finalize()
+			}
+			return
+		}
+		r.mu.Unlock()
+	}
+}
+
+// deliver calls the callback with given event and applies the options
+// which take effect after the callback returns.
+func (r *registration) deliver(event Event, s *Scratch) {
+	p := r.poller
+	if event&EventPollClosed == 0 && r.desc.abandoned() {
+		p.stopRegistration(r, StopPeerAbandoned)
+		return
+	}
+	atomic.AddUint64(&p.stats.callbacks, 1)
+	if r.grouped {
+		atomic.AddUint64(&r.desc.fired, 1)
+	}
+	if p.config.ParkIdle > 0 {
+		atomic.StoreInt64(&r.active, nanotime())
+	}
+	var strict strictCall
+	if p.config.Strict {
+		strict = r.enterStrict(event)
+	}
+	if p.config.Metrics || p.recorder != nil {
+		// Record the label the callback was called with.
+		label := atomic.LoadPointer(&r.desc.label)
+		start := nanotime()
+		r.call(event, s)
+		end := nanotime()
+		if p.config.Metrics {
+			atomic.AddUint64(&p.stats.callbackNanos, uint64(end-start))
+		}
+		if p.recorder != nil {
+			p.recorder.add(r.desc.Fd(), label, r.gen, event, r.received, start, end)
+		}
+	} else {
+		r.call(event, s)
+	}
+	if f := r.desc.fifo; f != nil && event&EventRead != 0 {
+		f.delay = 0
+	}
+	if p.config.StrictEdge && event&EventRead != 0 {
+		r.checkDrained()
+	}
+	if r.opts.StopOnHup && r.hangup(event) {
+		p.stopRegistration(r, StopHangup)
+	}
+	if r.opts.AutoResume && !r.hangup(event) {
+		r.autoResume(event)
+	}
+	if p.config.Strict {
+		r.exitStrict(strict)
+	}
+}
+
+// checkDrained calls Config.OnUndrained if edge-triggered descriptor has
+// data left unread after the callback returned.
+func (r *registration) checkDrained() {
+	if r.events()&EventEdgeTriggered == 0 {
+		return
+	}
+	r.mu.Lock()
+	stopped := r.stopped
+	r.mu.Unlock()
+	// Stopped descriptor could be closed by the callback already.
+	if stopped {
+		return
+	}
+	if n, err := readableBytes(r.desc.Fd()); err == nil && n > 0 {
+		r.poller.config.OnUndrained(r.desc, n)
+	}
+}
+
+// autoResume resumes the one-shot descriptor after the callback returned,
+// unless it was stopped by the callback (or concurrently with it). Note
+// that the registration is resumed rather than the descriptor, which could
+// be started again by the callback after Stop().
+func (r *registration) autoResume(event Event) {
+	if event&EventPollClosed != 0 || r.events()&EventOneShot == 0 {
+		return
+	}
+	if err := r.resume(); err != ErrDescClosed {
+		r.report("resume", err)
+	}
+}
+
+// call calls the callback with given event. Callbacks started by
+// StartWithScratch() get the arena which is reset right after they return:
+// the given one of the worker, the poller's one if run inline or a new one
+// otherwise.
+func (r *registration) call(event Event, s *Scratch) {
+	fn := r.opts.scratch
+	if fn == nil {
+		if r.cb != nil {
+			r.cb(event)
+		}
+		return
+	}
+	p := r.poller
+	var owned bool
+	if s == nil {
+		if p.inline && atomic.CompareAndSwapInt32(&p.arenaBusy, 0, 1) {
+			s, owned = &p.arena, true
+		} else {
+			s = new(Scratch)
+		}
+	}
+	s.debug = p.config.DebugScratch
+	fn(event, s)
+	s.reset()
+	if owned {
+		atomic.StoreInt32(&p.arenaBusy, 0)
+	}
+}
+
+// hangup reports whether event tells that descriptor is not able to make
+// any progress anymore. Kernel reports such events continuously, regardless
+// of being consumed or not.
+func hangup(event Event) bool {
+	return event&EventPollClosed == 0 &&
+		event&(EventHup|EventErr) != 0 &&
+		event&(EventRead|EventPri) == 0
+}
+
+// hangup is like hangup() but takes the descriptor into account: kernel TLS
+// sockets report errors of the records (e.g. decryption failures) as well as
+// the pending error queue by EventErr, while the connection is still alive.
+// Such errors are surfaced by reading (see ReadKTLS()), so the event is
+// delivered as usual.
+func (r *registration) hangup(event Event) bool {
+	if !hangup(event) {
+		return false
+	}
+	return event&EventHup != 0 || !isKernelTLS(r.desc.Fd())
+}
+
+// mute disarms the descriptor after hang up event until Resume() is called.
+// It reports whether the event must be passed to the callback, that is if
+// the descriptor was not muted before. The error is the one of disarming,
+// which does not affect the result.
+func (r *registration) mute() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped || r.muted {
+		return false, nil
+	}
+	r.muted = true
+
+	return true, r.poller.backend.disarm(r.desc.Fd(), r.events())
+}
+
+// report passes err of the internal operation on the descriptor to
+// Config.OnDescError, if any. Errors caused by concurrent Stop() or Close()
+// calls are not reported. Note that r.mu must not be held.
+func (r *registration) report(op string, err error) {
+	fn := r.poller.config.OnDescError
+	if err == nil || fn == nil || err == ErrNotRegistered || err == ErrClosed {
+		return
+	}
+	fn(r.desc, wrapDescErr(op, r.desc, r.events(), err))
+}
+
+// coalesce reports whether the event must not be passed to the callback
+// because it was received within the coalescing window of the previous one.
+//
+// The first event received within the window disarms the descriptor until
+// the window ends. Then descriptor is armed again, making the kernel to
+// report it once more if it is still ready. That is, at most one trailing
+// callback is made after the window and no readiness is lost for both
+// level- and edge-triggered descriptors.
+//
+// The error is the one of disarming, in which case the event is let through
+// rather than lost.
+func (r *registration) coalesce(window int64) (bool, error) {
+	now := nanotime()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped || r.deferred {
+		return true, nil
+	}
+	if now >= r.until {
+		r.until = now + window
+		return false, nil
+	}
+	if err := r.hold(now, r.until); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// throttle reports whether the event must not be passed to the callback
+// because the descriptor or the poller exceeded its rate limit. In such case
+// descriptor is disarmed until the next token is available. The activated
+// value is true if this call made the descriptor to be disarmed. The error
+// is the one of disarming, in which case the event is let through.
+func (r *registration) throttle() (held, activated bool, err error) {
+	now := nanotime()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped || r.deferred {
+		return true, false, nil
+	}
+	var wait int64
+	if r.limit != nil {
+		wait = r.limit.take(now)
+	}
+	if wait == 0 && r.poller.limit != nil {
+		wait = r.poller.limit.take(now)
+	}
+	if wait == 0 {
+		return false, false, nil
+	}
+	if err = r.hold(now, now+wait); err != nil {
+		return false, false, err
+	}
+	return true, true, nil
+}
+
+// hold disarms the descriptor until the given time. If it could not be
+// disarmed, the error is returned and the event must be let through rather
+// than lost. Note that r.mu must be held.
+func (r *registration) hold(now, until int64) error {
+	if err := r.poller.backend.disarm(r.desc.Fd(), r.events()); err != nil {
+		return err
+	}
+	r.deferred = true
+
+	if d := time.Duration(until - now); r.timer == nil {
+		r.timer = time.AfterFunc(d, r.rearm)
+	} else {
+		r.timer.Reset(d)
+	}
+
+	return nil
+}
+
+// rearm is called when the descriptor disarmed by hold() must be armed
+// again.
+func (r *registration) rearm() {
+	r.mu.Lock()
+	if r.stopped || !r.deferred {
+		r.mu.Unlock()
+		return
+	}
+	r.deferred = false
+	if r.muted {
+		r.mu.Unlock()
+		return
+	}
+	err := r.poller.backend.mod(r.desc.Fd(), r.interest())
+	r.mu.Unlock()
+
+	r.report("rearm", err)
+}
+
+// stop marks registration as stopped with given reason. The OnStop hook is
+// called right away if callback is not running, or after it returns
+// otherwise. Subsequent calls have no effect.
+func (r *registration) stop(reason StopReason) {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	r.reason = reason
+	if atomic.CompareAndSwapInt32(&r.parked, 1, 0) {
+		atomic.AddInt64(&r.poller.stats.parked, -1)
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.lifetime != nil {
+		r.lifetime.Stop()
+	}
+	finish := r.finish()
+	r.mu.Unlock()
+
+	if finish {
+		r.finalize()
+	}
+}
+
+// finish reports whether the OnStop hook must be called by the caller. It
+// returns true at most once, when registration is stopped and callback is
+// not running. Note that r.mu must be held.
+func (r *registration) finish() bool {
+	if !r.stopped || r.running || r.finished {
+		return false
+	}
+	r.finished = true
+	return true
+}
+
+// finalize calls the OnStop hook and then closes r.done.
+func (r *registration) finalize() {
+	if fn := r.opts.OnStop; fn != nil {
+		fn(r.desc, r.reason)
+	}
+	if r.closeDesc || r.reason == StopPeerAbandoned {
+		r.desc.Close()
+	}
+	close(r.done)
+}
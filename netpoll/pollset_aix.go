@@ -0,0 +1,82 @@
+// +build aix
+
+package netpoll
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+//go:cgo_import_dynamic libc_pollset_create pollset_create "libc.a/shr_64.o"
+//go:cgo_import_dynamic libc_pollset_destroy pollset_destroy "libc.a/shr_64.o"
+//go:cgo_import_dynamic libc_pollset_ctl pollset_ctl "libc.a/shr_64.o"
+//go:cgo_import_dynamic libc_pollset_poll pollset_poll "libc.a/shr_64.o"
+
+//go:linkname libc_pollset_create libc_pollset_create
+//go:linkname libc_pollset_destroy libc_pollset_destroy
+//go:linkname libc_pollset_ctl libc_pollset_ctl
+//go:linkname libc_pollset_poll libc_pollset_poll
+
+type libcFunc uintptr
+
+var (
+	libc_pollset_create,
+	libc_pollset_destroy,
+	libc_pollset_ctl,
+	libc_pollset_poll libcFunc
+)
+
+// Implemented in pollset_aix_ppc64.s (it jumps to the syscall package).
+func syscall6(trap, nargs, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err unix.Errno)
+
+// Commands of the struct poll_ctl.
+const (
+	_PS_ADD    = 0
+	_PS_MOD    = 1
+	_PS_DELETE = 2
+)
+
+// pollCtl is the struct poll_ctl.
+type pollCtl struct {
+	cmd    int16
+	events int16
+	fd     int32
+}
+
+func pollsetCreate(maxfd int) (int, error) {
+	r, _, e := syscall6(uintptr(unsafe.Pointer(&libc_pollset_create)), 1, uintptr(maxfd), 0, 0, 0, 0, 0)
+	if int32(r) == -1 {
+		return -1, e
+	}
+	return int(int32(r)), nil
+}
+
+func pollsetDestroy(ps int) error {
+	r, _, e := syscall6(uintptr(unsafe.Pointer(&libc_pollset_destroy)), 1, uintptr(ps), 0, 0, 0, 0, 0)
+	if int32(r) == -1 {
+		return e
+	}
+	return nil
+}
+
+func pollsetCtl(ps int, cmd int16, fd int, events int16) error {
+	ctl := pollCtl{
+		cmd:    cmd,
+		events: events,
+		fd:     int32(fd),
+	}
+	r, _, e := syscall6(uintptr(unsafe.Pointer(&libc_pollset_ctl)), 3, uintptr(ps), uintptr(unsafe.Pointer(&ctl)), 1, 0, 0, 0)
+	if int32(r) == -1 {
+		return e
+	}
+	return nil
+}
+
+func pollsetPoll(ps int, fds []unix.PollFd, timeout int) (int, error) {
+	r, _, e := syscall6(uintptr(unsafe.Pointer(&libc_pollset_poll)), 4, uintptr(ps), uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)), uintptr(timeout), 0, 0)
+	if int32(r) == -1 {
+		return 0, e
+	}
+	return int(int32(r)), nil
+}
@@ -0,0 +1,6 @@
+// +build aix
+
+#include "textflag.h"
+
+TEXT ·syscall6(SB),NOSPLIT,$0-88
+	JMP	syscall·syscall6(SB)
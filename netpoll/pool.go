@@ -0,0 +1,601 @@
+package netpoll
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// PoolConfig contains options for Pool configuration.
+type PoolConfig struct {
+	// Size is the number of pollers within the pool.
+	// If zero, runtime.GOMAXPROCS(0) is used.
+	Size int
+
+	// Config is used to create each poller of the pool.
+	Config *Config
+
+	// Picker chooses poller for each new descriptor.
+	// If nil, RoundRobin() is used.
+	Picker Picker
+
+	// ShardCPUs contains lists of CPUs for each poller of the pool. If not
+	// empty, the pool consists of len(ShardCPUs) pollers and the wait loop
+	// of i-th poller is bound to ShardCPUs[i] (if not empty). That is, the
+	// inline callbacks are also run on those CPUs.
+	//
+	// See DetectNUMATopology() for NUMA-aware placement.
+	//
+	// Note that binding is supported on linux only and is ignored on other
+	// operating systems. On linux NewPool() fails if some poller could not
+	// be bound. ShardCPUs[i] overrides Config.CPUAffinity for i-th poller.
+	ShardCPUs [][]int
+}
+
+// Picker chooses a poller within Pool for a new descriptor.
+type Picker interface {
+	// Pick returns index of the poller in range [0, len(load)) which must
+	// observe the descriptor. The load contains the number of descriptors
+	// registered within each poller at the moment. The keyed value is true
+	// if the key was passed by WithKey() option.
+	Pick(key uint64, keyed bool, load []int) int
+}
+
+// PickerFunc is an adapter to allow the use of ordinary functions as Picker.
+type PickerFunc func(key uint64, keyed bool, load []int) int
+
+// Pick implements Picker interface.
+func (fn PickerFunc) Pick(key uint64, keyed bool, load []int) int {
+	return fn(key, keyed, load)
+}
+
+// RoundRobin returns Picker which chooses pollers one after another.
+func RoundRobin() Picker {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *roundRobin) Pick(_ uint64, _ bool, load []int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.next % len(load)
+	r.next = i + 1
+
+	return i
+}
+
+// LeastLoaded returns Picker which chooses poller with the least number of
+// registered descriptors.
+func LeastLoaded() Picker {
+	return PickerFunc(func(_ uint64, _ bool, load []int) int {
+		var min int
+		for i, n := range load {
+			if n < load[min] {
+				min = i
+			}
+		}
+		return min
+	})
+}
+
+// Hash returns Picker which maps the key passed by WithKey() option to the
+// poller by consistent hashing. That is, descriptors with equal keys are
+// always registered within the same poller. Descriptors without a key are
+// distributed in round-robin manner.
+func Hash() Picker {
+	rr := RoundRobin()
+	return PickerFunc(func(key uint64, keyed bool, load []int) int {
+		if !keyed {
+			return rr.Pick(key, keyed, load)
+		}
+		return jumpHash(key, len(load))
+	})
+}
+
+// jumpHash implements "A Fast, Minimal Memory, Consistent Hash Algorithm" by
+// John Lamping and Eric Veach.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Pool is an EventPoll implementation which distributes descriptors among
+// multiple pollers.
+type Pool struct {
+	pollers []EventPoll
+	picker  Picker
+
+	mu     sync.Mutex
+	shards map[*Desc]int
+}
+
+// NewPool creates new Pool with given config.
+func NewPool(c *PoolConfig) (*Pool, error) {
+	var config PoolConfig
+	if c != nil {
+		config = *c
+	}
+	if n := len(config.ShardCPUs); n > 0 {
+		config.Size = n
+	}
+	if config.Size <= 0 {
+		config.Size = runtime.GOMAXPROCS(0)
+	}
+	if config.Picker == nil {
+		config.Picker = RoundRobin()
+	}
+
+	p := &Pool{
+		pollers: make([]EventPoll, 0, config.Size),
+		picker:  config.Picker,
+		shards:  make(map[*Desc]int),
+	}
+	for i := 0; i < config.Size; i++ {
+		var c Config
+		if config.Config != nil {
+			c = *config.Config
+		}
+		if i < len(config.ShardCPUs) {
+			c.cpus = config.ShardCPUs[i]
+		}
+		i := i
+		c.onStop = func(desc *Desc) {
+			p.forget(desc, i)
+		}
+		poller, err := New(&c)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.pollers = append(p.pollers, poller)
+	}
+
+	return p, nil
+}
+
+// Start implements EventPoll.Start() method.
+func (p *Pool) Start(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb)
+}
+
+// StartWithOptions implements EventPoll.StartWithOptions() method.
+// Descriptor is registered within the poller chosen by the pool's Picker.
+// If the descriptor was registered before, the same poller is used again.
+func (p *Pool) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	s := resolveStartOptions(opts)
+
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	if !has {
+		i = p.pick(s)
+	}
+	p.mu.Unlock()
+
+	// The pool's lock is not held while descriptor is started: the poller
+	// could stop it right away (e.g. after hang up found by the initial
+	// readiness check), which calls forget().
+	if err := p.pollers[i].StartWithOptions(desc, cb, opts...); err != nil {
+		return err
+	}
+	p.remember(desc, i)
+
+	return nil
+}
+
+// attach implements migrator interface.
+func (p *Pool) attach(desc *Desc, m *migration) error {
+	p.mu.Lock()
+	if _, has := p.shards[desc]; has {
+		p.mu.Unlock()
+		return ErrRegistered
+	}
+	i := p.pick(m.opts)
+	p.mu.Unlock()
+
+	if err := p.pollers[i].(migrator).attach(desc, m); err != nil {
+		return err
+	}
+	p.remember(desc, i)
+
+	return nil
+}
+
+// pick chooses the poller for the descriptor started with given options.
+// Note that p.mu must be held.
+func (p *Pool) pick(s startOptions) int {
+	load := make([]int, len(p.pollers))
+	for j, poller := range p.pollers {
+		load[j] = poller.Stats().Registered
+	}
+	return p.picker.Pick(s.key, s.keyed, load)
+}
+
+// remember records that desc was started within i-th poller, unless it was
+// stopped by that poller already.
+func (p *Pool) remember(desc *Desc, i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if desc.Owner() == p.pollers[i] {
+		p.shards[desc] = i
+	}
+}
+
+// forget is called by i-th poller when it stops desc by itself.
+func (p *Pool) forget(desc *Desc, i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if j, has := p.shards[desc]; has && j == i {
+		delete(p.shards, desc)
+	}
+}
+
+// detach implements migrator interface.
+func (p *Pool) detach(desc *Desc) (*migration, error) {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	delete(p.shards, desc)
+	p.mu.Unlock()
+
+	if !has {
+		return nil, ErrNotRegistered
+	}
+	return p.pollers[i].(migrator).detach(desc)
+}
+
+// registered implements migrator interface.
+func (p *Pool) registered() []*Desc {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	descs := make([]*Desc, 0, len(p.shards))
+	for desc := range p.shards {
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// Migrate implements EventPoll.Migrate() method.
+func (p *Pool) Migrate(desc *Desc, to EventPoll) error {
+	return migrate(p, desc, to)
+}
+
+// emfileStrategy implements emfileStrategist interface. All pollers of the
+// pool are created with the same config.
+func (p *Pool) emfileStrategy() EMFILEStrategy {
+	if s, ok := p.pollers[0].(emfileStrategist); ok {
+		return s.emfileStrategy()
+	}
+	return EMFILEBackoff
+}
+
+// internalFds implements internalFder interface.
+func (p *Pool) internalFds() (fds []int) {
+	for _, poller := range p.pollers {
+		if f, ok := poller.(internalFder); ok {
+			fds = append(fds, f.internalFds()...)
+		}
+	}
+	return fds
+}
+
+// Stop implements EventPoll.Stop() method.
+func (p *Pool) Stop(desc *Desc) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	delete(p.shards, desc)
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].Stop(desc)
+}
+
+// StopAndClose implements EventPoll.StopAndClose() method.
+func (p *Pool) StopAndClose(desc *Desc) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	delete(p.shards, desc)
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].StopAndClose(desc)
+}
+
+// Resume implements EventPoll.Resume() method.
+func (p *Pool) Resume(desc *Desc) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	err := p.pollers[i].Resume(desc)
+	if err == ErrDescClosed {
+		p.mu.Lock()
+		delete(p.shards, desc)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// ModifyEvent implements EventPoll.ModifyEvent() method.
+func (p *Pool) ModifyEvent(desc *Desc, event Event) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].ModifyEvent(desc, event)
+}
+
+// SetDeliveryMask implements EventPoll.SetDeliveryMask() method.
+func (p *Pool) SetDeliveryMask(desc *Desc, mask Event) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].SetDeliveryMask(desc, mask)
+}
+
+// NewGroup implements EventPoll.NewGroup() method.
+func (p *Pool) NewGroup() *Group {
+	return newGroup(p, p)
+}
+
+// StopAll implements EventPoll.StopAll() method.
+func (p *Pool) StopAll() error {
+	p.mu.Lock()
+	descs := make([]*Desc, 0, len(p.shards))
+	for desc := range p.shards {
+		descs = append(descs, desc)
+	}
+	p.mu.Unlock()
+
+	return p.stopDescs(descs, StopReset, false)
+}
+
+// stopDescs implements groupStopper interface. Descriptors are stopped
+// within the pollers they are registered in.
+func (p *Pool) stopDescs(descs []*Desc, reason StopReason, close bool) error {
+	shards := make([][]*Desc, len(p.pollers))
+	p.mu.Lock()
+	for _, desc := range descs {
+		// Descriptors which are not registered are passed to the first
+		// poller, which closes them if needed.
+		i := p.shards[desc]
+		delete(p.shards, desc)
+		shards[i] = append(shards[i], desc)
+	}
+	p.mu.Unlock()
+
+	var err error
+	for i, descs := range shards {
+		if len(descs) == 0 {
+			continue
+		}
+		if e := p.pollers[i].(groupStopper).stopDescs(descs, reason, close); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SetLowWater implements EventPoll.SetLowWater() method.
+func (p *Pool) SetLowWater(desc *Desc, n int) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].SetLowWater(desc, n)
+}
+
+// SetCoalesce implements EventPoll.SetCoalesce() method.
+func (p *Pool) SetCoalesce(desc *Desc, window time.Duration) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].SetCoalesce(desc, window)
+}
+
+// Park implements EventPoll.Park() method.
+func (p *Pool) Park(desc *Desc) error {
+	p.mu.Lock()
+	i, has := p.shards[desc]
+	p.mu.Unlock()
+
+	if !has {
+		return ErrNotRegistered
+	}
+	return p.pollers[i].Park(desc)
+}
+
+// Export implements EventPoll.Export() method.
+// It returns states of all pollers registrations.
+func (p *Pool) Export() ([]DescState, error) {
+	var states []DescState
+	for _, poller := range p.pollers {
+		s, err := poller.Export()
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s...)
+	}
+	sortDescStates(states)
+	return states, nil
+}
+
+// Capabilities implements EventPoll.Capabilities() method.
+// All pollers of the pool share the same capabilities.
+func (p *Pool) Capabilities() Capabilities {
+	return p.pollers[0].Capabilities()
+}
+
+// SetBatchHandler implements EventPoll.SetBatchHandler() method.
+// The fn is set for every poller of the pool, thus it may be called
+// concurrently.
+func (p *Pool) SetBatchHandler(fn BatchHandler) {
+	for _, poller := range p.pollers {
+		poller.SetBatchHandler(fn)
+	}
+}
+
+// DumpEvents implements EventPoll.DumpEvents() method.
+// Records of all pollers are merged in chronological order.
+func (p *Pool) DumpEvents(w io.Writer, format DumpFormat) error {
+	return dumpEvents(w, p.records(-1), format)
+}
+
+// DumpEventsFor implements EventPoll.DumpEventsFor() method.
+func (p *Pool) DumpEventsFor(w io.Writer, desc *Desc, format DumpFormat) error {
+	return dumpEvents(w, p.records(desc.Fd()), format)
+}
+
+func (p *Pool) records(fd int) []EventRecord {
+	var recs []EventRecord
+	for _, x := range p.pollers {
+		if x, ok := x.(*poller); ok {
+			recs = append(recs, x.recorder.records(fd)...)
+		}
+	}
+	sortEventRecords(recs)
+	return recs
+}
+
+// Stats implements EventPoll.Stats() method.
+// It returns the sum of all pollers statistics.
+func (p *Pool) Stats() (s Stats) {
+	for _, poller := range p.pollers {
+		x := poller.Stats()
+		s.Registered += x.Registered
+		s.Callbacks += x.Callbacks
+		s.Suppressed += x.Suppressed
+		s.Throttled += x.Throttled
+		s.WaitBlockedNanos += x.WaitBlockedNanos
+		s.Waits += x.Waits
+		s.CallbackNanos += x.CallbackNanos
+		s.Wakeups += x.Wakeups
+		s.CoalescedWakeups += x.CoalescedWakeups
+		s.Parked += x.Parked
+		s.Promoted += x.Promoted
+	}
+	return s
+}
+
+// Barrier implements EventPoll.Barrier() method.
+// The fn is called while no callbacks are dispatched by any poller of the
+// pool.
+func (p *Pool) Barrier(fn func()) {
+	p.barrier(0, fn)
+}
+
+func (p *Pool) barrier(i int, fn func()) {
+	if i == len(p.pollers) {
+		if fn != nil {
+			fn()
+		}
+		return
+	}
+	p.pollers[i].Barrier(func() {
+		p.barrier(i+1, fn)
+	})
+}
+
+// Wakeup implements EventPoll.Wakeup() method.
+// It wakes up every poller of the pool and returns the first error occurred.
+func (p *Pool) Wakeup() (err error) {
+	for _, poller := range p.pollers {
+		if e := poller.Wakeup(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// PollerFd implements EventPoll.PollerFd() method.
+// It always returns ErrUnsupported since pool consists of multiple pollers.
+func (p *Pool) PollerFd() (int, error) {
+	return -1, ErrUnsupported
+}
+
+// Iterate implements EventPoll.Iterate() method.
+// It always returns ErrUnsupported since pool consists of multiple pollers.
+func (p *Pool) Iterate(time.Duration) error {
+	return ErrUnsupported
+}
+
+// CloseContext closes all pollers of the pool gracefully, passing
+// EventClosing to every registered callback first. Pollers are closed
+// concurrently, sharing the same ctx. See poller's CloseContext() for
+// details.
+// It returns the first error occurred.
+func (p *Pool) CloseContext(ctx context.Context) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(p.pollers))
+	)
+	for i, poller := range p.pollers {
+		c, ok := poller.(interface {
+			CloseContext(context.Context) error
+		})
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.CloseContext(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Close closes all pollers of the pool.
+// It returns the first error occurred.
+func (p *Pool) Close() (err error) {
+	for _, poller := range p.pollers {
+		c, ok := poller.(io.Closer)
+		if !ok {
+			continue
+		}
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHashPicker(t *testing.T) {
+	picker := Hash()
+	for _, n := range []int{1, 2, 3, 8, 13} {
+		load := make([]int, n)
+		for key := uint64(0); key < 1000; key++ {
+			i := picker.Pick(key, true, load)
+			if i < 0 || i >= n {
+				t.Fatalf("Pick(%d) = %d; want in range [0, %d)", key, i, n)
+			}
+			// Load must not affect the choice.
+			load[i] += 100
+			if j := picker.Pick(key, true, load); j != i {
+				t.Fatalf("Pick(%d) = %d; want %d as before", key, j, i)
+			}
+		}
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	pool, err := NewPool(&PoolConfig{
+		Size:   4,
+		Config: config(t),
+		Picker: Hash(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	shards := make(map[uint64]int)
+	for i := 0; i < 32; i++ {
+		desc, peer, _, _, err := NewSyntheticPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer desc.Close()
+		defer peer.Close()
+
+		key := uint64(i % 4)
+		if err = pool.StartWithOptions(desc, func(e Event) { t.Log(e) }, WithKey(key)); err != nil {
+			t.Fatal(err)
+		}
+		shard := pool.shards[desc]
+		if prev, has := shards[key]; has && prev != shard {
+			t.Errorf("descriptor with key %d registered within poller #%d; want #%d", key, shard, prev)
+		}
+		shards[key] = shard
+
+		if err = pool.Resume(desc); err != nil {
+			t.Fatal(err)
+		}
+		if err = pool.Stop(desc); err != nil {
+			t.Fatal(err)
+		}
+		if err = pool.Stop(desc); err != ErrNotRegistered {
+			t.Errorf("second Stop() error is %v; want %v", err, ErrNotRegistered)
+		}
+	}
+}
+
+func TestPoolLeastLoaded(t *testing.T) {
+	const size = 4
+
+	pool, err := NewPool(&PoolConfig{
+		Size:   size,
+		Config: config(t),
+		Picker: LeastLoaded(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	start := func(n int) []*Desc {
+		descs := make([]*Desc, n)
+		for i := range descs {
+			desc, peer, _, _, err := NewSyntheticPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			closers = append(closers, desc, peer)
+			if err = pool.Start(desc, func(Event) {}); err != nil {
+				t.Fatal(err)
+			}
+			descs[i] = desc
+		}
+		return descs
+	}
+	load := func() []int {
+		ret := make([]int, size)
+		for i, poller := range pool.pollers {
+			ret[i] = poller.Stats().Registered
+		}
+		return ret
+	}
+
+	// Skew the load by stopping descriptors registered everywhere except the
+	// first poller.
+	for _, desc := range start(5 * size) {
+		if pool.shards[desc] != 0 {
+			if err = pool.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if l := load(); l[0] != 5 || l[1]+l[2]+l[3] != 0 {
+		t.Fatalf("unexpected load after skew: %v", l)
+	}
+
+	start(3 * 5)
+	for i, n := range load() {
+		if n != 5 {
+			t.Errorf("poller #%d has %d descriptors; want 5", i, n)
+		}
+	}
+}
+
+func TestPoolForgetStopped(t *testing.T) {
+	pool, err := NewPool(&PoolConfig{Size: 2, Config: config(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var fds [2]int
+	if err = unix.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	desc := Must(NewDesc(uintptr(fds[1]), EventWrite))
+	defer desc.Close()
+
+	stopped := make(chan struct{}, 1)
+	err = pool.StartWithOptions(desc, func(Event) {},
+		WithStopOnHup(),
+		WithOnStop(func(*Desc, StopReason) { stopped <- struct{}{} }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Descriptor stopped by the poller after hang up must not be left in
+	// the pool.
+	if err = unix.Close(fds[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("descriptor is not stopped after hang up")
+	}
+	pool.mu.Lock()
+	n := len(pool.shards)
+	pool.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("pool holds %d stopped descriptors; want 0", n)
+	}
+	if err = pool.Stop(desc); err != ErrNotRegistered {
+		t.Fatalf("Stop() of stopped desc returned %v; want %v", err, ErrNotRegistered)
+	}
+	if err = pool.Start(desc, func(Event) {}); err != nil {
+		t.Fatalf("Start() of stopped desc returned %v", err)
+	}
+	if err = pool.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+}
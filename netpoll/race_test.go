@@ -0,0 +1,6 @@
+// +build race
+
+package netpoll
+
+// raceEnabled is true when tests are run with the race detector.
+const raceEnabled = true
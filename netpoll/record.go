@@ -0,0 +1,200 @@
+package netpoll
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// EventRecord is a record of a single callback call made by poller. See
+// Config.RecordEvents.
+type EventRecord struct {
+	// Time is the time the callback was called.
+	Time time.Time
+
+	// Fd is the file descriptor of the registration.
+	Fd int
+
+	// Label is the label of the descriptor at the time of the call (see
+	// Desc.SetLabel()).
+	Label string
+
+	// Gen is the generation of the registration. It is unique among the
+	// registrations of the poller and distinguishes registrations of the
+	// reused file descriptor numbers.
+	Gen uint64
+
+	// Event is the event passed to the callback.
+	Event Event
+
+	// Latency is the time passed since the event was received until the
+	// callback was called, e.g. while the event was queued by Dispatcher.
+	Latency time.Duration
+
+	// Duration is the time the callback was running.
+	Duration time.Duration
+}
+
+// DumpFormat is a format of records written by EventPoll.DumpEvents().
+type DumpFormat int
+
+const (
+	// DumpText renders each record as a line of text.
+	DumpText DumpFormat = iota
+
+	// DumpNDJSON renders each record as a JSON object on its own line.
+	DumpNDJSON
+)
+
+// recorder is a fixed size ring buffer of event records. Writers reserve
+// slots by incrementing the counter, so recording does not allocate and
+// does not take locks. Each slot holds the sequence number of the record
+// written to it, which makes possible for readers to skip slots being
+// overwritten concurrently.
+type recorder struct {
+	next  uint64
+	slots []recordSlot
+}
+
+// recordSlot holds a single record. Its fields are accessed atomically.
+type recordSlot struct {
+	seq      uint64
+	time     uint64
+	fd       uint64
+	gen      uint64
+	event    uint64
+	latency  uint64
+	duration uint64
+
+	// label holds the *string of the descriptor's label.
+	label unsafe.Pointer
+
+	// The padding keeps the size of the slot a multiple of 8 bytes, thus
+	// the uint64 fields of all slots are 64-bit aligned on 32-bit platforms
+	// too.
+	_ [(8 - unsafe.Sizeof(uintptr(0))) % 8]byte
+}
+
+func newRecorder(size int) *recorder {
+	if size <= 0 {
+		return nil
+	}
+	return &recorder{
+		slots: make([]recordSlot, size),
+	}
+}
+
+// add records callback call. Times are given in nanotime() units.
+func (r *recorder) add(fd int, label unsafe.Pointer, gen uint64, event Event, received, start, end int64) {
+	seq := atomic.AddUint64(&r.next, 1)
+	s := &r.slots[(seq-1)%uint64(len(r.slots))]
+
+	atomic.StoreUint64(&s.seq, 0)
+	atomic.StoreUint64(&s.time, uint64(start))
+	atomic.StoreUint64(&s.fd, uint64(fd))
+	atomic.StorePointer(&s.label, label)
+	atomic.StoreUint64(&s.gen, gen)
+	atomic.StoreUint64(&s.event, uint64(event))
+	atomic.StoreUint64(&s.latency, uint64(start-received))
+	atomic.StoreUint64(&s.duration, uint64(end-start))
+	atomic.StoreUint64(&s.seq, seq)
+}
+
+// records returns records currently held by the ring in chronological
+// order. If fd is not negative, only records of fd are returned.
+func (r *recorder) records(fd int) []EventRecord {
+	if r == nil {
+		return nil
+	}
+	var (
+		size = uint64(len(r.slots))
+		last = atomic.LoadUint64(&r.next)
+		seq  uint64
+		recs []EventRecord
+	)
+	if last > size {
+		seq = last - size
+	}
+	for seq++; seq <= last; seq++ {
+		s := &r.slots[(seq-1)%size]
+		if atomic.LoadUint64(&s.seq) != seq {
+			continue
+		}
+		rec := EventRecord{
+			Time:     epoch.Add(time.Duration(atomic.LoadUint64(&s.time))),
+			Fd:       int(atomic.LoadUint64(&s.fd)),
+			Label:    loadLabel(&s.label),
+			Gen:      atomic.LoadUint64(&s.gen),
+			Event:    Event(atomic.LoadUint64(&s.event)),
+			Latency:  time.Duration(atomic.LoadUint64(&s.latency)),
+			Duration: time.Duration(atomic.LoadUint64(&s.duration)),
+		}
+		if atomic.LoadUint64(&s.seq) != seq {
+			// Overwritten while being read.
+			continue
+		}
+		if fd >= 0 && rec.Fd != fd {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sortEventRecords(recs)
+	return recs
+}
+
+// sortEventRecords sorts records by time. Records written concurrently are
+// not ordered within the ring.
+func sortEventRecords(recs []EventRecord) {
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Time.Before(recs[j].Time)
+	})
+}
+
+// dumpEvents writes recs to w in given format.
+func dumpEvents(w io.Writer, recs []EventRecord, format DumpFormat) error {
+	bw := bufio.NewWriter(w)
+	for _, rec := range recs {
+		var err error
+		switch format {
+		case DumpText:
+			_, err = fmt.Fprintf(bw, "%s fd=%d", rec.Time.Format(time.RFC3339Nano), rec.Fd)
+			if err == nil && rec.Label != "" {
+				_, err = fmt.Fprintf(bw, " label=%q", rec.Label)
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(bw, " gen=%d event=%s latency=%s duration=%s\n",
+					rec.Gen, rec.Event, rec.Latency, rec.Duration,
+				)
+			}
+		case DumpNDJSON:
+			var p []byte
+			p, err = json.Marshal(struct {
+				Time     time.Time `json:"time"`
+				Fd       int       `json:"fd"`
+				Label    string    `json:"label,omitempty"`
+				Gen      uint64    `json:"gen"`
+				Event    string    `json:"event"`
+				Latency  int64     `json:"latency_ns"`
+				Duration int64     `json:"duration_ns"`
+			}{
+				rec.Time, rec.Fd, rec.Label, rec.Gen, rec.Event.String(),
+				int64(rec.Latency), int64(rec.Duration),
+			})
+			if err == nil {
+				bw.Write(p)
+				err = bw.WriteByte('\n')
+			}
+		default:
+			return fmt.Errorf("netpoll: unknown dump format %d", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
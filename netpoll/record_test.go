@@ -0,0 +1,87 @@
+package netpoll
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestRecorderWrap(t *testing.T) {
+	r := newRecorder(4)
+	for i := 1; i <= 10; i++ {
+		r.add(i, nil, uint64(i), EventRead, int64(i*100), int64(i*100+1), int64(i*100+3))
+	}
+	recs := r.records(-1)
+	if n := len(recs); n != 4 {
+		t.Fatalf("got %d records; want 4", n)
+	}
+	for i, rec := range recs {
+		exp := 7 + i
+		if rec.Fd != exp || rec.Gen != uint64(exp) {
+			t.Errorf("record #%d is of fd %d gen %d; want %d", i, rec.Fd, rec.Gen, exp)
+		}
+		if rec.Latency != 1 || rec.Duration != 2 {
+			t.Errorf("record #%d has latency %s and duration %s; want 1ns and 2ns", i, rec.Latency, rec.Duration)
+		}
+		if i > 0 && !recs[i-1].Time.Before(rec.Time) {
+			t.Errorf("records are not in chronological order")
+		}
+	}
+	if recs = r.records(9); len(recs) != 1 || recs[0].Fd != 9 {
+		t.Errorf("unexpected records of fd 9: %+v", recs)
+	}
+}
+
+func TestDumpEvents(t *testing.T) {
+	r := newRecorder(8)
+	label := "upstream"
+	r.add(5, nil, 1, EventRead|EventHup, 0, 10, 20)
+	r.add(6, unsafe.Pointer(&label), 2, EventWrite, 20, 30, 40)
+	recs := r.records(-1)
+
+	var buf bytes.Buffer
+	if err := dumpEvents(&buf, recs, DumpText); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines of text dump; want 2:\n%s", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], "fd=5 gen=1 event=EventRead|EventHup") {
+		t.Errorf("unexpected line: %q", lines[0])
+	}
+	if !strings.Contains(lines[1], `fd=6 label="upstream" gen=2 event=EventWrite`) {
+		t.Errorf("unexpected line: %q", lines[1])
+	}
+
+	buf.Reset()
+	if err := dumpEvents(&buf, recs, DumpNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		s      = bufio.NewScanner(&buf)
+		fds    []int
+		labels []string
+	)
+	for s.Scan() {
+		var rec struct {
+			Fd    int    `json:"fd"`
+			Label string `json:"label"`
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, rec.Fd)
+		labels = append(labels, rec.Label)
+	}
+	if len(fds) != 2 || fds[0] != 5 || fds[1] != 6 {
+		t.Errorf("unexpected NDJSON dump: fds %v", fds)
+	}
+	if len(labels) != 2 || labels[0] != "" || labels[1] != label {
+		t.Errorf("unexpected NDJSON dump: labels %q", labels)
+	}
+}
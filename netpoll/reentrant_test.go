@@ -0,0 +1,175 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestCallbackReentrant calls Stop(), Close(), Resume() and ModifyEvent()
+// in every combination of two from within the descriptor's own callback.
+func TestCallbackReentrant(t *testing.T) {
+	type op struct {
+		name string
+		call func(EventPoll, *Desc) error
+		// stops is true if no more callbacks must be made after the op.
+		stops bool
+	}
+	ops := []op{
+		{"stop", func(p EventPoll, desc *Desc) error {
+			return p.Stop(desc)
+		}, true},
+		{"close", func(_ EventPoll, desc *Desc) error {
+			return desc.Close()
+		}, true},
+		{"resume", func(p EventPoll, desc *Desc) error {
+			return p.Resume(desc)
+		}, false},
+		{"modify", func(p EventPoll, desc *Desc) error {
+			return p.ModifyEvent(desc, desc.event)
+		}, false},
+	}
+	modes := []struct {
+		name  string
+		event Event
+		opts  Options
+	}{
+		{"level", EventRead, Options{}},
+		{"edge", EventRead | EventEdgeTriggered, Options{}},
+		{"oneshot", EventRead | EventOneShot, Options{}},
+		{"autoresume", EventRead | EventOneShot, Options{AutoResume: true}},
+	}
+
+	for _, dispatcher := range []struct {
+		name string
+		d    Dispatcher
+	}{
+		{"inline", InlineDispatcher},
+		{"go", GoDispatcher},
+	} {
+		t.Run(dispatcher.name, func(t *testing.T) {
+			c := config(t)
+			c.Dispatcher = dispatcher.d
+			c.OnDescError = func(desc *Desc, err error) {
+				t.Errorf("unexpected descriptor error: %v", err)
+			}
+			poller, err := New(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			for _, mode := range modes {
+				for _, first := range ops {
+					for _, second := range ops {
+						seq := []op{first, second}
+						name := mode.name + "/" + first.name + "/" + second.name
+						t.Run(name, func(t *testing.T) {
+							r, w, err := socketPair()
+							if err != nil {
+								t.Fatal(err)
+							}
+							defer unix.Close(w)
+							desc := Must(NewDesc(uintptr(r), mode.event))
+							defer desc.Close()
+
+							var (
+								calls  int32
+								done   = make(chan []error, 1)
+								again  = make(chan struct{}, 1)
+								stops  = make(chan StopReason, 1)
+								opts   = mode.opts
+								buf    = make([]byte, 64)
+								closed bool
+							)
+							opts.OnStop = func(_ *Desc, reason StopReason) {
+								stops <- reason
+							}
+							err = poller.StartWithOptions(desc, func(Event) {
+								if atomic.AddInt32(&calls, 1) > 1 {
+									// Drain the data to not be called
+									// in a loop by level-triggered desc.
+									if !closed {
+										unix.Read(desc.Fd(), buf)
+									}
+									signal(again)
+									return
+								}
+								// Leave the data unread, thus the next
+								// callback is made unless stopped.
+								var errs []error
+								for _, op := range seq {
+									errs = append(errs, op.call(poller, desc))
+									closed = closed || op.name == "close"
+								}
+								done <- errs
+							}, opts)
+							if err != nil {
+								t.Fatal(err)
+							}
+							if _, err = unix.Write(w, []byte("x")); err != nil {
+								t.Fatal(err)
+							}
+
+							var errs []error
+							select {
+							case errs = <-done:
+							case <-time.After(time.Second):
+								t.Fatal("no callback made")
+							}
+							var stopped bool
+							for i, op := range seq {
+								err := errs[i]
+								switch {
+								case !stopped && err != nil:
+									t.Errorf("%s error is %v; want nil", op.name, err)
+								case stopped && op.name == "close":
+									// Close() after Stop() is fine; the
+									// second Close() fails as usual.
+								case stopped && err != ErrNotRegistered:
+									t.Errorf(
+										"%s after stop error is %v; want %v",
+										op.name, err, ErrNotRegistered,
+									)
+								}
+								stopped = stopped || op.stops
+							}
+
+							if _, err = unix.Write(w, []byte("y")); err != nil && !stopped {
+								t.Fatal(err)
+							}
+							if !stopped {
+								select {
+								case <-again:
+								case <-time.After(time.Second):
+									t.Fatal("no callback made after the first one")
+								}
+								if err := poller.Stop(desc); err != nil {
+									t.Fatal(err)
+								}
+								return
+							}
+							select {
+							case reason := <-stops:
+								if reason != StopExplicit {
+									t.Errorf("OnStop() reason is %s; want %s", reason, StopExplicit)
+								}
+							case <-time.After(time.Second):
+								t.Fatal("OnStop() was not called")
+							}
+							time.Sleep(10 * time.Millisecond)
+							if n := atomic.LoadInt32(&calls); n != 1 {
+								t.Errorf("callback called %d times; want 1", n)
+							}
+						})
+					}
+				}
+			}
+		})
+	}
+}
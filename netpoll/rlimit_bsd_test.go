@@ -0,0 +1,11 @@
+// +build freebsd dragonfly
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// setRlimitCur sets the soft limit of lim to n. Note that the limits are
+// signed on this system.
+func setRlimitCur(lim *unix.Rlimit, n int) {
+	lim.Cur = int64(n)
+}
@@ -0,0 +1,10 @@
+// +build linux darwin netbsd openbsd
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// setRlimitCur sets the soft limit of lim to n.
+func setRlimitCur(lim *unix.Rlimit, n int) {
+	lim.Cur = uint64(n)
+}
@@ -0,0 +1,111 @@
+package netpoll
+
+const (
+	// scratchSlabSize is the size of memory chunks Scratch hands out slices
+	// from. Larger requests are served by the heap.
+	scratchSlabSize = 16 << 10
+
+	// scratchMaxSlabs is the number of slabs Scratch retains between
+	// callbacks.
+	scratchMaxSlabs = 4
+
+	// scratchPoison is a byte value the memory is filled with after reset
+	// when Config.DebugScratch is set.
+	scratchPoison = 0xa5
+)
+
+// ScratchCallbackFn is a variant of CallbackFn which also receives a scratch
+// allocator valid for the duration of the call.
+type ScratchCallbackFn func(Event, *Scratch)
+
+// Scratch is a bump allocator of temporary buffers handed to callbacks
+// started by StartWithScratch(). Memory obtained from Scratch is reclaimed
+// all at once right after the callback returns, so there is no need to free
+// or pool it.
+//
+// Slices returned by Scratch, as well as Scratch itself, must not be
+// retained after the callback returns: the same memory is handed out to
+// the next callbacks. Use Config.DebugScratch to catch such misuse.
+//
+// Scratch is not safe for concurrent use.
+type Scratch struct {
+	slabs [][]byte
+	slab  int // index of the current slab
+	off   int // offset within the current slab
+	debug bool
+}
+
+// Bytes returns a zeroed slice of length n. Its capacity is also n, thus
+// appending to it does not overwrite memory of other slices.
+func (s *Scratch) Bytes(n int) []byte {
+	if n < 0 {
+		panic("netpoll: negative Scratch.Bytes() size")
+	}
+	if n > scratchSlabSize {
+		return make([]byte, n)
+	}
+	for {
+		if s.slab == len(s.slabs) {
+			s.slabs = append(s.slabs, make([]byte, scratchSlabSize))
+		}
+		if end := s.off + n; end <= scratchSlabSize {
+			b := s.slabs[s.slab][s.off:end:end]
+			for i := range b {
+				b[i] = 0
+			}
+			s.off = end
+			return b
+		}
+		s.slab++
+		s.off = 0
+	}
+}
+
+// reset makes all the memory handed out before to be available again.
+func (s *Scratch) reset() {
+	if s.debug {
+		for i := 0; i <= s.slab && i < len(s.slabs); i++ {
+			b := s.slabs[i]
+			if i == s.slab {
+				b = b[:s.off]
+			}
+			for j := range b {
+				b[j] = scratchPoison
+			}
+		}
+	}
+	if len(s.slabs) > scratchMaxSlabs {
+		for i := scratchMaxSlabs; i < len(s.slabs); i++ {
+			s.slabs[i] = nil
+		}
+		s.slabs = s.slabs[:scratchMaxSlabs]
+	}
+	s.slab = 0
+	s.off = 0
+}
+
+// StartWithScratch adds desc to the observation list of poller just like
+// StartWithOptions() does, but calls cb with a Scratch allocator.
+//
+// Pollers created by New() and Pool hand out the arena owned by the wait
+// loop to callbacks run by InlineDispatcher, and the arena of the worker to
+// callbacks run by ScratchDispatcher (e.g. WorkerDispatcher), so steady
+// state callbacks allocate nothing. Otherwise, that is with other
+// Dispatchers or other EventPoll implementations, a new Scratch is
+// allocated for each call, which saves nothing over allocating in the
+// callback.
+func StartWithScratch(poller EventPoll, desc *Desc, cb ScratchCallbackFn, opts ...StartOption) error {
+	all := make([]StartOption, 0, len(opts)+1)
+	all = append(all, opts...)
+	all = append(all, scratchOption(cb))
+
+	return poller.StartWithOptions(desc, func(event Event) {
+		cb(event, new(Scratch))
+	}, all...)
+}
+
+type scratchOption ScratchCallbackFn
+
+func (fn scratchOption) applyStart(s *startOptions) {
+	s.scratch = ScratchCallbackFn(fn)
+}
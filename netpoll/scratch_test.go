@@ -0,0 +1,84 @@
+package netpoll
+
+import "testing"
+
+func TestScratchBytes(t *testing.T) {
+	var s Scratch
+	for _, n := range []int{0, 1, 7, 100, scratchSlabSize - 108, 1, scratchSlabSize, scratchSlabSize + 1} {
+		b := s.Bytes(n)
+		if len(b) != n || cap(b) != n {
+			t.Fatalf("Bytes(%d) returned slice of len %d and cap %d", n, len(b), cap(b))
+		}
+		for i, c := range b {
+			if c != 0 {
+				t.Fatalf("Bytes(%d)[%d] = %#x; want 0", n, i, c)
+			}
+		}
+		for i := range b {
+			b[i] = byte(n)
+		}
+	}
+
+	// Slices must not overlap.
+	a := s.Bytes(10)
+	b := s.Bytes(10)
+	for i := range a {
+		a[i] = 'a'
+	}
+	for i := range b {
+		if b[i] != 0 {
+			t.Fatalf("slices overlap")
+		}
+	}
+}
+
+func TestScratchReset(t *testing.T) {
+	var s Scratch
+	a := s.Bytes(64)
+	for i := range a {
+		a[i] = 'x'
+	}
+	for i := 0; i < scratchMaxSlabs*2; i++ {
+		s.Bytes(scratchSlabSize)
+	}
+	s.reset()
+
+	if n := len(s.slabs); n > scratchMaxSlabs {
+		t.Errorf("%d slabs retained after reset; want at most %d", n, scratchMaxSlabs)
+	}
+	b := s.Bytes(64)
+	if &a[0] != &b[0] {
+		t.Errorf("memory is not reused after reset")
+	}
+	for i, c := range b {
+		if c != 0 {
+			t.Fatalf("Bytes()[%d] = %#x after reset; want 0", i, c)
+		}
+	}
+}
+
+func TestScratchDebug(t *testing.T) {
+	s := Scratch{debug: true}
+	b := s.Bytes(16)
+	s.reset()
+	for i, c := range b {
+		if c != scratchPoison {
+			t.Fatalf("retained slice [%d] = %#x after reset; want %#x", i, c, scratchPoison)
+		}
+	}
+}
+
+func TestScratchAllocs(t *testing.T) {
+	var s Scratch
+	s.Bytes(1)
+	s.reset()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s.Bytes(128)
+		s.Bytes(4096)
+		s.reset()
+	})
+	if allocs != 0 {
+		t.Errorf("Bytes() made %v allocations; want 0", allocs)
+	}
+}
@@ -0,0 +1,133 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/sctp.h.
+const (
+	sctpRecvRcvInfo = 32
+	sctpEvents      = 11
+
+	sctpMsgNotification = 0x8000
+
+	sctpAssocChange   = 0x8001
+	sctpShutdownEvent = 0x8005
+
+	sctpCommLost     = 1
+	sctpShutdownComp = 3
+)
+
+// EnableSCTPNotifications configures SCTP one-to-one socket represented by
+// desc to deliver association change and shutdown notifications in-band and
+// to attach sctp_rcvinfo to received messages. It should be called once
+// before the first call to ReadSCTP.
+//
+// Descriptors of SCTP sockets could be created by NewDesc() with a raw file
+// descriptor.
+func EnableSCTPNotifications(desc *Desc) error {
+	fd := desc.Fd()
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_SCTP, sctpRecvRcvInfo, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	// struct sctp_event_subscribe: data_io, association, address,
+	// send_failure, peer_error, shutdown.
+	events := string([]byte{0, 1, 0, 0, 0, 1})
+	if err := unix.SetsockoptString(fd, unix.IPPROTO_SCTP, sctpEvents, events); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// ReadSCTP reads single message from SCTP socket represented by desc.
+//
+// It reports whether the message is SCTP notification rather than user
+// data. Notification about association shutdown or loss is reported with
+// io.EOF error, such that connection teardown could be handled as for TCP.
+// If there is no data available, it returns syscall.EAGAIN.
+func ReadSCTP(desc *Desc, buf []byte) (n int, notification bool, err error) {
+	var (
+		oob   [64]byte
+		flags int
+	)
+	for {
+		n, _, flags, _, err = unix.Recvmsg(desc.Fd(), buf, oob[:], 0)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if flags&sctpMsgNotification == 0 {
+		if n == 0 {
+			return 0, false, io.EOF
+		}
+		return n, false, nil
+	}
+	if sctpTeardown(buf[:n]) {
+		return n, true, io.EOF
+	}
+	return n, true, nil
+}
+
+// SCTPCallback returns callback which calls cb with EventHup and
+// EventReadHup added to the read event, if the next message to be read from
+// SCTP socket represented by desc is the association shutdown or loss
+// notification. Thus connection teardown could be handled by cb as for TCP.
+// The notification is only peeked: it is still returned by ReadSCTP() with
+// io.EOF.
+//
+// Notifications must be enabled by EnableSCTPNotifications(). Note that if
+// the notification is queued after the user data, it is detected once the
+// data is read, that is by the next callback call for level-triggered
+// descriptor, while edge-triggered one gets io.EOF from ReadSCTP() instead.
+func SCTPCallback(desc *Desc, cb CallbackFn) CallbackFn {
+	return func(event Event) {
+		if event&EventRead != 0 && event&EventHup == 0 && sctpTeardownPending(desc.Fd()) {
+			event |= EventHup | EventReadHup
+		}
+		cb(event)
+	}
+}
+
+// sctpTeardownPending reports whether the next message queued on fd is the
+// notification about association teardown.
+func sctpTeardownPending(fd int) bool {
+	var buf [16]byte
+	for {
+		n, _, flags, _, err := unix.Recvmsg(fd, buf[:], nil, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		if err == syscall.EINTR {
+			continue
+		}
+		return err == nil && flags&sctpMsgNotification != 0 && sctpTeardown(buf[:n])
+	}
+}
+
+// sctpTeardown reports whether the notification p means that the
+// association is not usable anymore.
+func sctpTeardown(p []byte) bool {
+	// All notifications begin with the type (u16), flags (u16) and length
+	// (u32) header.
+	if len(p) < 8 {
+		return false
+	}
+	switch *(*uint16)(unsafe.Pointer(&p[0])) {
+	case sctpShutdownEvent:
+		return true
+	case sctpAssocChange:
+		if len(p) < 10 {
+			return false
+		}
+		state := *(*uint16)(unsafe.Pointer(&p[8]))
+		return state == sctpCommLost || state == sctpShutdownComp
+	}
+	return false
+}
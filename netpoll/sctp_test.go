@@ -0,0 +1,136 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadSCTP(t *testing.T) {
+	desc, client := sctpPair(t)
+	defer desc.Close()
+
+	if _, err := unix.Write(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(client)
+
+	var (
+		buf      = make([]byte, 1024)
+		received []byte
+		deadline = time.Now().Add(time.Second)
+	)
+	for time.Now().Before(deadline) {
+		n, notification, err := ReadSCTP(desc, buf)
+		if err == unix.EAGAIN {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err == io.EOF {
+			if string(received) != "hello" {
+				t.Errorf("received %q; want %q", received, "hello")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !notification {
+			received = append(received, buf[:n]...)
+		}
+	}
+	t.Fatalf("no shutdown notification received")
+}
+
+func TestSCTPCallback(t *testing.T) {
+	desc, client := sctpPair(t)
+	defer desc.Close()
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	events := make(chan Event, 16)
+	err = poller.Start(desc, SCTPCallback(desc, func(event Event) {
+		buf := make([]byte, 1024)
+		if _, _, err := ReadSCTP(desc, buf); err != nil && err != unix.EAGAIN && err != io.EOF {
+			t.Error(err)
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if _, err = unix.Write(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(client)
+
+	for timeout := time.After(time.Second); ; {
+		select {
+		case event := <-events:
+			if event&EventHup != 0 {
+				if event&EventReadHup == 0 {
+					t.Errorf("callback called with %s; want %s too", event, EventReadHup)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("association shutdown is not reported as hang up")
+		}
+	}
+}
+
+// sctpPair returns descriptor of accepted SCTP one-to-one socket with
+// notifications enabled and its connected peer. It skips the test if SCTP is
+// not supported.
+func sctpPair(t *testing.T) (desc *Desc, client int) {
+	ln, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_SCTP)
+	if err != nil {
+		t.Skipf("sctp is not supported: %v", err)
+	}
+	defer unix.Close(ln)
+
+	addr := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}
+	if err = unix.Bind(ln, addr); err != nil {
+		t.Skipf("could not bind sctp socket: %v", err)
+	}
+	if err = unix.Listen(ln, 1); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := unix.Getsockname(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_SCTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Connect(client, sa); err != nil {
+		unix.Close(client)
+		t.Skipf("could not connect sctp socket: %v", err)
+	}
+	conn, _, err := unix.Accept(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc = Must(NewDesc(uintptr(conn), EventRead))
+	if err = EnableSCTPNotifications(desc); err != nil {
+		desc.Close()
+		t.Fatal(err)
+	}
+	return desc, client
+}
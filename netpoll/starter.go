@@ -0,0 +1,41 @@
+package netpoll
+
+// Compile time checks of the interfaces implemented by the pollers.
+var (
+	_ EventPoll = (*poller)(nil)
+	_ Closer    = (*poller)(nil)
+	_ EventPoll = (*Pool)(nil)
+	_ Closer    = (*Pool)(nil)
+)
+
+// ModifyIfSupported changes the set of events desc is observed for by p. It
+// calls ModifyEvent() if p implements Modifier. Otherwise it falls back to
+// stopping desc and starting it again with event and cb, which is the
+// callback desc was started with. In both cases desc itself is left
+// unchanged.
+//
+// Note that the fallback is not atomic: events received between stopping
+// and starting desc are not delivered, and level-triggered ones are
+// reported again after the restart.
+func ModifyIfSupported(p Starter, desc *Desc, event Event, cb CallbackFn) error {
+	if m, ok := p.(Modifier); ok {
+		return m.ModifyEvent(desc, event)
+	}
+	if err := p.Stop(desc); err != nil {
+		return err
+	}
+	prev := desc.event
+	desc.event = event
+	err := p.Start(desc, cb)
+	desc.event = prev
+	return err
+}
+
+// CloseIfSupported closes p if it implements Closer. It returns
+// ErrUnsupported otherwise.
+func CloseIfSupported(p Starter) error {
+	if c, ok := p.(Closer); ok {
+		return c.Close()
+	}
+	return ErrUnsupported
+}
@@ -0,0 +1,87 @@
+package netpoll
+
+import "sync/atomic"
+
+// Stats contains EventPoll runtime statistics.
+type Stats struct {
+	// Registered is the number of descriptors currently registered within
+	// the poller. The descriptors the poller uses internally (e.g. the
+	// epoll instance and its wakeup eventfd or pipe) are not counted.
+	Registered int
+
+	// Callbacks is the total number of callback calls made by the poller.
+	Callbacks uint64
+
+	// Suppressed is the total number of events that were not passed to
+	// callbacks due to the descriptor's coalescing window.
+	Suppressed uint64
+
+	// Throttled is the total number of times descriptors were disarmed due
+	// to exceeded rate limits.
+	Throttled uint64
+
+	// WaitBlockedNanos is the total time in nanoseconds the poller spent
+	// blocked waiting for events, e.g. in epoll_wait(2).
+	// It is collected only if Config.Metrics is set.
+	WaitBlockedNanos uint64
+
+	// Waits is the total number of system calls the poller made to wait for
+	// events, e.g. epoll_wait(2). Comparing it with Callbacks shows how many
+	// events are delivered per call.
+	// It is collected only if Config.Metrics is set.
+	Waits uint64
+
+	// CallbackNanos is the total time in nanoseconds spent in callbacks.
+	// High callback time relative to WaitBlockedNanos signals a CPU-bound
+	// loop that needs a Dispatcher or more pollers.
+	// It is collected only if Config.Metrics is set.
+	CallbackNanos uint64
+
+	// Wakeups is the total number of EventPoll.Wakeup() calls.
+	Wakeups uint64
+
+	// CoalescedWakeups is the number of Wakeup() calls which were merged
+	// with the already pending wakeup, that is which did not cost a system
+	// call and a separate Config.OnWakeup call.
+	CoalescedWakeups uint64
+
+	// Parked is the number of registered descriptors which are parked at
+	// the moment (see EventPoll.Park()).
+	Parked int
+
+	// Promoted is the total number of parked descriptors which were
+	// promoted back on event.
+	Promoted uint64
+}
+
+// stats holds EventPoll counters.
+// Its fields must be accessed atomically.
+type stats struct {
+	callbacks  uint64
+	suppressed uint64
+	throttled  uint64
+
+	callbackNanos uint64
+
+	wakeups   uint64
+	coalesced uint64
+
+	parked   int64
+	promoted uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Callbacks:  atomic.LoadUint64(&s.callbacks),
+		Suppressed: atomic.LoadUint64(&s.suppressed),
+		Throttled:  atomic.LoadUint64(&s.throttled),
+
+		CallbackNanos: atomic.LoadUint64(&s.callbackNanos),
+
+		Wakeups:          atomic.LoadUint64(&s.wakeups),
+		CoalescedWakeups: atomic.LoadUint64(&s.coalesced),
+
+		Parked:   int(atomic.LoadInt64(&s.parked)),
+		Promoted: atomic.LoadUint64(&s.promoted),
+	}
+}
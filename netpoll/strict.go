@@ -0,0 +1,161 @@
+package netpoll
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// strictRunning is the number of callbacks of the strict pollers being
+	// run at the moment. The checks are skipped while it is zero. Must be
+	// accessed atomically.
+	strictRunning int32
+
+	// callbacks maps the ids of goroutines running callbacks of the strict
+	// pollers to the registrations of those callbacks.
+	callbacks sync.Map
+)
+
+// goid returns the id of the current goroutine. It is slow and is used in
+// strict mode only.
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// runningCallback returns the registration which callback is run by the
+// current goroutine, if any, and the poller which runs it is strict.
+func runningCallback() *registration {
+	if atomic.LoadInt32(&strictRunning) == 0 {
+		return nil
+	}
+	r, _ := callbacks.Load(goid())
+	if r == nil {
+		return nil
+	}
+	return r.(*registration)
+}
+
+// strictBlocking panics if the current goroutine runs a callback inline,
+// that is when op would block the wait loop. The op is the name of the
+// blocking operation.
+func strictBlocking(op string) {
+	if r := runningCallback(); r != nil && r.poller.inline {
+		panic(fmt.Sprintf(
+			"netpoll: %s called from the inline callback of fd %d: "+
+				"it blocks the wait loop which must deliver the events it waits for",
+			op, r.desc.Fd(),
+		))
+	}
+}
+
+// strictClose panics if the current goroutine runs a callback of p inline,
+// since closing p waits for its wait loop to return.
+func (p *poller) strictClose(op string) {
+	if r := runningCallback(); r != nil && r.poller == p && p.inline {
+		panic(fmt.Sprintf(
+			"netpoll: %s of the poller called from the inline callback of fd %d: "+
+				"it waits for the wait loop running the callback to return",
+			op, r.desc.Fd(),
+		))
+	}
+}
+
+// strictStart panics if the current goroutine runs the callback of desc
+// within p while desc is registered.
+func (p *poller) strictStart(desc *Desc) {
+	r := runningCallback()
+	if r == nil || r.desc != desc || r.poller != p {
+		return
+	}
+	r.mu.Lock()
+	stopped := r.stopped
+	r.mu.Unlock()
+	if !stopped {
+		panic(fmt.Sprintf(
+			"netpoll: Start of fd %d called from its own callback: "+
+				"descriptor is registered already; use Resume to arm one-shot descriptor",
+			desc.Fd(),
+		))
+	}
+}
+
+// strictDetach panics if the current goroutine runs the callback of desc
+// within p, since detaching waits for that callback to return.
+func (p *poller) strictDetach(desc *Desc) {
+	if r := runningCallback(); r != nil && r.desc == desc && r.poller == p {
+		panic(fmt.Sprintf(
+			"netpoll: fd %d is moved from its own callback: "+
+				"it waits for the callback to return",
+			desc.Fd(),
+		))
+	}
+}
+
+// strictCall holds the state of the descriptor taken before the callback
+// call, which is checked after the callback returns.
+type strictCall struct {
+	id      uint64
+	prev    interface{}
+	event   Event
+	resumes uint32
+	unread  int
+}
+
+// enterStrict marks the current goroutine as running the callback of r with
+// given event.
+func (r *registration) enterStrict(event Event) strictCall {
+	c := strictCall{
+		id:      goid(),
+		event:   event,
+		resumes: atomic.LoadUint32(&r.resumes),
+		unread:  -1,
+	}
+	if event&EventRead != 0 && r.events()&EventOneShot != 0 {
+		if n, err := readableBytes(r.desc.Fd()); err == nil {
+			c.unread = n
+		}
+	}
+	// Callbacks could be nested, e.g. when EventPollClosed is delivered
+	// within the callback closing the poller run by some Dispatcher.
+	c.prev, _ = callbacks.Load(c.id)
+	callbacks.Store(c.id, r)
+	atomic.AddInt32(&strictRunning, 1)
+	return c
+}
+
+// exitStrict unmarks the current goroutine and calls Config.OnStuck if the
+// callback of one-shot descriptor returned leaving it disarmed without
+// reading any data.
+func (r *registration) exitStrict(c strictCall) {
+	if c.prev != nil {
+		callbacks.Store(c.id, c.prev)
+	} else {
+		callbacks.Delete(c.id)
+	}
+	atomic.AddInt32(&strictRunning, -1)
+	if c.unread <= 0 || atomic.LoadInt32(&r.armed) == 1 ||
+		atomic.LoadUint32(&r.resumes) != c.resumes {
+		return
+	}
+	r.mu.Lock()
+	stopped := r.stopped
+	r.mu.Unlock()
+	// Stopped descriptor could be closed by the callback already.
+	if stopped {
+		return
+	}
+	if n, err := readableBytes(r.desc.Fd()); err == nil && n >= c.unread {
+		r.poller.config.OnStuck(r.desc, c.event)
+	}
+}
@@ -0,0 +1,205 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStrictMisuse(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		fn    func(poller EventPoll, desc *Desc) error
+		panic string
+	}{
+		{
+			name: "close",
+			fn: func(poller EventPoll, _ *Desc) error {
+				return poller.(io.Closer).Close()
+			},
+			panic: "Close of the poller called from the inline callback",
+		},
+		{
+			name: "start",
+			fn: func(poller EventPoll, desc *Desc) error {
+				return poller.Start(desc, func(Event) {})
+			},
+			panic: "called from its own callback",
+		},
+		{
+			name: "wait",
+			fn: func(_ EventPoll, desc *Desc) error {
+				_, err := WaitOne(desc, time.Millisecond)
+				return err
+			},
+			panic: "WaitOne called from the inline callback",
+		},
+		{
+			name: "accept",
+			fn: func(poller EventPoll, _ *Desc) error {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return err
+				}
+				pl, err := NewPollListener(poller, ln)
+				if err != nil {
+					ln.Close()
+					return err
+				}
+				defer pl.Close()
+				_, err = pl.Accept()
+				return err
+			},
+			panic: "PollListener.Accept called from the inline callback",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config(t)
+			cfg.Strict = true
+			cfg.OnStuck = func(*Desc, Event) {}
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(io.Closer).Close()
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+			desc := Must(NewDesc(uintptr(r), EventRead))
+			defer desc.Close()
+
+			result := make(chan interface{}, 1)
+			err = poller.Start(desc, func(event Event) {
+				if event&EventRead == 0 {
+					return
+				}
+				defer func() {
+					result <- recover()
+				}()
+				if err := test.fn(poller, desc); err != nil {
+					t.Error(err)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.Stop(desc)
+
+			if _, err = unix.Write(w, []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case v := <-result:
+				msg, _ := v.(string)
+				if !strings.Contains(msg, test.panic) {
+					t.Fatalf("unexpected panic: %v; want message containing %q", v, test.panic)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("callback is not called")
+			}
+		})
+	}
+}
+
+func TestStrictStuck(t *testing.T) {
+	stuck := make(chan Event, 1)
+	cfg := config(t)
+	cfg.Strict = true
+	cfg.OnStuck = func(_ *Desc, event Event) {
+		stuck <- event
+	}
+	poller, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead|EventOneShot))
+	defer desc.Close()
+
+	const (
+		ignore = iota
+		read
+		resume
+		stop
+	)
+	var mode int32
+	called := make(chan struct{}, 1)
+	err = poller.Start(desc, func(event Event) {
+		switch atomic.LoadInt32(&mode) {
+		case read:
+			unix.Read(r, make([]byte, 1))
+		case resume:
+			// Data is not read, thus the event is delivered again.
+			atomic.StoreInt32(&mode, read)
+			poller.Resume(desc)
+			return
+		case stop:
+			poller.Stop(desc)
+		}
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	for _, test := range []struct {
+		mode  int32
+		stuck bool
+	}{
+		{ignore, true},
+		{read, false},
+		{resume, false},
+		{stop, false},
+	} {
+		atomic.StoreInt32(&mode, test.mode)
+		if _, err = unix.Write(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			t.Fatal("callback is not called")
+		}
+		// Wait for the check made after the callback returned.
+		select {
+		case event := <-stuck:
+			if !test.stuck {
+				t.Fatalf("OnStuck called for mode %d", test.mode)
+			}
+			if event&EventRead == 0 {
+				t.Errorf("OnStuck called with %s", event)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if test.stuck {
+				t.Fatalf("OnStuck is not called for mode %d", test.mode)
+			}
+		}
+		// Discard the data left unread.
+		unix.Read(r, make([]byte, 16))
+		if test.mode != stop {
+			if err = poller.Resume(desc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package netpoll
+
+import "time"
+
+// TCPInfo contains the state of TCP connection as reported by the kernel.
+// Fields the operating system does not report are zero.
+type TCPInfo struct {
+	// State is the state of the connection (e.g. established). Its values
+	// are operating system specific.
+	State uint8
+
+	// RTT is the smoothed round-trip time and RTTVar is its mean deviation.
+	RTT    time.Duration
+	RTTVar time.Duration
+
+	// RTO is the current retransmission timeout.
+	RTO time.Duration
+
+	// SndMSS is the maximum segment size used for sending.
+	SndMSS int
+
+	// SndCwnd is the congestion window in bytes.
+	SndCwnd int
+
+	// Unacked is the number of segments sent and not acknowledged yet, and
+	// Lost is the number of them considered lost. They are reported on
+	// linux only.
+	Unacked int
+	Lost    int
+
+	// Retransmits is the number of consecutive retransmission timeouts
+	// which are not recovered yet. It is reported on linux only.
+	Retransmits int
+
+	// TotalRetrans is the total number of segments retransmitted.
+	TotalRetrans uint64
+}
+
+// TCPInfo returns the state of TCP connection represented by the
+// descriptor, e.g. to adapt the sending rate from within the callback.
+// It returns ErrUnsupported if the descriptor is not a TCP socket or the
+// operating system does not provide such information.
+func (h *Desc) TCPInfo() (*TCPInfo, error) {
+	return tcpInfo(h.Fd())
+}
@@ -0,0 +1,68 @@
+//go:build darwin
+// +build darwin
+
+package netpoll
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpConnectionInfo is struct tcp_connection_info from netinet/tcp.h.
+type tcpConnectionInfo struct {
+	state      uint8
+	sndWscale  uint8
+	rcvWscale  uint8
+	_          uint8
+	options    uint32
+	flags      uint32
+	rto        uint32
+	maxseg     uint32
+	sndSsthres uint32
+	sndCwnd    uint32
+	sndWnd     uint32
+	sndSbbytes uint32
+	rcvWnd     uint32
+	rttcur     uint32
+	srtt       uint32
+	rttvar     uint32
+	tfo        uint32
+
+	txpackets           uint64
+	txbytes             uint64
+	txretransmitbytes   uint64
+	rxpackets           uint64
+	rxbytes             uint64
+	rxoutoforderbytes   uint64
+	txretransmitpackets uint64
+}
+
+func tcpInfo(fd int) (*TCPInfo, error) {
+	var (
+		ti tcpConnectionInfo
+		n  = uint32(unsafe.Sizeof(ti))
+	)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd),
+		unix.IPPROTO_TCP, unix.TCP_CONNECTION_INFO,
+		uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&n)), 0)
+	switch errno {
+	case 0:
+	case unix.ENOTSOCK, unix.EOPNOTSUPP, unix.ENOPROTOOPT:
+		return nil, ErrUnsupported
+	default:
+		return nil, os.NewSyscallError("getsockopt", errno)
+	}
+	// Times are reported in milliseconds.
+	return &TCPInfo{
+		State:        ti.state,
+		RTT:          time.Duration(ti.srtt) * time.Millisecond,
+		RTTVar:       time.Duration(ti.rttvar) * time.Millisecond,
+		RTO:          time.Duration(ti.rto) * time.Millisecond,
+		SndMSS:       int(ti.maxseg),
+		SndCwnd:      int(ti.sndCwnd),
+		TotalRetrans: ti.txretransmitpackets,
+	}, nil
+}
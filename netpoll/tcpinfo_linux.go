@@ -0,0 +1,33 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func tcpInfo(fd int) (*TCPInfo, error) {
+	ti, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	switch err {
+	case nil:
+	case unix.ENOTSOCK, unix.EOPNOTSUPP, unix.ENOPROTOOPT:
+		return nil, ErrUnsupported
+	default:
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	return &TCPInfo{
+		State:        ti.State,
+		RTT:          time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:       time.Duration(ti.Rttvar) * time.Microsecond,
+		RTO:          time.Duration(ti.Rto) * time.Microsecond,
+		SndMSS:       int(ti.Snd_mss),
+		SndCwnd:      int(ti.Snd_cwnd) * int(ti.Snd_mss),
+		Unacked:      int(ti.Unacked),
+		Lost:         int(ti.Lost),
+		Retransmits:  int(ti.Retransmits),
+		TotalRetrans: uint64(ti.Total_retrans),
+	}, nil
+}
@@ -0,0 +1,7 @@
+// +build !linux,!darwin
+
+package netpoll
+
+func tcpInfo(fd int) (*TCPInfo, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,80 @@
+// +build linux darwin
+
+package netpoll
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDescTCPInfo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Let the kernel to measure the round-trip time.
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [5]byte
+	if _, err = conn.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := Handle(client, EventRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	info, err := desc.TCPInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State == 0 || info.SndMSS <= 0 || info.SndCwnd < info.SndMSS || info.RTO <= 0 {
+		t.Errorf("unexpected info of established connection: %+v", info)
+	}
+}
+
+func TestDescTCPInfoUnsupported(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+	desc := Must(NewDesc(uintptr(r), EventRead))
+	defer desc.Close()
+
+	if _, err = desc.TCPInfo(); err != ErrUnsupported {
+		t.Errorf("TCPInfo() of unix socket returned %v; want %v", err, ErrUnsupported)
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	desc, err = HandleRead(udp.(*net.UDPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	if _, err = desc.TCPInfo(); err != ErrUnsupported {
+		t.Errorf("TCPInfo() of UDP socket returned %v; want %v", err, ErrUnsupported)
+	}
+}
@@ -0,0 +1,88 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// EnableRxTimestamps makes the kernel to attach receive timestamp to each
+// packet received by the socket represented by desc. Timestamps could be
+// read then by ReadWithTimestamp().
+func EnableRxTimestamps(desc *Desc) error {
+	return enableRxTimestamps(desc.Fd())
+}
+
+// ReadWithTimestamp reads single packet from the socket represented by desc
+// along with its kernel receive timestamp, which is not affected by the
+// scheduling delays of the callback.
+//
+// The returned ts is zero if socket has no timestamps enabled (see
+// EnableRxTimestamps()) or if control message was truncated. If packet was
+// larger than buf, it returns truncated data with io.ErrShortBuffer error.
+// If there is no data available, it returns ErrWouldBlock.
+func ReadWithTimestamp(desc *Desc, buf []byte) (n int, addr net.Addr, ts time.Time, err error) {
+	var (
+		oob   = make([]byte, rxTimestampSpace)
+		oobn  int
+		flags int
+		from  unix.Sockaddr
+	)
+	for {
+		n, oobn, flags, from, err = unix.Recvmsg(desc.Fd(), buf, oob, 0)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EAGAIN {
+		return 0, nil, ts, ErrWouldBlock
+	}
+	if err != nil {
+		return 0, nil, ts, os.NewSyscallError("recvmsg", err)
+	}
+
+	if flags&unix.MSG_CTRUNC == 0 {
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return 0, nil, ts, os.NewSyscallError("recvmsg", err)
+		}
+		for _, msg := range msgs {
+			if t, ok := parseRxTimestamp(msg); ok {
+				ts = t
+			}
+		}
+	}
+	if flags&unix.MSG_TRUNC != 0 {
+		err = io.ErrShortBuffer
+	}
+
+	return n, sockaddrToUDP(from), ts, err
+}
+
+func sockaddrToUDP(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.UDPAddr{
+			IP:   append(net.IP(nil), sa.Addr[:]...),
+			Port: sa.Port,
+		}
+	case *unix.SockaddrInet6:
+		var zone string
+		if sa.ZoneId != 0 {
+			zone = strconv.Itoa(int(sa.ZoneId))
+		}
+		return &net.UDPAddr{
+			IP:   append(net.IP(nil), sa.Addr[:]...),
+			Port: sa.Port,
+			Zone: zone,
+		}
+	}
+	return nil
+}
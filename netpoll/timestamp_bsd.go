@@ -0,0 +1,34 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxTimestampSpace is a size of buffer enough to receive timestamp control
+// message, which is struct timeval.
+var rxTimestampSpace = unix.CmsgSpace(int(unsafe.Sizeof(unix.Timeval{})))
+
+func enableRxTimestamps(fd int) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMP, 1)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+func parseRxTimestamp(msg unix.SocketControlMessage) (time.Time, bool) {
+	if msg.Header.Level != unix.SOL_SOCKET || msg.Header.Type != unix.SCM_TIMESTAMP {
+		return time.Time{}, false
+	}
+	if len(msg.Data) < int(unsafe.Sizeof(unix.Timeval{})) {
+		return time.Time{}, false
+	}
+	tv := *(*unix.Timeval)(unsafe.Pointer(&msg.Data[0]))
+	return time.Unix(tv.Unix()), true
+}
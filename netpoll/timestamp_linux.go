@@ -0,0 +1,47 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxTimestampSpace is a size of buffer enough to receive timestamp control
+// message, which is struct __kernel_timespec or struct timespec.
+var rxTimestampSpace = unix.CmsgSpace(16)
+
+func enableRxTimestamps(fd int) error {
+	// SO_TIMESTAMPNS_NEW provides 64-bit timestamps on every architecture,
+	// but is not supported by kernels older than 5.1.
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS_NEW, 1)
+	if err == unix.ENOPROTOOPT {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS_OLD, 1)
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+func parseRxTimestamp(msg unix.SocketControlMessage) (time.Time, bool) {
+	if msg.Header.Level != unix.SOL_SOCKET {
+		return time.Time{}, false
+	}
+	switch {
+	case msg.Header.Type == unix.SO_TIMESTAMPNS_NEW && len(msg.Data) >= 16:
+		// struct __kernel_timespec.
+		ts := *(*[2]int64)(unsafe.Pointer(&msg.Data[0]))
+		sec, nsec := ts[0], ts[1]
+		return time.Unix(sec, nsec), true
+
+	case msg.Header.Type == unix.SCM_TIMESTAMPNS && len(msg.Data) >= int(unsafe.Sizeof(unix.Timespec{})):
+		ts := *(*unix.Timespec)(unsafe.Pointer(&msg.Data[0]))
+		return time.Unix(ts.Unix()), true
+	}
+	return time.Time{}, false
+}
+
@@ -0,0 +1,116 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadWithTimestamp(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	recv, send := udpPair(t)
+	defer recv.Close()
+	defer send.Close()
+
+	if err = EnableRxTimestamps(recv); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		ts   time.Time
+		now  time.Time
+		data string
+		err  error
+	}
+	done := make(chan result, 1)
+	buf := make([]byte, 64)
+	err = poller.Start(recv, func(Event) {
+		n, _, ts, err := ReadWithTimestamp(recv, buf)
+		now := time.Now()
+		if err == ErrWouldBlock {
+			return
+		}
+		select {
+		case done <- result{ts, now, string(buf[:n]), err}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = unix.Write(send.Fd(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.data != "hello" {
+		t.Errorf("read %q; want %q", res.data, "hello")
+	}
+	if res.ts.IsZero() {
+		t.Fatalf("no timestamp received")
+	}
+	if res.ts.After(res.now) {
+		t.Errorf("timestamp %v is after callback time %v", res.ts, res.now)
+	}
+	if d := res.now.Sub(res.ts); d > time.Second {
+		t.Errorf("timestamp is %v earlier than callback time; want less than a second", d)
+	}
+
+	if err = poller.Stop(recv); err != nil {
+		t.Fatal(err)
+	}
+	// No more data.
+	if _, _, _, err = ReadWithTimestamp(recv, buf); err != ErrWouldBlock {
+		t.Errorf("ReadWithTimestamp() error is %v; want %v", err, ErrWouldBlock)
+	}
+}
+
+func TestReadWithTimestampTruncated(t *testing.T) {
+	recv, send := udpPair(t)
+	defer recv.Close()
+	defer send.Close()
+
+	if _, err := unix.Write(send.Fd(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2)
+	var err error
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		var n int
+		var ts time.Time
+		n, _, ts, err = ReadWithTimestamp(recv, buf)
+		if err == ErrWouldBlock {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if n != len(buf) {
+			t.Errorf("read %d bytes; want %d", n, len(buf))
+		}
+		if !ts.IsZero() {
+			t.Errorf("unexpected timestamp without EnableRxTimestamps(): %v", ts)
+		}
+		break
+	}
+	if err != io.ErrShortBuffer {
+		t.Errorf("ReadWithTimestamp() error is %v; want %v", err, io.ErrShortBuffer)
+	}
+}
@@ -0,0 +1,241 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// NewTTYDesc opens terminal device (e.g. serial port) at given path and
+// creates descriptor for further use in EventPoll methods.
+//
+// The device is opened in non-blocking mode and does not become the
+// controlling terminal of the process. Note that some devices (e.g. USB
+// serial adapters) report their disconnection with an error event only;
+// such events are delivered with EventHup set too, so the device could be
+// reopened (see ReopenOnHup()).
+func NewTTYDesc(path string, ev Event, opts ...DescOption) (*Desc, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), path)
+
+	desc, err := newDesc(file, ev, resolveDescOptions(opts))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	desc.tty = true
+
+	return desc, nil
+}
+
+// HandleTTY creates descriptor for the already opened terminal device f,
+// e.g. serial port opened and configured by some termios library. It
+// returns error with syscall.ENOTTY if f is not a character device.
+//
+// The poller handles readiness only: the caller must configure the device
+// (raw mode, baud rate and so on) by itself. Descriptor is made
+// non-blocking, which affects f as well, since descriptor holds a duplicate
+// of f's file descriptor.
+func HandleTTY(f *os.File, ev Event, opts ...DescOption) (*Desc, error) {
+	desc, err := handleFile(f, ev, opts, func(mode uint32) error {
+		if mode != unix.S_IFCHR {
+			return syscall.ENOTTY
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	desc.tty = true
+
+	return desc, nil
+}
+
+// ReopenConfig contains options for ReopenOnHup().
+type ReopenConfig struct {
+	// MinBackoff is the delay before the first reopen attempt.
+	// If zero, 10ms is used.
+	MinBackoff time.Duration
+
+	// MaxBackoff limits the delay between reopen attempts, which is doubled
+	// after each failed attempt.
+	// If zero, 5s is used.
+	MaxBackoff time.Duration
+
+	// OnError is called when reopen attempt fails.
+	OnError func(error)
+}
+
+func (c *ReopenConfig) withDefaults() (config ReopenConfig) {
+	if c != nil {
+		config = *c
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 10 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 5 * time.Second
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = config.MinBackoff
+	}
+	return config
+}
+
+// Reopener keeps a descriptor registered within EventPoll, creating a fresh
+// one each time the previous gets hung up.
+type Reopener struct {
+	poller EventPoll
+	open   func() (*Desc, error)
+	cb     func(*Desc, Event)
+	config ReopenConfig
+
+	mu      sync.Mutex
+	desc    *Desc
+	closed  bool
+	backoff time.Duration
+	timer   *time.Timer
+}
+
+// ReopenOnHup creates descriptor by open and starts it within poller. When
+// the descriptor gets EventHup or EventErr, it is stopped, closed and then
+// open is called again with exponential backoff until it succeeds, e.g. when
+// the device node reappears.
+//
+// The cb is called with every event received for current descriptor,
+// including the hang up one.
+func ReopenOnHup(poller EventPoll, open func() (*Desc, error), cb func(*Desc, Event), c *ReopenConfig) (*Reopener, error) {
+	r := &Reopener{
+		poller: poller,
+		open:   open,
+		cb:     cb,
+		config: c.withDefaults(),
+	}
+	r.backoff = r.config.MinBackoff
+
+	desc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.start(desc); err != nil {
+		desc.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Desc returns current descriptor. It returns nil while descriptor is being
+// reopened.
+func (r *Reopener) Desc() *Desc {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.desc
+}
+
+// Close stops reopen attempts, stops and closes current descriptor.
+func (r *Reopener) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.desc == nil {
+		return nil
+	}
+	desc := r.desc
+	r.desc = nil
+	r.poller.Stop(desc)
+
+	return desc.Close()
+}
+
+func (r *Reopener) start(desc *Desc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	err := r.poller.Start(desc, func(event Event) {
+		r.handle(desc, event)
+	})
+	if err != nil {
+		return err
+	}
+	r.desc = desc
+
+	return nil
+}
+
+func (r *Reopener) handle(desc *Desc, event Event) {
+	if event&EventPollClosed != 0 {
+		return
+	}
+	r.cb(desc, event)
+	if event&(EventHup|EventErr) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.desc != desc {
+		return
+	}
+	r.desc = nil
+	r.poller.Stop(desc)
+	desc.Close()
+
+	r.backoff = r.config.MinBackoff
+	r.schedule()
+}
+
+// schedule schedules next reopen attempt. Note that r.mu must be held.
+func (r *Reopener) schedule() {
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.backoff, r.reopen)
+	} else {
+		r.timer.Reset(r.backoff)
+	}
+}
+
+func (r *Reopener) reopen() {
+	desc, err := r.open()
+	if err == nil {
+		if err = r.start(desc); err != nil {
+			desc.Close()
+		}
+	}
+	if err == nil || err == ErrClosed {
+		return
+	}
+	if fn := r.config.OnError; fn != nil {
+		fn(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	if r.backoff *= 2; r.backoff > r.config.MaxBackoff {
+		r.backoff = r.config.MaxBackoff
+	}
+	r.schedule()
+}
@@ -0,0 +1,261 @@
+// +build linux
+
+package netpoll
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTTYDesc(t *testing.T) {
+	master, path, err := openPTY()
+	if err != nil {
+		t.Skipf("pseudo terminals are not available: %v", err)
+	}
+	defer master.Close()
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	desc, err := NewTTYDesc(path, EventRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	received := make(chan []byte, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		p := make([]byte, 64)
+		n, err := unix.Read(desc.Fd(), p)
+		if err != nil {
+			return
+		}
+		select {
+		case received <- p[:n]:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = master.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if string(p) != "hello\n" {
+			t.Errorf("received %q; want %q", p, "hello\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data received")
+	}
+}
+
+func TestHandleTTY(t *testing.T) {
+	master, path, err := openPTY()
+	if err != nil {
+		t.Skipf("pseudo terminals are not available: %v", err)
+	}
+	defer master.Close()
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	desc, err := HandleTTY(f, EventRead|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	received := make(chan []byte, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		var p []byte
+		DrainRead(desc, func(b []byte) bool {
+			p = append(p, b...)
+			return true
+		})
+		select {
+		case received <- p:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = master.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if string(p) != "hello\n" {
+			t.Errorf("received %q; want %q", p, "hello\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data received")
+	}
+
+	// Not a character device.
+	tmp, err := ioutil.TempFile("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = HandleTTY(tmp, EventRead)
+	if e, ok := err.(*Error); !ok || e.Err != unix.ENOTTY {
+		t.Errorf("HandleTTY() error is %v; want %v", err, unix.ENOTTY)
+	}
+}
+
+func TestReopenOnHup(t *testing.T) {
+	if master, _, err := openPTY(); err != nil {
+		t.Skipf("pseudo terminals are not available: %v", err)
+	} else {
+		master.Close()
+	}
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	var (
+		mu       sync.Mutex
+		masters  []*os.File
+		attempts int32
+		absent   = errors.New("device is absent")
+	)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range masters {
+			m.Close()
+		}
+	}()
+	open := func() (*Desc, error) {
+		// Pretend that device is absent for a few attempts after the first
+		// open.
+		if n := atomic.AddInt32(&attempts, 1); n > 1 && n < 4 {
+			return nil, absent
+		}
+		master, path, err := openPTY()
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		masters = append(masters, master)
+		mu.Unlock()
+		return NewTTYDesc(path, EventRead)
+	}
+
+	var (
+		hups   = make(chan struct{}, 1)
+		errs   = make(chan error, 16)
+		reads  = make(chan string, 16)
+		buffer = make([]byte, 64)
+	)
+	reopener, err := ReopenOnHup(poller, open, func(desc *Desc, event Event) {
+		if event&EventHup != 0 {
+			hups <- struct{}{}
+			return
+		}
+		if n, err := unix.Read(desc.Fd(), buffer); err == nil {
+			reads <- string(buffer[:n])
+		}
+	}, &ReopenConfig{
+		MinBackoff: time.Millisecond,
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopener.Close()
+
+	// Simulate disconnection of the device.
+	mu.Lock()
+	masters[0].Close()
+	mu.Unlock()
+	select {
+	case <-hups:
+	case <-time.After(time.Second):
+		t.Fatalf("no hang up event received")
+	}
+
+	var desc *Desc
+	for deadline := time.Now().Add(time.Second); desc == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("descriptor was not reopened")
+		}
+		time.Sleep(time.Millisecond)
+		desc = reopener.Desc()
+	}
+	if n := len(errs); n != 2 {
+		t.Errorf("OnError called %d times; want 2", n)
+	}
+
+	mu.Lock()
+	master := masters[len(masters)-1]
+	mu.Unlock()
+	if _, err = master.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-reads:
+		if s != "hello\n" {
+			t.Errorf("read %q; want %q", s, "hello\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data received from reopened descriptor")
+	}
+}
+
+// openPTY opens pseudo terminal pair and returns its master end and the path
+// of its slave end.
+func openPTY() (*os.File, string, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), fmt.Sprintf("/dev/pts/%d", n), nil
+}
@@ -0,0 +1,71 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// tunDevice is the path of the TUN/TAP clone device.
+const tunDevice = "/dev/net/tun"
+
+// ifreqFlags is the struct ifreq with the ifr_flags member set, as expected
+// by TUNSETIFF ioctl. It is padded up to the size of struct ifreq on 64-bit
+// platforms, which is the largest one.
+type ifreqFlags struct {
+	name  [unix.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// OpenTUN opens the TUN/TAP clone device /dev/net/tun, attaches it to the
+// network interface with given name and creates descriptor for further use
+// in EventPoll methods. Interface is created if it does not exist; if name
+// is empty, the kernel chooses it (e.g. "tun0"). The actual interface name
+// is returned along with the descriptor.
+//
+// The flags must contain unix.IFF_TUN or unix.IFF_TAP and may contain
+// unix.IFF_NO_PI and unix.IFF_MULTI_QUEUE. Configuring the interface
+// (addresses, routes, bringing it up) is left to the caller.
+//
+// Note that creating an interface requires CAP_NET_ADMIN capability. Without
+// it, only the persistent interface created beforehand for the process's
+// user or group could be attached (e.g. by "ip tuntap add mode tun user
+// ..."); otherwise the error with syscall.EPERM is returned.
+//
+// Each read of the descriptor returns single packet, thus EventRead is
+// reported until all queued packets are read.
+func OpenTUN(name string, flags uint16, ev Event, opts ...DescOption) (*Desc, string, error) {
+	var ifr ifreqFlags
+	if len(name) >= len(ifr.name) {
+		return nil, "", &os.PathError{Op: "open", Path: tunDevice, Err: unix.EINVAL}
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = flags
+
+	fd, err := unix.Open(tunDevice, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: tunDevice, Err: err}
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		unix.Close(fd)
+		return nil, "", os.NewSyscallError("ioctl", errno)
+	}
+	n := 0
+	for n < len(ifr.name) && ifr.name[n] != 0 {
+		n++
+	}
+	name = string(ifr.name[:n])
+
+	file := os.NewFile(uintptr(fd), tunDevice)
+	desc, err := newDesc(file, ev, resolveDescOptions(opts))
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+	return desc, name, nil
+}
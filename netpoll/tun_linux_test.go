@@ -0,0 +1,110 @@
+// +build linux
+
+package netpoll
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHandleFile(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	desc, err := HandleFile(r, EventRead)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	if !nonblock(t, desc.Fd()) {
+		t.Fatalf("descriptor is not in non-blocking mode")
+	}
+
+	received := make(chan string, 1)
+	err = poller.Start(desc, func(event Event) {
+		p := make([]byte, 64)
+		n, err := unix.Read(desc.Fd(), p)
+		if err != nil {
+			return
+		}
+		received <- string(p[:n])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-received:
+		if s != "hello" {
+			t.Errorf("received %q; want %q", s, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data received")
+	}
+
+	tmp, err := ioutil.TempFile("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = HandleFile(tmp, EventRead)
+	if e, ok := err.(*Error); !ok || e.Err != syscall.EPERM {
+		t.Errorf("HandleFile() error is %v; want %v", err, syscall.EPERM)
+	}
+}
+
+func TestOpenTUN(t *testing.T) {
+	desc, name, err := OpenTUN("", unix.IFF_TUN|unix.IFF_NO_PI, EventRead)
+	if err != nil {
+		t.Skipf("TUN device is not available: %v", err)
+	}
+	defer desc.Close()
+	if name == "" {
+		t.Errorf("empty interface name")
+	}
+	if !nonblock(t, desc.Fd()) {
+		t.Fatalf("descriptor is not in non-blocking mode")
+	}
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(io.Closer).Close()
+
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(desc)
+
+	// The interface is down, thus there are no packets to read.
+	if _, err = unix.Read(desc.Fd(), make([]byte, 1500)); err != unix.EAGAIN {
+		t.Errorf("Read() error is %v; want %v", err, unix.EAGAIN)
+	}
+
+	if _, _, err = OpenTUN("too-long-interface-name", unix.IFF_TUN, EventRead); err == nil {
+		t.Errorf("no error for too long interface name")
+	}
+}
@@ -0,0 +1,318 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// io_uring(7) definitions which are not in golang.org/x/sys/unix.
+const (
+	_IORING_OP_NOP         = 0
+	_IORING_OP_POLL_ADD    = 6
+	_IORING_OP_POLL_REMOVE = 7
+
+	_IORING_POLL_ADD_MULTI = 1 << 0
+
+	_IORING_SETUP_CQSIZE = 1 << 3
+
+	_IORING_FEAT_NODROP  = 1 << 1
+	_IORING_FEAT_EXT_ARG = 1 << 8
+
+	_IORING_ENTER_GETEVENTS = 1 << 0
+	_IORING_ENTER_EXT_ARG   = 1 << 3
+
+	_IORING_CQE_F_MORE = 1 << 1
+
+	_IORING_OFF_SQ_RING = 0
+	_IORING_OFF_CQ_RING = 0x8000000
+	_IORING_OFF_SQES    = 0x10000000
+)
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+// uringSQOffsets is struct io_sqring_offsets.
+type uringSQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// uringCQOffsets is struct io_cqring_offsets.
+type uringCQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// uringSQE is struct io_uring_sqe, limited to the fields used by poll
+// requests.
+type uringSQE struct {
+	opcode     uint8
+	flags      uint8
+	ioprio     uint16
+	fd         int32
+	off        uint64
+	addr       uint64
+	len        uint32
+	pollEvents uint32
+	userData   uint64
+	_          [3]uint64
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringGeteventsArg is struct io_uring_getevents_arg.
+type uringGeteventsArg struct {
+	sigmask   uint64
+	sigmaskSz uint32
+	pad       uint32
+	ts        uint64
+}
+
+const (
+	uringSQEntries = 64
+	uringCQEntries = 8192
+
+	// maxUringEntries bounds the number of entries of both rings, so they
+	// could be accessed as slices of fixed-size arrays.
+	maxUringEntries = 1 << 16
+)
+
+// uring is an io_uring instance. Its submission queue must be used by a
+// single goroutine at a time, while the completion queue could be consumed
+// concurrently with submissions by another one.
+type uring struct {
+	fd int
+
+	sqMem   []byte
+	cqMem   []byte
+	sqesMem []byte
+
+	sqTail  *uint32
+	sqHead  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []uringSQE
+
+	// tail is the tail of the submission queue including the entries
+	// which are not submitted yet.
+	tail uint32
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+
+	// waitArg and waitTs are passed to the kernel by wait(). They are kept
+	// here to have stable addresses.
+	waitArg uringGeteventsArg
+	waitTs  unix.Timespec
+}
+
+// newUring creates io_uring instance. It returns ErrUnsupported if the
+// kernel lacks the features used by the poller.
+func newUring() (*uring, error) {
+	params := uringParams{
+		flags:     _IORING_SETUP_CQSIZE,
+		cqEntries: uringCQEntries,
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringSQEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	u := &uring{fd: int(fd)}
+	if params.features&(_IORING_FEAT_NODROP|_IORING_FEAT_EXT_ARG) != _IORING_FEAT_NODROP|_IORING_FEAT_EXT_ARG ||
+		params.sqEntries > maxUringEntries || params.cqEntries > maxUringEntries {
+		unix.Close(u.fd)
+		return nil, ErrUnsupported
+	}
+	if err := u.mmap(&params); err != nil {
+		u.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return u, nil
+}
+
+// mmap maps the rings of the instance into memory. The rings are mapped
+// separately, even if the kernel has IORING_FEAT_SINGLE_MMAP.
+func (u *uring) mmap(p *uringParams) (err error) {
+	const prot = unix.PROT_READ | unix.PROT_WRITE
+	const flags = unix.MAP_SHARED | unix.MAP_POPULATE
+
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	if u.sqMem, err = unix.Mmap(u.fd, _IORING_OFF_SQ_RING, sqSize, prot, flags); err != nil {
+		return err
+	}
+	cqSize := int(p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if u.cqMem, err = unix.Mmap(u.fd, _IORING_OFF_CQ_RING, cqSize, prot, flags); err != nil {
+		return err
+	}
+	sqesSize := int(p.sqEntries * uint32(unsafe.Sizeof(uringSQE{})))
+	if u.sqesMem, err = unix.Mmap(u.fd, _IORING_OFF_SQES, sqesSize, prot, flags); err != nil {
+		return err
+	}
+
+	u.sqHead = (*uint32)(unsafe.Pointer(&u.sqMem[p.sqOff.head]))
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqMem[p.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqMem[p.sqOff.ringMask]))
+	u.sqArray = (*[maxUringEntries]uint32)(unsafe.Pointer(&u.sqMem[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	u.sqes = (*[maxUringEntries]uringSQE)(unsafe.Pointer(&u.sqesMem[0]))[:p.sqEntries:p.sqEntries]
+	u.tail = atomic.LoadUint32(u.sqTail)
+
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqMem[p.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqMem[p.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqMem[p.cqOff.ringMask]))
+	u.cqes = (*[maxUringEntries]uringCQE)(unsafe.Pointer(&u.cqMem[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+
+	return nil
+}
+
+// close unmaps the rings and closes the instance, which cancels all its
+// requests.
+func (u *uring) close() error {
+	for _, mem := range [][]byte{u.sqesMem, u.cqMem, u.sqMem} {
+		if mem != nil {
+			unix.Munmap(mem)
+		}
+	}
+	u.sqesMem, u.cqMem, u.sqMem = nil, nil, nil
+	return unix.Close(u.fd)
+}
+
+// sqe returns the next entry of the submission queue, which is submitted by
+// the next submit() call. It returns nil if the queue is full.
+func (u *uring) sqe() *uringSQE {
+	if u.tail-atomic.LoadUint32(u.sqHead) >= uint32(len(u.sqes)) {
+		return nil
+	}
+	i := u.tail & u.sqMask
+	u.sqArray[i] = i
+	u.tail++
+
+	e := &u.sqes[i]
+	*e = uringSQE{}
+	return e
+}
+
+// publish makes the entries queued by sqe() visible to the kernel, which
+// consumes them on the next io_uring_enter(2) call made by submit() or
+// wait().
+func (u *uring) publish() {
+	atomic.StoreUint32(u.sqTail, u.tail)
+}
+
+// submit submits the entries queued by sqe(). If they could not be
+// submitted, the error is returned and they are left queued.
+func (u *uring) submit() error {
+	u.publish()
+	for {
+		n := u.tail - atomic.LoadUint32(u.sqHead)
+		if n == 0 {
+			return nil
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(n), 0, 0, 0, 0)
+		if errno != 0 && errno != unix.EINTR {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+	}
+}
+
+// ready returns the number of completions available at the moment.
+func (u *uring) ready() uint32 {
+	return atomic.LoadUint32(u.cqTail) - atomic.LoadUint32(u.cqHead)
+}
+
+// reap copies the completions available at the moment into cqes and
+// returns their number. It does not block.
+func (u *uring) reap(cqes []uringCQE) int {
+	head := atomic.LoadUint32(u.cqHead)
+	tail := atomic.LoadUint32(u.cqTail)
+	n := 0
+	for ; head != tail && n < len(cqes); head++ {
+		cqes[n] = u.cqes[head&u.cqMask]
+		n++
+	}
+	atomic.StoreUint32(u.cqHead, head)
+	return n
+}
+
+// wait submits the published entries and blocks until some completion is
+// available or timeout passes. Negative timeout means infinite waiting. It
+// returns syscall.ETIME on timeout.
+//
+// Note that it could be called concurrently with sqe() and submit().
+func (u *uring) wait(timeout int64) error {
+	var (
+		flags uintptr = _IORING_ENTER_GETEVENTS
+		arg   unsafe.Pointer
+		size  uintptr
+	)
+	if timeout >= 0 {
+		u.waitTs = unix.NsecToTimespec(timeout)
+		u.waitArg = uringGeteventsArg{ts: uint64(uintptr(unsafe.Pointer(&u.waitTs)))}
+		flags |= _IORING_ENTER_EXT_ARG
+		arg, size = unsafe.Pointer(&u.waitArg), unsafe.Sizeof(u.waitArg)
+	}
+	n := atomic.LoadUint32(u.sqTail) - atomic.LoadUint32(u.sqHead)
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(n), 1, flags, uintptr(arg), size)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// kernelVersionAtLeast reports whether the version of the running kernel is at
+// least major.minor.
+func kernelVersionAtLeast(major, minor int) bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	var v [2]int
+	i := 0
+	for _, c := range uts.Release {
+		switch {
+		case c >= '0' && c <= '9':
+			v[i] = v[i]*10 + int(c-'0')
+		case c == '.' && i == 0:
+			i++
+		default:
+			return v[0] > major || v[0] == major && v[1] >= minor
+		}
+	}
+	return v[0] > major || v[0] == major && v[1] >= minor
+}
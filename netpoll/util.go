@@ -1,11 +1,64 @@
 package netpoll
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+	"time"
+)
 
 func temporaryErr(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
 	errno, ok := err.(syscall.Errno)
 	if !ok {
 		return false
 	}
 	return errno.Temporary()
 }
+
+// idleTracker tracks consecutive waits for events which received nothing
+// and reports the idle time to fn once it exceeds threshold.
+type idleTracker struct {
+	fn        func(time.Duration)
+	threshold time.Duration
+	idle      time.Duration
+}
+
+// timeout returns the wait timeout the loop must use, that is threshold if
+// tracking is enabled or negative value for infinite waiting otherwise.
+func (t *idleTracker) timeout() time.Duration {
+	if t.fn == nil {
+		return -1
+	}
+	return t.threshold
+}
+
+// observe must be called after each successful wait which started at the
+// given time and received n events.
+func (t *idleTracker) observe(start int64, n int) {
+	if t.fn == nil {
+		return
+	}
+	if n > 0 {
+		t.idle = 0
+		return
+	}
+	t.idle += time.Duration(nanotime() - start)
+	if t.idle >= t.threshold {
+		t.fn(t.idle)
+	}
+}
+
+// timeoutMillis converts timeout to milliseconds, rounding it up. Negative
+// timeout is converted to -1, which means infinite waiting.
+func timeoutMillis(timeout time.Duration) int {
+	if timeout < 0 {
+		return -1
+	}
+	return int((timeout + time.Millisecond - 1) / time.Millisecond)
+}
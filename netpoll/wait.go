@@ -0,0 +1,69 @@
+package netpoll
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	waitPollerOnce sync.Once
+	waitPollerInst *poller
+	waitPollerErr  error
+)
+
+// waitPoller returns the poller shared by WaitOne() calls. It is created on
+// the first call and is never closed.
+func waitPoller() (*poller, error) {
+	waitPollerOnce.Do(func() {
+		var p EventPoll
+		p, waitPollerErr = New(nil)
+		if waitPollerErr == nil {
+			waitPollerInst = p.(*poller)
+		}
+	})
+	return waitPollerInst, waitPollerErr
+}
+
+// WaitOne blocks until desc is ready for any of the events it was created
+// with, or until timeout passes. Non-positive timeout means no timeout.
+// It returns the received event or ErrWaitTimeout.
+//
+// It is a synchronous convenience for simple programs and tests, which
+// avoids the callback machinery: desc is registered within a shared poller
+// in one-shot mode for the time of the call only. Thus desc must not be
+// registered within some other poller at the same time.
+func WaitOne(desc *Desc, timeout time.Duration) (Event, error) {
+	strictBlocking("WaitOne")
+	p, err := waitPoller()
+	if err != nil {
+		return 0, err
+	}
+	ch := make(chan Event, 1)
+	err = p.attach(desc, &migration{
+		cb: func(event Event) {
+			select {
+			case ch <- event:
+			default:
+			}
+		},
+		event: desc.event | EventOneShot,
+		armed: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer p.Stop(desc)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		tm := time.NewTimer(timeout)
+		defer tm.Stop()
+		expired = tm.C
+	}
+	select {
+	case event := <-ch:
+		return event, nil
+	case <-expired:
+		return 0, ErrWaitTimeout
+	}
+}